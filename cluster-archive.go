@@ -0,0 +1,481 @@
+package kuttilib
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kuttiproject/drivercore"
+)
+
+const (
+	// archiveformatversion is the version of the cluster archive
+	// layout written by ExportCluster.
+	archiveformatversion = 1
+
+	archivemanifestfile = "manifest.json"
+	archiveclusterfile  = "cluster.json"
+	archivediskprefix   = "disks/"
+)
+
+// archivemanifest is the first entry of a cluster archive. It
+// describes the rest of the archive.
+type archivemanifest struct {
+	FormatVersion int
+	SchemaVersion int
+	Cluster       string
+	DriverName    string
+	K8sVersion    string
+	ExportedAt    time.Time
+	Disks         []string `json:",omitempty"`
+}
+
+// MachineDiskExporter is implemented by the machines of drivers that
+// can export their disk as a stream. The size of the stream must be
+// known in advance. ExportCluster uses it to include node disks in an
+// archive, and returns ErrDiskExportNotSupported if the host of a node
+// does not implement it.
+type MachineDiskExporter interface {
+	ExportDisk() (disk io.ReadCloser, size int64, err error)
+}
+
+// MachineImporter is implemented by drivers that can create a machine
+// from a disk exported by MachineDiskExporter. ImportCluster uses it to
+// create nodes whose disks are included in an archive, and returns
+// ErrDiskImportNotSupported if the driver does not implement it.
+type MachineImporter interface {
+	ImportMachine(machinename string, clustername string, k8sversion string, disk io.Reader) (drivercore.Machine, error)
+}
+
+// ExportOptions control what ExportCluster includes in an archive.
+type ExportOptions struct {
+	// IncludeDisks adds the disk of each node to the archive, so that
+	// nodes can be imported with their contents. All nodes must be
+	// stopped, and the cluster's driver must be able to export disks.
+	IncludeDisks bool
+}
+
+// ExportCluster writes the named cluster to w as a gzip-compressed tar
+// archive, which can be read by ImportCluster. The archive contains the
+// configuration of the cluster and its nodes, including port mappings,
+// and optionally the node disks.
+//
+// If opts.IncludeDisks is set and a node is running, ErrNodeIsRunning
+// is returned. If the driver cannot export disks, because its machines
+// do not implement MachineDiskExporter, ErrDiskExportNotSupported is
+// returned. Nothing is written in either
+// case.
+func ExportCluster(name string, w io.Writer, opts ExportOptions) error {
+	cluster, ok := GetCluster(name)
+	if !ok {
+		return ErrClusterDoesNotExist
+	}
+
+	err := cluster.ensuredriver()
+	if err != nil {
+		return err
+	}
+
+	// The join token is a credential for the original cluster, and
+	// is not exported.
+	exported := cluster.data()
+	exported.JoinToken = ""
+	exported.JoinTokenExpiresAt = time.Time{}
+	clusterjson, err := json.MarshalIndent(exported, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	nodes := cluster.nodelist()
+	sortnodes(nodes)
+	manifest := archivemanifest{
+		FormatVersion: archiveformatversion,
+		SchemaVersion: ConfigSchemaVersion,
+		Cluster:       cluster.name,
+		DriverName:    cluster.driverName,
+		K8sVersion:    cluster.K8sVersion(),
+		ExportedAt:    time.Now().UTC(),
+	}
+
+	exporters := map[string]MachineDiskExporter{}
+	if opts.IncludeDisks {
+		for _, node := range nodes {
+			err = node.ensurehost()
+			if err != nil {
+				return node.wraperror("export", err)
+			}
+
+			if node.Status() != NodeStatusStopped {
+				return node.wraperror("export", ErrNodeIsRunning)
+			}
+
+			exporter, ok := node.host.(MachineDiskExporter)
+			if !ok {
+				return node.wraperror("export", ErrDiskExportNotSupported)
+			}
+
+			exporters[node.name] = exporter
+			manifest.Disks = append(manifest.Disks, node.name)
+		}
+	}
+
+	manifestjson, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gzwriter := gzip.NewWriter(w)
+	tarwriter := tar.NewWriter(gzwriter)
+
+	err = writearchivefile(tarwriter, archivemanifestfile, manifestjson)
+	if err == nil {
+		err = writearchivefile(tarwriter, archiveclusterfile, clusterjson)
+	}
+	for _, node := range nodes {
+		exporter, ok := exporters[node.name]
+		if err != nil || !ok {
+			continue
+		}
+
+		logf(VerbosityInfo, node.logfields("export"), "Exporting disk of node %s...", node.name)
+		start := time.Now()
+		err = writearchivedisk(tarwriter, node.name, exporter)
+		if err != nil {
+			err = node.wraperror("export", err)
+			continue
+		}
+		logf(VerbosityInfo, append(node.logfields("export"), "duration", time.Since(start)), "Disk of node %s exported.", node.name)
+	}
+
+	if err == nil {
+		err = tarwriter.Close()
+	}
+	if err == nil {
+		err = gzwriter.Close()
+	}
+	return err
+}
+
+// sortnodes sorts nodes by startrank, and then by name. This is the
+// order in which nodes are copied to other clusters.
+func sortnodes(nodes []*Node) {
+	sort.Slice(nodes, func(i, j int) bool {
+		ranki, rankj := startrank(nodes[i].nodetype), startrank(nodes[j].nodetype)
+		if ranki != rankj {
+			return ranki < rankj
+		}
+		return nodes[i].name < nodes[j].name
+	})
+}
+
+func writearchivefile(tarwriter *tar.Writer, name string, data []byte) error {
+	err := tarwriter.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = tarwriter.Write(data)
+	return err
+}
+
+func writearchivedisk(tarwriter *tar.Writer, nodename string, exporter MachineDiskExporter) error {
+	disk, size, err := exporter.ExportDisk()
+	if err != nil {
+		return err
+	}
+	defer disk.Close()
+
+	err = tarwriter.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     archivediskprefix + nodename,
+		Mode:     0600,
+		Size:     size,
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tarwriter, disk)
+	return err
+}
+
+// ImportCluster recreates a cluster from an archive written by
+// ExportCluster, with the name newname. If newname is empty, the name
+// of the exported cluster is used. The name is checked with
+// ValidateClusterName. The driver and Kubernetes version of the
+// exported cluster must be available.
+//
+// Nodes whose disks are included in the archive are created from
+// them, which requires a driver that implements MachineImporter. If
+// the driver does not, ErrDiskImportNotSupported is returned when the
+// first such node is imported. Other nodes are created afresh, with
+// the same name, type and spec, and are joined to the Kubernetes
+// cluster if they are managed. Automatic port forwarding is restored
+// before any node is created, and the port mappings of each node
+// before anything is run on it, so that nodes can be reached over SSH
+// on drivers that use NAT networking. If a host port is already in
+// use, another one is allocated with AllocateHostPort.
+//
+// A control plane node imported with its disk is started, and the new
+// cluster's workers join it at its own address. If that is not the
+// address of the exported node, the control plane, and workers
+// imported with their disks, are moved to it as CloneCluster does.
+//
+// If an error occurs after the cluster has been created, the cluster
+// is returned along with the error, as it stands. It can be removed
+// with DeleteClusterCascade.
+func ImportCluster(r io.Reader, newname string) (*Cluster, error) {
+	gzreader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrArchiveInvalid, err)
+	}
+	tarreader := tar.NewReader(gzreader)
+
+	var manifest archivemanifest
+	err = readarchivefile(tarreader, archivemanifestfile, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.FormatVersion > archiveformatversion {
+		return nil, fmt.Errorf("%w: unsupported format version %v", ErrArchiveInvalid, manifest.FormatVersion)
+	}
+	if manifest.SchemaVersion > ConfigSchemaVersion {
+		return nil, fmt.Errorf(
+			"%w: the archive has schema version %v, but this version of kuttilib supports up to %v. Please upgrade",
+			ErrConfigSchemaTooNew,
+			manifest.SchemaVersion,
+			ConfigSchemaVersion,
+		)
+	}
+
+	var exported clusterdata
+	err = readarchivefile(tarreader, archiveclusterfile, &exported)
+	if err != nil {
+		return nil, err
+	}
+
+	if newname == "" {
+		newname = exported.Name
+	}
+	err = ValidateClusterName(newname)
+	if err != nil {
+		return nil, err
+	}
+
+	err = addcluster(context.Background(), newname, exported.K8sVersion, exported.DriverName, exported.Type)
+	if err != nil {
+		return nil, err
+	}
+	cluster, _ := GetCluster(newname)
+
+	// Automatic port forwarding is set first, so that nodes can be
+	// reached over SSH as they are imported on drivers that use NAT.
+	err = cluster.SetAutoForwardPorts(exported.AutoForwardPorts)
+	if err != nil {
+		return cluster, err
+	}
+
+	imported := map[string]bool{}
+	for {
+		header, err := tarreader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return cluster, fmt.Errorf("%w: %w", ErrArchiveInvalid, err)
+		}
+
+		nodename, ok := strings.CutPrefix(header.Name, archivediskprefix)
+		if !ok {
+			continue
+		}
+
+		source, ok := exported.Nodes[nodename]
+		if !ok || imported[nodename] {
+			return cluster, fmt.Errorf("%w: unexpected disk for node %s", ErrArchiveInvalid, nodename)
+		}
+
+		node, err := cluster.importnode(source, tarreader)
+		if err != nil {
+			return cluster, err
+		}
+		imported[nodename] = true
+
+		// Disks are exported in start order, so workers are imported
+		// after the control plane, and need its endpoint to be added,
+		// and to be pointed at it.
+		switch node.nodetype {
+		case NodeTypeControlPlane:
+			err = node.setcopiedendpoint("import", exported.ControlPlaneEndpoint, exported.CACertHash)
+		case NodeTypeWorker:
+			err = node.setcopiedworkerendpoint("import", exported.ControlPlaneEndpoint)
+		}
+		if err != nil {
+			return cluster, err
+		}
+	}
+
+	sources := make([]*Node, 0, len(exported.Nodes))
+	for _, source := range exported.Nodes {
+		sources = append(sources, source)
+	}
+	sortnodes(sources)
+
+	for _, source := range sources {
+		if imported[source.name] {
+			continue
+		}
+
+		nodetype := source.nodetype
+		if nodetype != NodeTypeControlPlane && nodetype != NodeTypeWorker {
+			nodetype = NodeTypeUnmanaged
+		}
+
+		_, err = cluster.newnodewithspec(source.name, nodetype, source.spec, func(n *Node) error {
+			return n.importports(source.ports)
+		})
+		if err != nil {
+			return cluster, err
+		}
+	}
+
+	return cluster, nil
+}
+
+// readarchivefile reads the next entry of an archive, which must be
+// the named file, and unmarshals it into v.
+func readarchivefile(tarreader *tar.Reader, name string, v any) error {
+	header, err := tarreader.Next()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrArchiveInvalid, err)
+	}
+	if header.Name != name {
+		return fmt.Errorf("%w: expected %s, found %s", ErrArchiveInvalid, name, header.Name)
+	}
+
+	data, err := io.ReadAll(tarreader)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrArchiveInvalid, err)
+	}
+
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrArchiveInvalid, name, err)
+	}
+	return nil
+}
+
+// importnode creates a node like source, from an exported disk. The
+// driver imports the disk before the node is added, so that the
+// configuration is not locked while it does. The node keeps the
+// Kubernetes version recorded for source, if any.
+func (c *Cluster) importnode(source *Node, disk io.Reader) (*Node, error) {
+	err := c.ensuredriver()
+	if err != nil {
+		return nil, err
+	}
+
+	importer, ok := c.driver.(MachineImporter)
+	if !ok {
+		return nil, wrapnodeerror(c.name, source.name, "import", ErrDiskImportNotSupported)
+	}
+
+	logf(VerbosityInfo, []any{"cluster", c.name, "node", source.name, "driver", c.driverName, "operation", "import"}, "Importing node %s...", source.name)
+	start := time.Now()
+	k8sversion := source.k8sVersion
+	if k8sversion == "" {
+		k8sversion = c.K8sVersion()
+	}
+	node, err := c.addnodewithhost(source.name, source.nodetype, source.spec, func(n *Node) error {
+		n.k8sVersion = k8sversion
+		host, err := importer.ImportMachine(source.name, c.name, k8sversion, disk)
+		n.host = host
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	logf(VerbosityInfo, append(node.logfields("import"), "duration", time.Since(start)), "Node %s imported.", node.name)
+
+	return node, errors.Join(node.importports(source.ports), node.setup())
+}
+
+// setjoindetails sets the details needed to join workers to the
+// Kubernetes cluster, when its control plane node has been copied from
+// another cluster rather than initialized.
+func (c *Cluster) setjoindetails(endpoint string, cacerthash string) error {
+	return clusterconfigmanager.Update(func() error {
+		err := c.checkconfigured()
+		if err != nil {
+			return err
+		}
+
+		configlock.Lock()
+		c.controlPlaneEndpoint = endpoint
+		c.caCertHash = cacerthash
+		configlock.Unlock()
+
+		return nil
+	})
+}
+
+// importports forwards node ports to the host ports they were
+// forwarded to in an exported cluster, as importport does. It is
+// called before a new node is set up, so that a forwarded SSH port is
+// available to run commands.
+func (n *Node) importports(ports map[int]int) error {
+	nodeports := make([]int, 0, len(ports))
+	for nodeport := range ports {
+		nodeports = append(nodeports, nodeport)
+	}
+	sort.Ints(nodeports)
+
+	for _, nodeport := range nodeports {
+		err := n.importport(ports[nodeport], nodeport)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importport forwards a node port to the host port it was forwarded to
+// in an exported cluster, or to a newly allocated host port if that one
+// is in use.
+func (n *Node) importport(hostport int, nodeport int) error {
+	if _, ok := n.Ports()[nodeport]; ok {
+		return nil
+	}
+
+	err := n.ForwardPort(hostport, nodeport)
+	if !errors.Is(err, ErrPortHostPortAlreadyUsed) && !errors.Is(err, ErrPortHostPortUnavailable) {
+		return err
+	}
+
+	newhostport, err := AllocateHostPort()
+	if err != nil {
+		return n.porterror("import", hostport, nodeport, err)
+	}
+
+	logf(
+		VerbosityInfo,
+		append(n.logfields("import"), "nodeport", nodeport, "hostport", newhostport),
+		"Host port %v is in use. Forwarding node %s port %v to host port %v instead.",
+		hostport, n.name, nodeport, newhostport,
+	)
+	return n.ForwardPort(newhostport, nodeport)
+}
@@ -0,0 +1,210 @@
+package kuttilib
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// BulkOptions control operations on all the nodes of a cluster.
+type BulkOptions struct {
+	// Parallelism is the maximum number of nodes operated on
+	// at the same time. If it is zero or less, all nodes of
+	// the same type are operated on at the same time.
+	Parallelism int
+}
+
+// NodeResult reports the outcome of a bulk operation on one node.
+type NodeResult struct {
+	// Node is the name of the node.
+	Node string
+	// Skipped is true if the node was already in the desired
+	// state, and so was not operated on.
+	Skipped bool
+	// Err is the error returned by the operation, if any.
+	Err error
+}
+
+// BulkResult reports the outcome of a bulk operation on the nodes
+// of a cluster.
+type BulkResult struct {
+	// Op is the operation performed.
+	Op string
+	// Results contains one NodeResult per node, in the order in
+	// which the nodes were operated on.
+	Results []NodeResult
+}
+
+// Failed returns the results of nodes for which the operation
+// failed.
+func (r *BulkResult) Failed() []NodeResult {
+	result := []NodeResult{}
+	for _, noderesult := range r.Results {
+		if noderesult.Err != nil {
+			result = append(result, noderesult)
+		}
+	}
+	return result
+}
+
+// Err returns an error joining the errors of all failed nodes,
+// or nil if the operation succeeded on all nodes.
+func (r *BulkResult) Err() error {
+	errs := []error{}
+	for _, noderesult := range r.Failed() {
+		errs = append(errs, noderesult.Err)
+	}
+	return errors.Join(errs...)
+}
+
+// StartAll starts all stopped nodes in the cluster. Control plane
+// nodes are started first, and then all other nodes. Nodes of the
+// same type are started concurrently, subject to opts.Parallelism.
+// Failures on some nodes do not stop the operation on others. The
+// returned error joins the errors of all failed nodes.
+func (c *Cluster) StartAll(ctx context.Context, opts BulkOptions) (*BulkResult, error) {
+	return c.bulkoperation(ctx, "start", opts, true, func(ctx context.Context, n *Node) (bool, error) {
+		if n.Status() == NodeStatusRunning {
+			return true, nil
+		}
+		return false, n.StartContext(ctx)
+	})
+}
+
+// StopAll gracefully stops all running nodes in the cluster. Nodes
+// are stopped in the reverse of the order used by StartAll.
+// Failures on some nodes do not stop the operation on others. The
+// returned error joins the errors of all failed nodes.
+func (c *Cluster) StopAll(ctx context.Context, opts BulkOptions) (*BulkResult, error) {
+	return c.bulkoperation(ctx, "stop", opts, false, func(ctx context.Context, n *Node) (bool, error) {
+		if n.Status() != NodeStatusRunning {
+			return true, nil
+		}
+		return false, n.StopContext(ctx)
+	})
+}
+
+// ForceStopAll forcibly stops all nodes in the cluster that are not
+// stopped, in the same order as StopAll.
+func (c *Cluster) ForceStopAll(ctx context.Context, opts BulkOptions) (*BulkResult, error) {
+	return c.bulkoperation(ctx, "force stop", opts, false, func(ctx context.Context, n *Node) (bool, error) {
+		if n.Status() == NodeStatusStopped {
+			return true, nil
+		}
+		return false, n.ForceStopContext(ctx)
+	})
+}
+
+// RestartAll stops all running nodes in the cluster as StopAll does,
+// and then starts the nodes it stopped as StartAll does. Nodes which
+// were already stopped, or which fail to stop, are not started. The
+// result contains one entry per node, reporting the first error
+// encountered for that node.
+func (c *Cluster) RestartAll(ctx context.Context, opts BulkOptions) (*BulkResult, error) {
+	stopresult, _ := c.StopAll(ctx, opts)
+
+	stopped := map[string]NodeResult{}
+	for _, noderesult := range stopresult.Results {
+		stopped[noderesult.Node] = noderesult
+	}
+
+	startresult, _ := c.bulkoperation(ctx, "start", opts, true, func(ctx context.Context, n *Node) (bool, error) {
+		noderesult, ok := stopped[n.name]
+		if ok && noderesult.Err != nil {
+			return false, noderesult.Err
+		}
+		if ok && noderesult.Skipped {
+			return true, nil
+		}
+		return false, n.StartContext(ctx)
+	})
+
+	result := &BulkResult{Op: "restart", Results: startresult.Results}
+	return result, result.Err()
+}
+
+// startrank returns the position of a node type in the start order.
+func startrank(nodetype string) int {
+	if nodetype == NodeTypeControlPlane {
+		return 0
+	}
+	return 1
+}
+
+// bulkoperation runs op on all nodes of the cluster, in waves of
+// nodes of the same type. Waves are ordered by startrank, or its
+// reverse if startorder is false. Within a wave, up to
+// opts.Parallelism nodes are operated on concurrently. The op
+// function returns true if it skipped the node.
+func (c *Cluster) bulkoperation(
+	ctx context.Context,
+	opname string,
+	opts BulkOptions,
+	startorder bool,
+	op func(context.Context, *Node) (bool, error),
+) (*BulkResult, error) {
+	waves := map[int][]*Node{}
+	for _, node := range c.Nodes() {
+		rank := startrank(node.nodetype)
+		waves[rank] = append(waves[rank], node)
+	}
+
+	ranks := make([]int, 0, len(waves))
+	for rank := range waves {
+		ranks = append(ranks, rank)
+	}
+	sort.Ints(ranks)
+	if !startorder {
+		sort.Sort(sort.Reverse(sort.IntSlice(ranks)))
+	}
+
+	result := &BulkResult{Op: opname, Results: []NodeResult{}}
+	for _, rank := range ranks {
+		result.Results = append(result.Results, runwave(ctx, opname, waves[rank], opts.Parallelism, op)...)
+	}
+
+	return result, result.Err()
+}
+
+// runwave runs op on nodes concurrently, with at most parallelism
+// operations in flight.
+func runwave(
+	ctx context.Context,
+	opname string,
+	nodes []*Node,
+	parallelism int,
+	op func(context.Context, *Node) (bool, error),
+) []NodeResult {
+	if parallelism <= 0 || parallelism > len(nodes) {
+		parallelism = len(nodes)
+	}
+
+	results := make([]NodeResult, len(nodes))
+	slots := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+
+	for i, node := range nodes {
+		results[i].Node = node.name
+
+		err := checkcontext(ctx, opname)
+		if err != nil {
+			results[i].Err = node.wraperror(opname, err)
+			continue
+		}
+
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, node *Node) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			skipped, err := op(ctx, node)
+			results[i].Skipped = skipped
+			results[i].Err = node.wraperror(opname, err)
+		}(i, node)
+	}
+
+	wg.Wait()
+	return results
+}
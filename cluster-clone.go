@@ -0,0 +1,314 @@
+package kuttilib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kuttiproject/drivercore"
+)
+
+// readdresstimeout is how long the API server of a control plane node
+// that has been moved to a new address is given to come back. Its
+// certificates have been issued again, and its static pods have to be
+// restarted, which takes much longer than a node status change.
+const readdresstimeout = 5 * time.Minute
+
+// MachineCloner is implemented by drivers that can create a machine in
+// one cluster as a copy of a machine in another. If linked is true, the
+// driver creates a linked clone, which shares unchanged disk data with
+// the original, if it supports them. CloneCluster uses it, and returns
+// ErrCloneNotSupported if the driver does not implement it.
+type MachineCloner interface {
+	CloneMachine(machinename string, clustername string, newclustername string, linked bool) (drivercore.Machine, error)
+}
+
+// CloneOptions control how CloneCluster copies nodes.
+type CloneOptions struct {
+	// FullClones makes the host of each cloned node an independent
+	// copy. By default, linked clones are created where the driver
+	// supports them. They are faster to create and use less disk
+	// space, but depend on the original hosts.
+	FullClones bool
+}
+
+// CloneCluster creates a cluster named dst as a copy of the cluster
+// named src, with the same driver, Kubernetes version, type and nodes.
+// The host of each node is cloned by the driver, so nodes keep their
+// contents, and their own Kubernetes versions, which differ from that
+// of the cluster while an upgrade is incomplete. If the driver uses
+// per-cluster networking, the new cluster gets a network of its own.
+// Automatic port forwarding is copied before any node is cloned, and
+// the port forwards of each original node are recreated on fresh host
+// ports, allocated with AllocateHostPort, before anything is run on
+// its clone.
+//
+// The name dst is checked with ValidateClusterName. If the driver
+// cannot clone hosts, because it does not implement MachineCloner,
+// ErrCloneNotSupported is returned. Whether nodes
+// may be running while they are cloned depends on the driver.
+//
+// The cloned control plane node of a managed cluster is started, and
+// the new cluster's workers join it at its own address. If that is not
+// the address of the original, the certificates of its API server and
+// etcd are issued again, and its kubeconfig files, static pod
+// manifests and the cluster-info and kube-proxy ConfigMaps are changed
+// to the new address, as are the kubelet kubeconfig files of cloned
+// workers.
+//
+// If an error occurs after the new cluster has been created, the
+// cluster is returned along with the error, as it stands. It can be
+// removed with DeleteClusterCascade.
+func CloneCluster(src string, dst string, opts CloneOptions) (*Cluster, error) {
+	source, ok := GetCluster(src)
+	if !ok {
+		return nil, ErrClusterDoesNotExist
+	}
+
+	err := source.ensuredriver()
+	if err != nil {
+		return nil, err
+	}
+
+	cloner, ok := source.driver.(MachineCloner)
+	if !ok {
+		return nil, ErrCloneNotSupported
+	}
+
+	err = ValidateClusterName(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	err = addcluster(context.Background(), dst, source.K8sVersion(), source.driverName, source.Type())
+	if err != nil {
+		return nil, err
+	}
+	cluster, _ := GetCluster(dst)
+
+	// Automatic port forwarding is set first, so that cloned nodes can
+	// be reached over SSH on drivers that use NAT.
+	err = cluster.SetAutoForwardPorts(source.AutoForwardPorts())
+	if err != nil {
+		return cluster, err
+	}
+
+	configlock.RLock()
+	endpoint, cacerthash := source.controlPlaneEndpoint, source.caCertHash
+	configlock.RUnlock()
+
+	nodes := source.nodelist()
+	sortnodes(nodes)
+
+	for _, node := range nodes {
+		clone, err := cluster.clonenode(cloner, source, node, !opts.FullClones)
+		if err != nil {
+			return cluster, err
+		}
+
+		// Workers are cloned after the control plane, and need its
+		// endpoint to be added, and to be pointed at it.
+		switch clone.nodetype {
+		case NodeTypeControlPlane:
+			err = clone.setcopiedendpoint("clone", endpoint, cacerthash)
+		case NodeTypeWorker:
+			err = clone.setcopiedworkerendpoint("clone", endpoint)
+		}
+		if err != nil {
+			return cluster, err
+		}
+	}
+
+	return cluster, nil
+}
+
+// clonenode adds a copy of a node of source to the cluster. The
+// driver clones the host before the node is added, so that the
+// configuration is not locked while it does. The clone keeps the
+// Kubernetes version of the node, which is not that of the cluster if
+// an upgrade has not reached it. The ports of the node are forwarded
+// to fresh host ports before the clone is set up.
+func (c *Cluster) clonenode(cloner MachineCloner, source *Cluster, node *Node, linked bool) (*Node, error) {
+	logf(VerbosityInfo, node.logfields("clone"), "Cloning node %s to cluster %s...", node.name, c.name)
+	start := time.Now()
+	k8sversion := node.K8sVersion()
+	clone, err := c.addnodewithhost(node.name, node.nodetype, node.spec, func(n *Node) error {
+		n.k8sVersion = k8sversion
+		host, err := cloner.CloneMachine(node.name, source.name, c.name, linked)
+		n.host = host
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	logf(VerbosityInfo, append(node.logfields("clone"), "duration", time.Since(start)), "Node %s cloned.", node.name)
+
+	return clone, errors.Join(clone.cloneports(node.Ports()), clone.setup())
+}
+
+// cloneports forwards the specified node ports to freshly allocated
+// host ports.
+func (n *Node) cloneports(ports map[int]int) error {
+	nodeports := make([]int, 0, len(ports))
+	for nodeport := range ports {
+		nodeports = append(nodeports, nodeport)
+	}
+	sort.Ints(nodeports)
+
+	for _, nodeport := range nodeports {
+		if _, ok := n.Ports()[nodeport]; ok {
+			continue
+		}
+
+		hostport, err := AllocateHostPort()
+		if err != nil {
+			return n.porterror("clone", 0, nodeport, err)
+		}
+
+		err = n.ForwardPort(hostport, nodeport)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setcopiedendpoint sets the control plane endpoint of the cluster of
+// a control plane node copied from another cluster to the node's own
+// address, and the CA certificate hash to that of the original. The
+// node is started to find its address. If it is not the host of
+// sourceendpoint, the control plane is moved to it with
+// readdresscontrolplane.
+func (n *Node) setcopiedendpoint(op string, sourceendpoint string, cacerthash string) error {
+	sourcehost, port, err := net.SplitHostPort(sourceendpoint)
+	if err != nil {
+		return n.wraperror(op, err)
+	}
+
+	err = n.ensurerunning()
+	if err != nil {
+		return n.wraperror(op, err)
+	}
+
+	address := n.IPAddress()
+	if address != sourcehost {
+		err = n.readdresscontrolplane(sourcehost, address)
+		if err != nil {
+			return n.wraperror(op, err)
+		}
+	}
+
+	return n.Cluster().setjoindetails(net.JoinHostPort(address, port), cacerthash)
+}
+
+// setcopiedworkerendpoint points the kubelet of a worker node copied
+// from another cluster at the control plane endpoint of its own
+// cluster, if that is not sourceendpoint. The node is started if it is
+// stopped.
+func (n *Node) setcopiedworkerendpoint(op string, sourceendpoint string) error {
+	c := n.Cluster()
+	configlock.RLock()
+	endpoint := c.controlPlaneEndpoint
+	configlock.RUnlock()
+
+	sourcehost, _, err := net.SplitHostPort(sourceendpoint)
+	if err != nil {
+		return n.wraperror(op, err)
+	}
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil || host == sourcehost {
+		return nil
+	}
+
+	err = n.ensurerunning()
+	if err == nil {
+		err = n.ensurecommands(context.Background())
+	}
+	if err != nil {
+		return n.wraperror(op, err)
+	}
+
+	logf(VerbosityInfo, n.logfields(op), "Pointing node %s at control plane address %s...", n.name, host)
+	_, err = n.runcommand(
+		context.Background(),
+		"sudo sed -i "+addressreplacement(sourcehost, host)+" /etc/kubernetes/kubelet.conf && sudo systemctl restart kubelet",
+	)
+	return n.wraperror(op, err)
+}
+
+// readdresscontrolplane moves the Kubernetes control plane on a node
+// copied from another cluster from oldaddress to newaddress. The
+// certificates of the API server and etcd, which name the address, are
+// issued again by kubeadm, with the cluster's CA. The address is
+// replaced in the kubeconfig files and static pod manifests, and the
+// kubelet is restarted. Once the API server answers, the address is
+// replaced in the cluster-info ConfigMap, which kubeadm join uses to
+// find the API server, and the kube-proxy ConfigMap.
+func (n *Node) readdresscontrolplane(oldaddress string, newaddress string) error {
+	err := n.ensurecommands(context.Background())
+	if err != nil {
+		return err
+	}
+
+	logf(VerbosityInfo, n.logfields("readdress"), "Moving control plane on node %s from %s to %s...", n.name, oldaddress, newaddress)
+	start := time.Now()
+
+	replacement := addressreplacement(oldaddress, newaddress)
+	pki := "/etc/kubernetes/pki/"
+	commands := []string{
+		"sudo sed -i " + replacement + " /etc/kubernetes/*.conf /etc/kubernetes/manifests/*.yaml",
+		"sudo rm -f " + strings.Join([]string{
+			pki + "apiserver.crt", pki + "apiserver.key",
+			pki + "etcd/server.crt", pki + "etcd/server.key",
+			pki + "etcd/peer.crt", pki + "etcd/peer.key",
+		}, " "),
+		"sudo kubeadm init phase certs apiserver --apiserver-advertise-address " + newaddress,
+		"sudo kubeadm init phase certs etcd-server",
+		"sudo kubeadm init phase certs etcd-peer",
+		"sudo systemctl restart kubelet",
+	}
+	for _, command := range commands {
+		_, err = n.runcommand(context.Background(), command)
+		if err != nil {
+			return err
+		}
+	}
+
+	kubectl := "sudo kubectl --kubeconfig /etc/kubernetes/admin.conf "
+	configmaps := [][2]string{{"kube-public", "cluster-info"}, {"kube-system", "kube-proxy"}}
+	for _, configmap := range configmaps {
+		command := fmt.Sprintf(
+			"%s-n %s get configmap %s -o yaml | %s | %sreplace -f -",
+			kubectl, configmap[0], configmap[1],
+			"sed "+replacement,
+			kubectl,
+		)
+
+		// The API server may take a while to come back after the
+		// kubelet restarts.
+		opts := WaitOptions{Timeout: readdresstimeout, Backoff: 2, MaxPollInterval: 10 * time.Second}
+		err = waitfor(context.Background(), "readdress", opts, func(ctx context.Context) (bool, string, error) {
+			_, err := n.runcommand(ctx, command)
+			if err != nil {
+				return false, err.Error(), nil
+			}
+			return true, "", nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	logf(VerbosityInfo, append(n.logfields("readdress"), "duration", time.Since(start)), "Control plane on node %s moved.", n.name)
+
+	return nil
+}
+
+// addressreplacement returns a quoted sed expression that replaces
+// oldaddress with newaddress.
+func addressreplacement(oldaddress string, newaddress string) string {
+	return fmt.Sprintf(`'s/\b%s\b/%s/g'`, strings.ReplaceAll(oldaddress, ".", `\.`), newaddress)
+}
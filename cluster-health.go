@@ -0,0 +1,360 @@
+package kuttilib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// HealthStatus is the verdict of a health check, or of a set of them.
+type HealthStatus string
+
+// The HealthStatus* constants list possible health verdicts.
+const (
+	// HealthStatusHealthy means that the check passed, or all checks
+	// passed.
+	HealthStatusHealthy HealthStatus = "Healthy"
+	// HealthStatusDegraded means that the control plane of a cluster
+	// is healthy, but some other nodes are not.
+	HealthStatusDegraded HealthStatus = "Degraded"
+	// HealthStatusUnhealthy means that the check failed, or some
+	// essential check failed.
+	HealthStatusUnhealthy HealthStatus = "Unhealthy"
+	// HealthStatusUnknown means that the check could not be performed,
+	// for example because a node is stopped or commands cannot be run
+	// on it.
+	HealthStatusUnknown HealthStatus = "Unknown"
+)
+
+// The HealthCheck* constants list the names of node health checks.
+const (
+	// HealthCheckRunning checks that the node's host is running.
+	HealthCheckRunning = "Running"
+	// HealthCheckSSH checks that the node can be reached over SSH.
+	HealthCheckSSH = "SSHReachable"
+	// HealthCheckKubelet checks that the kubelet service is active on
+	// the node. It is only performed for nodes of managed clusters.
+	HealthCheckKubelet = "KubeletActive"
+	// HealthCheckNodeReady checks that the Kubernetes API server
+	// reports the node as Ready. It is only performed for nodes of
+	// managed clusters.
+	HealthCheckNodeReady = "NodeReady"
+	// HealthCheckDiskPressure checks that the Kubernetes API server
+	// does not report disk pressure on the node. It is only performed
+	// for nodes of managed clusters.
+	HealthCheckDiskPressure = "NoDiskPressure"
+)
+
+// HealthCheck is the result of one health check on a node.
+type HealthCheck struct {
+	// Name is one of the HealthCheck* constants.
+	Name string
+	// Status is the verdict of the check.
+	Status HealthStatus
+	// Message explains a verdict other than HealthStatusHealthy.
+	Message string
+}
+
+// NodeHealth is the result of the health checks on a node.
+type NodeHealth struct {
+	Cluster string
+	Node    string
+	// Status is HealthStatusUnhealthy if any check failed,
+	// HealthStatusUnknown if no check failed but some could not be
+	// performed, and HealthStatusHealthy otherwise.
+	Status HealthStatus
+	// Checks contains the results of individual checks, in the order
+	// in which they were performed.
+	Checks []HealthCheck
+}
+
+// Check returns the result of the named check, and false if the check
+// was not performed.
+func (h *NodeHealth) Check(name string) (HealthCheck, bool) {
+	for _, check := range h.Checks {
+		if check.Name == name {
+			return check, true
+		}
+	}
+	return HealthCheck{}, false
+}
+
+func (h *NodeHealth) add(name string, status HealthStatus, message string) {
+	h.Checks = append(h.Checks, HealthCheck{Name: name, Status: status, Message: message})
+}
+
+func (h *NodeHealth) setstatus() {
+	h.Status = HealthStatusHealthy
+	for _, check := range h.Checks {
+		switch check.Status {
+		case HealthStatusUnhealthy:
+			h.Status = HealthStatusUnhealthy
+			return
+		case HealthStatusUnknown:
+			h.Status = HealthStatusUnknown
+		}
+	}
+}
+
+// ClusterHealth is the result of the health checks on all nodes of a
+// cluster.
+type ClusterHealth struct {
+	Cluster string
+	// Status is the overall verdict:
+	//   - HealthStatusHealthy if all nodes are healthy.
+	//   - HealthStatusDegraded if the control plane node, if any, and
+	//     some other nodes are healthy, but not all.
+	//   - HealthStatusUnhealthy if the control plane node is not
+	//     healthy, or no node is.
+	//   - HealthStatusUnknown if the cluster has no nodes.
+	Status HealthStatus
+	// Nodes contains the health of each node, in the order returned
+	// by Cluster.Nodes.
+	Nodes []*NodeHealth
+}
+
+// Health performs health checks on the node. A node being reported as
+// running by its driver does not mean that it is usable, so the node is
+// also checked for SSH access, and, if it belongs to a managed cluster,
+// for an active kubelet and its conditions as reported by the
+// Kubernetes API server.
+//
+// Failed checks are reported in the result, not as errors. An error is
+// returned only if ctx is canceled before the checks complete.
+func (n *Node) Health(ctx context.Context) (*NodeHealth, error) {
+	err := checkcontext(ctx, "check health")
+	if err != nil {
+		return nil, n.wraperror("check health", err)
+	}
+
+	conditions := map[string]nodeconditions{}
+	var conditionserr error
+	if n.ismanaged() {
+		conditions, conditionserr = n.Cluster().nodeconditions(ctx)
+		err = checkcontext(ctx, "check health")
+		if err != nil {
+			return nil, n.wraperror("check health", err)
+		}
+	}
+
+	return n.health(ctx, conditions, conditionserr)
+}
+
+// Health performs health checks on all nodes of the cluster, as
+// Node.Health does, and combines them into an overall verdict.
+func (c *Cluster) Health(ctx context.Context) (*ClusterHealth, error) {
+	err := checkcontext(ctx, "check health")
+	if err != nil {
+		return nil, err
+	}
+
+	conditions := map[string]nodeconditions{}
+	var conditionserr error
+	if c.Type() == ClusterTypeManaged {
+		conditions, conditionserr = c.nodeconditions(ctx)
+		err = checkcontext(ctx, "check health")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := &ClusterHealth{Cluster: c.name, Nodes: []*NodeHealth{}}
+	healthy := 0
+	controlplanehealthy := true
+	for _, node := range c.Nodes() {
+		nodehealth, err := node.health(ctx, conditions, conditionserr)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Nodes = append(result.Nodes, nodehealth)
+		if nodehealth.Status == HealthStatusHealthy {
+			healthy++
+		} else if node.Type() == NodeTypeControlPlane {
+			controlplanehealthy = false
+		}
+	}
+
+	switch {
+	case len(result.Nodes) == 0:
+		result.Status = HealthStatusUnknown
+	case healthy == len(result.Nodes):
+		result.Status = HealthStatusHealthy
+	case healthy > 0 && controlplanehealthy:
+		result.Status = HealthStatusDegraded
+	default:
+		result.Status = HealthStatusUnhealthy
+	}
+
+	return result, nil
+}
+
+// ismanaged returns true if the node is joined to a Kubernetes cluster
+// by kuttilib.
+func (n *Node) ismanaged() bool {
+	return n.nodetype == NodeTypeControlPlane || n.nodetype == NodeTypeWorker
+}
+
+// health performs health checks on the node, using node conditions
+// already fetched from the API server.
+func (n *Node) health(ctx context.Context, conditions map[string]nodeconditions, conditionserr error) (*NodeHealth, error) {
+	result := &NodeHealth{Cluster: n.clusterName, Node: n.name, Checks: []HealthCheck{}}
+	defer result.setstatus()
+
+	status := n.Status()
+	if status != NodeStatusRunning {
+		message := fmt.Sprintf("node status is %v", status)
+		result.add(HealthCheckRunning, HealthStatusUnhealthy, message)
+		result.add(HealthCheckSSH, HealthStatusUnknown, message)
+		if n.ismanaged() {
+			result.add(HealthCheckKubelet, HealthStatusUnknown, message)
+			result.add(HealthCheckNodeReady, HealthStatusUnknown, message)
+			result.add(HealthCheckDiskPressure, HealthStatusUnknown, message)
+		}
+		return result, nil
+	}
+	result.add(HealthCheckRunning, HealthStatusHealthy, "")
+
+	_, _, exitcode, err := n.Exec(ctx, "true")
+	if err == nil {
+		err = commandfailure(exitcode, "")
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return nil, err
+	}
+	if err != nil {
+		result.add(HealthCheckSSH, HealthStatusUnhealthy, err.Error())
+	} else {
+		result.add(HealthCheckSSH, HealthStatusHealthy, "")
+	}
+
+	if !n.ismanaged() {
+		return result, nil
+	}
+
+	output, err := n.runcommand(ctx, "systemctl is-active kubelet")
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return nil, err
+	}
+	kubeletstatus := strings.TrimSpace(output)
+	switch {
+	case kubeletstatus == "active":
+		result.add(HealthCheckKubelet, HealthStatusHealthy, "")
+	case errors.Is(err, ErrCommandsNotSupported):
+		result.add(HealthCheckKubelet, HealthStatusUnknown, err.Error())
+	case kubeletstatus != "":
+		result.add(HealthCheckKubelet, HealthStatusUnhealthy, "kubelet is "+kubeletstatus)
+	case err != nil:
+		result.add(HealthCheckKubelet, HealthStatusUnhealthy, err.Error())
+	default:
+		result.add(HealthCheckKubelet, HealthStatusUnhealthy, "kubelet is not active")
+	}
+
+	if conditionserr != nil {
+		message := "could not query the API server: " + conditionserr.Error()
+		result.add(HealthCheckNodeReady, HealthStatusUnknown, message)
+		result.add(HealthCheckDiskPressure, HealthStatusUnknown, message)
+		return result, nil
+	}
+
+	nodeconditions, ok := conditions[n.name]
+	if !ok {
+		message := "node is not registered with the API server"
+		result.add(HealthCheckNodeReady, HealthStatusUnhealthy, message)
+		result.add(HealthCheckDiskPressure, HealthStatusUnknown, message)
+		return result, nil
+	}
+
+	ready, ok := nodeconditions["Ready"]
+	switch {
+	case !ok:
+		result.add(HealthCheckNodeReady, HealthStatusUnknown, "Ready condition not reported")
+	case ready.Status == "True":
+		result.add(HealthCheckNodeReady, HealthStatusHealthy, "")
+	default:
+		result.add(HealthCheckNodeReady, HealthStatusUnhealthy, ready.describe())
+	}
+
+	diskpressure, ok := nodeconditions["DiskPressure"]
+	switch {
+	case !ok:
+		result.add(HealthCheckDiskPressure, HealthStatusUnknown, "DiskPressure condition not reported")
+	case diskpressure.Status == "False":
+		result.add(HealthCheckDiskPressure, HealthStatusHealthy, "")
+	default:
+		result.add(HealthCheckDiskPressure, HealthStatusUnhealthy, diskpressure.describe())
+	}
+
+	return result, nil
+}
+
+// nodecondition is the part of a Kubernetes node condition used by
+// health checks.
+type nodecondition struct {
+	Type    string `json:"type"`
+	Status  string `json:"status"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (nc nodecondition) describe() string {
+	result := fmt.Sprintf("%s is %s", nc.Type, nc.Status)
+	if nc.Reason != "" {
+		result += ": " + nc.Reason
+	}
+	if nc.Message != "" {
+		result += ": " + nc.Message
+	}
+	return result
+}
+
+// nodeconditions maps condition types to conditions.
+type nodeconditions map[string]nodecondition
+
+// nodelist is the part of a Kubernetes node list used by health checks.
+type nodelist struct {
+	Items []struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Status struct {
+			Conditions []nodecondition `json:"conditions"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// nodeconditions fetches the conditions of all nodes in a managed
+// cluster from the Kubernetes API server, keyed by node name.
+func (c *Cluster) nodeconditions(ctx context.Context) (map[string]nodeconditions, error) {
+	node, err := c.controlplanenode()
+	if err != nil {
+		return nil, err
+	}
+
+	if node.Status() != NodeStatusRunning {
+		return nil, fmt.Errorf("control plane node %s is not running", node.name)
+	}
+
+	output, err := node.runcommand(ctx, "sudo kubectl --kubeconfig /etc/kubernetes/admin.conf get nodes -o json")
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes nodelist
+	err = json.Unmarshal([]byte(output), &nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]nodeconditions{}
+	for _, item := range nodes.Items {
+		conditions := nodeconditions{}
+		for _, condition := range item.Status.Conditions {
+			conditions[condition.Type] = condition
+		}
+		result[item.Metadata.Name] = conditions
+	}
+	return result, nil
+}
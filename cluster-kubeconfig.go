@@ -0,0 +1,267 @@
+package kuttilib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"sigs.k8s.io/yaml"
+)
+
+// apiserverport is the port on which kubeadm configures the
+// Kubernetes API server to listen.
+const apiserverport = 6443
+
+// kubeconfig is the part of the kubeconfig file format that kuttilib
+// manipulates. The details of each entry are kept as generic maps,
+// so that fields unknown to kuttilib are preserved.
+type kubeconfig struct {
+	APIVersion     string            `json:"apiVersion"`
+	Kind           string            `json:"kind"`
+	Preferences    map[string]any    `json:"preferences"`
+	Clusters       []kubeconfigentry `json:"clusters"`
+	Contexts       []kubeconfigentry `json:"contexts"`
+	Users          []kubeconfigentry `json:"users"`
+	CurrentContext string            `json:"current-context"`
+	Extensions     json.RawMessage   `json:"extensions,omitempty"`
+}
+
+type kubeconfigentry struct {
+	Name    string         `json:"name"`
+	Cluster map[string]any `json:"cluster,omitempty"`
+	Context map[string]any `json:"context,omitempty"`
+	User    map[string]any `json:"user,omitempty"`
+}
+
+// KubeconfigContextName returns the name used for the cluster, user
+// and context entries of a kutti cluster in a kubeconfig file.
+func KubeconfigContextName(clustername string) string {
+	return "kutti-" + clustername
+}
+
+// Kubeconfig fetches the administrator kubeconfig from the control
+// plane node of a managed cluster, and returns it in JSON format.
+//
+// The cluster, user and context in the returned kubeconfig are all
+// named as returned by KubeconfigContextName. If the cluster's driver
+// uses NAT networking, the API server address is changed to the host
+// port to which the control plane node's API server port is
+// forwarded. If that port is not forwarded, ErrAPIServerNotForwarded
+// is returned.
+func (c *Cluster) Kubeconfig() ([]byte, error) {
+	node, err := c.controlplanenode()
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := node.runcommand(context.Background(), "sudo kubectl --kubeconfig /etc/kubernetes/admin.conf config view --raw -o json")
+	if err != nil {
+		return nil, node.wraperror("get kubeconfig", err)
+	}
+
+	adminconfig, err := parsekubeconfig([]byte(output))
+	if err != nil {
+		return nil, node.wraperror("get kubeconfig", err)
+	}
+	if len(adminconfig.Clusters) != 1 || len(adminconfig.Contexts) != 1 || len(adminconfig.Users) != 1 {
+		return nil, node.wraperror("get kubeconfig", ErrInvalidKubeconfig)
+	}
+
+	err = c.ensuredriver()
+	if err != nil {
+		return nil, err
+	}
+
+	clusterentry := adminconfig.Clusters[0].Cluster
+	if clusterentry == nil {
+		return nil, node.wraperror("get kubeconfig", ErrInvalidKubeconfig)
+	}
+	if c.driver.UsesNATNetworking() {
+		address, err := c.APIServerAddress()
+		if err != nil {
+			return nil, node.wraperror("get kubeconfig", err)
+		}
+
+		// The API server certificate is not issued for localhost,
+		// so verify it against the name it is issued for instead.
+		clusterentry["server"] = "https://" + address
+		clusterentry["tls-server-name"] = "kubernetes"
+	}
+
+	name := KubeconfigContextName(c.name)
+	username := name + "-admin"
+	adminconfig.Clusters[0].Name = name
+	adminconfig.Users[0].Name = username
+	adminconfig.Contexts[0].Name = name
+	adminconfig.Contexts[0].Context = map[string]any{
+		"cluster": name,
+		"user":    username,
+	}
+	adminconfig.CurrentContext = name
+
+	return json.MarshalIndent(adminconfig, "", "  ")
+}
+
+// controlplanenode returns the control plane node of a managed cluster.
+func (c *Cluster) controlplanenode() (*Node, error) {
+	if c.Type() != ClusterTypeManaged {
+		return nil, ErrClusterNotManaged
+	}
+
+	for _, node := range c.Nodes() {
+		if node.Type() == NodeTypeControlPlane {
+			return node, nil
+		}
+	}
+
+	return nil, ErrNoControlPlane
+}
+
+// apiserverport returns the node port on which the API server of
+// the cluster listens.
+func (c *Cluster) apiserverport() int {
+	configlock.RLock()
+	endpoint := c.controlPlaneEndpoint
+	configlock.RUnlock()
+
+	_, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return apiserverport
+	}
+
+	result, err := strconv.Atoi(port)
+	if err != nil {
+		return apiserverport
+	}
+	return result
+}
+
+// DefaultKubeconfigPath returns the kubeconfig file used by kubectl:
+// the first file listed in the KUBECONFIG environment variable, or
+// .kube/config in the user's home directory.
+func DefaultKubeconfigPath() (string, error) {
+	for _, path := range filepath.SplitList(os.Getenv("KUBECONFIG")) {
+		if path != "" {
+			return path, nil
+		}
+	}
+
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homedir, ".kube", "config"), nil
+}
+
+// WriteKubeconfig writes a kubeconfig to a file, replacing it if it
+// exists. The file is readable only by the current user.
+func WriteKubeconfig(filename string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return err
+	}
+
+	return writefileatomic(filename, data, 0600)
+}
+
+// MergeKubeconfig merges the cluster, user and context entries of a
+// kubeconfig into a kubeconfig file. Entries in the file with the same
+// names are replaced. If the file does not exist, it is created. The
+// current context of the file is changed only if setcurrent is true,
+// or the file has no current context.
+//
+// If the file is not in JSON format, it is read as YAML, and the merged
+// result is written back in YAML format. If it cannot be read as YAML,
+// an error wrapping ErrKubeconfigNotMergeable is returned.
+func MergeKubeconfig(filename string, data []byte, setcurrent bool) error {
+	newconfig, err := parsekubeconfig(data)
+	if err != nil {
+		return err
+	}
+
+	existingdata, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return WriteKubeconfig(filename, data)
+	}
+	if err != nil {
+		return err
+	}
+
+	isjson := json.Valid(existingdata)
+	if !isjson {
+		existingdata, err = yaml.YAMLToJSON(existingdata)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrKubeconfigNotMergeable, err)
+		}
+	}
+
+	existingconfig, err := parsekubeconfig(existingdata)
+	if err != nil {
+		return err
+	}
+
+	existingconfig.Clusters = mergekubeconfigentries(existingconfig.Clusters, newconfig.Clusters)
+	existingconfig.Contexts = mergekubeconfigentries(existingconfig.Contexts, newconfig.Contexts)
+	existingconfig.Users = mergekubeconfigentries(existingconfig.Users, newconfig.Users)
+	if setcurrent || existingconfig.CurrentContext == "" {
+		existingconfig.CurrentContext = newconfig.CurrentContext
+	}
+
+	mergeddata, err := json.MarshalIndent(existingconfig, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if !isjson {
+		mergeddata, err = yaml.JSONToYAML(mergeddata)
+		if err != nil {
+			return err
+		}
+	}
+
+	return WriteKubeconfig(filename, mergeddata)
+}
+
+func parsekubeconfig(data []byte) (*kubeconfig, error) {
+	result := &kubeconfig{}
+	err := json.Unmarshal(data, result)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidKubeconfig, err)
+	}
+
+	if result.APIVersion == "" {
+		result.APIVersion = "v1"
+	}
+	if result.Kind == "" {
+		result.Kind = "Config"
+	}
+	if result.Preferences == nil {
+		result.Preferences = map[string]any{}
+	}
+
+	return result, nil
+}
+
+// mergekubeconfigentries returns existing, with entries replaced by
+// entries of the same name from added, and the remaining added
+// entries appended.
+func mergekubeconfigentries(existing []kubeconfigentry, added []kubeconfigentry) []kubeconfigentry {
+	result := make([]kubeconfigentry, 0, len(existing)+len(added))
+	addednames := map[string]bool{}
+	for _, entry := range added {
+		addednames[entry.Name] = true
+	}
+
+	for _, entry := range existing {
+		if !addednames[entry.Name] {
+			result = append(result, entry)
+		}
+	}
+
+	return append(result, added...)
+}
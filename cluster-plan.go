@@ -0,0 +1,393 @@
+package kuttilib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// PlanOptions control how a plan is made.
+type PlanOptions struct {
+	// Prune causes the plan to delete nodes, and unforward ports,
+	// that exist but are not described in the spec. Port forwards
+	// that differ from the spec are replaced, except for the SSH
+	// port, which cannot be unmapped. Automatic port forwarding is
+	// disabled if the spec does not enable it.
+	Prune bool
+}
+
+// PlanStep is a single step in a Plan. Only the fields relevant to
+// the Action are set.
+type PlanStep struct {
+	// Action is one of the Action* constants.
+	Action string
+	// Cluster is the name of the cluster acted on.
+	Cluster string
+	// Driver, K8sVersion and ClusterType describe the cluster to be
+	// created by ActionCreateCluster.
+	Driver      string `json:",omitempty"`
+	K8sVersion  string `json:",omitempty"`
+	ClusterType string `json:",omitempty"`
+	// AutoForwardPorts is the setting made by
+	// ActionSetAutoForwardPorts.
+	AutoForwardPorts bool `json:",omitempty"`
+	// Node is the name of the node acted on, if any.
+	Node string `json:",omitempty"`
+	// NodeType and Spec describe the node to be created by
+	// ActionCreateNode.
+	NodeType string   `json:",omitempty"`
+	Spec     NodeSpec `json:",omitzero"`
+	// HostPort and NodePort identify a port to be forwarded or
+	// unforwarded.
+	HostPort int `json:",omitempty"`
+	NodePort int `json:",omitempty"`
+}
+
+// String returns a one-line description of the step.
+func (s PlanStep) String() string {
+	switch s.Action {
+	case ActionCreateCluster:
+		return fmt.Sprintf("create %s cluster %s with driver %s and version %s", strings.ToLower(s.ClusterType), s.Cluster, s.Driver, s.K8sVersion)
+	case ActionSetAutoForwardPorts:
+		if s.AutoForwardPorts {
+			return fmt.Sprintf("enable automatic port forwarding for cluster %s", s.Cluster)
+		}
+		return fmt.Sprintf("disable automatic port forwarding for cluster %s", s.Cluster)
+	case ActionCreateNode:
+		return fmt.Sprintf("create %s node %s", strings.ToLower(s.NodeType), s.Node)
+	case ActionDeleteNode:
+		return fmt.Sprintf("delete node %s", s.Node)
+	case ActionForwardPort:
+		return fmt.Sprintf("forward node %s port %v to host port %v", s.Node, s.NodePort, s.HostPort)
+	case ActionUnforwardPort:
+		return fmt.Sprintf("unforward node %s port %v from host port %v", s.Node, s.NodePort, s.HostPort)
+	case ActionStartNode:
+		return fmt.Sprintf("start node %s", s.Node)
+	case ActionStopNode:
+		return fmt.Sprintf("stop node %s", s.Node)
+	}
+	return fmt.Sprintf("%s %s", s.Action, s.Node)
+}
+
+// Execute performs the step.
+func (s PlanStep) Execute(ctx context.Context) error {
+	logf(VerbosityInfo, []any{"cluster", s.Cluster, "node", s.Node, "operation", string(s.Action)}, "Executing: %s...", s)
+
+	if s.Action == ActionCreateCluster {
+		return addcluster(ctx, s.Cluster, s.K8sVersion, s.Driver, s.ClusterType)
+	}
+
+	cluster, ok := GetCluster(s.Cluster)
+	if !ok {
+		return ErrClusterDoesNotExist
+	}
+
+	switch s.Action {
+	case ActionSetAutoForwardPorts:
+		return cluster.SetAutoForwardPorts(s.AutoForwardPorts)
+	case ActionCreateNode:
+		var err error
+		switch s.NodeType {
+		case NodeTypeControlPlane:
+			_, err = cluster.NewControlPlaneNodeWithSpec(s.Node, s.Spec)
+		case NodeTypeWorker:
+			_, err = cluster.NewWorkerNodeWithSpec(s.Node, s.Spec)
+		default:
+			_, err = cluster.NewUninitializedNodeWithSpec(s.Node, s.Spec)
+		}
+		return err
+	case ActionDeleteNode:
+		return cluster.DeleteNodeContext(ctx, s.Node, true)
+	}
+
+	node, ok := cluster.GetNode(s.Node)
+	if !ok {
+		return wrapnodeerror(s.Cluster, s.Node, s.Action, ErrNodeNotFound)
+	}
+
+	switch s.Action {
+	case ActionForwardPort:
+		return node.ForwardPort(s.HostPort, s.NodePort)
+	case ActionUnforwardPort:
+		return node.UnforwardPort(s.NodePort)
+	case ActionStartNode:
+		return node.StartContext(ctx)
+	case ActionStopNode:
+		return node.StopContext(ctx)
+	}
+
+	return fmt.Errorf("%w: %s", ErrUnknownPlanAction, s.Action)
+}
+
+// Plan is an ordered list of steps that bring a cluster to the state
+// described by a ClusterSpec. It can be serialized as JSON, reviewed,
+// and then executed all at once using Execute, or step by step using
+// PlanStep.Execute.
+type Plan struct {
+	// Cluster is the name of the cluster.
+	Cluster string
+	// Steps are the steps to execute, in order.
+	Steps []PlanStep
+}
+
+// IsEmpty returns true if the plan has no steps, which means the
+// cluster already matches the spec.
+func (p *Plan) IsEmpty() bool {
+	return len(p.Steps) == 0
+}
+
+// String returns a numbered list of the steps in the plan, one
+// per line.
+func (p *Plan) String() string {
+	if p.IsEmpty() {
+		return fmt.Sprintf("Cluster %s is up to date.\n", p.Cluster)
+	}
+
+	var sb strings.Builder
+	for i, step := range p.Steps {
+		fmt.Fprintf(&sb, "%3d. %s\n", i+1, step)
+	}
+	return sb.String()
+}
+
+// StepResult reports the outcome of executing one step of a plan.
+type StepResult struct {
+	// Step is the step executed.
+	Step PlanStep
+	// Err is the error returned by the step, if any.
+	Err error
+}
+
+// PlanResult reports the outcome of executing a plan.
+type PlanResult struct {
+	// Cluster is the name of the cluster.
+	Cluster string
+	// Steps contains one StepResult per step executed, in order.
+	Steps []StepResult
+}
+
+// Err returns an error joining the errors of all failed steps, or
+// nil if all executed steps succeeded.
+func (r *PlanResult) Err() error {
+	errs := []error{}
+	for _, stepresult := range r.Steps {
+		if stepresult.Err != nil {
+			errs = append(errs, stepresult.Err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Execute performs the steps of the plan in order. It stops at the
+// first step that fails, or when ctx is canceled. The result lists
+// the steps that were executed.
+func (p *Plan) Execute(ctx context.Context) (*PlanResult, error) {
+	result := &PlanResult{Cluster: p.Cluster, Steps: []StepResult{}}
+
+	for _, step := range p.Steps {
+		err := checkcontext(ctx, "execute plan")
+		if err != nil {
+			return result, err
+		}
+
+		err = step.Execute(ctx)
+		result.Steps = append(result.Steps, StepResult{Step: step, Err: err})
+		if err != nil {
+			break
+		}
+	}
+
+	return result, result.Err()
+}
+
+// PlanClusterSpec compares spec with the current state of the cluster
+// it describes, and returns a plan to bring the cluster to that state.
+//
+// Steps are ordered so that they can be executed one after the other:
+// the cluster is created first, if needed, and automatic port
+// forwarding is set up next, so that new nodes can be reached over
+// SSH as they are created. If opts.Prune is set, ports and nodes not
+// in the spec are removed next. Then nodes are created, control plane
+// nodes first, ports are forwarded, and finally nodes are started or
+// stopped as the spec's State fields require.
+//
+// If an existing cluster or node conflicts with the spec in a way the
+// plan cannot fix, an error wrapping ErrClusterSpecConflict is
+// returned.
+func PlanClusterSpec(spec *ClusterSpec, opts PlanOptions) (*Plan, error) {
+	plan := &Plan{Cluster: spec.Name, Steps: []PlanStep{}}
+
+	err := spec.Validate()
+	if err != nil {
+		return plan, err
+	}
+
+	cluster, exists := GetCluster(spec.Name)
+	if exists {
+		err = checkclusterspec(cluster, spec)
+		if err != nil {
+			return plan, err
+		}
+	} else {
+		plan.Steps = append(plan.Steps, PlanStep{
+			Action:      ActionCreateCluster,
+			Cluster:     spec.Name,
+			Driver:      spec.Driver,
+			K8sVersion:  spec.K8sVersion,
+			ClusterType: spec.clustertype(),
+		})
+	}
+
+	autoforwardports := exists && cluster.AutoForwardPorts()
+	if spec.AutoForwardPorts != autoforwardports && (spec.AutoForwardPorts || opts.Prune) {
+		plan.Steps = append(plan.Steps, PlanStep{
+			Action:           ActionSetAutoForwardPorts,
+			Cluster:          spec.Name,
+			AutoForwardPorts: spec.AutoForwardPorts,
+		})
+	}
+
+	specnodes := make([]ClusterSpecNode, len(spec.Nodes))
+	copy(specnodes, spec.Nodes)
+	sort.SliceStable(specnodes, func(i, j int) bool {
+		return startrank(spec.nodetype(specnodes[i])) < startrank(spec.nodetype(specnodes[j]))
+	})
+
+	existing := map[string]*Node{}
+	if exists {
+		for _, node := range cluster.Nodes() {
+			existing[node.Name()] = node
+		}
+	}
+
+	var removals, creations, forwards, starts, stops []PlanStep
+
+	for _, specnode := range specnodes {
+		nodetype := spec.nodetype(specnode)
+		node, ok := existing[specnode.Name]
+		delete(existing, specnode.Name)
+
+		currentports := map[int]int{}
+		currentstatus := createdstatus(nodetype)
+		if ok {
+			if node.Type() != nodetype {
+				return plan, fmt.Errorf(
+					"%w: node %s exists with type %s",
+					ErrClusterSpecConflict,
+					node.Name(),
+					node.Type(),
+				)
+			}
+			currentports = node.Ports()
+			currentstatus = node.Status()
+		} else {
+			creations = append(creations, PlanStep{
+				Action:   ActionCreateNode,
+				Cluster:  spec.Name,
+				Node:     specnode.Name,
+				NodeType: nodetype,
+				Spec:     specnode.Spec,
+			})
+		}
+
+		for _, nodeport := range sortedports(specnode.Ports) {
+			hostport := specnode.Ports[nodeport]
+			currenthostport, forwarded := currentports[nodeport]
+			if forwarded && currenthostport == hostport {
+				continue
+			}
+
+			if forwarded {
+				if !opts.Prune || nodeport == 22 {
+					return plan, fmt.Errorf(
+						"%w: node %s already forwards %w",
+						ErrClusterSpecConflict,
+						specnode.Name,
+						&PortError{HostPort: currenthostport, NodePort: nodeport, Err: ErrPortNodePortInUse},
+					)
+				}
+				removals = append(removals, unforwardstep(spec.Name, specnode.Name, nodeport, currenthostport))
+			}
+
+			forwards = append(forwards, PlanStep{
+				Action:   ActionForwardPort,
+				Cluster:  spec.Name,
+				Node:     specnode.Name,
+				HostPort: hostport,
+				NodePort: nodeport,
+			})
+		}
+
+		if opts.Prune {
+			for _, nodeport := range sortedports(currentports) {
+				if _, ok := specnode.Ports[nodeport]; !ok && nodeport != 22 {
+					removals = append(removals, unforwardstep(spec.Name, specnode.Name, nodeport, currentports[nodeport]))
+				}
+			}
+		}
+
+		switch {
+		case specnode.State == NodeStatusRunning && currentstatus != NodeStatusRunning:
+			starts = append(starts, PlanStep{Action: ActionStartNode, Cluster: spec.Name, Node: specnode.Name})
+		case specnode.State == NodeStatusStopped && currentstatus == NodeStatusRunning:
+			stops = append([]PlanStep{{Action: ActionStopNode, Cluster: spec.Name, Node: specnode.Name}}, stops...)
+		}
+	}
+
+	if opts.Prune {
+		extranodes := make([]*Node, 0, len(existing))
+		for _, node := range existing {
+			extranodes = append(extranodes, node)
+		}
+		sort.Slice(extranodes, func(i, j int) bool {
+			ranki, rankj := startrank(extranodes[i].Type()), startrank(extranodes[j].Type())
+			if ranki != rankj {
+				return ranki > rankj
+			}
+			return extranodes[i].Name() < extranodes[j].Name()
+		})
+
+		for _, node := range extranodes {
+			removals = append(removals, PlanStep{Action: ActionDeleteNode, Cluster: spec.Name, Node: node.Name()})
+		}
+	}
+
+	plan.Steps = append(plan.Steps, removals...)
+	plan.Steps = append(plan.Steps, creations...)
+	plan.Steps = append(plan.Steps, forwards...)
+	plan.Steps = append(plan.Steps, stops...)
+	plan.Steps = append(plan.Steps, starts...)
+
+	return plan, nil
+}
+
+func unforwardstep(clustername string, nodename string, nodeport int, hostport int) PlanStep {
+	return PlanStep{
+		Action:   ActionUnforwardPort,
+		Cluster:  clustername,
+		Node:     nodename,
+		HostPort: hostport,
+		NodePort: nodeport,
+	}
+}
+
+func sortedports(ports map[int]int) []int {
+	result := make([]int, 0, len(ports))
+	for nodeport := range ports {
+		result = append(result, nodeport)
+	}
+	sort.Ints(result)
+	return result
+}
+
+// createdstatus returns the status of a node of the specified type
+// once it has been created. Control plane and worker nodes are started
+// to run kubeadm, and other nodes are left stopped.
+func createdstatus(nodetype string) NodeStatus {
+	if nodetype == NodeTypeControlPlane || nodetype == NodeTypeWorker {
+		return NodeStatusRunning
+	}
+	return NodeStatusStopped
+}
@@ -0,0 +1,126 @@
+package kuttilib
+
+import (
+	"errors"
+	"net"
+	"strconv"
+)
+
+// AutoForwardPorts returns true if host ports are automatically
+// forwarded for new nodes in the cluster.
+func (c *Cluster) AutoForwardPorts() bool {
+	configlock.RLock()
+	defer configlock.RUnlock()
+
+	return c.autoForwardPorts
+}
+
+// SetAutoForwardPorts sets whether host ports are automatically
+// forwarded for new nodes in the cluster.
+//
+// If enabled, and the cluster's driver uses NAT networking, each node
+// created afterwards has its SSH port forwarded to a free host port.
+// Control plane nodes also have their API server port forwarded. A
+// host port is allocated using AllocateHostPort. Existing nodes are
+// not changed.
+func (c *Cluster) SetAutoForwardPorts(enabled bool) error {
+	return clusterconfigmanager.Update(func() error {
+		err := c.checkconfigured()
+		if err != nil {
+			return err
+		}
+
+		configlock.Lock()
+		c.autoForwardPorts = enabled
+		configlock.Unlock()
+
+		return nil
+	})
+}
+
+// APIServerAddress returns the host:port address at which the
+// Kubernetes API server of a managed cluster can be reached from the
+// host. If the cluster's driver uses NAT networking, this is a
+// localhost address, and ErrAPIServerNotForwarded is returned if the
+// API server port of the control plane node is not forwarded.
+func (c *Cluster) APIServerAddress() (string, error) {
+	node, err := c.controlplanenode()
+	if err != nil {
+		return "", err
+	}
+
+	err = c.ensuredriver()
+	if err != nil {
+		return "", err
+	}
+
+	if c.driver.UsesNATNetworking() {
+		hostport, ok := node.Ports()[c.apiserverport()]
+		if !ok {
+			return "", ErrAPIServerNotForwarded
+		}
+		return net.JoinHostPort("127.0.0.1", strconv.Itoa(hostport)), nil
+	}
+
+	configlock.RLock()
+	endpoint := c.controlPlaneEndpoint
+	configlock.RUnlock()
+
+	if endpoint == "" {
+		return "", ErrNoControlPlane
+	}
+	return endpoint, nil
+}
+
+// autoforwardports forwards the SSH port of the node, and the API
+// server port of a control plane node, to free host ports, if the
+// cluster is set up for it.
+func (n *Node) autoforwardports() error {
+	c := n.Cluster()
+	if !c.AutoForwardPorts() || !c.driver.UsesNATNetworking() {
+		return nil
+	}
+
+	nodeports := []int{22}
+	if n.nodetype == NodeTypeControlPlane {
+		nodeports = append(nodeports, c.apiserverport())
+	}
+
+	err := n.ensurehost()
+	if err != nil {
+		return n.wraperror("forward port", err)
+	}
+
+	// Ports that were forwarded must be saved even if others fail,
+	// so failures are collected rather than returned from Update.
+	errs := []error{}
+	forwarded := map[int]int{}
+	err = clusterconfigmanager.Update(func() error {
+		for _, nodeport := range nodeports {
+			if _, ok := n.Ports()[nodeport]; ok {
+				continue
+			}
+
+			hostport, err := AllocateHostPort()
+			if err != nil {
+				errs = append(errs, n.porterror("forward port", 0, nodeport, err))
+				continue
+			}
+
+			err = n.forwardport(hostport, nodeport)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			forwarded[nodeport] = hostport
+		}
+		return nil
+	})
+	if err == nil {
+		for nodeport, hostport := range forwarded {
+			publish(Event{Type: EventPortForwarded, Cluster: n.clusterName, Node: n.name, HostPort: hostport, NodePort: nodeport})
+		}
+	}
+
+	return errors.Join(append(errs, err)...)
+}
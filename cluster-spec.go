@@ -0,0 +1,258 @@
+package kuttilib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"sigs.k8s.io/yaml"
+)
+
+// ClusterSpec describes a cluster and its nodes declaratively. It can
+// be stored as YAML or JSON, and applied using ApplyClusterSpec.
+type ClusterSpec struct {
+	// Name is the name of the cluster.
+	Name string
+	// Driver is the name of the driver used by the cluster.
+	Driver string
+	// K8sVersion is the Kubernetes version of the cluster.
+	K8sVersion string
+	// Type is ClusterTypeUnmanaged or ClusterTypeManaged. If empty,
+	// the cluster is unmanaged.
+	Type string `json:",omitempty"`
+	// AutoForwardPorts enables automatic port forwarding for the
+	// cluster, as SetAutoForwardPorts does, before any node is
+	// created. Nodes can then be reached over SSH as they are set up
+	// on drivers that use NAT networking. Ports which are forwarded
+	// automatically, the SSH port of every node and the API server
+	// port of the control plane node, cannot also be listed in Ports.
+	AutoForwardPorts bool `json:",omitempty"`
+	// Nodes describes the nodes of the cluster.
+	Nodes []ClusterSpecNode `json:",omitempty"`
+}
+
+// ClusterSpecNode describes a node in a ClusterSpec.
+type ClusterSpecNode struct {
+	// Name is the name of the node.
+	Name string
+	// Type is one of the NodeType* constants. If empty, the node is
+	// an unmanaged node in an unmanaged cluster, or a worker node in
+	// a managed cluster.
+	Type string `json:",omitempty"`
+	// Spec describes the hardware resources of the node.
+	Spec NodeSpec `json:",omitzero"`
+	// Ports maps node ports to host ports to be forwarded.
+	Ports map[int]int `json:",omitempty"`
+	// State is NodeStatusRunning or NodeStatusStopped, if the node
+	// should be started or stopped. If empty, the node is left in
+	// whatever state it is in. New control plane and worker nodes
+	// are running, since they are started to run kubeadm, and other
+	// new nodes are stopped.
+	State NodeStatus `json:",omitempty"`
+}
+
+// The Action* constants list the actions that a Plan step may
+// perform.
+const (
+	ActionCreateCluster       = "CreateCluster"
+	ActionSetAutoForwardPorts = "SetAutoForwardPorts"
+	ActionCreateNode          = "CreateNode"
+	ActionDeleteNode          = "DeleteNode"
+	ActionForwardPort         = "ForwardPort"
+	ActionUnforwardPort       = "UnforwardPort"
+	ActionStartNode           = "StartNode"
+	ActionStopNode            = "StopNode"
+)
+
+// ApplyReport reports what ApplyClusterSpec did.
+type ApplyReport struct {
+	// Cluster is the name of the cluster.
+	Cluster string
+	// Actions lists the steps performed, in order. It is empty
+	// if the cluster already matched the spec.
+	Actions []PlanStep
+}
+
+// ParseClusterSpec parses a YAML or JSON-encoded ClusterSpec, and
+// validates it. Field names are those of ClusterSpec and
+// ClusterSpecNode, as in JSON. Unknown fields are treated as errors.
+func ParseClusterSpec(data []byte) (*ClusterSpec, error) {
+	// JSON is valid YAML, so both are converted to JSON, and decoded
+	// strictly.
+	jsondata, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrClusterSpecInvalid, err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(jsondata))
+	decoder.DisallowUnknownFields()
+
+	result := &ClusterSpec{}
+	err = decoder.Decode(result)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrClusterSpecInvalid, err)
+	}
+
+	return result, result.Validate()
+}
+
+// LoadClusterSpec reads a YAML or JSON-encoded ClusterSpec from a
+// file, and validates it, as ParseClusterSpec does.
+func LoadClusterSpec(filename string) (*ClusterSpec, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseClusterSpec(data)
+}
+
+// Validate checks the spec for errors that can be found without
+// consulting the driver or the current configuration. Errors wrap
+// ErrClusterSpecInvalid.
+func (s *ClusterSpec) Validate() error {
+	if !ValidName(s.Name) {
+		return fmt.Errorf("%w: cluster %q: %w", ErrClusterSpecInvalid, s.Name, ErrInvalidName)
+	}
+
+	if s.Driver == "" || s.K8sVersion == "" {
+		return fmt.Errorf("%w: Driver and K8sVersion are required", ErrClusterSpecInvalid)
+	}
+
+	clustertype := s.clustertype()
+	if clustertype != ClusterTypeUnmanaged && clustertype != ClusterTypeManaged {
+		return fmt.Errorf("%w: unknown cluster type %q", ErrClusterSpecInvalid, s.Type)
+	}
+
+	nodenames := map[string]bool{}
+	hostports := map[int]string{}
+	controlplanes := 0
+	for _, node := range s.Nodes {
+		if !ValidName(node.Name) {
+			return fmt.Errorf("%w: node %q: %w", ErrClusterSpecInvalid, node.Name, ErrInvalidName)
+		}
+
+		if nodenames[node.Name] {
+			return fmt.Errorf("%w: node %s: %w", ErrClusterSpecInvalid, node.Name, ErrNodeExists)
+		}
+		nodenames[node.Name] = true
+
+		switch s.nodetype(node) {
+		case NodeTypeUnmanaged:
+			if clustertype == ClusterTypeManaged {
+				return fmt.Errorf("%w: node %s: unmanaged nodes cannot be added to a managed cluster", ErrClusterSpecInvalid, node.Name)
+			}
+		case NodeTypeControlPlane:
+			controlplanes++
+			fallthrough
+		case NodeTypeWorker:
+			if clustertype != ClusterTypeManaged {
+				return fmt.Errorf("%w: node %s: %w", ErrClusterSpecInvalid, node.Name, ErrClusterNotManaged)
+			}
+		default:
+			return fmt.Errorf("%w: node %s: unknown node type %q", ErrClusterSpecInvalid, node.Name, node.Type)
+		}
+
+		if node.State != "" && node.State != NodeStatusRunning && node.State != NodeStatusStopped {
+			return fmt.Errorf("%w: node %s: unknown state %q", ErrClusterSpecInvalid, node.Name, node.State)
+		}
+
+		err := node.Spec.Validate(NodeSpecLimits{})
+		if err != nil {
+			return fmt.Errorf("%w: node %s: %w", ErrClusterSpecInvalid, node.Name, err)
+		}
+
+		for nodeport, hostport := range node.Ports {
+			if s.AutoForwardPorts && (nodeport == 22 || (nodeport == apiserverport && s.nodetype(node) == NodeTypeControlPlane)) {
+				return fmt.Errorf("%w: node %s: port %v is forwarded automatically", ErrClusterSpecInvalid, node.Name, nodeport)
+			}
+			if !ValidPort(nodeport) {
+				return fmt.Errorf("%w: node %s: %w", ErrClusterSpecInvalid, node.Name, &PortError{HostPort: hostport, NodePort: nodeport, Err: ErrPortNodePortInvalid})
+			}
+			if !ValidPort(hostport) {
+				return fmt.Errorf("%w: node %s: %w", ErrClusterSpecInvalid, node.Name, &PortError{HostPort: hostport, NodePort: nodeport, Err: ErrPortHostPortInvalid})
+			}
+			if othernode, ok := hostports[hostport]; ok {
+				return fmt.Errorf("%w: nodes %s and %s: %w", ErrClusterSpecInvalid, othernode, node.Name, &PortError{HostPort: hostport, Err: ErrPortHostPortAlreadyUsed})
+			}
+			hostports[hostport] = node.Name
+		}
+	}
+
+	if controlplanes > 1 {
+		return fmt.Errorf("%w: %w", ErrClusterSpecInvalid, ErrControlPlaneExists)
+	}
+	if clustertype == ClusterTypeManaged && controlplanes == 0 && len(s.Nodes) > 0 {
+		return fmt.Errorf("%w: %w", ErrClusterSpecInvalid, ErrNoControlPlane)
+	}
+
+	return nil
+}
+
+func (s *ClusterSpec) clustertype() string {
+	if s.Type == "" {
+		return ClusterTypeUnmanaged
+	}
+	return s.Type
+}
+
+func (s *ClusterSpec) nodetype(node ClusterSpecNode) string {
+	if node.Type != "" {
+		return node.Type
+	}
+	if s.clustertype() == ClusterTypeManaged {
+		return NodeTypeWorker
+	}
+	return NodeTypeUnmanaged
+}
+
+// ApplyClusterSpec creates the cluster described by spec, or whatever
+// parts of it are missing: the cluster itself, automatic port
+// forwarding, nodes, and port forwards, and starts or stops nodes as
+// required. It is equivalent
+// to executing the plan returned by PlanClusterSpec without pruning.
+// Nodes, ports and clusters that exist but are not described in the
+// spec are left alone, so applying the same spec again does nothing.
+//
+// If an existing cluster, node or port forward conflicts with the
+// spec, an error wrapping ErrClusterSpecConflict is returned, and
+// nothing is done. Otherwise, the operation stops at the first
+// error, and the returned report lists the actions performed until
+// then.
+func ApplyClusterSpec(ctx context.Context, spec *ClusterSpec) (*ApplyReport, error) {
+	report := &ApplyReport{Cluster: spec.Name, Actions: []PlanStep{}}
+
+	plan, err := PlanClusterSpec(spec, PlanOptions{})
+	if err != nil {
+		return report, err
+	}
+
+	result, err := plan.Execute(ctx)
+	for _, stepresult := range result.Steps {
+		if stepresult.Err == nil {
+			report.Actions = append(report.Actions, stepresult.Step)
+		}
+	}
+
+	return report, err
+}
+
+// checkclusterspec returns an error if an existing cluster does not
+// match the spec.
+func checkclusterspec(cluster *Cluster, spec *ClusterSpec) error {
+	if cluster.DriverName() != spec.Driver ||
+		cluster.K8sVersion() != spec.K8sVersion ||
+		cluster.Type() != spec.clustertype() {
+		return fmt.Errorf(
+			"%w: cluster %s exists with driver %s, version %s and type %s",
+			ErrClusterSpecConflict,
+			cluster.Name(),
+			cluster.DriverName(),
+			cluster.K8sVersion(),
+			cluster.Type(),
+		)
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+package kuttilib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kuttiproject/drivercore"
+)
+
+// MachineK8sInstaller is implemented by the machines of drivers that
+// can install the Kubernetes binaries of a version on a running
+// machine, from the driver's local image of that version.
+// Cluster.Upgrade uses it, and returns ErrUpgradeNotSupported if the
+// host of a node does not implement it.
+type MachineK8sInstaller interface {
+	InstallK8sVersion(k8sversion string) error
+}
+
+// Upgrade upgrades the Kubernetes version of a managed cluster to
+// targetversion. See UpgradeContext for details.
+func (c *Cluster) Upgrade(targetversion string) error {
+	return c.UpgradeContext(context.Background(), targetversion)
+}
+
+// UpgradeContext upgrades the Kubernetes version of a managed cluster
+// to targetversion, which must be a downloaded, non-deprecated Version
+// of the cluster's driver. The target must be a later patch release of
+// the current minor version, or a release of the next minor version,
+// since kubeadm cannot skip minor versions. Otherwise,
+// ErrUpgradeInvalid is returned.
+//
+// The control plane node is upgraded first, and then the worker nodes,
+// one at a time. Stopped nodes are started first. Each node is drained,
+// and the driver installs the Kubernetes binaries of the target version
+// on it from its image. The node is then upgraded using kubeadm, and
+// uncordoned. If the driver cannot install binaries, because the host
+// of a node does not implement MachineK8sInstaller,
+// ErrUpgradeNotSupported is returned before any node is drained.
+//
+// Once a node has been upgraded, the version of its kubelet is checked.
+// If it, or the version of kubeadm on the control plane node, is not
+// the target version, ErrUpgradeFailed is returned. A drained node is
+// uncordoned even if its upgrade fails.
+//
+// The version of each node is recorded as it is upgraded, and reported
+// by Node.K8sVersion. The version of the cluster is changed once all
+// nodes have been upgraded. If the upgrade fails part of the way, it
+// can be run again, and nodes already upgraded are skipped. New nodes
+// are created from the image of the cluster's version.
+//
+// If ctx is canceled or its deadline expires, the upgrade stops before
+// the next node, and a *CanceledError is returned.
+func (c *Cluster) UpgradeContext(ctx context.Context, targetversion string) error {
+	err := checkcontext(ctx, "upgrade")
+	if err != nil {
+		return err
+	}
+
+	err = c.checkupgrade(targetversion)
+	if err != nil {
+		return err
+	}
+
+	controlplane, err := c.controlplanenode()
+	if err != nil {
+		return err
+	}
+
+	nodes := c.nodelist()
+	sortnodes(nodes)
+
+	logf(VerbosityInfo, c.logfields("upgrade"), "Upgrading cluster %s to version %s...", c.name, targetversion)
+	start := time.Now()
+	for _, node := range nodes {
+		if !node.ismanaged() || node.K8sVersion() == targetversion {
+			continue
+		}
+
+		err = checkcontext(ctx, "upgrade")
+		if err != nil {
+			return err
+		}
+
+		err = node.upgrade(controlplane, targetversion)
+		if err != nil {
+			return node.wraperror("upgrade", err)
+		}
+	}
+
+	err = clusterconfigmanager.Update(func() error {
+		err := c.checkconfigured()
+		if err != nil {
+			return err
+		}
+
+		configlock.Lock()
+		c.k8sVersion = targetversion
+		configlock.Unlock()
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logf(VerbosityInfo, append(c.logfields("upgrade"), "duration", time.Since(start)), "Cluster %s upgraded to version %s.", c.name, targetversion)
+
+	return nil
+}
+
+// checkupgrade returns an error if the cluster cannot be upgraded to
+// targetversion.
+func (c *Cluster) checkupgrade(targetversion string) error {
+	if c.Type() != ClusterTypeManaged {
+		return ErrClusterNotManaged
+	}
+
+	err := c.ensuredriver()
+	if err != nil {
+		return err
+	}
+
+	for _, node := range c.nodelist() {
+		if !node.ismanaged() {
+			continue
+		}
+
+		err = node.ensurehost()
+		if err != nil {
+			return node.wraperror("upgrade", err)
+		}
+
+		if _, ok := node.host.(MachineK8sInstaller); !ok {
+			return node.wraperror("upgrade", ErrUpgradeNotSupported)
+		}
+	}
+
+	driverimage, err := c.driver.GetImage(targetversion)
+	if err != nil {
+		return err
+	}
+
+	if driverimage.Status() != drivercore.ImageStatusDownloaded {
+		return ErrImageNotAvailable
+	}
+
+	if driverimage.Deprecated() {
+		return ErrVersionDeprecated
+	}
+
+	currentversion := c.K8sVersion()
+	current, ok := parsek8sversion(currentversion)
+	if !ok {
+		return fmt.Errorf("%w: cannot parse current version %s", ErrUpgradeInvalid, currentversion)
+	}
+
+	target, ok := parsek8sversion(targetversion)
+	if !ok {
+		return fmt.Errorf("%w: cannot parse target version %s", ErrUpgradeInvalid, targetversion)
+	}
+
+	samemajor := target[0] == current[0]
+	nextpatch := samemajor && target[1] == current[1] && target[2] > current[2]
+	nextminor := samemajor && target[1] == current[1]+1
+	if !nextpatch && !nextminor {
+		return fmt.Errorf(
+			"%w: cannot upgrade from %s to %s",
+			ErrUpgradeInvalid,
+			currentversion,
+			targetversion,
+		)
+	}
+
+	return nil
+}
+
+// parsek8sversion parses a Kubernetes version of the form MAJOR.MINOR
+// or MAJOR.MINOR.PATCH, with an optional v prefix. A missing patch
+// number is taken to be 0.
+func parsek8sversion(version string) ([3]int, bool) {
+	var result [3]int
+
+	parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return result, false
+	}
+
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 {
+			return result, false
+		}
+		result[i] = number
+	}
+	return result, true
+}
+
+// k8sversionmatches returns true if version, as reported by kubeadm or
+// the kubelet, is targetversion. If targetversion has no patch number,
+// any patch release of it matches.
+func k8sversionmatches(version string, targetversion string) bool {
+	installed, ok := parsek8sversion(version)
+	if !ok {
+		return false
+	}
+
+	target, ok := parsek8sversion(targetversion)
+	if !ok {
+		return false
+	}
+
+	if strings.Count(targetversion, ".") < 2 {
+		installed[2] = 0
+	}
+	return installed == target
+}
+
+// upgrade drains the node, upgrades it to targetversion, and
+// uncordons it. Cluster-wide commands are run on controlplane. The node
+// is uncordoned even if the upgrade fails, and its version is recorded
+// only if it succeeds.
+func (n *Node) upgrade(controlplane *Node, targetversion string) error {
+	err := n.ensurerunning()
+	if err != nil {
+		return err
+	}
+	if controlplane != n {
+		err = controlplane.ensurerunning()
+		if err != nil {
+			return err
+		}
+	}
+
+	installer, ok := n.host.(MachineK8sInstaller)
+	if !ok {
+		return ErrUpgradeNotSupported
+	}
+
+	logf(VerbosityInfo, n.logfields("upgrade"), "Upgrading node %s to version %s...", n.name, targetversion)
+	start := time.Now()
+
+	kubectl := "sudo kubectl --kubeconfig /etc/kubernetes/admin.conf "
+	_, err = controlplane.runcommand(context.Background(), kubectl+"drain "+n.name+" --ignore-daemonsets --delete-emptydir-data")
+	if err != nil {
+		return err
+	}
+
+	err = n.upgradedrained(installer, targetversion)
+	_, uncordonerr := controlplane.runcommand(context.Background(), kubectl+"uncordon "+n.name)
+	if err != nil || uncordonerr != nil {
+		return errors.Join(err, uncordonerr)
+	}
+
+	err = clusterconfigmanager.Update(func() error {
+		err := n.checkconfigured()
+		if err != nil {
+			return err
+		}
+
+		configlock.Lock()
+		n.k8sVersion = targetversion
+		configlock.Unlock()
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logf(VerbosityInfo, append(n.logfields("upgrade"), "duration", time.Since(start)), "Node %s upgraded.", n.name)
+
+	return nil
+}
+
+// upgradedrained upgrades a drained node to targetversion. The driver
+// installs the Kubernetes binaries of targetversion from its image,
+// kubeadm upgrades the node, and the kubelet is restarted. The version
+// of kubeadm is checked before the upgrade, and that of the kubelet
+// after it.
+func (n *Node) upgradedrained(installer MachineK8sInstaller, targetversion string) error {
+	err := installer.InstallK8sVersion(targetversion)
+	if err != nil {
+		return err
+	}
+
+	upgradecommand := "sudo kubeadm upgrade node"
+	if n.nodetype == NodeTypeControlPlane {
+		output, err := n.runcommand(context.Background(), "sudo kubeadm version -o short")
+		if err != nil {
+			return err
+		}
+
+		kubeadmversion := strings.TrimSpace(output)
+		if !k8sversionmatches(kubeadmversion, targetversion) {
+			return fmt.Errorf("%w: kubeadm version is %q", ErrUpgradeFailed, kubeadmversion)
+		}
+		upgradecommand = "sudo kubeadm upgrade apply -y " + kubeadmversion
+	}
+	_, err = n.runcommand(context.Background(), upgradecommand)
+	if err != nil {
+		return err
+	}
+
+	_, err = n.runcommand(context.Background(), "sudo systemctl daemon-reload && sudo systemctl restart kubelet")
+	if err != nil {
+		return err
+	}
+
+	output, err := n.runcommand(context.Background(), "kubelet --version")
+	if err != nil {
+		return err
+	}
+
+	// The kubelet reports its version as "Kubernetes vX.Y.Z".
+	kubeletversion := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(output), "Kubernetes"))
+	if !k8sversionmatches(kubeletversion, targetversion) {
+		return fmt.Errorf("%w: kubelet version is %q", ErrUpgradeFailed, kubeletversion)
+	}
+
+	return nil
+}
@@ -1,15 +1,27 @@
 package kuttilib
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"sort"
+	"sync"
 	"time"
 
-	"github.com/kuttiproject/kuttilog"
-
 	"github.com/kuttiproject/drivercore"
 )
 
+// The ClusterType* constants list valid cluster types.
+const (
+	// ClusterTypeUnmanaged clusters contain nodes which are not
+	// joined to a Kubernetes cluster by kuttilib.
+	ClusterTypeUnmanaged = "Unmanaged"
+	// ClusterTypeManaged clusters contain nodes which are
+	// bootstrapped into a Kubernetes cluster using kubeadm.
+	ClusterTypeManaged = "Managed"
+)
+
 // clusterdata is a data-only representation of the Cluster type,
 // used for serialization and output.
 type clusterdata struct {
@@ -19,6 +31,14 @@ type clusterdata struct {
 	CreatedAt  time.Time
 	Type       string
 	Nodes      map[string]*Node
+
+	ControlPlaneEndpoint string    `json:",omitempty"`
+	JoinToken            string    `json:",omitempty"`
+	JoinTokenExpiresAt   time.Time `json:",omitzero"`
+	CACertHash           string    `json:",omitempty"`
+
+	AutoForwardPorts bool `json:",omitempty"`
+	Deleting         bool `json:",omitempty"`
 }
 
 // Cluster represents a Kubernetes cluster, consisting of Nodes.
@@ -33,7 +53,8 @@ type clusterdata struct {
 // which the Nodes in the cluster will be created.
 //
 // The Driver and Version are selected while creating the
-//  cluster, and cannot be changed later.
+// cluster. The Driver cannot be changed later, but a managed
+// cluster can be upgraded to a later Version using Upgrade.
 type Cluster struct {
 	name        string
 	driverName  string
@@ -44,6 +65,23 @@ type Cluster struct {
 	nodes       map[string]*Node
 	clustertype string
 	status      string
+
+	// mu guards the driver, network and status, which are
+	// cached at runtime, and the names of nodes being added.
+	// Persisted fields are guarded by configlock.
+	mu          sync.Mutex
+	addingnodes map[string]bool
+
+	controlPlaneEndpoint string
+	joinToken            string
+	joinTokenExpiresAt   time.Time
+	caCertHash           string
+
+	autoForwardPorts bool
+
+	// deleting is set while the network of the cluster is deleted,
+	// outside the configuration lock, so that no nodes are added.
+	deleting bool
 }
 
 // Name returns the name of the cluster.
@@ -67,6 +105,9 @@ func (c *Cluster) Driver() *Driver {
 // K8sVersion returns the Kubernetes version
 // associated with this cluster.
 func (c *Cluster) K8sVersion() string {
+	configlock.RLock()
+	defer configlock.RUnlock()
+
 	return c.k8sVersion
 }
 
@@ -85,13 +126,13 @@ func (c *Cluster) Type() string {
 // already exists in the cluster.
 func (c *Cluster) ValidateNodeName(name string) error {
 	if !ValidName(name) {
-		return errInvalidName
+		return ErrInvalidName
 	}
 
 	// Check if name exists
-	_, ok := c.nodes[name]
+	_, ok := c.GetNode(name)
 	if ok {
-		return errNodeExists
+		return ErrNodeExists
 	}
 
 	return nil
@@ -100,6 +141,9 @@ func (c *Cluster) ValidateNodeName(name string) error {
 // NodeNames returns the names of all nodes
 // in the cluster. The order is not predictable.
 func (c *Cluster) NodeNames() []string {
+	configlock.RLock()
+	defer configlock.RUnlock()
+
 	result := make([]string, len(c.nodes))
 	i := 0
 	for nodename := range c.nodes {
@@ -112,12 +156,7 @@ func (c *Cluster) NodeNames() []string {
 // Nodes returns all the Nodes in the cluster, in reverse
 // order of creation time.
 func (c *Cluster) Nodes() []*Node {
-	result := make([]*Node, len(c.nodes))
-	i := 0
-	for _, node := range c.nodes {
-		result[i] = node
-		i++
-	}
+	result := c.nodelist()
 	sort.Slice(result, func(i, j int) bool {
 		return result[i].createdAt.After(result[j].createdAt)
 	})
@@ -130,7 +169,7 @@ func (c *Cluster) Nodes() []*Node {
 // invoked with the Node as a parameter. If the
 // function returns false, iteration stops.
 func (c *Cluster) ForEachNode(f func(*Node) bool) {
-	for _, node := range c.nodes {
+	for _, node := range c.nodelist() {
 		if cancel := f(node); cancel {
 			break
 		}
@@ -139,6 +178,9 @@ func (c *Cluster) ForEachNode(f func(*Node) bool) {
 
 // GetNode returns the node with the specified name, or nil.
 func (c *Cluster) GetNode(nodename string) (*Node, bool) {
+	configlock.RLock()
+	defer configlock.RUnlock()
+
 	result, ok := c.nodes[nodename]
 	return result, ok
 }
@@ -148,9 +190,33 @@ func (c *Cluster) GetNode(nodename string) (*Node, bool) {
 // deleted. In some rare cases for some drivers, manual cleanup may be
 // needed after a forced delete.
 func (c *Cluster) DeleteNode(nodename string, force bool) error {
-	n, ok := c.nodes[nodename]
+	_, err := c.deletenodecontext(context.Background(), nodename, force)
+	return err
+}
+
+// DeleteNodeContext deletes a node completely, like DeleteNode. If
+// the node has to be stopped first, DeleteNodeContext waits until it
+// has stopped.
+// If ctx is canceled or its deadline expires before the node's host
+// is deleted, a *CanceledError is returned and the node is left in
+// the cluster configuration. Once host deletion has begun, the
+// operation runs to completion.
+func (c *Cluster) DeleteNodeContext(ctx context.Context, nodename string, force bool) error {
+	_, err := c.deletenodecontext(ctx, nodename, force)
+	return err
+}
+
+// deletenodecontext implements DeleteNodeContext, and also returns
+// any port forwards which could not be removed.
+func (c *Cluster) deletenodecontext(ctx context.Context, nodename string, force bool) ([]LeftoverArtifact, error) {
+	err := checkcontext(ctx, "delete")
+	if err != nil {
+		return nil, wrapnodeerror(c.name, nodename, "delete", err)
+	}
+
+	n, ok := c.GetNode(nodename)
 	if !ok {
-		return errNodeNotFound
+		return nil, wrapnodeerror(c.name, nodename, "delete", ErrNodeNotFound)
 	}
 
 	nodestatus := n.Status()
@@ -158,56 +224,77 @@ func (c *Cluster) DeleteNode(nodename string, force bool) error {
 	if nodestatus == NodeStatusUnknown ||
 		nodestatus == NodeStatusError {
 
-		return c.deletenodeentry(nodename)
+		return nil, wrapnodeerror(c.name, nodename, "delete", c.deletenodeentry(nodename))
 	}
 
 	if nodestatus == NodeStatusRunning {
 		if !force {
-			return errNodeIsRunning
+			return nil, wrapnodeerror(c.name, nodename, "delete", ErrNodeIsRunning)
+		}
+
+		logf(VerbosityInfo, n.logfields("delete"), "Stopping node %s...", nodename)
+		start := time.Now()
+		err := n.ForceStopContext(ctx)
+		var cancelerr *CanceledError
+		if errors.As(err, &cancelerr) {
+			return nil, wrapnodeerror(c.name, nodename, "delete", err)
 		}
 
-		kuttilog.Printf(kuttilog.Info, "Stopping node %s...", nodename)
-		err := n.ForceStop()
 		if err != nil {
-			kuttilog.Printf(kuttilog.Quiet, "Error stopping node: %v. Some VirtualBox artifacts may be left behind.")
+			logf(VerbosityQuiet, append(n.logfields("delete"), "error", err), "Error stopping node: %v. Some artifacts may be left behind.", err)
 		} else {
-			kuttilog.Printf(kuttilog.Info, "Node %s stopped.", nodename)
+			logf(VerbosityInfo, append(n.logfields("delete"), "duration", time.Since(start)), "Node %s stopped.", nodename)
 		}
 	}
 
-	if c.Driver().UsesNATNetworking() {
-		// Unmap ports
-		kuttilog.Println(kuttilog.Info, "Unmapping ports...")
-		for key := range n.ports {
-			err := n.host.UnforwardPort(key)
-			if err != nil {
-				kuttilog.Printf(kuttilog.Quiet, "Error while unmapping ports for node '%s': %v.", nodename, err)
-			}
-		}
-		kuttilog.Println(kuttilog.Info, "Ports unmapped.")
+	err = checkcontext(ctx, "delete")
+	if err != nil {
+		return nil, wrapnodeerror(c.name, nodename, "delete", err)
 	}
 
-	return c.deletenode(nodename, force)
+	leftovers := c.unmapnodeports(n)
+
+	return leftovers, wrapnodeerror(c.name, nodename, "delete", c.deletenode(nodename, force))
 }
 
 // NewUninitializedNode adds a node, but does not join it to a kubernetes cluster.
 // It uses ValidName to check name validity, and also checks if a node with the
 // name already exists.
 func (c *Cluster) NewUninitializedNode(nodename string) (*Node, error) {
-	err := c.ValidateNodeName(nodename)
-	if err != nil {
-		return nil, err
-	}
+	return c.NewUninitializedNodeWithSpec(nodename, NodeSpec{})
+}
+
+// NewControlPlaneNode adds a node, and initializes a Kubernetes control
+// plane on it using kubeadm init. The cluster must be a managed cluster,
+// and can have only one control plane node. If forwarding ports to the
+// new node fails, the control plane is still initialized, and both
+// errors are returned. If initialization fails, the node is deleted
+// again and nil is returned with the error, so that it can be retried.
+// It uses ValidName to check name validity, and also checks if a node with the
+// name already exists.
+func (c *Cluster) NewControlPlaneNode(nodename string) (*Node, error) {
+	return c.NewControlPlaneNodeWithSpec(nodename, NodeSpec{})
+}
 
-	return c.addnode(nodename, "Unmanaged")
+// NewWorkerNode adds a node, and joins it to the Kubernetes cluster using
+// kubeadm join. The cluster must be a managed cluster, and must already
+// have a control plane node. If forwarding ports to the new node fails,
+// it is still joined, and both errors are returned.
+// It uses ValidName to check name validity, and also checks if a node with the
+// name already exists.
+func (c *Cluster) NewWorkerNode(nodename string) (*Node, error) {
+	return c.NewWorkerNodeWithSpec(nodename, NodeSpec{})
 }
 
 // CheckHostPort returns an error if a host port is occupied in the current cluster.
 func (c *Cluster) CheckHostPort(hostport int) error {
+	configlock.RLock()
+	defer configlock.RUnlock()
+
 	for _, nodevalue := range c.nodes {
 		for _, hostportvalue := range nodevalue.ports {
 			if hostportvalue == hostport {
-				return errPortHostPortAlreadyUsed
+				return &PortError{HostPort: hostport, Err: ErrPortHostPortAlreadyUsed}
 			}
 		}
 	}
@@ -216,17 +303,37 @@ func (c *Cluster) CheckHostPort(hostport int) error {
 
 // MarshalJSON returns the JSON encoding of the cluster.
 func (c *Cluster) MarshalJSON() ([]byte, error) {
+	// Nodes are marshaled outside the lock, since they take it too
+	return json.Marshal(c.data())
+}
+
+// data returns a data-only copy of the cluster.
+func (c *Cluster) data() clusterdata {
 	utcloc, _ := time.LoadLocation("UTC")
-	savedata := clusterdata{
+
+	configlock.RLock()
+	defer configlock.RUnlock()
+
+	nodes := make(map[string]*Node, len(c.nodes))
+	for name, node := range c.nodes {
+		nodes[name] = node
+	}
+	return clusterdata{
 		Name:       c.name,
 		DriverName: c.driverName,
 		K8sVersion: c.k8sVersion,
 		CreatedAt:  c.createdAt.In(utcloc),
-		Nodes:      c.nodes,
+		Nodes:      nodes,
 		Type:       c.clustertype,
-	}
 
-	return json.Marshal(savedata)
+		ControlPlaneEndpoint: c.controlPlaneEndpoint,
+		JoinToken:            c.joinToken,
+		JoinTokenExpiresAt:   c.joinTokenExpiresAt,
+		CACertHash:           c.caCertHash,
+
+		AutoForwardPorts: c.autoForwardPorts,
+		Deleting:         c.deleting,
+	}
 }
 
 // UnmarshalJSON  parses and restores a JSON-encoded
@@ -247,16 +354,92 @@ func (c *Cluster) UnmarshalJSON(b []byte) error {
 	c.createdAt = loaddata.CreatedAt.In(localloc)
 	c.nodes = loaddata.Nodes
 	c.clustertype = loaddata.Type
+	c.controlPlaneEndpoint = loaddata.ControlPlaneEndpoint
+	c.joinToken = loaddata.JoinToken
+	c.joinTokenExpiresAt = loaddata.JoinTokenExpiresAt
+	c.caCertHash = loaddata.CACertHash
+	c.autoForwardPorts = loaddata.AutoForwardPorts
+	c.deleting = loaddata.Deleting
 
 	return nil
 }
 
+// sameas returns true if loaded represents the same cluster as c,
+// rather than a different cluster created with the same name.
+func (c *Cluster) sameas(loaded *Cluster) bool {
+	return c.driverName == loaded.driverName &&
+		c.clustertype == loaded.clustertype &&
+		c.createdAt.Equal(loaded.createdAt)
+}
+
+// merge updates the mutable persisted fields of the cluster, and
+// its nodes, from a freshly loaded copy. It must be called with
+// configlock held for writing.
+func (c *Cluster) merge(loaded *Cluster) {
+	c.k8sVersion = loaded.k8sVersion
+	c.controlPlaneEndpoint = loaded.controlPlaneEndpoint
+	c.joinToken = loaded.joinToken
+	c.joinTokenExpiresAt = loaded.joinTokenExpiresAt
+	c.caCertHash = loaded.caCertHash
+	c.autoForwardPorts = loaded.autoForwardPorts
+	c.deleting = loaded.deleting
+
+	if c.nodes == nil {
+		c.nodes = map[string]*Node{}
+	}
+
+	for name, loadednode := range loaded.nodes {
+		node, ok := c.nodes[name]
+		if !ok || !node.sameas(loadednode) {
+			loadednode.cluster = c
+			c.nodes[name] = loadednode
+			continue
+		}
+
+		node.merge(loadednode)
+	}
+
+	for name := range c.nodes {
+		if _, ok := loaded.nodes[name]; !ok {
+			delete(c.nodes, name)
+		}
+	}
+}
+
+// checkconfigured returns an error if the cluster has been deleted
+// from the configuration, possibly by another process.
+func (c *Cluster) checkconfigured() error {
+	configlock.RLock()
+	defer configlock.RUnlock()
+
+	if config.Clusters[c.name] != c {
+		return ErrClusterDoesNotExist
+	}
+
+	return nil
+}
+
+// checknotdeleting returns ErrClusterDeleting if the cluster is being
+// deleted.
+func (c *Cluster) checknotdeleting() error {
+	configlock.RLock()
+	defer configlock.RUnlock()
+
+	if c.deleting {
+		return ErrClusterDeleting
+	}
+	return nil
+}
+
 func (c *Cluster) ensuredriver() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if c.driver == nil {
 		driver, ok := drivercore.GetDriver(c.driverName)
 		if !ok {
 			c.status = "DriverNotPresent"
-			return errDriverDoesNotExist
+			return ErrDriverDoesNotExist
 		}
 
 		c.driver = driver
@@ -267,6 +450,9 @@ func (c *Cluster) ensuredriver() error {
 }
 
 func (c *Cluster) createnetwork() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	nw, err := c.driver.NewNetwork(c.name)
 	if err != nil {
 		c.status = "NetworkError"
@@ -279,6 +465,10 @@ func (c *Cluster) createnetwork() error {
 
 func (c *Cluster) deletenetwork() error {
 	c.ensuredriver()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	err := c.driver.DeleteNetwork(c.name)
 	if err != nil {
 		c.status = "NetworkDeleteError"
@@ -289,33 +479,244 @@ func (c *Cluster) deletenetwork() error {
 	return nil
 }
 
-func (c *Cluster) addnode(nodename string, nodetype string) (*Node, error) {
+func (c *Cluster) addnode(nodename string, nodetype string, spec NodeSpec) (*Node, error) {
+	return c.addnodewithhost(nodename, nodetype, spec, (*Node).createhost)
+}
+
+// addnodewithhost adds a node, using createhost to create its host.
+// The host is created before the node is added to the configuration,
+// so that the configuration is not locked while the driver works. If
+// the node cannot be added, the host is deleted again. Since the node
+// is not shared yet, createhost may also change its other fields.
+// The node is not set up; see setup.
+func (c *Cluster) addnodewithhost(nodename string, nodetype string, spec NodeSpec, createhost func(*Node) error) (*Node, error) {
 	err := c.ensuredriver()
 	if err != nil {
 		return nil, err
 	}
 
+	err = c.checknodespec(spec)
+	if err == nil {
+		err = c.checknotdeleting()
+	}
+	if err != nil {
+		return nil, wrapnodeerror(c.name, nodename, "create", err)
+	}
+
+	err = c.ValidateNodeName(nodename)
+	if err == nil {
+		err = c.checknodetype(nodetype)
+	}
+	if err == nil {
+		err = c.reservenodename(nodename)
+	}
+	if err != nil {
+		publish(Event{Type: EventNodeCreateFailed, Cluster: c.name, Node: nodename, Err: err})
+		return nil, err
+	}
+	defer c.releasenodename(nodename)
+
 	newnode := &Node{
 		cluster:     c,
 		clusterName: c.name,
 		name:        nodename,
 		createdAt:   time.Now(),
 		nodetype:    nodetype,
+		k8sVersion:  c.K8sVersion(),
+		spec:        spec,
 		ports:       map[int]int{},
 	}
 
-	err = newnode.createhost()
+	// The node name is reserved in the artifacts file as well, so that
+	// another process cannot create a host with the same name until
+	// this one has been added or deleted. A host the driver already
+	// has belongs to someone else, and is left alone.
+	err = reserveartifact(c.driverName, c.name, nodename)
+	if errors.Is(err, errartifactpending) {
+		err = ErrNodeExists
+	}
 	if err == nil {
+		if _, hosterr := c.driver.GetMachine(nodename, c.name); hosterr == nil {
+			err = ErrNodeExists
+		} else {
+			err = createhost(newnode)
+		}
+		if err != nil {
+			forgetartifact(c.driverName, c.name, nodename)
+		}
+	}
+	if err != nil {
+		err = newnode.wraperror("create", err)
+		publish(Event{Type: EventNodeCreateFailed, Cluster: c.name, Node: nodename, Err: err})
+		return nil, err
+	}
+
+	err = clusterconfigmanager.Update(func() error {
+		// Validate again, in case another process has changed the cluster
+		err := c.checkconfigured()
+		if err != nil {
+			return err
+		}
+
+		err = c.checknotdeleting()
+		if err != nil {
+			return err
+		}
+
+		err = c.ValidateNodeName(nodename)
+		if err != nil {
+			return err
+		}
+
+		err = c.checknodetype(nodetype)
+		if err != nil {
+			return err
+		}
+
+		configlock.Lock()
 		c.nodes[nodename] = newnode
-		err = clusterconfigmanager.Save()
+		configlock.Unlock()
+
+		return nil
+	})
+	if err != nil {
+		// The host was created by this call, so it can be deleted. If
+		// it cannot, its record is kept, so that Reconcile reports it.
+		deleteerr := c.driver.DeleteMachine(nodename, c.name)
+		if deleteerr != nil {
+			logf(VerbosityQuiet, append(newnode.logfields("create"), "error", deleteerr), "Error deleting host of node %s: %v. It may be left behind.", nodename, deleteerr)
+			confirmartifact(c.driverName, c.name, nodename)
+		} else {
+			forgetartifact(c.driverName, c.name, nodename)
+		}
+	}
+	publishresult(EventNodeCreated, EventNodeCreateFailed, Event{Cluster: c.name, Node: nodename}, err)
+	if err != nil {
+		return nil, err
+	}
+	confirmartifact(c.driverName, c.name, nodename)
+	return newnode, nil
+}
+
+// reservenodename marks a node name as being added, until
+// releasenodename is called. It returns ErrNodeExists if the name is
+// already being added.
+func (c *Cluster) reservenodename(nodename string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.addingnodes[nodename] {
+		return ErrNodeExists
+	}
+	if c.addingnodes == nil {
+		c.addingnodes = map[string]bool{}
+	}
+	c.addingnodes[nodename] = true
+	return nil
+}
+
+// releasenodename removes the mark made by reservenodename.
+func (c *Cluster) releasenodename(nodename string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.addingnodes, nodename)
+}
+
+// setup prepares a newly added node for use, by forwarding its ports
+// if the cluster is set up for it, and adding the workspace SSH key.
+// Failures to add the key are returned, unless the node cannot run
+// commands at all.
+func (n *Node) setup() error {
+	return errors.Join(n.autoforwardports(), n.ensuresshkey(context.Background()))
+}
+
+// checknodetype checks if a node of the specified type can be
+// added to the cluster.
+func (c *Cluster) checknodetype(nodetype string) error {
+	configlock.RLock()
+	defer configlock.RUnlock()
+
+	switch nodetype {
+	case NodeTypeControlPlane:
+		if c.clustertype != ClusterTypeManaged {
+			return ErrClusterNotManaged
+		}
+
+		for _, node := range c.nodes {
+			if node.nodetype == NodeTypeControlPlane {
+				return ErrControlPlaneExists
+			}
+		}
+	case NodeTypeWorker:
+		if c.clustertype != ClusterTypeManaged {
+			return ErrClusterNotManaged
+		}
+
+		if c.controlPlaneEndpoint == "" {
+			return ErrNoControlPlane
+		}
 	}
 
-	return newnode, err
+	return nil
+}
+
+// nodelist returns the nodes of the cluster, in no particular order.
+func (c *Cluster) nodelist() []*Node {
+	configlock.RLock()
+	defer configlock.RUnlock()
+
+	result := make([]*Node, 0, len(c.nodes))
+	for _, node := range c.nodes {
+		result = append(result, node)
+	}
+	return result
+}
+
+// unmapnodeports removes all port forwards of a node from its host,
+// and returns the ones which could not be removed.
+func (c *Cluster) unmapnodeports(n *Node) []LeftoverArtifact {
+	leftovers := []LeftoverArtifact{}
+	if c.Driver().UsesNATNetworking() {
+		// Unmap ports
+		logprintln(VerbosityInfo, n.logfields("delete"), "Unmapping ports...")
+		for key, hostport := range n.Ports() {
+			err := n.host.UnforwardPort(key)
+			if err == nil {
+				publish(Event{Type: EventPortUnforwarded, Cluster: c.name, Node: n.name, HostPort: hostport, NodePort: key})
+			} else {
+				logf(VerbosityQuiet, append(n.logfields("delete"), "hostport", hostport, "nodeport", key, "error", err), "Error while unmapping ports for node '%s': %v.", n.name, err)
+				leftovers = append(leftovers, LeftoverArtifact{
+					Kind:    ArtifactPortForward,
+					Cluster: c.name,
+					Node:    n.name,
+					Detail:  fmt.Sprintf("host port %v to node port %v: %v", hostport, key, err),
+				})
+			}
+		}
+		logprintln(VerbosityInfo, n.logfields("delete"), "Ports unmapped.")
+	}
+	return leftovers
 }
 
 func (c *Cluster) deletenodeentry(nodename string) error {
-	delete(c.nodes, nodename)
-	return clusterconfigmanager.Save()
+	err := clusterconfigmanager.Update(func() error {
+		configlock.Lock()
+		defer configlock.Unlock()
+
+		if n, ok := c.nodes[nodename]; ok && n.nodetype == NodeTypeControlPlane {
+			c.controlPlaneEndpoint = ""
+			c.joinToken = ""
+			c.joinTokenExpiresAt = time.Time{}
+			c.caCertHash = ""
+		}
+
+		delete(c.nodes, nodename)
+		return nil
+	})
+	publishresult(EventNodeDeleted, EventNodeDeleteFailed, Event{Cluster: c.name, Node: nodename}, err)
+
+	return err
 }
 
 func (c *Cluster) deletenode(nodename string, force bool) error {
@@ -325,9 +726,13 @@ func (c *Cluster) deletenode(nodename string, force bool) error {
 	}
 
 	err = c.driver.DeleteMachine(nodename, c.name)
-	if err == nil || force {
-		err = c.deletenodeentry(nodename)
+	if err != nil && !force {
+		publish(Event{Type: EventNodeDeleteFailed, Cluster: c.name, Node: nodename, Err: err})
+		return err
+	}
+	if err == nil {
+		forgetartifact(c.driverName, c.name, nodename)
 	}
 
-	return err
+	return c.deletenodeentry(nodename)
 }
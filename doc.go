@@ -24,6 +24,22 @@
 // using the SetWorkspace method. See that method, and the package
 // github.com/kuttiproject/workspace for details.
 //
+// Several processes may use the same workspace at the same time.
+// The cluster configuration file is locked while it is being read
+// or changed, and is reloaded before every change, so that changes
+// made by other processes are not lost.
+//
+// The configuration file records its schema version. Files written by
+// older versions of kuttilib are migrated when loaded, after saving a
+// backup copy. Files written by newer versions are refused with
+// ErrConfigSchemaTooNew.
+//
+// Concurrency
+//
+// Apart from SetWorkspace and ResetWorkspace, the API is safe for
+// concurrent use by multiple goroutines. Collections such as the
+// result of Node.Ports are returned as copies.
+//
 // Drivers
 //
 // The kuttilib package itself does not include any drivers. When
@@ -47,8 +63,77 @@
 // once the appropriate version templates have been downloaded. See
 // the Cluster family of functions and the Cluster type for details.
 //
+// Clusters created with NewEmptyCluster are unmanaged: kuttilib creates
+// their nodes, but does not join them into a Kubernetes cluster.
+// Clusters created with NewManagedCluster are bootstrapped using
+// kubeadm as control plane and worker nodes are added to them. The
+// Kubeconfig method of a managed cluster returns credentials for it,
+// which can be saved using WriteKubeconfig or MergeKubeconfig.
+// Cluster.Upgrade upgrades a managed cluster to a later Kubernetes
+// version, one node at a time.
+//
+// A cluster, its nodes and their port forwards can also be described
+// by a ClusterSpec, stored as YAML or JSON, and created in one call
+// using ApplyClusterSpec. PlanClusterSpec shows what would change
+// before anything is done, as a Plan that can be reviewed and then
+// executed.
+//
+// ExportCluster writes a cluster, its nodes and their port forwards to
+// an archive, optionally with node disks, and ImportCluster recreates
+// the cluster from it, under the same or a new name. With drivers that
+// can clone hosts, CloneCluster copies a cluster directly.
+//
 // Nodes
 //
 // Nodes may be created and managed for each cluster. See the Cluster
-// and Node types for details.
+// and Node types for details. Drivers that support it can create nodes
+// with specific hardware resources, described by a NodeSpec.
+//
+// With drivers that use NAT networking, node ports are forwarded to
+// host ports. A host port can be mapped by only one node in the
+// workspace. AllocateHostPort finds a free one, within the ranges set
+// by SetHostPortRanges.
+//
+// Commands can be run on nodes, and files copied to and from them,
+// over SSH. The host key of each node is pinned the first time it is
+// connected to, and files are copied with the scp protocol.
+//
+// With drivers that support it, Node.Snapshot saves the state of a
+// node, which Node.RestoreSnapshot can later return it to.
+// Cluster.SnapshotAll takes a consistent snapshot of all nodes of a
+// cluster.
+//
+// Node.Health and Cluster.Health check whether nodes are actually
+// usable, beyond their status as reported by the driver: whether they
+// can be reached over SSH, and, in managed clusters, whether kubelet is
+// active and the API server reports them as Ready.
+//
+// Node.WaitFor waits for a condition on a node, such as NodeHasStatus
+// or NodeIsHealthy, and Cluster.WaitForReady waits until all nodes of
+// a cluster are healthy. WaitOptions sets the timeout and how often
+// the condition is checked.
+//
+// EnsureSSHKey generates an SSH key pair for the workspace. Its public
+// key is then added to nodes when they are created, or when they are
+// first used over SSH, and RotateSSHKey replaces it on all nodes.
+//
+// Subscribe registers a handler for events, such as EventClusterCreated
+// or EventNodeStarted, published when kuttilib changes clusters, nodes
+// and port mappings.
+//
+// Messages are printed using kuttilog, at the level set by
+// SetVerbosityLevel. SetLogger sends them to a log/slog logger instead,
+// with the cluster, node and operation as attributes.
+//
+// If the configuration and the state of driver machines or networks
+// drift apart, for example because a VM was deleted outside kutti,
+// Cluster.Check and Reconcile report the differences, and can repair
+// them.
+//
+// Errors
+//
+// The errors returned by kuttilib are available as Err* variables.
+// Errors from operations on nodes and ports are wrapped in NodeError
+// and PortError values, which identify the cluster, node or port
+// involved. Use errors.Is and errors.As to inspect them.
 package kuttilib
@@ -6,6 +6,9 @@ require (
 	github.com/kuttiproject/drivercore v0.3.1
 	github.com/kuttiproject/kuttilog v0.2.1
 	github.com/kuttiproject/workspace v0.3.1
+	golang.org/x/crypto v0.48.0
+	golang.org/x/sys v0.41.0
+	sigs.k8s.io/yaml v1.4.0
 )
 
 retract [v0.1.0, v0.1.1] // Broke compatibility with original kutti
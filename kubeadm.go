@@ -0,0 +1,241 @@
+package kuttilib
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// runcommand runs a shell command on the node host, using the
+// current CommandRunner. If the runner is a ContextCommandRunner, the
+// command is stopped when ctx is done.
+func (n *Node) runcommand(ctx context.Context, command string) (string, error) {
+	logf(VerbosityDebug, append(n.logfields("run command"), "command", command), "Running on node %s: %s", n.name, command)
+
+	runner := currentcommandrunner()
+	if contextrunner, ok := runner.(ContextCommandRunner); ok {
+		return contextrunner.RunCommandContext(ctx, n, command)
+	}
+	return runner.RunCommand(n, command)
+}
+
+// ensurecommands waits until commands can be run on the node, as
+// waitforssh does, and adds the workspace SSH key to it if needed, as
+// ensuresshkey does. Unlike when a node is used over SSH, a failure to
+// add the key is returned rather than logged, since the commands that
+// follow would fail anyway.
+func (n *Node) ensurecommands(ctx context.Context) error {
+	err := n.waitforssh(ctx)
+	if err != nil {
+		return err
+	}
+	return n.ensuresshkey(ctx)
+}
+
+// ensurerunning starts the node if it is stopped.
+func (n *Node) ensurerunning() error {
+	if n.Status() == NodeStatusRunning {
+		return nil
+	}
+
+	logf(VerbosityInfo, n.logfields("start"), "Starting node %s...", n.name)
+	start := time.Now()
+	err := n.Start()
+	if err != nil {
+		return err
+	}
+	logf(VerbosityInfo, append(n.logfields("start"), "duration", time.Since(start)), "Node %s started.", n.name)
+
+	return nil
+}
+
+// jointokenttl is how long bootstrap tokens created to join nodes
+// remain valid. A token is stored with the cluster, and replaced once
+// it is within jointokenrenewal of expiring.
+const (
+	jointokenttl     = 24 * time.Hour
+	jointokenrenewal = time.Hour
+)
+
+// kubeadminit initializes a Kubernetes control plane on the node,
+// and records the details needed for other nodes to join in the
+// cluster.
+func (n *Node) kubeadminit() error {
+	err := n.ensurerunning()
+	if err != nil {
+		return err
+	}
+
+	err = n.ensurecommands(context.Background())
+	if err != nil {
+		return err
+	}
+
+	logf(VerbosityInfo, n.logfields("kubeadm init"), "Initializing Kubernetes control plane on node %s...", n.name)
+	start := time.Now()
+	command := "sudo kubeadm init --node-name " + n.name
+	if ipaddress := n.IPAddress(); ipaddress != "" {
+		command += " --apiserver-advertise-address " + ipaddress
+	}
+
+	_, err = n.runcommand(context.Background(), command)
+	if err != nil {
+		return err
+	}
+
+	endpoint, token, cacerthash, expiresat, err := n.createjointoken()
+	if err != nil {
+		return err
+	}
+
+	c := n.Cluster()
+	err = clusterconfigmanager.Update(func() error {
+		err := n.checkconfigured()
+		if err != nil {
+			return err
+		}
+
+		configlock.Lock()
+		c.controlPlaneEndpoint = endpoint
+		c.joinToken = token
+		c.joinTokenExpiresAt = expiresat
+		c.caCertHash = cacerthash
+		configlock.Unlock()
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logf(VerbosityInfo, append(n.logfields("kubeadm init"), "duration", time.Since(start)), "Control plane initialized on node %s.", n.name)
+
+	return nil
+}
+
+// kubeadmjoin joins the node to the Kubernetes cluster as a worker,
+// using the join details recorded for the cluster.
+func (n *Node) kubeadmjoin() error {
+	err := n.ensurerunning()
+	if err != nil {
+		return err
+	}
+
+	err = n.ensurecommands(context.Background())
+	if err != nil {
+		return err
+	}
+
+	c := n.Cluster()
+	token, err := c.jointoken()
+	if err != nil {
+		return err
+	}
+
+	configlock.RLock()
+	joincommand := fmt.Sprintf(
+		"sudo kubeadm join %s --token %s --discovery-token-ca-cert-hash %s --node-name %s",
+		c.controlPlaneEndpoint,
+		token,
+		c.caCertHash,
+		n.name,
+	)
+	configlock.RUnlock()
+
+	logf(VerbosityInfo, n.logfields("kubeadm join"), "Joining node %s to cluster %s...", n.name, c.name)
+	start := time.Now()
+	_, err = n.runcommand(context.Background(), joincommand)
+	if err != nil {
+		return err
+	}
+	logf(VerbosityInfo, append(n.logfields("kubeadm join"), "duration", time.Since(start)), "Node %s joined.", n.name)
+
+	return nil
+}
+
+// jointoken returns the bootstrap token recorded for the cluster. If
+// there is none, or it is about to expire, a new token is created on
+// the control plane node and recorded instead. Tokens recorded without
+// an expiry time do not expire.
+func (c *Cluster) jointoken() (string, error) {
+	configlock.RLock()
+	token, expiresat := c.joinToken, c.joinTokenExpiresAt
+	configlock.RUnlock()
+
+	if token != "" && (expiresat.IsZero() || time.Until(expiresat) > jointokenrenewal) {
+		return token, nil
+	}
+
+	controlplane, err := c.controlplanenode()
+	if err != nil {
+		return "", err
+	}
+
+	err = controlplane.ensurerunning()
+	if err != nil {
+		return "", err
+	}
+
+	_, token, _, expiresat, err = controlplane.createjointoken()
+	if err != nil {
+		return "", err
+	}
+
+	err = clusterconfigmanager.Update(func() error {
+		err := c.checkconfigured()
+		if err != nil {
+			return err
+		}
+
+		configlock.Lock()
+		c.joinToken = token
+		c.joinTokenExpiresAt = expiresat
+		configlock.Unlock()
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// createjointoken creates a bootstrap token on the control plane node,
+// and returns the join details printed by kubeadm along with the time
+// the token expires.
+func (n *Node) createjointoken() (string, string, string, time.Time, error) {
+	expiresat := time.Now().Add(jointokenttl).UTC()
+	joincommand, err := n.runcommand(context.Background(), "sudo kubeadm token create --ttl "+jointokenttl.String()+" --print-join-command")
+	if err != nil {
+		return "", "", "", time.Time{}, err
+	}
+
+	endpoint, token, cacerthash, err := parsejoincommand(joincommand)
+	return endpoint, token, cacerthash, expiresat, err
+}
+
+// parsejoincommand extracts the control plane endpoint, token and CA
+// certificate hash from the output of kubeadm token create
+// --print-join-command.
+func parsejoincommand(joincommand string) (string, string, string, error) {
+	var endpoint, token, cacerthash string
+
+	fields := strings.Fields(joincommand)
+	for i := 0; i < len(fields)-1; i++ {
+		switch fields[i] {
+		case "join":
+			endpoint = fields[i+1]
+		case "--token":
+			token = fields[i+1]
+		case "--discovery-token-ca-cert-hash":
+			cacerthash = fields[i+1]
+		}
+	}
+
+	if endpoint == "" || token == "" || cacerthash == "" {
+		return "", "", "", ErrInvalidJoinCommand
+	}
+
+	return endpoint, token, cacerthash, nil
+}
@@ -0,0 +1,224 @@
+package kuttilib
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const artifactsFileName = "kuttilib-artifacts.json"
+
+// errartifactpending is returned by reserveartifact when an artifact
+// is already being created.
+var errartifactpending = errors.New("artifact is being created")
+
+// artifactgraceperiod is how long a recorded artifact which the
+// driver does not report is kept in the ledger, since it may still
+// be in the process of being created.
+const artifactgraceperiod = time.Hour
+
+// artifactrecord identifies a driver machine or network created for
+// a cluster of the workspace. Node is empty for networks. Pending is
+// true from just before the artifact is created until its node or
+// cluster has been added to the configuration, which may be done by
+// another process.
+type artifactrecord struct {
+	Driver     string
+	Cluster    string
+	Node       string `json:",omitempty"`
+	Pending    bool   `json:",omitempty"`
+	RecordedAt time.Time
+}
+
+// increation returns true if the artifact may still be in the process
+// of being created.
+func (a artifactrecord) increation() bool {
+	return a.Pending && time.Since(a.RecordedAt) <= artifactgraceperiod
+}
+
+func (a artifactrecord) sameas(other artifactrecord) bool {
+	return a.Driver == other.Driver && a.Cluster == other.Cluster && a.Node == other.Node
+}
+
+// artifactledger is a data-only representation of the artifacts
+// file.
+//
+// Drivers are shared by all workspaces, and name machines and networks
+// in their own way. So, every machine and network is recorded in the
+// artifacts file of the workspace before it is created, and forgotten
+// once it has been deleted. This allows Reconcile to find artifacts
+// left behind by the workspace, even if the cluster configuration has
+// been lost, without mistaking those of other workspaces for them.
+//
+// The artifacts file is kept apart from the cluster configuration, so
+// that it survives if that is lost or reset. It is read and written
+// under the configuration file lock, so it must not be updated from
+// within clusterconfigmanager.Update.
+type artifactledger struct {
+	Artifacts []artifactrecord
+}
+
+func artifactsfilename() string {
+	return filepath.Join(filepath.Dir(clusterconfigmanager.filename), artifactsFileName)
+}
+
+func readartifacts() (*artifactledger, error) {
+	ledger := &artifactledger{Artifacts: []artifactrecord{}}
+
+	filedata, err := os.ReadFile(artifactsfilename())
+	if errors.Is(err, os.ErrNotExist) {
+		return ledger, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(filedata, ledger)
+	if err != nil {
+		return nil, err
+	}
+	return ledger, nil
+}
+
+// updateartifacts reads the artifacts file, calls f to change it, and
+// writes it back, all under the configuration file lock.
+func updateartifacts(f func(ledger *artifactledger)) error {
+	return clusterconfigmanager.withlock(func() error {
+		ledger, err := readartifacts()
+		if err != nil {
+			return err
+		}
+
+		f(ledger)
+
+		filedata, err := json.Marshal(ledger)
+		if err != nil {
+			return err
+		}
+		return writefileatomic(artifactsfilename(), filedata, 0644)
+	})
+}
+
+// listartifacts returns the artifacts recorded in the workspace.
+func listartifacts() ([]artifactrecord, error) {
+	var result []artifactrecord
+	err := clusterconfigmanager.withlock(func() error {
+		ledger, err := readartifacts()
+		if err != nil {
+			return err
+		}
+
+		result = ledger.Artifacts
+		return nil
+	})
+	return result, err
+}
+
+// recordartifact records a machine, or a network if nodename is empty,
+// before the driver creates it. The record is pending until
+// confirmartifact is called.
+func recordartifact(drivername string, clustername string, nodename string) error {
+	record := artifactrecord{
+		Driver:     drivername,
+		Cluster:    clustername,
+		Node:       nodename,
+		Pending:    true,
+		RecordedAt: time.Now().UTC(),
+	}
+
+	return updateartifacts(func(ledger *artifactledger) {
+		for i, existing := range ledger.Artifacts {
+			if existing.sameas(record) {
+				ledger.Artifacts[i] = record
+				return
+			}
+		}
+		ledger.Artifacts = append(ledger.Artifacts, record)
+	})
+}
+
+// reserveartifact records a machine, or a network if nodename is
+// empty, as recordartifact does, unless the record is pending because
+// another process, or another call in this one, is creating it. Then
+// it returns errartifactpending. This reserves the name of the
+// artifact across processes until confirmartifact or forgetartifact is
+// called, or artifactgraceperiod has passed.
+func reserveartifact(drivername string, clustername string, nodename string) error {
+	record := artifactrecord{
+		Driver:     drivername,
+		Cluster:    clustername,
+		Node:       nodename,
+		Pending:    true,
+		RecordedAt: time.Now().UTC(),
+	}
+
+	pending := false
+	err := updateartifacts(func(ledger *artifactledger) {
+		for i, existing := range ledger.Artifacts {
+			if existing.sameas(record) {
+				pending = existing.increation()
+				if !pending {
+					ledger.Artifacts[i] = record
+				}
+				return
+			}
+		}
+		ledger.Artifacts = append(ledger.Artifacts, record)
+	})
+	if err == nil && pending {
+		err = errartifactpending
+	}
+	return err
+}
+
+// confirmartifact marks the record of a machine, or a network if
+// nodename is empty, as no longer pending, once its node or cluster
+// has been added to the configuration. Failures are only logged, since
+// pending records are treated as confirmed once they are older than
+// artifactgraceperiod.
+func confirmartifact(drivername string, clustername string, nodename string) {
+	record := artifactrecord{Driver: drivername, Cluster: clustername, Node: nodename}
+	err := updateartifacts(func(ledger *artifactledger) {
+		for i, existing := range ledger.Artifacts {
+			if existing.sameas(record) {
+				ledger.Artifacts[i].Pending = false
+			}
+		}
+	})
+	if err != nil {
+		logf(VerbosityDebug, []any{"operation", "confirm artifact", "error", err}, "Error updating the artifacts file: %v.", err)
+	}
+}
+
+// forgetartifacts removes records of machines and networks that have
+// been deleted. Failures are only logged, since Reconcile forgets
+// records of artifacts the driver no longer has.
+func forgetartifacts(records ...artifactrecord) {
+	err := updateartifacts(func(ledger *artifactledger) {
+		kept := make([]artifactrecord, 0, len(ledger.Artifacts))
+		for _, existing := range ledger.Artifacts {
+			forgotten := false
+			for _, record := range records {
+				if existing.sameas(record) {
+					forgotten = true
+					break
+				}
+			}
+			if !forgotten {
+				kept = append(kept, existing)
+			}
+		}
+		ledger.Artifacts = kept
+	})
+	if err != nil {
+		logf(VerbosityDebug, []any{"operation", "forget artifacts", "error", err}, "Error updating the artifacts file: %v.", err)
+	}
+}
+
+// forgetartifact removes the record of a machine, or a network if
+// nodename is empty, once the driver has deleted it.
+func forgetartifact(drivername string, clustername string, nodename string) {
+	forgetartifacts(artifactrecord{Driver: drivername, Cluster: clustername, Node: nodename})
+}
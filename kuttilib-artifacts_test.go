@@ -0,0 +1,65 @@
+package kuttilib_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/kuttiproject/workspace"
+)
+
+// recordpendingartifact records a machine in the artifacts file of the
+// workspace as another process does just before creating it.
+func recordpendingartifact(t *testing.T, drivername string, clustername string, nodename string) {
+	updateartifactsfile(t, func(artifacts []map[string]any) []map[string]any {
+		return append(artifacts, map[string]any{
+			"Driver":     drivername,
+			"Cluster":    clustername,
+			"Node":       nodename,
+			"Pending":    true,
+			"RecordedAt": time.Now().UTC(),
+		})
+	})
+}
+
+// dropartifact removes the record of a machine from the artifacts file
+// of the workspace, as another process does once it has been created.
+func dropartifact(t *testing.T, drivername string, clustername string, nodename string) {
+	updateartifactsfile(t, func(artifacts []map[string]any) []map[string]any {
+		return slices.DeleteFunc(artifacts, func(artifact map[string]any) bool {
+			return artifact["Driver"] == drivername &&
+				artifact["Cluster"] == clustername &&
+				artifact["Node"] == nodename
+		})
+	})
+}
+
+// updateartifactsfile changes the records in the artifacts file of the
+// workspace.
+func updateartifactsfile(t *testing.T, update func([]map[string]any) []map[string]any) {
+	confdir, _ := workspace.ConfigDir()
+	artifactsfile := filepath.Join(confdir, "kuttilib-artifacts.json")
+
+	var ondisk struct {
+		Artifacts []map[string]any
+	}
+	filedata, err := os.ReadFile(artifactsfile)
+	if err == nil {
+		err = json.Unmarshal(filedata, &ondisk)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("reading artifacts file failed with: %v", err)
+	}
+
+	ondisk.Artifacts = update(ondisk.Artifacts)
+
+	filedata, _ = json.Marshal(ondisk)
+	err = os.WriteFile(artifactsfile, filedata, 0644)
+	if err != nil {
+		t.Fatalf("writing artifacts file failed with: %v", err)
+	}
+}
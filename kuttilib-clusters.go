@@ -1,17 +1,20 @@
 package kuttilib
 
 import (
+	"context"
 	"sort"
+	"sync"
 	"time"
 
-	"github.com/kuttiproject/kuttilog"
-
 	"github.com/kuttiproject/drivercore"
 )
 
 // ClusterNames returns the names of all clusters. The
 // order is not predictable.
 func ClusterNames() []string {
+	configlock.RLock()
+	defer configlock.RUnlock()
+
 	result := make([]string, len(config.Clusters))
 	i := 0
 	for clustername := range config.Clusters {
@@ -24,12 +27,7 @@ func ClusterNames() []string {
 // Clusters returns all clusters, sorted in reverse order of
 // creation time.
 func Clusters() []*Cluster {
-	result := make([]*Cluster, len(config.Clusters))
-	i := 0
-	for _, cluster := range config.Clusters {
-		result[i] = cluster
-		i++
-	}
+	result := clusterlist()
 	sort.Slice(result, func(a, b int) bool {
 		return result[a].createdAt.After(result[b].createdAt)
 	})
@@ -38,7 +36,7 @@ func Clusters() []*Cluster {
 
 // ForEachCluster iterates over clusters.
 func ForEachCluster(f func(*Cluster) bool) {
-	for _, cluster := range config.Clusters {
+	for _, cluster := range clusterlist() {
 		if cancel := f(cluster); cancel {
 			break
 		}
@@ -47,6 +45,9 @@ func ForEachCluster(f func(*Cluster) bool) {
 
 // GetCluster gets a named cluster, or nil if not present.
 func GetCluster(name string) (*Cluster, bool) {
+	configlock.RLock()
+	defer configlock.RUnlock()
+
 	cluster, ok := config.Clusters[name]
 	if !ok {
 		return nil, ok
@@ -55,41 +56,153 @@ func GetCluster(name string) (*Cluster, bool) {
 }
 
 // DeleteCluster deletes a cluster.
-// Currently, the cluster must be empty.
+// Currently, the cluster must be empty. To delete a cluster
+// along with its nodes, use DeleteClusterCascade.
 func DeleteCluster(clustername string, force bool) error {
-	cluster, ok := GetCluster(clustername)
-	if !ok {
-		return errClusterDoesNotExist
+	return deletecluster(context.Background(), clustername, force)
+}
+
+// DeleteClusterContext deletes a cluster, like DeleteCluster.
+// If ctx is canceled or its deadline expires before the cluster
+// network is deleted, a *CanceledError is returned and the cluster
+// is left unchanged.
+func DeleteClusterContext(ctx context.Context, clustername string, force bool) error {
+	return deletecluster(ctx, clustername, force)
+}
+
+// clusterlist returns all clusters, in no particular order.
+func clusterlist() []*Cluster {
+	configlock.RLock()
+	defer configlock.RUnlock()
+
+	result := make([]*Cluster, 0, len(config.Clusters))
+	for _, cluster := range config.Clusters {
+		result = append(result, cluster)
 	}
+	return result
+}
 
-	if len(cluster.nodes) > 0 {
-		return errClusterNotEmpty
+func deletecluster(ctx context.Context, clustername string, force bool) error {
+	err := checkcontext(ctx, "delete cluster")
+	if err != nil {
+		return err
 	}
 
-	if cluster.Driver().UsesPerClusterNetworking() {
-		kuttilog.Println(kuttilog.Info, "Deleting network...")
-		err := cluster.deletenetwork()
-		if err != nil {
-			if !force {
-				return err
-			}
+	// A cluster with a network is marked as deleting, and its network
+	// is deleted outside the configuration lock, since the driver may
+	// take a while. The cluster is removed once that is done.
+	var cluster *Cluster
+	deletingnetwork := false
+	err = clusterconfigmanager.Update(func() error {
+		var ok bool
+		cluster, ok = GetCluster(clustername)
+		if !ok {
+			return ErrClusterDoesNotExist
+		}
+
+		if len(cluster.nodes) > 0 {
+			return ErrClusterNotEmpty
+		}
 
-			kuttilog.Printf(
-				kuttilog.Quiet,
+		deletingnetwork = cluster.Driver().UsesPerClusterNetworking()
+
+		configlock.Lock()
+		if deletingnetwork {
+			cluster.deleting = true
+		} else {
+			delete(config.Clusters, clustername)
+		}
+		configlock.Unlock()
+
+		return nil
+	})
+	if err != nil || !deletingnetwork {
+		publishresult(EventClusterDeleted, EventClusterDeleteFailed, Event{Cluster: clustername}, err)
+		return err
+	}
+
+	err = checkcontext(ctx, "delete cluster")
+	deletednetwork := false
+	if err == nil {
+		logprintln(VerbosityInfo, cluster.logfields("delete"), "Deleting network...")
+		err = cluster.deletenetwork()
+		if err == nil {
+			deletednetwork = true
+		} else if force {
+			logf(
+				VerbosityQuiet,
+				append(cluster.logfields("delete"), "error", err),
 				"Warning: Errors returned while deleting network: %v. Some artifacts may need manual cleanup.",
 				err,
 			)
+			err = nil
 		}
 
-		kuttilog.Println(kuttilog.Info, "Network deleted.")
+		if err == nil {
+			logprintln(VerbosityInfo, cluster.logfields("delete"), "Network deleted.")
+		}
 	}
 
-	delete(config.Clusters, clustername)
+	// If the network was not deleted, the cluster is left as it was.
+	removecluster := err == nil
+	updateerr := clusterconfigmanager.Update(func() error {
+		updateerr := cluster.checkconfigured()
+		if updateerr != nil {
+			return updateerr
+		}
+
+		configlock.Lock()
+		if removecluster {
+			delete(config.Clusters, clustername)
+		}
+		cluster.deleting = false
+		configlock.Unlock()
+
+		return nil
+	})
+	if err == nil {
+		err = updateerr
+	}
 
-	return clusterconfigmanager.Save()
+	publishresult(EventClusterDeleted, EventClusterDeleteFailed, Event{Cluster: clustername}, err)
+	if err == nil && deletednetwork {
+		forgetartifact(cluster.driverName, clustername, "")
+	}
+
+	return err
+}
+
+var (
+	addingclusterslock sync.Mutex
+	// addingclusters holds the names of clusters being added by this
+	// process, whose networks are created outside the configuration
+	// lock.
+	addingclusters = map[string]bool{}
+)
+
+// reserveclustername marks a cluster name as being added in this process,
+// until releaseclustername is called. It returns ErrClusterExists if
+// the name is already being added.
+func reserveclustername(name string) error {
+	addingclusterslock.Lock()
+	defer addingclusterslock.Unlock()
+
+	if addingclusters[name] {
+		return ErrClusterExists
+	}
+	addingclusters[name] = true
+	return nil
 }
 
-func newunmanagedcluster(name string, k8sversion string, drivername string) (*Cluster, error) {
+// releaseclustername removes the mark made by reserveclustername.
+func releaseclustername(name string) {
+	addingclusterslock.Lock()
+	defer addingclusterslock.Unlock()
+
+	delete(addingclusters, name)
+}
+
+func newcluster(name string, k8sversion string, drivername string, clustertype string) (*Cluster, error) {
 	newCluster := &Cluster{
 		name:       name,
 		k8sVersion: k8sversion,
@@ -107,16 +220,16 @@ func newunmanagedcluster(name string, k8sversion string, drivername string) (*Cl
 
 	// Create Network if required
 	if newCluster.Driver().UsesPerClusterNetworking() {
-		kuttilog.Println(kuttilog.Info, "Creating network...")
+		logprintln(VerbosityInfo, newCluster.logfields("create"), "Creating network...")
 		err = newCluster.createnetwork()
 		if err != nil {
 			return newCluster, err
 		}
 
-		kuttilog.Println(kuttilog.Info, "Network created.")
+		logprintln(VerbosityInfo, newCluster.logfields("create"), "Network created.")
 	}
 
-	newCluster.clustertype = "Unmanaged"
+	newCluster.clustertype = clustertype
 	newCluster.status = "Ready"
 
 	return newCluster, nil
@@ -126,8 +239,41 @@ func newunmanagedcluster(name string, k8sversion string, drivername string) (*Cl
 // It uses ValidName to check name validity, and also checks if a cluster with the
 // name already exists.
 func NewEmptyCluster(name string, k8sversion string, drivername string) error {
+	return addcluster(context.Background(), name, k8sversion, drivername, ClusterTypeUnmanaged)
+}
+
+// NewEmptyClusterContext creates a new, empty cluster, like NewEmptyCluster.
+// If ctx is canceled or its deadline expires before the cluster is
+// saved, a *CanceledError is returned, any network created for the
+// cluster is deleted, and the cluster is not saved.
+func NewEmptyClusterContext(ctx context.Context, name string, k8sversion string, drivername string) error {
+	return addcluster(ctx, name, k8sversion, drivername, ClusterTypeUnmanaged)
+}
+
+// NewManagedCluster creates a new, empty managed cluster.
+// Nodes added to a managed cluster using NewControlPlaneNode and
+// NewWorkerNode are bootstrapped into a Kubernetes cluster using
+// kubeadm.
+// It uses ValidName to check name validity, and also checks if a cluster with the
+// name already exists.
+func NewManagedCluster(name string, k8sversion string, drivername string) error {
+	return addcluster(context.Background(), name, k8sversion, drivername, ClusterTypeManaged)
+}
+
+// NewManagedClusterContext creates a new, empty managed cluster, like
+// NewManagedCluster. Cancellation behaves as in NewEmptyClusterContext.
+func NewManagedClusterContext(ctx context.Context, name string, k8sversion string, drivername string) error {
+	return addcluster(ctx, name, k8sversion, drivername, ClusterTypeManaged)
+}
+
+func addcluster(ctx context.Context, name string, k8sversion string, drivername string, clustertype string) error {
+	err := checkcontext(ctx, "create cluster")
+	if err != nil {
+		return err
+	}
+
 	// Validate name
-	err := ValidateClusterName(name)
+	err = ValidateClusterName(name)
 	if err != nil {
 		return err
 	}
@@ -135,7 +281,7 @@ func NewEmptyCluster(name string, k8sversion string, drivername string) error {
 	// Validate driver
 	driver, ok := drivercore.GetDriver(drivername)
 	if !ok {
-		return errDriverDoesNotExist
+		return ErrDriverDoesNotExist
 	}
 
 	// Validate k8sversion
@@ -145,19 +291,61 @@ func NewEmptyCluster(name string, k8sversion string, drivername string) error {
 	}
 
 	if driverimage.Status() != drivercore.ImageStatusDownloaded {
-		return errImageNotAvailable
+		return ErrImageNotAvailable
 	}
 
 	if driverimage.Deprecated() {
-		return errVersionDeprecated
+		return ErrVersionDeprecated
 	}
 
-	// Create cluster
-	newCluster, err := newunmanagedcluster(name, k8sversion, drivername)
+	err = reserveclustername(name)
 	if err != nil {
 		return err
 	}
+	defer releaseclustername(name)
+
+	// The cluster, and its network, are created before the cluster is
+	// added to the configuration, so that the configuration is not
+	// locked while the driver works. The network is recorded as soon
+	// as it exists. If the cluster cannot be added, the network is
+	// deleted again, and forgotten.
+	newCluster, err := newcluster(name, k8sversion, drivername, clustertype)
+	if err == nil && newCluster.network != nil {
+		err = recordartifact(drivername, name, "")
+	}
+	if err == nil {
+		err = clusterconfigmanager.Update(func() error {
+			// Validate name again, in case another process has created it
+			err := ValidateClusterName(name)
+			if err != nil {
+				return err
+			}
+
+			err = checkcontext(ctx, "create cluster")
+			if err != nil {
+				return err
+			}
+
+			configlock.Lock()
+			config.Clusters[name] = newCluster
+			configlock.Unlock()
+
+			return nil
+		})
+	}
+	if err != nil && newCluster != nil && newCluster.network != nil {
+		deleteerr := newCluster.deletenetwork()
+		if deleteerr != nil {
+			logf(VerbosityQuiet, append(newCluster.logfields("create"), "error", deleteerr), "Error deleting network of cluster %s: %v. It may be left behind.", name, deleteerr)
+			confirmartifact(drivername, name, "")
+		} else {
+			forgetartifact(drivername, name, "")
+		}
+	}
+	publishresult(EventClusterCreated, EventClusterCreateFailed, Event{Cluster: name}, err)
+	if err == nil && newCluster.network != nil {
+		confirmartifact(drivername, name, "")
+	}
 
-	config.Clusters[name] = newCluster
-	return clusterconfigmanager.Save()
+	return err
 }
@@ -0,0 +1,81 @@
+package kuttilib
+
+import (
+	"context"
+	"sync"
+)
+
+// CommandRunner runs shell commands on the host of a Node, and
+// returns the standard output of the command.
+//
+// kuttilib uses a CommandRunner for operations that need to run
+// software inside a node, such as bootstrapping Kubernetes with
+// kubeadm. By default, commands are run over SSH, as Node.Exec does,
+// since drivers can only run a fixed set of predefined commands on
+// their machines. Clients can replace this using SetCommandRunner.
+type CommandRunner interface {
+	RunCommand(node *Node, command string) (string, error)
+}
+
+// ContextCommandRunner is a CommandRunner which can also stop running
+// a command when a context is done. kuttilib uses RunCommandContext
+// rather than RunCommand for operations that take a context, such as
+// Node.Health, if the CommandRunner set with SetCommandRunner
+// implements it. The default CommandRunner does.
+type ContextCommandRunner interface {
+	CommandRunner
+	RunCommandContext(ctx context.Context, node *Node, command string) (string, error)
+}
+
+// CommandRunnerFunc is an adapter to allow the use of ordinary
+// functions as CommandRunners.
+type CommandRunnerFunc func(node *Node, command string) (string, error)
+
+// RunCommand calls f(node, command).
+func (f CommandRunnerFunc) RunCommand(node *Node, command string) (string, error) {
+	return f(node, command)
+}
+
+// defaultcommandrunner is the CommandRunner used unless a client
+// sets another.
+type defaultcommandrunner struct{}
+
+// RunCommand runs command on node over SSH, as RunCommandContext
+// does.
+func (r defaultcommandrunner) RunCommand(node *Node, command string) (string, error) {
+	return r.RunCommandContext(context.Background(), node, command)
+}
+
+// RunCommandContext runs command on node over SSH, adding the
+// workspace SSH key first as ExecStream does. If the node has no SSH
+// address, ErrCommandsNotSupported is returned.
+func (defaultcommandrunner) RunCommandContext(ctx context.Context, node *Node, command string) (string, error) {
+	if node.SSHAddress() == "" {
+		return "", ErrCommandsNotSupported
+	}
+	node.ensuresshkeyonuse(ctx)
+	return runsshcommand(ctx, node, command)
+}
+
+var (
+	commandrunnerlock sync.RWMutex
+	commandrunner     CommandRunner = defaultcommandrunner{}
+)
+
+// SetCommandRunner sets the CommandRunner used to run commands on
+// nodes. If runner is nil, the default CommandRunner is restored.
+func SetCommandRunner(runner CommandRunner) {
+	if runner == nil {
+		runner = defaultcommandrunner{}
+	}
+
+	commandrunnerlock.Lock()
+	defer commandrunnerlock.Unlock()
+	commandrunner = runner
+}
+
+func currentcommandrunner() CommandRunner {
+	commandrunnerlock.RLock()
+	defer commandrunnerlock.RUnlock()
+	return commandrunner
+}
@@ -0,0 +1,116 @@
+package kuttilib_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/kuttiproject/kuttilib"
+)
+
+// recordingrunner is a CommandRunner that records the commands
+// issued to nodes, and returns canned output for kubeadm.
+type recordingrunner struct {
+	mu       sync.Mutex
+	commands []string
+
+	// k8sversion, if set, returns the Kubernetes version reported by
+	// kubeadm and the kubelet on a node.
+	k8sversion func(node *kuttilib.Node) string
+
+	// failing, if set, makes commands containing it fail.
+	failing string
+}
+
+func (r *recordingrunner) RunCommand(node *kuttilib.Node, command string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.commands = append(r.commands, node.Name()+": "+command)
+	if r.failing != "" && strings.Contains(command, r.failing) {
+		return "", errors.New("command failed")
+	}
+	if strings.Contains(command, "--print-join-command") {
+		return TESTJOINCOMMAND, nil
+	}
+	if strings.Contains(command, "config view") {
+		return TESTADMINCONF, nil
+	}
+	if strings.Contains(command, "get nodes") {
+		return TESTNODELIST, nil
+	}
+	if strings.Contains(command, "systemctl is-active") {
+		return "active\n", nil
+	}
+	if r.k8sversion != nil && strings.Contains(command, "kubeadm version") {
+		return "v" + r.k8sversion(node) + ".2\n", nil
+	}
+	if r.k8sversion != nil && strings.Contains(command, "kubelet --version") {
+		return "Kubernetes v" + r.k8sversion(node) + ".2\n", nil
+	}
+	return "", nil
+}
+
+func (r *recordingrunner) issued(prefix string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, command := range r.commands {
+		if strings.HasPrefix(command, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// issuedcontaining returns true if any command issued contains
+// substring.
+func (r *recordingrunner) issuedcontaining(substring string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, command := range r.commands {
+		if strings.Contains(command, substring) {
+			return true
+		}
+	}
+	return false
+}
+
+// countcontaining returns the number of commands issued which contain
+// substring.
+func (r *recordingrunner) countcontaining(substring string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	count := 0
+	for _, command := range r.commands {
+		if strings.Contains(command, substring) {
+			count++
+		}
+	}
+	return count
+}
+
+// fail makes commands containing substring fail, or no commands if
+// substring is empty.
+func (r *recordingrunner) fail(substring string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.failing = substring
+}
+
+// blockingrunner is a ContextCommandRunner whose commands run until
+// their context is done.
+type blockingrunner struct{}
+
+func (blockingrunner) RunCommand(node *kuttilib.Node, command string) (string, error) {
+	return "", errors.New("blockingrunner commands need a context")
+}
+
+func (blockingrunner) RunCommandContext(ctx context.Context, node *kuttilib.Node, command string) (string, error) {
+	<-ctx.Done()
+	return "", ctx.Err()
+}
@@ -2,51 +2,118 @@ package kuttilib
 
 import (
 	"encoding/json"
-
-	"github.com/kuttiproject/workspace"
+	"errors"
+	"sync"
 )
 
 const configFileName = "kuttilib-clusters.json"
 
 var (
-	clusterconfigmanager workspace.ConfigManager
+	clusterconfigmanager *fileconfigmanager
 	config               *clusterConfigData
+
+	// configlock guards the in-memory cluster configuration: the
+	// config.Clusters map, and the mutable persisted fields of every
+	// Cluster and Node in it. Changes are serialized by
+	// clusterconfigmanager.Update, so code running inside Update may
+	// read the configuration without holding configlock, but must
+	// hold it for writing. Code holding configlock for writing must
+	// not call anything that takes it again.
+	configlock sync.RWMutex
 )
 
 type clusterConfigData struct {
-	Clusters map[string]*Cluster
+	SchemaVersion  int
+	Clusters       map[string]*Cluster
+	HostPortRanges []PortRange `json:",omitempty"`
 }
 
 func (cc *clusterConfigData) Serialize() ([]byte, error) {
+	cc.SchemaVersion = ConfigSchemaVersion
 	return json.Marshal(cc)
 }
 
+// Deserialize loads configuration data, migrating it first if it has
+// an older schema version. Data with a newer schema version is refused
+// with an error wrapping ErrConfigSchemaTooNew.
 func (cc *clusterConfigData) Deserialize(data []byte) error {
+	version, err := configschemaversion(data)
+	if err != nil {
+		return err
+	}
+
+	if version < ConfigSchemaVersion {
+		data, err = migrateconfig(data, version)
+		if err != nil {
+			return err
+		}
+	}
+
 	var loadedconfig *clusterConfigData
-	err := json.Unmarshal(data, &loadedconfig)
+	err = json.Unmarshal(data, &loadedconfig)
 	if err == nil {
+		cc.SchemaVersion = loadedconfig.SchemaVersion
 		cc.Clusters = loadedconfig.Clusters
+		cc.HostPortRanges = loadedconfig.HostPortRanges
 	}
 
 	return err
 }
 
 func (cc *clusterConfigData) SetDefaults() {
+	cc.SchemaVersion = ConfigSchemaVersion
 	cc.Clusters = map[string]*Cluster{}
+	cc.HostPortRanges = nil
 }
 
-func setworkspaceconfigmanager() {
+// merge updates the configuration to match loaded, which was
+// freshly read from the configuration file. Existing Cluster
+// and Node objects are updated in place, so that references
+// held by clients remain valid. It must be called with configlock
+// held for writing.
+func (cc *clusterConfigData) merge(loaded *clusterConfigData) {
+	cc.HostPortRanges = loaded.HostPortRanges
+
+	for name, loadedcluster := range loaded.Clusters {
+		cluster, ok := cc.Clusters[name]
+		if !ok || !cluster.sameas(loadedcluster) {
+			cc.Clusters[name] = loadedcluster
+			continue
+		}
+
+		cluster.merge(loadedcluster)
+	}
+
+	for name := range cc.Clusters {
+		if _, ok := loaded.Clusters[name]; !ok {
+			delete(cc.Clusters, name)
+		}
+	}
+}
+
+// setworkspaceconfigmanager loads the cluster configuration of the
+// current workspace. If the configuration has a newer schema version
+// than this version of kuttilib supports, the error is returned, and
+// is kept by the configuration manager, which returns it from every
+// subsequent change to the workspace.
+func setworkspaceconfigmanager() error {
 	config = &clusterConfigData{
 		Clusters: map[string]*Cluster{},
 	}
 
 	var err error
-	clusterconfigmanager, err = workspace.NewFileConfigManager(configFileName, config)
+	clusterconfigmanager, err = newfileconfigmanager(configFileName, config)
+	if errors.Is(err, ErrConfigSchemaTooNew) {
+		return err
+	}
 	if err != nil {
 		panic("could not initialize cluster configuration manager")
 	}
+	return nil
 }
 
 func init() {
-	setworkspaceconfigmanager()
+	// The error is kept by the configuration manager, and returned
+	// by every change to the workspace.
+	_ = setworkspaceconfigmanager()
 }
@@ -0,0 +1,175 @@
+package kuttilib
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/kuttiproject/workspace"
+)
+
+// fileconfigmanager loads and saves the cluster configuration file.
+//
+// Several kutti processes may work in the same workspace. So, the
+// configuration file is only read or written while holding an
+// advisory lock on a companion lock file, and is written atomically
+// by writing a temporary file and renaming it over the original.
+// Mutations should be performed using Update, which reloads the
+// file before applying a change and saves it afterwards, all under
+// the lock.
+//
+// If the file could not be loaded because it has a newer schema
+// version than this version of kuttilib supports, the error is kept,
+// and every later operation under the lock fails with it, so that the
+// workspace is never written to by an older kuttilib.
+type fileconfigmanager struct {
+	mu       sync.Mutex
+	filename string
+	data     *clusterConfigData
+	loaderr  error
+}
+
+func newfileconfigmanager(filename string, data *clusterConfigData) (*fileconfigmanager, error) {
+	configdir, err := workspace.ConfigDir()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &fileconfigmanager{
+		filename: filepath.Join(configdir, filename),
+		data:     data,
+	}
+
+	err = result.Load()
+	if errors.Is(err, ErrConfigSchemaTooNew) {
+		result.loaderr = err
+	}
+	return result, err
+}
+
+// Load reads the configuration file. If the file does not exist,
+// the configuration is set to defaults.
+func (m *fileconfigmanager) Load() error {
+	return m.withlock(func() error {
+		return m.read(m.data)
+	})
+}
+
+// Save writes the current configuration to the file.
+func (m *fileconfigmanager) Save() error {
+	return m.withlock(m.write)
+}
+
+// Update reloads the configuration file, merging changes made by
+// other processes into the current configuration, and then calls f.
+// If f succeeds, the configuration is saved. The file stays locked
+// throughout, so concurrent updates are serialized. Update must not
+// be called from within f.
+func (m *fileconfigmanager) Update(f func() error) error {
+	return m.withlock(func() error {
+		loaded := &clusterConfigData{}
+		err := m.read(loaded)
+		if err != nil {
+			return err
+		}
+		configlock.Lock()
+		m.data.merge(loaded)
+		configlock.Unlock()
+
+		err = f()
+		if err != nil {
+			return err
+		}
+
+		return m.write()
+	})
+}
+
+func (m *fileconfigmanager) withlock(f func() error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.loaderr != nil {
+		return m.loaderr
+	}
+
+	lockfile, err := os.OpenFile(m.filename+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lockfile.Close()
+
+	err = lockfileexclusive(lockfile)
+	if err != nil {
+		return err
+	}
+	defer unlockfile(lockfile)
+
+	return f()
+}
+
+func (m *fileconfigmanager) read(data *clusterConfigData) error {
+	filedata, err := os.ReadFile(m.filename)
+	if errors.Is(err, os.ErrNotExist) {
+		data.SetDefaults()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	version, err := configschemaversion(filedata)
+	if err == nil && version < ConfigSchemaVersion {
+		err = backupconfigfile(m.filename, version, filedata)
+		if err != nil {
+			return err
+		}
+	}
+
+	return data.Deserialize(filedata)
+}
+
+func (m *fileconfigmanager) write() error {
+	filedata, err := m.data.Serialize()
+	if err != nil {
+		return err
+	}
+
+	// The configuration holds cluster join tokens, so it is only
+	// readable by the owner.
+	return writefileatomic(m.filename, filedata, 0600)
+}
+
+// writefileatomic writes data to a temporary file in the same
+// directory as filename, and renames it over filename, so that
+// readers never see a partially written file.
+func writefileatomic(filename string, data []byte, perm os.FileMode) error {
+	tempfile, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tempfilename := tempfile.Name()
+
+	_, err = tempfile.Write(data)
+	if err == nil {
+		err = tempfile.Chmod(perm)
+	}
+	if err == nil {
+		err = tempfile.Sync()
+	}
+	closeerr := tempfile.Close()
+	if err == nil {
+		err = closeerr
+	}
+	if err != nil {
+		os.Remove(tempfilename)
+		return err
+	}
+
+	err = os.Rename(tempfilename, filename)
+	if err != nil {
+		os.Remove(tempfilename)
+	}
+	return err
+}
@@ -0,0 +1,59 @@
+package kuttilib_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kuttiproject/kuttilib"
+	"github.com/kuttiproject/workspace"
+)
+
+// dropfromconfigfile removes a node, or a cluster if nodename is
+// empty, from the configuration file, as if it had been lost.
+func dropfromconfigfile(t *testing.T, clustername string, nodename string) {
+	confdir, _ := workspace.ConfigDir()
+	configfile := filepath.Join(confdir, "kuttilib-clusters.json")
+
+	filedata, err := os.ReadFile(configfile)
+	if err != nil {
+		t.Fatalf("reading config file failed with: %v", err)
+	}
+
+	var ondisk map[string]any
+	err = json.Unmarshal(filedata, &ondisk)
+	if err != nil {
+		t.Fatalf("parsing config file failed with: %v", err)
+	}
+
+	clusters := ondisk["Clusters"].(map[string]any)
+	if nodename == "" {
+		delete(clusters, clustername)
+	} else {
+		delete(clusters[clustername].(map[string]any)["Nodes"].(map[string]any), nodename)
+	}
+
+	filedata, _ = json.Marshal(ondisk)
+	err = os.WriteFile(configfile, filedata, 0644)
+	if err != nil {
+		t.Fatalf("writing config file failed with: %v", err)
+	}
+}
+
+// configupdatable returns true if the configuration of cluster can be
+// changed within a second, which it cannot while it is locked.
+func configupdatable(cluster *kuttilib.Cluster) bool {
+	done := make(chan error, 1)
+	go func() {
+		done <- cluster.SetAutoForwardPorts(cluster.AutoForwardPorts())
+	}()
+
+	select {
+	case err := <-done:
+		return err == nil
+	case <-time.After(time.Second):
+		return false
+	}
+}
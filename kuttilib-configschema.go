@@ -0,0 +1,104 @@
+package kuttilib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ConfigSchemaVersion is the version of the cluster configuration file
+// format written by this version of kuttilib. It must be incremented,
+// and a migration added to configmigrations, whenever the format
+// changes in a way that older data cannot be loaded as is.
+const ConfigSchemaVersion = 1
+
+// configmigration converts cluster configuration data from one schema
+// version to the next. The data is the top-level JSON object of the
+// configuration file, and is modified in place.
+type configmigration func(data map[string]json.RawMessage) error
+
+// configmigrations holds the migration from each schema version to the
+// next, keyed by the version it migrates from.
+var configmigrations = map[int]configmigration{
+	// Version 0 files were written before schema versions were
+	// introduced. Their layout is the same as version 1: fields
+	// added since then are optional.
+	0: func(data map[string]json.RawMessage) error {
+		return nil
+	},
+}
+
+// configschemaversion returns the schema version of cluster
+// configuration data. Data without a version is version 0.
+func configschemaversion(data []byte) (int, error) {
+	var versiondata struct {
+		SchemaVersion int
+	}
+	err := json.Unmarshal(data, &versiondata)
+	if err != nil {
+		return 0, err
+	}
+
+	if versiondata.SchemaVersion > ConfigSchemaVersion {
+		return versiondata.SchemaVersion, fmt.Errorf(
+			"%w: the workspace configuration has schema version %v, but this version of kuttilib supports up to %v. Please upgrade",
+			ErrConfigSchemaTooNew,
+			versiondata.SchemaVersion,
+			ConfigSchemaVersion,
+		)
+	}
+	return versiondata.SchemaVersion, nil
+}
+
+// migrateconfig applies migrations to cluster configuration data of
+// the specified schema version, and returns data of the current
+// version.
+func migrateconfig(data []byte, version int) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	for ; version < ConfigSchemaVersion; version++ {
+		migration, ok := configmigrations[version]
+		if !ok {
+			return nil, fmt.Errorf("%w: no migration from schema version %v", ErrConfigMigrationFailed, version)
+		}
+
+		err = migration(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%w: from schema version %v: %w", ErrConfigMigrationFailed, version, err)
+		}
+	}
+
+	fields["SchemaVersion"], _ = json.Marshal(ConfigSchemaVersion)
+	return json.Marshal(fields)
+}
+
+// backupconfigfile saves a copy of a configuration file of an older
+// schema version before it is migrated, as filename.vN.bak. An
+// existing backup is not replaced, so that it always holds the data
+// as it was before the first migration. Like the configuration file,
+// the backup is only readable by the owner.
+func backupconfigfile(filename string, version int, data []byte) error {
+	backupfile, err := os.OpenFile(
+		fmt.Sprintf("%s.v%v.bak", filename, version),
+		os.O_CREATE|os.O_EXCL|os.O_WRONLY,
+		0600,
+	)
+	if errors.Is(err, os.ErrExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = backupfile.Write(data)
+	closeerr := backupfile.Close()
+	if err == nil {
+		err = closeerr
+	}
+	return err
+}
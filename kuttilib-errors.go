@@ -1,25 +1,281 @@
 package kuttilib
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
 
+// The Err* variables are the errors returned by kuttilib. Errors
+// returned by operations on nodes and ports may be wrapped in a
+// *NodeError or a *PortError, so they should be checked using
+// errors.Is rather than direct comparison.
 var (
-	errInvalidName             = errors.New("invalid name. Valid names are up to 10 characters long, must start with a lowercase letter, and may contain lowercase letters and digits only")
-	errClusterExists           = errors.New("cluster already exists")
-	errClusterDoesNotExist     = errors.New("cluster does not exist")
-	errClusterNotEmpty         = errors.New("cluster is not empty")
-	errDriverDoesNotExist      = errors.New("driver does not exist")
-	errVersionDeprecated       = errors.New("version is deprecated")
-	errImageNotAvailable       = errors.New("image not available")
-	errNodeExists              = errors.New("node already exists")
-	errNodeNotFound            = errors.New("node not found")
-	errNodeIsRunning           = errors.New("node is running")
-	errNodeCannotStart         = errors.New("cannot start node")
-	errNodeCannotStop          = errors.New("node not started. Cannot stop node")
-	errPortForwardNotSupported = errors.New("port forwarding not supported")
-	errPortNotForwarded        = errors.New("port not forwarded")
-	errPortCannotUnmap         = errors.New("the SSH port cannot be unmapped")
-	errPortNodePortInvalid     = errors.New("node port is invalid")
-	errPortNodePortInUse       = errors.New("node port has already been forwarded")
-	errPortHostPortInvalid     = errors.New("host port is invalid")
-	errPortHostPortAlreadyUsed = errors.New("port already used")
+	// ErrInvalidName is returned when a cluster or node name is invalid.
+	ErrInvalidName = errors.New("invalid name. Valid names are up to 10 characters long, must start with a lowercase letter, and may contain lowercase letters and digits only")
+	// ErrClusterExists is returned when a cluster name is already in use.
+	ErrClusterExists = errors.New("cluster already exists")
+	// ErrClusterDoesNotExist is returned when a named cluster cannot be found.
+	ErrClusterDoesNotExist = errors.New("cluster does not exist")
+	// ErrClusterNotEmpty is returned when deleting a cluster that has nodes.
+	ErrClusterNotEmpty = errors.New("cluster is not empty")
+	// ErrClusterDeleting is returned when adding a node to a cluster
+	// whose network is being deleted.
+	ErrClusterDeleting = errors.New("cluster is being deleted")
+	// ErrClusterNotManaged is returned when a managed cluster operation is
+	// attempted on an unmanaged cluster.
+	ErrClusterNotManaged = errors.New("cluster is not a managed cluster")
+	// ErrControlPlaneExists is returned when adding a second control plane node.
+	ErrControlPlaneExists = errors.New("cluster already has a control plane node")
+	// ErrNoControlPlane is returned when an operation needs a control plane
+	// node, and the cluster does not have one.
+	ErrNoControlPlane = errors.New("cluster does not have a control plane node")
+	// ErrCommandsNotSupported is returned when commands cannot be run on a node.
+	ErrCommandsNotSupported = errors.New("commands are run on nodes over SSH, and the node cannot be reached over SSH")
+	// ErrCommandFailed is returned when a command run on a node exits with
+	// a non-zero status.
+	ErrCommandFailed = errors.New("command failed")
+	// ErrSSHNotAvailable is returned when a node has no SSH address. The
+	// node may be stopped, or its SSH port may not be forwarded.
+	ErrSSHNotAvailable = errors.New("node cannot be reached over SSH")
+	// ErrSSHFailed is returned when an SSH connection to a node fails.
+	ErrSSHFailed = errors.New("SSH connection failed")
+	// ErrSSHHostKeyMismatch is returned when a node presents an SSH
+	// host key other than the one pinned for it.
+	ErrSSHHostKeyMismatch = errors.New("SSH host key of node does not match the pinned key")
+	// ErrNoSSHKey is returned when the workspace does not have an SSH
+	// key pair.
+	ErrNoSSHKey = errors.New("workspace does not have an SSH key")
+	// ErrNoSSHPassword is returned when adding the workspace SSH key to
+	// a node which does not accept it yet, and no password has been set
+	// with SetSSHPassword to log in with instead.
+	ErrNoSSHPassword = errors.New("node does not accept the SSH key, and no SSH password is set")
+	// ErrSSHKeyInvalid is returned when the workspace SSH key file
+	// cannot be read.
+	ErrSSHKeyInvalid = errors.New("SSH key file is invalid")
+	// ErrInvalidJoinCommand is returned when kubeadm join details cannot be parsed.
+	ErrInvalidJoinCommand = errors.New("could not parse kubeadm join command")
+	// ErrClusterSpecInvalid is returned when a ClusterSpec is malformed.
+	ErrClusterSpecInvalid = errors.New("cluster spec is invalid")
+	// ErrClusterSpecConflict is returned when an existing cluster, node or
+	// port forward conflicts with a ClusterSpec.
+	ErrClusterSpecConflict = errors.New("existing cluster conflicts with cluster spec")
+	// ErrUnknownPlanAction is returned when executing a plan step with an
+	// unknown action.
+	ErrUnknownPlanAction = errors.New("unknown plan action")
+	// ErrInvalidKubeconfig is returned when a kubeconfig cannot be parsed.
+	ErrInvalidKubeconfig = errors.New("invalid kubeconfig")
+	// ErrAPIServerNotForwarded is returned when a kubeconfig is requested
+	// for a cluster whose driver uses NAT networking, and the API server
+	// port of the control plane node is not forwarded.
+	ErrAPIServerNotForwarded = errors.New("the API server port of the control plane node is not forwarded")
+	// ErrKubeconfigNotMergeable is returned when an existing kubeconfig file
+	// is in neither JSON nor YAML format.
+	ErrKubeconfigNotMergeable = errors.New("cannot merge into kubeconfig file")
+	// ErrDriverDoesNotExist is returned when a named driver is not available.
+	ErrDriverDoesNotExist = errors.New("driver does not exist")
+	// ErrVersionDeprecated is returned when a deprecated version is used.
+	ErrVersionDeprecated = errors.New("version is deprecated")
+	// ErrImageNotAvailable is returned when a version has not been downloaded.
+	ErrImageNotAvailable = errors.New("image not available")
+	// ErrNodeExists is returned when a node name is already in use.
+	ErrNodeExists = errors.New("node already exists")
+	// ErrNodeNotFound is returned when a named node cannot be found.
+	ErrNodeNotFound = errors.New("node not found")
+	// ErrNodeIsRunning is returned when deleting a running node without
+	// force, or when an operation requires a node to be stopped.
+	ErrNodeIsRunning = errors.New("node is running")
+	// ErrNodeCannotStart is returned when starting a node that is not stopped.
+	ErrNodeCannotStart = errors.New("cannot start node")
+	// ErrNodeCannotStop is returned when stopping a node that is not running.
+	ErrNodeCannotStop = errors.New("node not started. Cannot stop node")
+	// ErrNodeSpecNotSupported is returned when creating a node with a
+	// non-default NodeSpec on a driver that cannot honour it.
+	ErrNodeSpecNotSupported = errors.New("node hardware sizing not supported by this driver")
+	// ErrNodeSpecInvalid is returned when a NodeSpec contains negative values.
+	ErrNodeSpecInvalid = errors.New("node spec is invalid")
+	// ErrNodeSpecExceedsLimits is returned when a NodeSpec exceeds the
+	// limits reported by the driver.
+	ErrNodeSpecExceedsLimits = errors.New("node spec exceeds driver limits")
+	// ErrPortForwardNotSupported is returned when forwarding ports on a
+	// driver that does not use NAT networking.
+	ErrPortForwardNotSupported = errors.New("port forwarding not supported")
+	// ErrPortNotForwarded is returned when unforwarding a port that is not
+	// forwarded.
+	ErrPortNotForwarded = errors.New("port not forwarded")
+	// ErrPortCannotUnmap is returned when unforwarding the SSH port.
+	ErrPortCannotUnmap = errors.New("the SSH port cannot be unmapped")
+	// ErrPortNodePortInvalid is returned when a node port number is invalid.
+	ErrPortNodePortInvalid = errors.New("node port is invalid")
+	// ErrPortNodePortInUse is returned when a node port is already forwarded.
+	ErrPortNodePortInUse = errors.New("node port has already been forwarded")
+	// ErrPortHostPortInvalid is returned when a host port number is invalid.
+	ErrPortHostPortInvalid = errors.New("host port is invalid")
+	// ErrNoFreeHostPort is returned when no free host port can be found
+	// in the configured host port ranges.
+	ErrNoFreeHostPort = errors.New("no free host port available")
+	// ErrPortHostPortUnavailable is returned when a host port is in use by
+	// another process.
+	ErrPortHostPortUnavailable = errors.New("host port is in use by another process")
+	// ErrPortRangeInvalid is returned when a host port range is invalid.
+	ErrPortRangeInvalid = errors.New("host port range is invalid")
+	// ErrPortHostPortAlreadyUsed is returned when a host port is already
+	// mapped to a node.
+	ErrPortHostPortAlreadyUsed = errors.New("port already used")
+	// ErrConfigSchemaTooNew is returned when the workspace configuration
+	// was written by a newer version of kuttilib, with a schema version
+	// that this version does not support.
+	ErrConfigSchemaTooNew = errors.New("workspace configuration schema is too new")
+	// ErrConfigMigrationFailed is returned when the workspace
+	// configuration cannot be migrated to the current schema version.
+	ErrConfigMigrationFailed = errors.New("workspace configuration migration failed")
+	// ErrArchiveInvalid is returned when importing a cluster from
+	// data that is not a valid cluster archive.
+	ErrArchiveInvalid = errors.New("invalid cluster archive")
+	// ErrDiskExportNotSupported is returned when exporting node disks
+	// of a cluster whose driver cannot export them.
+	ErrDiskExportNotSupported = errors.New("driver cannot export node disks")
+	// ErrDiskImportNotSupported is returned when importing a cluster
+	// archive containing node disks into a driver that cannot import
+	// them.
+	ErrDiskImportNotSupported = errors.New("driver cannot import node disks")
+	// ErrSnapshotsNotSupported is returned by snapshot operations on
+	// nodes whose driver cannot take snapshots.
+	ErrSnapshotsNotSupported = errors.New("snapshots not supported by this driver")
+	// ErrSnapshotExists is returned when taking a snapshot with the
+	// name of an existing snapshot of the node.
+	ErrSnapshotExists = errors.New("snapshot already exists")
+	// ErrSnapshotNotFound is returned when restoring or deleting a
+	// snapshot that does not exist.
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+	// ErrCloneNotSupported is returned when cloning a cluster whose
+	// driver cannot clone node hosts.
+	ErrCloneNotSupported = errors.New("cloning nodes not supported by this driver")
+	// ErrUpgradeInvalid is returned when upgrading a cluster to a
+	// version that is not a later patch release of its current minor
+	// version, or a release of the next minor version.
+	ErrUpgradeInvalid = errors.New("invalid upgrade. Clusters can only be upgraded to a later patch release, or to the next minor version")
+	// ErrUpgradeNotSupported is returned when upgrading a cluster whose
+	// driver cannot install Kubernetes binaries on its nodes.
+	ErrUpgradeNotSupported = errors.New("driver does not support upgrading Kubernetes on nodes")
+	// ErrUpgradeFailed is returned when the Kubernetes version on a
+	// node is not the target version after an upgrade.
+	ErrUpgradeFailed = errors.New("upgrade failed. Node is not at the target version")
 )
+
+// NodeError records an error that occurred during an operation on
+// a node. It wraps the underlying kuttilib or driver error.
+type NodeError struct {
+	// Cluster is the name of the cluster the node belongs to.
+	Cluster string
+	// Node is the name of the node.
+	Node string
+	// Op is the operation that failed.
+	Op string
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *NodeError) Error() string {
+	return fmt.Sprintf("%s node %s in cluster %s: %v", e.Op, e.Node, e.Cluster, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *NodeError) Unwrap() error {
+	return e.Err
+}
+
+// PortError records an error that occurred while forwarding or
+// checking a port. NodePort is 0 if the error concerns only the
+// host port.
+type PortError struct {
+	// HostPort is the host port involved.
+	HostPort int
+	// NodePort is the node port involved.
+	NodePort int
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *PortError) Error() string {
+	if e.NodePort == 0 {
+		return fmt.Sprintf("host port %v: %v", e.HostPort, e.Err)
+	}
+	return fmt.Sprintf("host port %v, node port %v: %v", e.HostPort, e.NodePort, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *PortError) Unwrap() error {
+	return e.Err
+}
+
+// wrapnodeerror wraps err in a *NodeError, unless it is nil or
+// already wraps one.
+func wrapnodeerror(clustername string, nodename string, op string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var nodeerr *NodeError
+	if errors.As(err, &nodeerr) {
+		return err
+	}
+
+	return &NodeError{Cluster: clustername, Node: nodename, Op: op, Err: err}
+}
+
+// CanceledError is returned by the Context variants of operations
+// when the supplied context is canceled, or its deadline expires,
+// before the operation completes. It wraps the error returned by
+// the context, so errors.Is(err, context.Canceled) and
+// errors.Is(err, context.DeadlineExceeded) work as expected.
+type CanceledError struct {
+	// Op is the operation that was interrupted.
+	Op string
+	// Err is the error returned by the context.
+	Err error
+}
+
+func (e *CanceledError) Error() string {
+	return fmt.Sprintf("%s interrupted: %v", e.Op, e.Err)
+}
+
+// Unwrap returns the underlying context error.
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+// TimeoutError is returned by WaitFor and WaitForReady when the
+// timeout specified in WaitOptions passes before the condition waited
+// for is met. It wraps context.DeadlineExceeded.
+type TimeoutError struct {
+	// Op is the operation that timed out.
+	Op string
+	// Timeout is the timeout that passed.
+	Timeout time.Duration
+	// LastStatus describes what was observed at the last check of
+	// the condition.
+	LastStatus string
+}
+
+func (e *TimeoutError) Error() string {
+	if e.LastStatus == "" {
+		return fmt.Sprintf("%s timed out after %v", e.Op, e.Timeout)
+	}
+	return fmt.Sprintf("%s timed out after %v, last observed: %s", e.Op, e.Timeout, e.LastStatus)
+}
+
+// Unwrap returns context.DeadlineExceeded.
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// checkcontext returns a *CanceledError if ctx is done.
+func checkcontext(ctx context.Context, op string) error {
+	err := ctx.Err()
+	if err != nil {
+		return &CanceledError{Op: op, Err: err}
+	}
+	return nil
+}
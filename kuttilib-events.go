@@ -0,0 +1,190 @@
+package kuttilib
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType identifies the kind of an Event.
+type EventType string
+
+// The Event* constants list the types of events published by
+// kuttilib.
+const (
+	// EventClusterCreated is published when a cluster is created.
+	EventClusterCreated EventType = "ClusterCreated"
+	// EventClusterCreateFailed is published when creating a cluster
+	// fails after validation.
+	EventClusterCreateFailed EventType = "ClusterCreateFailed"
+	// EventClusterDeleted is published when a cluster is deleted.
+	EventClusterDeleted EventType = "ClusterDeleted"
+	// EventClusterDeleteFailed is published when deleting a cluster
+	// fails.
+	EventClusterDeleteFailed EventType = "ClusterDeleteFailed"
+	// EventNodeCreated is published when a node is added to a
+	// cluster.
+	EventNodeCreated EventType = "NodeCreated"
+	// EventNodeCreateFailed is published when adding a node fails
+	// after validation.
+	EventNodeCreateFailed EventType = "NodeCreateFailed"
+	// EventNodeDeleted is published when a node is deleted.
+	EventNodeDeleted EventType = "NodeDeleted"
+	// EventNodeDeleteFailed is published when deleting a node's host
+	// or configuration fails.
+	EventNodeDeleteFailed EventType = "NodeDeleteFailed"
+	// EventNodeStarted is published when a node's host has been
+	// started.
+	EventNodeStarted EventType = "NodeStarted"
+	// EventNodeStartFailed is published when the driver fails to
+	// start a node's host.
+	EventNodeStartFailed EventType = "NodeStartFailed"
+	// EventNodeStopped is published when a node's host has been
+	// stopped.
+	EventNodeStopped EventType = "NodeStopped"
+	// EventNodeStopFailed is published when the driver fails to stop
+	// a node's host.
+	EventNodeStopFailed EventType = "NodeStopFailed"
+	// EventPortForwarded is published when a node port is forwarded
+	// to a host port.
+	EventPortForwarded EventType = "PortForwarded"
+	// EventPortUnforwarded is published when the forwarding of a node
+	// port is removed, including when its node is deleted.
+	EventPortUnforwarded EventType = "PortUnforwarded"
+)
+
+// Event describes a lifecycle change made by kuttilib.
+type Event struct {
+	// Type is the kind of the event.
+	Type EventType
+	// Time is when the event happened.
+	Time time.Time
+	// Cluster is the name of the cluster involved.
+	Cluster string
+	// Node is the name of the node involved, for node and port
+	// events.
+	Node string
+	// HostPort and NodePort are the ports involved, for port events.
+	HostPort int
+	NodePort int
+	// Err is the error that caused a failure event.
+	Err error
+}
+
+// subscriber delivers events to a handler, in order, on its own
+// goroutine, so that a slow handler does not hold up kuttilib or
+// other subscribers.
+type subscriber struct {
+	handler func(Event)
+
+	mu      sync.Mutex
+	queue   []Event
+	stopped bool
+	wake    chan struct{}
+}
+
+func (s *subscriber) enqueue(event Event) {
+	s.mu.Lock()
+	if !s.stopped {
+		s.queue = append(s.queue, event)
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) stop() {
+	s.mu.Lock()
+	s.stopped = true
+	s.queue = nil
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) run() {
+	for range s.wake {
+		for {
+			s.mu.Lock()
+			if s.stopped {
+				s.mu.Unlock()
+				return
+			}
+			if len(s.queue) == 0 {
+				s.mu.Unlock()
+				break
+			}
+			event := s.queue[0]
+			s.queue = s.queue[1:]
+			s.mu.Unlock()
+
+			s.handler(event)
+		}
+	}
+}
+
+var (
+	subscriberslock sync.RWMutex
+	subscribers     = map[*subscriber]bool{}
+)
+
+// Subscribe registers a handler to be called with every event
+// published by kuttilib in this process. Each handler is called on a
+// goroutine of its own, with events in the order in which they were
+// published. Events are queued, so handlers never hold up the
+// operations that publish them.
+//
+// Subscribe returns a function that unsubscribes the handler. Events
+// not yet delivered when it is called are discarded.
+func Subscribe(handler func(Event)) func() {
+	s := &subscriber{
+		handler: handler,
+		wake:    make(chan struct{}, 1),
+	}
+	go s.run()
+
+	subscriberslock.Lock()
+	subscribers[s] = true
+	subscriberslock.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			subscriberslock.Lock()
+			delete(subscribers, s)
+			subscriberslock.Unlock()
+
+			s.stop()
+		})
+	}
+}
+
+// publish sends an event to all subscribers. The event time is set
+// here.
+func publish(event Event) {
+	event.Time = time.Now()
+
+	subscriberslock.RLock()
+	defer subscriberslock.RUnlock()
+
+	for s := range subscribers {
+		s.enqueue(event)
+	}
+}
+
+// publishresult publishes event with the success type if err is nil,
+// or with the failure type and err otherwise.
+func publishresult(success EventType, failure EventType, event Event, err error) {
+	if err != nil {
+		event.Type = failure
+		event.Err = err
+	} else {
+		event.Type = success
+	}
+	publish(event)
+}
@@ -0,0 +1,29 @@
+//go:build aix || solaris
+
+package kuttilib
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// These platforms do not have flock, so fcntl record locks over the
+// whole file are used instead. Such locks are held per process, which
+// is enough since in-process serialization is done separately.
+
+func lockfileexclusive(f *os.File) error {
+	return fcntllock(f, syscall.F_WRLCK)
+}
+
+func unlockfile(f *os.File) error {
+	return fcntllock(f, syscall.F_UNLCK)
+}
+
+func fcntllock(f *os.File, locktype int16) error {
+	lock := syscall.Flock_t{
+		Type:   locktype,
+		Whence: io.SeekStart,
+	}
+	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLKW, &lock)
+}
@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !aix && !solaris && !windows
+
+package kuttilib
+
+import "os"
+
+// On platforms without file locking, only in-process
+// serialization is available.
+
+func lockfileexclusive(f *os.File) error {
+	return nil
+}
+
+func unlockfile(f *os.File) error {
+	return nil
+}
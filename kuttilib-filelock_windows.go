@@ -0,0 +1,32 @@
+//go:build windows
+
+package kuttilib
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+func lockfileexclusive(f *os.File) error {
+	var overlapped windows.Overlapped
+	return windows.LockFileEx(
+		windows.Handle(f.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK,
+		0,
+		1,
+		0,
+		&overlapped,
+	)
+}
+
+func unlockfile(f *os.File) error {
+	var overlapped windows.Overlapped
+	return windows.UnlockFileEx(
+		windows.Handle(f.Fd()),
+		0,
+		1,
+		0,
+		&overlapped,
+	)
+}
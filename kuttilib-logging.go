@@ -0,0 +1,89 @@
+package kuttilib
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/kuttiproject/kuttilog"
+)
+
+var (
+	loggerlock sync.RWMutex
+	logger     *slog.Logger
+)
+
+// SetLogger sets a structured logger for kuttilib messages. Messages
+// are logged at the slog level corresponding to their verbosity level,
+// as returned by VerbosityLevel.SlogLevel, with attributes identifying
+// the cluster, node, driver and operation involved, and for some
+// messages, the duration of the operation. Filtering by level is left
+// to the logger's handler; SetVerbosityLevel has no effect on it.
+//
+// If logger is nil, messages are printed using kuttilog, which is the
+// default.
+func SetLogger(l *slog.Logger) {
+	loggerlock.Lock()
+	defer loggerlock.Unlock()
+	logger = l
+}
+
+func currentlogger() *slog.Logger {
+	loggerlock.RLock()
+	defer loggerlock.RUnlock()
+	return logger
+}
+
+// logf logs a message at a verbosity level. The message is formatted
+// as with fmt.Printf. The fields are alternating keys and values, as
+// accepted by slog.Logger.Log, and are only used by a logger set with
+// SetLogger. Without one, the message is printed with kuttilog.Printf.
+func logf(level VerbosityLevel, fields []any, format string, v ...any) {
+	l := currentlogger()
+	if l == nil {
+		kuttilog.Printf(int(level), format, v...)
+		return
+	}
+
+	l.Log(context.Background(), level.SlogLevel(), fmt.Sprintf(format, v...), fields...)
+}
+
+// logprint logs a message as logf does, but without a logger set with
+// SetLogger, prints it with kuttilog.Print. No newline is added, so a
+// message logged next with logprintln follows on the same line.
+func logprint(level VerbosityLevel, fields []any, message string) {
+	logmessage(level, fields, message, kuttilog.Print)
+}
+
+// logprintln logs a message as logf does, but without a logger set
+// with SetLogger, prints it with kuttilog.Println.
+func logprintln(level VerbosityLevel, fields []any, message string) {
+	logmessage(level, fields, message, kuttilog.Println)
+}
+
+func logmessage(level VerbosityLevel, fields []any, message string, print func(int, ...interface{})) {
+	l := currentlogger()
+	if l == nil {
+		print(int(level), message)
+		return
+	}
+
+	l.Log(context.Background(), level.SlogLevel(), message, fields...)
+}
+
+// logfields returns the structured logging fields for an operation
+// on the cluster.
+func (c *Cluster) logfields(op string) []any {
+	return []any{"cluster", c.name, "driver", c.driverName, "operation", op}
+}
+
+// logfields returns the structured logging fields for an operation
+// on the node.
+func (n *Node) logfields(op string) []any {
+	result := []any{"cluster", n.clusterName, "node", n.name}
+	if c := n.Cluster(); c != nil {
+		result = append(result, "driver", c.driverName)
+	}
+	return append(result, "operation", op)
+}
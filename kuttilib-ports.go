@@ -0,0 +1,119 @@
+package kuttilib
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// PortRange is an inclusive range of host port numbers.
+type PortRange struct {
+	First int
+	Last  int
+}
+
+// defaulthostportrange is the range of host ports used by
+// AllocateHostPort when no ranges have been configured.
+var defaulthostportrange = PortRange{First: 10022, Last: 10999}
+
+// probehostport returns true if a host port is free on the OS.
+func probehostport(hostport int) bool {
+	listener, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(hostport)))
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
+
+// HostPortRanges returns the ranges of host ports from which
+// AllocateHostPort allocates ports in the current workspace.
+func HostPortRanges() []PortRange {
+	configlock.RLock()
+	defer configlock.RUnlock()
+
+	if len(config.HostPortRanges) == 0 {
+		return []PortRange{defaulthostportrange}
+	}
+
+	result := make([]PortRange, len(config.HostPortRanges))
+	copy(result, config.HostPortRanges)
+	return result
+}
+
+// SetHostPortRanges sets the ranges of host ports from which
+// AllocateHostPort allocates ports in the current workspace. Ranges
+// are tried in the order given. If ranges is empty, the default
+// range of 10022-10999 is restored. The ranges are saved in the workspace.
+func SetHostPortRanges(ranges []PortRange) error {
+	for _, portrange := range ranges {
+		if !ValidPort(portrange.First) || !ValidPort(portrange.Last) || portrange.First > portrange.Last {
+			return fmt.Errorf("%w: %v-%v", ErrPortRangeInvalid, portrange.First, portrange.Last)
+		}
+	}
+
+	saved := make([]PortRange, len(ranges))
+	copy(saved, ranges)
+
+	return clusterconfigmanager.Update(func() error {
+		configlock.Lock()
+		defer configlock.Unlock()
+
+		if len(saved) == 0 {
+			config.HostPortRanges = nil
+		} else {
+			config.HostPortRanges = saved
+		}
+		return nil
+	})
+}
+
+// AllocateHostPort returns the first host port in the configured
+// ranges which is not mapped by any node of any cluster in the
+// current workspace, and is not in use by any other process. The
+// port is not reserved, so it should be forwarded promptly. If no
+// port is free, ErrNoFreeHostPort is returned.
+func AllocateHostPort() (int, error) {
+	used := usedhostports()
+	for _, portrange := range HostPortRanges() {
+		for hostport := portrange.First; hostport <= portrange.Last; hostport++ {
+			if !used[hostport] && probehostport(hostport) {
+				return hostport, nil
+			}
+		}
+	}
+	return 0, ErrNoFreeHostPort
+}
+
+// CheckWorkspaceHostPort returns an error if a host port is mapped by
+// any node of any cluster in the current workspace, or is in use by
+// another process. Unlike Cluster.CheckHostPort, it checks across
+// clusters, and with the OS.
+func CheckWorkspaceHostPort(hostport int) error {
+	if usedhostports()[hostport] {
+		return &PortError{HostPort: hostport, Err: ErrPortHostPortAlreadyUsed}
+	}
+
+	if !probehostport(hostport) {
+		return &PortError{HostPort: hostport, Err: ErrPortHostPortUnavailable}
+	}
+
+	return nil
+}
+
+// usedhostports returns the host ports mapped by all nodes of all
+// clusters.
+func usedhostports() map[int]bool {
+	configlock.RLock()
+	defer configlock.RUnlock()
+
+	result := map[int]bool{}
+	for _, cluster := range config.Clusters {
+		for _, node := range cluster.nodes {
+			for _, hostport := range node.ports {
+				result[hostport] = true
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,432 @@
+package kuttilib
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kuttiproject/drivercore"
+)
+
+// The Discrepancy* constants list the kinds of differences between
+// the cluster configuration and driver state that Reconcile and
+// Cluster.Check can find.
+const (
+	// DiscrepancyMissingHost is a node whose driver machine does
+	// not exist, as reported by a driver which implements
+	// MachineNotFoundReporter. Repair removes the node from the
+	// configuration.
+	DiscrepancyMissingHost = "MissingHost"
+	// DiscrepancyHostUnavailable is a node whose driver machine could
+	// not be looked up, for a reason other than it not existing. It is
+	// never repaired, since the machine may still exist.
+	DiscrepancyHostUnavailable = "HostUnavailable"
+	// DiscrepancyOrphanedMachine is a driver machine created by the
+	// workspace which does not belong to any configured node. Repair
+	// deletes the machine.
+	DiscrepancyOrphanedMachine = "OrphanedMachine"
+	// DiscrepancyStalePortMapping is a port mapping recorded in
+	// the configuration but not in the driver, or vice versa.
+	// Repair makes the driver match the configuration.
+	DiscrepancyStalePortMapping = "StalePortMapping"
+	// DiscrepancyMissingNetwork is a cluster whose driver network
+	// does not exist. Repair creates the network.
+	DiscrepancyMissingNetwork = "MissingNetwork"
+	// DiscrepancyOrphanedNetwork is a driver network created by the
+	// workspace for a cluster which is no longer configured. Repair
+	// deletes the network.
+	DiscrepancyOrphanedNetwork = "OrphanedNetwork"
+)
+
+// Discrepancy describes one difference between the cluster
+// configuration and driver state.
+type Discrepancy struct {
+	// Kind is one of the Discrepancy* constants.
+	Kind string
+	// Driver is the name of the driver involved.
+	Driver string
+	// Cluster is the name of the cluster involved, if known.
+	Cluster string
+	// Node is the name of the node involved, if known.
+	Node string
+	// Name is the driver's name for an orphaned machine or network.
+	Name string
+	// HostPort and NodePort identify a stale port mapping.
+	HostPort int
+	NodePort int
+	// Detail provides more information, if available.
+	Detail string
+	// Repaired is true if the discrepancy was repaired.
+	Repaired bool
+	// Err is the error encountered while repairing, if any.
+	Err error
+}
+
+// ReconcileOptions select the kinds of discrepancies to repair. If
+// no repairs are selected, discrepancies are only reported.
+type ReconcileOptions struct {
+	RemoveMissingHosts     bool
+	DeleteOrphanedMachines bool
+	RepairPortMappings     bool
+	CreateMissingNetworks  bool
+	DeleteOrphanedNetworks bool
+}
+
+// ReconcileReport lists the discrepancies found by Reconcile or
+// Cluster.Check.
+type ReconcileReport struct {
+	Discrepancies []Discrepancy
+}
+
+// OfKind returns the discrepancies of the specified kind.
+func (r *ReconcileReport) OfKind(kind string) []Discrepancy {
+	result := []Discrepancy{}
+	for _, discrepancy := range r.Discrepancies {
+		if discrepancy.Kind == kind {
+			result = append(result, discrepancy)
+		}
+	}
+	return result
+}
+
+// Err returns an error joining all repair errors, or nil.
+func (r *ReconcileReport) Err() error {
+	errs := []error{}
+	for _, discrepancy := range r.Discrepancies {
+		if discrepancy.Err != nil {
+			errs = append(errs, discrepancy.Err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *ReconcileReport) add(discrepancy Discrepancy) {
+	r.Discrepancies = append(r.Discrepancies, discrepancy)
+}
+
+// MachinePortLister is implemented by the machines of drivers that can
+// report their forwarded ports, as a map of machine port to host port.
+// Cluster.Check and Reconcile can only detect stale port mappings for
+// such machines. For others, no DiscrepancyStalePortMapping is
+// reported.
+type MachinePortLister interface {
+	ForwardedPorts() (map[int]int, error)
+}
+
+// MachineNotFoundReporter is implemented by drivers that can tell
+// whether an error returned by GetMachine means that the machine does
+// not exist, rather than that the driver could not find out.
+// Cluster.Check and Reconcile only report a node as
+// DiscrepancyMissingHost, and remove it, if its driver implements this
+// and says so. Other errors are reported as DiscrepancyHostUnavailable.
+type MachineNotFoundReporter interface {
+	IsMachineNotFound(err error) bool
+}
+
+// Check compares the cluster's configuration with the state reported
+// by its driver, and reports missing or unavailable hosts, stale port
+// mappings and a missing network. Discrepancies of the kinds selected in opts are
+// repaired. Orphaned machines and networks can only be found across
+// the workspace, by Reconcile.
+func (c *Cluster) Check(opts ReconcileOptions) (*ReconcileReport, error) {
+	report := &ReconcileReport{Discrepancies: []Discrepancy{}}
+
+	err := c.ensuredriver()
+	if err != nil {
+		return report, err
+	}
+
+	if c.driver.UsesPerClusterNetworking() {
+		c.checknetwork(report, opts)
+	}
+
+	for _, node := range c.Nodes() {
+		c.checknode(node, report, opts)
+	}
+
+	return report, report.Err()
+}
+
+func (c *Cluster) checknetwork(report *ReconcileReport, opts ReconcileOptions) {
+	_, err := c.driver.GetNetwork(c.name)
+	if err == nil {
+		return
+	}
+
+	discrepancy := Discrepancy{
+		Kind:    DiscrepancyMissingNetwork,
+		Driver:  c.driverName,
+		Cluster: c.name,
+		Detail:  err.Error(),
+	}
+
+	if opts.CreateMissingNetworks {
+		logf(VerbosityInfo, c.logfields("reconcile"), "Creating missing network for cluster %s...", c.name)
+		discrepancy.Err = recordartifact(c.driverName, c.name, "")
+		if discrepancy.Err == nil {
+			discrepancy.Err = c.createnetwork()
+		}
+		if discrepancy.Err == nil {
+			confirmartifact(c.driverName, c.name, "")
+		}
+		discrepancy.Repaired = discrepancy.Err == nil
+	}
+
+	report.add(discrepancy)
+}
+
+// machinenotfound returns true if err, returned by the GetMachine
+// method of driver, means that the machine does not exist.
+func machinenotfound(driver drivercore.Driver, err error) bool {
+	reporter, ok := driver.(MachineNotFoundReporter)
+	return ok && reporter.IsMachineNotFound(err)
+}
+
+func (c *Cluster) checknode(node *Node, report *ReconcileReport, opts ReconcileOptions) {
+	host, err := c.driver.GetMachine(node.name, c.name)
+	if err != nil && !machinenotfound(c.driver, err) {
+		report.add(Discrepancy{
+			Kind:    DiscrepancyHostUnavailable,
+			Driver:  c.driverName,
+			Cluster: c.name,
+			Node:    node.name,
+			Detail:  err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		discrepancy := Discrepancy{
+			Kind:    DiscrepancyMissingHost,
+			Driver:  c.driverName,
+			Cluster: c.name,
+			Node:    node.name,
+			Detail:  err.Error(),
+		}
+
+		if opts.RemoveMissingHosts {
+			logf(VerbosityInfo, node.logfields("reconcile"), "Removing node %s, whose host is missing...", node.name)
+			discrepancy.Err = node.wraperror("remove", c.deletenodeentry(node.name))
+			discrepancy.Repaired = discrepancy.Err == nil
+		}
+
+		report.add(discrepancy)
+		return
+	}
+
+	lister, ok := host.(MachinePortLister)
+	if !ok || !c.driver.UsesNATNetworking() {
+		return
+	}
+
+	driverports, err := lister.ForwardedPorts()
+	if err != nil {
+		return
+	}
+
+	configports := node.Ports()
+	for nodeport, hostport := range configports {
+		driverhostport, mapped := driverports[nodeport]
+		if mapped && driverhostport == hostport {
+			continue
+		}
+
+		discrepancy := Discrepancy{
+			Kind:     DiscrepancyStalePortMapping,
+			Driver:   c.driverName,
+			Cluster:  c.name,
+			Node:     node.name,
+			HostPort: hostport,
+			NodePort: nodeport,
+			Detail:   "mapping not present in driver",
+		}
+		if mapped {
+			discrepancy.Detail = fmt.Sprintf("driver maps node port to host port %v", driverhostport)
+		}
+
+		if opts.RepairPortMappings {
+			var err error
+			if mapped {
+				err = host.UnforwardPort(nodeport)
+			}
+			if err == nil {
+				err = host.ForwardPort(hostport, nodeport)
+			}
+			if err != nil {
+				discrepancy.Err = node.porterror("repair port", hostport, nodeport, err)
+			}
+			discrepancy.Repaired = discrepancy.Err == nil
+		}
+
+		report.add(discrepancy)
+	}
+
+	for nodeport, hostport := range driverports {
+		if _, ok := configports[nodeport]; ok {
+			continue
+		}
+
+		discrepancy := Discrepancy{
+			Kind:     DiscrepancyStalePortMapping,
+			Driver:   c.driverName,
+			Cluster:  c.name,
+			Node:     node.name,
+			HostPort: hostport,
+			NodePort: nodeport,
+			Detail:   "mapping not present in configuration",
+		}
+
+		if opts.RepairPortMappings {
+			err := host.UnforwardPort(nodeport)
+			if err != nil {
+				discrepancy.Err = node.porterror("repair port", hostport, nodeport, err)
+			}
+			discrepancy.Repaired = discrepancy.Err == nil
+		}
+
+		report.add(discrepancy)
+	}
+}
+
+// Reconcile compares the configuration of all clusters in the current
+// workspace with the state reported by all available drivers. In
+// addition to the discrepancies reported by Cluster.Check, it reports
+// driver machines and networks created by the workspace which do not
+// belong to any configured node or cluster, for example because a
+// deletion failed, or the configuration was lost. Discrepancies of
+// the kinds selected in opts are repaired.
+//
+// Drivers are shared by all workspaces, so kuttilib records every
+// machine and network it creates in the workspace, and only those are
+// reported as orphaned. Machines and networks of other workspaces, or
+// created by other tools, are never reported.
+func Reconcile(opts ReconcileOptions) (*ReconcileReport, error) {
+	report := &ReconcileReport{Discrepancies: []Discrepancy{}}
+	errs := []error{}
+
+	for _, cluster := range Clusters() {
+		clusterreport, err := cluster.Check(opts)
+		report.Discrepancies = append(report.Discrepancies, clusterreport.Discrepancies...)
+		if err != nil && clusterreport.Err() == nil {
+			errs = append(errs, err)
+		}
+	}
+
+	artifacts, err := listartifacts()
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		for _, driver := range Drivers() {
+			findorphans(driver.vmdriver, artifacts, report, opts)
+		}
+	}
+
+	errs = append(errs, report.Err())
+	return report, errors.Join(errs...)
+}
+
+// findorphans reports the recorded artifacts of a driver which the
+// driver still has, but which do not belong to any configured node or
+// cluster. Records of artifacts which the driver no longer has are
+// forgotten, once they are old enough not to be still in creation.
+func findorphans(driver drivercore.Driver, artifacts []artifactrecord, report *ReconcileReport, opts ReconcileOptions) {
+	machinenames := map[string]bool{}
+	if machines, err := driver.ListMachines(); err == nil {
+		for _, machine := range machines {
+			machinenames[machine.Name()] = true
+		}
+	}
+
+	networknames := map[string]bool{}
+	if driver.UsesPerClusterNetworking() {
+		if networks, err := driver.ListNetworks(); err == nil {
+			for _, network := range networks {
+				networknames[network.Name()] = true
+			}
+		}
+	}
+
+	forgotten := []artifactrecord{}
+	for _, artifact := range artifacts {
+		if artifact.Driver != driver.Name() || artifactconfigured(artifact) {
+			continue
+		}
+
+		var name string
+		if artifact.Node != "" {
+			machine, err := driver.GetMachine(artifact.Node, artifact.Cluster)
+			if err == nil && machinenames[machine.Name()] {
+				name = machine.Name()
+			}
+		} else if driver.UsesPerClusterNetworking() {
+			network, err := driver.GetNetwork(artifact.Cluster)
+			if err == nil && networknames[network.Name()] {
+				name = network.Name()
+			}
+		}
+
+		if name == "" {
+			if time.Since(artifact.RecordedAt) > artifactgraceperiod {
+				forgotten = append(forgotten, artifact)
+			}
+			continue
+		}
+
+		// The node or cluster may be about to be added by another
+		// process.
+		if artifact.increation() {
+			continue
+		}
+
+		discrepancy := Discrepancy{
+			Kind:    DiscrepancyOrphanedMachine,
+			Driver:  driver.Name(),
+			Cluster: artifact.Cluster,
+			Node:    artifact.Node,
+			Name:    name,
+		}
+		if artifact.Node == "" {
+			discrepancy.Kind = DiscrepancyOrphanedNetwork
+		}
+
+		if artifact.Node != "" && opts.DeleteOrphanedMachines {
+			logf(VerbosityInfo, []any{"cluster", artifact.Cluster, "node", artifact.Node, "driver", driver.Name(), "operation", "reconcile"}, "Deleting orphaned machine %s...", name)
+			discrepancy.Err = driver.DeleteMachine(artifact.Node, artifact.Cluster)
+			discrepancy.Repaired = discrepancy.Err == nil
+		}
+		if artifact.Node == "" && opts.DeleteOrphanedNetworks {
+			logf(VerbosityInfo, []any{"cluster", artifact.Cluster, "driver", driver.Name(), "operation", "reconcile"}, "Deleting orphaned network %s...", name)
+			discrepancy.Err = driver.DeleteNetwork(artifact.Cluster)
+			discrepancy.Repaired = discrepancy.Err == nil
+		}
+		if discrepancy.Repaired {
+			forgotten = append(forgotten, artifact)
+		}
+
+		report.add(discrepancy)
+	}
+
+	if len(forgotten) > 0 {
+		forgetartifacts(forgotten...)
+	}
+}
+
+// artifactconfigured returns true if a recorded artifact belongs to a
+// configured cluster or node, or to a node being added by this process.
+func artifactconfigured(artifact artifactrecord) bool {
+	cluster, ok := GetCluster(artifact.Cluster)
+	if !ok || cluster.driverName != artifact.Driver {
+		return false
+	}
+
+	if artifact.Node == "" {
+		return true
+	}
+
+	if _, ok := cluster.GetNode(artifact.Node); ok {
+		return true
+	}
+
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	return cluster.addingnodes[artifact.Node]
+}
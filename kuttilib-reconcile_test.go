@@ -0,0 +1,13 @@
+package kuttilib_test
+
+import "github.com/kuttiproject/drivercore/drivercoretest/drivermock"
+
+// notfounddriver is a mock driver which reports that machines it
+// cannot get do not exist.
+type notfounddriver struct {
+	*drivermock.MockDriver
+}
+
+func (d *notfounddriver) IsMachineNotFound(err error) bool {
+	return err != nil
+}
@@ -0,0 +1,270 @@
+package kuttilib
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kuttiproject/workspace"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// sshkeycomment is the comment attached to the workspace key.
+	sshkeycomment = "kuttilib"
+	// ssholdkeysuffix is appended to the workspace key file name to
+	// name the key it replaced when it was last rotated.
+	ssholdkeysuffix = ".old"
+)
+
+// sshkey is an ed25519 key pair used to connect to nodes.
+type sshkey struct {
+	signer ssh.Signer
+	// data is the private key in OpenSSH format.
+	data []byte
+}
+
+// publicbody returns the base64 encoded public key, as it appears in
+// an authorized_keys file.
+func (k *sshkey) publicbody() string {
+	return base64.StdEncoding.EncodeToString(k.signer.PublicKey().Marshal())
+}
+
+// authorizedkey returns the public key as a line of an
+// authorized_keys file.
+func (k *sshkey) authorizedkey() string {
+	return k.signer.PublicKey().Type() + " " + k.publicbody() + " " + sshkeycomment
+}
+
+// fingerprint returns the SHA256 fingerprint of the public key, in
+// the format used by ssh-keygen.
+func (k *sshkey) fingerprint() string {
+	return ssh.FingerprintSHA256(k.signer.PublicKey())
+}
+
+// parsesshkey parses an unencrypted ed25519 private key in the
+// OpenSSH private key format.
+func parsesshkey(data []byte) (*sshkey, error) {
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrSSHKeyInvalid, err)
+	}
+	if keytype := signer.PublicKey().Type(); keytype != ssh.KeyAlgoED25519 {
+		return nil, fmt.Errorf("%w: only %s keys are supported, not %s", ErrSSHKeyInvalid, ssh.KeyAlgoED25519, keytype)
+	}
+
+	return &sshkey{signer: signer, data: data}, nil
+}
+
+// sshkeypath returns the path of the workspace SSH private key file,
+// whether it exists or not.
+func sshkeypath() (string, error) {
+	configdir, err := workspace.ConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configdir, sshkeyfilename), nil
+}
+
+// loadsshkey reads a private key file. If the file does not exist,
+// ErrNoSSHKey is returned.
+func loadsshkey(filename string) (*sshkey, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoSSHKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parsesshkey(data)
+}
+
+// writesshkey writes a private key file, readable only by the current
+// user, and a public key file with the same name and a .pub suffix.
+func writesshkey(filename string, key *sshkey) error {
+	err := writefileatomic(filename, key.data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return writefileatomic(filename+".pub", []byte(key.authorizedkey()+"\n"), 0644)
+}
+
+func generatesshkey() (*sshkey, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := ssh.MarshalPrivateKey(private, sshkeycomment)
+	if err != nil {
+		return nil, err
+	}
+	return parsesshkey(pem.EncodeToMemory(block))
+}
+
+// workspacesshkey returns the workspace SSH key, or ErrNoSSHKey.
+func workspacesshkey() (*sshkey, error) {
+	filename, err := sshkeypath()
+	if err != nil {
+		return nil, err
+	}
+	return loadsshkey(filename)
+}
+
+// oldsshkey returns the workspace SSH key that was replaced when the
+// key was last rotated, or nil.
+func oldsshkey() *sshkey {
+	filename, err := sshkeypath()
+	if err != nil {
+		return nil
+	}
+
+	key, err := loadsshkey(filename + ssholdkeysuffix)
+	if err != nil {
+		return nil
+	}
+	return key
+}
+
+// EnsureSSHKey generates an ed25519 SSH key pair for the current
+// workspace, if it does not have one already, and returns the public
+// key in authorized_keys format.
+//
+// The private key is stored in OpenSSH format in the workspace
+// configuration directory, and is used for all SSH connections to
+// nodes. Once the workspace has a key, the public key is added to
+// each node's authorized keys when the node is created, and the first
+// time a node that does not have it yet is used over SSH.
+func EnsureSSHKey() (string, error) {
+	var result string
+	err := clusterconfigmanager.withlock(func() error {
+		key, err := workspacesshkey()
+		if errors.Is(err, ErrNoSSHKey) {
+			key, err = generatesshkey()
+			if err != nil {
+				return err
+			}
+
+			var filename string
+			filename, err = sshkeypath()
+			if err == nil {
+				err = writesshkey(filename, key)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		result = key.authorizedkey()
+		return nil
+	})
+	return result, err
+}
+
+// SSHPublicKey returns the public key of the workspace SSH key pair
+// in authorized_keys format. If the workspace does not have a key,
+// ErrNoSSHKey is returned.
+func SSHPublicKey() (string, error) {
+	key, err := workspacesshkey()
+	if err != nil {
+		return "", err
+	}
+	return key.authorizedkey(), nil
+}
+
+// RotateSSHKey replaces the workspace SSH key pair with a newly
+// generated one, and then replaces the old public key with the new
+// one on all running nodes of all clusters. The result contains a
+// BulkResult for each cluster, keyed by cluster name.
+//
+// Stopped nodes are skipped. They are updated the first time they are
+// used over SSH after being started, as long as the key is not rotated
+// again before that: the replaced key is kept, and used to connect to
+// nodes which have not been updated.
+// If the workspace does not have a key, ErrNoSSHKey is returned.
+func RotateSSHKey(ctx context.Context, opts BulkOptions) (map[string]*BulkResult, error) {
+	err := checkcontext(ctx, "rotate SSH key")
+	if err != nil {
+		return nil, err
+	}
+
+	err = clusterconfigmanager.withlock(func() error {
+		filename, err := sshkeypath()
+		if err != nil {
+			return err
+		}
+
+		oldkey, err := loadsshkey(filename)
+		if err != nil {
+			return err
+		}
+
+		newkey, err := generatesshkey()
+		if err != nil {
+			return err
+		}
+
+		err = writesshkey(filename+ssholdkeysuffix, oldkey)
+		if err != nil {
+			return err
+		}
+		return writesshkey(filename, newkey)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]*BulkResult{}
+	errs := []error{}
+	for _, cluster := range Clusters() {
+		clusterresult, err := cluster.bulkoperation(ctx, "rotate SSH key", opts, true, func(ctx context.Context, n *Node) (bool, error) {
+			if n.Status() != NodeStatusRunning {
+				return true, nil
+			}
+			return false, n.InjectSSHKeyContext(ctx)
+		})
+		result[cluster.Name()] = clusterresult
+		errs = append(errs, err)
+	}
+
+	return result, errors.Join(errs...)
+}
+
+// authorizedkeyscommand returns a shell command which adds key to the
+// authorized keys of the SSH user on a node, and removes oldkey from
+// them if it is not nil. The home directory of the user is looked up
+// with getent, rather than by expanding ~USER, so that the user name
+// is never interpreted by the shell.
+func authorizedkeyscommand(key *sshkey, oldkey *sshkey) string {
+	dir := `"$home/.ssh"`
+	file := `"$home/.ssh/authorized_keys"`
+
+	commands := []string{
+		"home=$(getent passwd " + shellquote(SSHUser()) + " | cut -d: -f6)",
+		`[ -n "$home" ]`,
+		"mkdir -p " + dir,
+		"chmod 700 " + dir,
+		"touch " + file,
+		"chmod 600 " + file,
+	}
+	if oldkey != nil && oldkey.publicbody() != key.publicbody() {
+		commands = append(commands, fmt.Sprintf(
+			"{ grep -v -F %s %s > %s.new; mv %s.new %s; }",
+			shellquote(oldkey.publicbody()), file, file, file, file,
+		))
+	}
+	commands = append(commands, fmt.Sprintf(
+		"{ grep -q -F %s %s || echo %s >> %s; }",
+		shellquote(key.publicbody()), file, shellquote(key.authorizedkey()), file,
+	))
+
+	return strings.Join(commands, " && ")
+}
@@ -0,0 +1,153 @@
+package kuttilib
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+// The Artifact* constants list the kinds of driver artifacts that
+// kuttilib creates for clusters and nodes.
+const (
+	ArtifactMachine     = "Machine"
+	ArtifactNetwork     = "Network"
+	ArtifactPortForward = "PortForward"
+)
+
+// LeftoverArtifact describes a driver artifact that could not be
+// cleaned up, and may need manual attention.
+type LeftoverArtifact struct {
+	// Kind is one of the Artifact* constants.
+	Kind string
+	// Cluster is the name of the cluster the artifact belonged to.
+	Cluster string
+	// Node is the name of the node the artifact belonged to, if any.
+	Node string
+	// Detail provides more information, if available.
+	Detail string
+}
+
+// CascadeOptions control a cascading cluster delete.
+type CascadeOptions struct {
+	// ContinueOnError causes the teardown to continue past failures
+	// to delete individual nodes or the cluster network. Artifacts
+	// left behind are listed in the TeardownReport.
+	ContinueOnError bool
+}
+
+// TeardownReport reports the outcome of a cascading cluster delete.
+type TeardownReport struct {
+	// Cluster is the name of the cluster.
+	Cluster string
+	// Nodes contains one NodeResult per node, in the order in
+	// which the nodes were deleted.
+	Nodes []NodeResult
+	// ClusterDeleted is true if the cluster itself was deleted.
+	ClusterDeleted bool
+	// Leftovers lists driver artifacts that remain after the
+	// teardown.
+	Leftovers []LeftoverArtifact
+}
+
+// DeleteClusterCascade deletes a cluster along with all its nodes.
+//
+// Each node is forcibly stopped and deleted as DeleteNodeContext does,
+// worker nodes before control plane nodes, and its forwarded ports are
+// unmapped. Then the cluster's network, if any, and the cluster itself
+// are deleted. By default, the teardown stops at the first failure.
+// If opts.ContinueOnError is set, it continues past failures, but the
+// cluster is only deleted if all its nodes could be deleted.
+//
+// The returned report lists driver artifacts that were left behind,
+// such as machines, networks or port forwards that the driver failed
+// to remove.
+func DeleteClusterCascade(ctx context.Context, clustername string, opts CascadeOptions) (*TeardownReport, error) {
+	cluster, ok := GetCluster(clustername)
+	if !ok {
+		return nil, ErrClusterDoesNotExist
+	}
+
+	report := &TeardownReport{
+		Cluster:   clustername,
+		Nodes:     []NodeResult{},
+		Leftovers: []LeftoverArtifact{},
+	}
+
+	nodes := cluster.Nodes()
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return startrank(nodes[i].nodetype) > startrank(nodes[j].nodetype)
+	})
+
+	var errs []error
+	for _, node := range nodes {
+		logf(VerbosityInfo, node.logfields("delete"), "Deleting node %s...", node.name)
+		start := time.Now()
+		leftovers, err := cluster.deletenodecontext(ctx, node.name, true)
+		report.Nodes = append(report.Nodes, NodeResult{Node: node.name, Err: err})
+		report.Leftovers = append(report.Leftovers, leftovers...)
+
+		if err != nil {
+			errs = append(errs, err)
+
+			var cancelerr *CanceledError
+			if !opts.ContinueOnError || errors.As(err, &cancelerr) {
+				break
+			}
+			continue
+		}
+		logf(VerbosityInfo, append(node.logfields("delete"), "duration", time.Since(start)), "Node %s deleted.", node.name)
+	}
+
+	if len(errs) == 0 {
+		err := deletecluster(ctx, clustername, opts.ContinueOnError)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			report.ClusterDeleted = true
+		}
+	}
+
+	report.Leftovers = append(report.Leftovers, cluster.remainingartifacts(nodes)...)
+
+	return report, errors.Join(errs...)
+}
+
+// remainingartifacts asks the driver for machines of the specified
+// nodes, and for the cluster network, and returns any that still
+// exist. Nodes that are still part of the cluster are not checked.
+func (c *Cluster) remainingartifacts(nodes []*Node) []LeftoverArtifact {
+	result := []LeftoverArtifact{}
+
+	err := c.ensuredriver()
+	if err != nil {
+		return result
+	}
+
+	for _, node := range nodes {
+		if _, ok := c.GetNode(node.name); ok {
+			continue
+		}
+
+		_, err := c.driver.GetMachine(node.name, c.name)
+		if err == nil {
+			result = append(result, LeftoverArtifact{
+				Kind:    ArtifactMachine,
+				Cluster: c.name,
+				Node:    node.name,
+			})
+		}
+	}
+
+	if _, ok := GetCluster(c.name); !ok && c.driver.UsesPerClusterNetworking() {
+		_, err := c.driver.GetNetwork(c.name)
+		if err == nil {
+			result = append(result, LeftoverArtifact{
+				Kind:    ArtifactNetwork,
+				Cluster: c.name,
+			})
+		}
+	}
+
+	return result
+}
@@ -1,6 +1,10 @@
 package kuttilib
 
-import "github.com/kuttiproject/kuttilog"
+import (
+	"log/slog"
+
+	"github.com/kuttiproject/kuttilog"
+)
 
 // VerbosityLevel represents the level of detail in logs.
 type VerbosityLevel int
@@ -19,3 +23,18 @@ const (
 func SetVerbosityLevel(level VerbosityLevel) {
 	kuttilog.SetLogLevel(int(level))
 }
+
+// SlogLevel returns the slog level at which messages of this verbosity
+// level are logged by a logger set with SetLogger: VerbosityQuiet maps
+// to slog.LevelWarn, VerbosityInfo to slog.LevelInfo, and
+// VerbosityDebug to slog.LevelDebug.
+func (level VerbosityLevel) SlogLevel() slog.Level {
+	switch {
+	case level <= VerbosityQuiet:
+		return slog.LevelWarn
+	case level == VerbosityInfo:
+		return slog.LevelInfo
+	default:
+		return slog.LevelDebug
+	}
+}
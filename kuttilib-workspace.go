@@ -5,18 +5,35 @@ import "github.com/kuttiproject/workspace"
 // SetWorkspace sets the kutti workspace to the path specified.
 // Config and Cache directories are set as subdirectories under the specified path,
 // called kutti-config and kutti-cache respectively.
+//
+// If the workspace configuration was written by a newer version of
+// kuttilib, with a schema version this version does not support, an
+// error wrapping ErrConfigSchemaTooNew is returned, and every later
+// change to the configuration, the workspace SSH key or other
+// workspace files fails with the same error.
+//
+// Unlike the rest of the API, SetWorkspace is not safe for concurrent
+// use. It should be called before any other operations.
 func SetWorkspace(workspacepath string) error {
 	err := workspace.Set(workspacepath)
-	if err == nil {
-		setworkspaceconfigmanager()
+	if err != nil {
+		return err
 	}
-	return err
+	return setworkspaceconfigmanager()
 }
 
 // ResetWorkspace resets the kutti workspace to the default location.
 // Config and Cache directories are set as subdirectories called kutti
 // under the current user's config and cache locations respectively.
+//
+// Like SetWorkspace, ResetWorkspace is not safe for concurrent use.
+// If the configuration of the default workspace has a newer schema
+// version than this version of kuttilib supports, every change to the
+// configuration, the workspace SSH key or other workspace files fails
+// with an error wrapping ErrConfigSchemaTooNew.
 func ResetWorkspace() {
 	workspace.Reset()
-	setworkspaceconfigmanager()
+	// The error is kept by the configuration manager, and returned
+	// by every change to the workspace.
+	_ = setworkspaceconfigmanager()
 }
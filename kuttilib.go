@@ -23,13 +23,13 @@ func ValidPort(portnumber int) bool {
 // a cluster with that name already exists.
 func ValidateClusterName(name string) error {
 	if !ValidName(name) {
-		return errInvalidName
+		return ErrInvalidName
 	}
 
 	// Check if name exists
-	_, ok := config.Clusters[name]
+	_, ok := GetCluster(name)
 	if ok {
-		return errClusterExists
+		return ErrClusterExists
 	}
 
 	return nil
@@ -1,30 +1,185 @@
 package kuttilib_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/kuttiproject/drivercore"
 	"github.com/kuttiproject/drivercore/drivercoretest/drivermock"
 	"github.com/kuttiproject/kuttilib"
 	"github.com/kuttiproject/workspace"
+	"golang.org/x/crypto/ssh"
+	"sigs.k8s.io/yaml"
 )
 
 const (
 	NEWCLUSTER1NAME = "zintakova"
 	K8SVERSION1     = "1.23"
+	K8SVERSION2     = "1.24"
+	K8SVERSION3     = "1.26"
 	DRIVER1         = "mock1"
+	DRIVER2         = "mock2"
+	DRIVER3         = "mock3"
+	DRIVER4         = "mock4"
 	NEWNODE1NAME    = "node1"
 	NEWNODE2NAME    = "node2"
 	HOSTPORT1       = 10022
 	HOSTPORT2       = 20022
+
+	MANAGEDCLUSTERNAME    = "kubeadm1"
+	CONTROLPLANENAME      = "control1"
+	WORKERNAME            = "worker1"
+	CONTEXTCLUSTERNAME    = "context1"
+	ERRORSCLUSTERNAME     = "errors1"
+	PROCESSCLUSTER1       = "process1"
+	PROCESSCLUSTER2       = "process2"
+	PROCESSCLUSTER3       = "process3"
+	HAMMERCLUSTERNAME     = "hammer1"
+	HAMMERWORKERS         = 4
+	BULKCLUSTERNAME       = "bulk1"
+	CASCADECLUSTERNAME    = "cascade1"
+	RECONCILECLUSTERNAME  = "reconcile1"
+	ORPHANNODENAME        = "ghost"
+	INFLIGHTNODENAME      = "inflight"
+	SIZEDCLUSTERNAME      = "sized1"
+	SPECCLUSTERNAME       = "spec1"
+	PLANCLUSTERNAME       = "plan1"
+	KUBECONFIGCLUSTERNAME = "kconfig1"
+	APISERVERHOSTPORT     = 16443
+	TESTADMINCONF         = `{
+		"apiVersion": "v1",
+		"kind": "Config",
+		"clusters": [{"name": "kubernetes", "cluster": {"server": "https://10.0.0.2:6443", "certificate-authority-data": "Q0E="}}],
+		"contexts": [{"name": "kubernetes-admin@kubernetes", "context": {"cluster": "kubernetes", "user": "kubernetes-admin"}}],
+		"users": [{"name": "kubernetes-admin", "user": {"client-certificate-data": "Q0VSVA==", "client-key-data": "S0VZ"}}],
+		"current-context": "kubernetes-admin@kubernetes"
+	}`
+	AUTOFORWARDCLUSTERNAME = "auto1"
+	PORTSCLUSTER1          = "ports1"
+	PORTSCLUSTER2          = "ports2"
+	EXECCLUSTERNAME        = "exec1"
+	SSHKEYCLUSTERNAME      = "sshkey1"
+	HEALTHCLUSTERNAME      = "health1"
+	TESTNODELIST           = `{"items": [
+		{"metadata": {"name": "node1"}, "status": {"conditions": [
+			{"type": "DiskPressure", "status": "False"},
+			{"type": "Ready", "status": "True"}]}},
+		{"metadata": {"name": "node2"}, "status": {"conditions": [
+			{"type": "DiskPressure", "status": "False"},
+			{"type": "Ready", "status": "False", "reason": "KubeletNotReady"}]}}
+	]}`
+	WAITCLUSTERNAME    = "wait1"
+	EVENTSCLUSTERNAME  = "events1"
+	LOGGERCLUSTERNAME  = "logger1"
+	EXPORTCLUSTERNAME  = "export1"
+	IMPORTCLUSTERNAME  = "import1"
+	IMPORTCLUSTER2NAME = "import2"
+	SNAPSHOTCLUSTER1   = "snap1"
+	SNAPSHOTCLUSTER2   = "snap2"
+	CLONESOURCENAME    = "source1"
+	CLONECLUSTER1      = "clone1"
+	CLONECLUSTER2      = "clone2"
+	UPGRADECLUSTERNAME = "upgrade1"
+	UPGRADECLUSTER2    = "upgrade2"
+	UPGRADECLONENAME   = "upgrade3"
+	FOREIGNCLUSTERNAME = "foreign1"
+	RECONCILEPORTSNAME = "reconcile2"
+	SSHBOOTSTRAPNAME   = "bootstrap1"
+	CLONECLUSTER3      = "clone3"
+	RUNNERCLUSTERNAME  = "runner1"
+	CREATECLUSTERNAME  = "create1"
+	CREATECLUSTER2NAME = "create2"
+	LOSTCLUSTERNAME    = "lost1"
+	MANAGEDSPECNAME    = "mspec1"
+	MANAGEDPLANNAME    = "mplan1"
+	RECONCILEHOSTSNAME = "reconcile3"
+	TESTJOINCOMMAND    = "kubeadm join 10.0.0.2:6443 --token abcdef.0123456789abcdef --discovery-token-ca-cert-hash sha256:0123456789\n"
+)
+
+// The mock drivers implement the optional driver interfaces.
+var (
+	_ kuttilib.MachineNotFoundReporter = (*notfounddriver)(nil)
+	_ kuttilib.SizedMachineCreator     = (*sizeddriver)(nil)
+	_ kuttilib.MachineCloner           = (*snapshotdriver)(nil)
+	_ kuttilib.MachineSnapshotter      = (*snapshotmachine)(nil)
+	_ kuttilib.MachineK8sInstaller     = (*snapshotmachine)(nil)
+	_ kuttilib.MachinePortLister       = (*snapshotmachine)(nil)
 )
 
+func ensureversion(t *testing.T) {
+	ensuredriverversion(t, DRIVER1)
+}
+
+func ensuredriverversion(t *testing.T, drivername string) {
+	mock1, _ := kuttilib.GetDriver(drivername)
+	err := mock1.UpdateVersionList()
+	if err != nil {
+		t.Fatalf("UpdateVersionList failed with: %v", err)
+	}
+
+	desiredversion, err := mock1.GetVersion(K8SVERSION1)
+	if err != nil {
+		t.Fatalf("getting k8s version %v failed with: %v", K8SVERSION1, err)
+	}
+
+	if desiredversion.Status() != kuttilib.VersionStatusDownloaded {
+		err = desiredversion.Fetch()
+		if err != nil {
+			t.Fatalf("desired version fetch failed with: %v", err)
+		}
+	}
+}
+
 func init() {
 	mock1 := drivermock.New("mock1", "Mock Driver with NAT", true, true)
 	if mock1 != nil {
-		drivercore.RegisterDriver("mock1", mock1)
+		drivercore.RegisterDriver("mock1", &notfounddriver{MockDriver: mock1})
 		mock1.UpdateRemoteImage(K8SVERSION1, false)
 	}
+
+	mock2 := drivermock.New(DRIVER2, "Mock Driver with sizing", true, true)
+	if mock2 != nil {
+		drivercore.RegisterDriver(DRIVER2, &sizeddriver{MockDriver: mock2, specs: map[string][4]int{}})
+		mock2.UpdateRemoteImage(K8SVERSION1, false)
+	}
+
+	mock3 := drivermock.New(DRIVER3, "Mock Driver with snapshots", true, true)
+	if mock3 != nil {
+		drivercore.RegisterDriver(DRIVER3, &snapshotdriver{
+			MockDriver: mock3,
+			snapshots:  map[string][]string{},
+			ports:      map[string]map[int]int{},
+			addresses:  map[string]string{},
+			installed:  map[string]string{},
+		})
+		mock3.UpdateRemoteImage(K8SVERSION1, false)
+		mock3.UpdateRemoteImage(K8SVERSION2, false)
+		mock3.UpdateRemoteImage(K8SVERSION3, false)
+	}
+
+	mock4 := drivermock.New(DRIVER4, "Mock Driver with SSH", true, true)
+	if mock4 != nil {
+		drivercore.RegisterDriver(DRIVER4, &sshdriver{MockDriver: mock4, hosts: map[string]*sshhost{}})
+		mock4.UpdateRemoteImage(K8SVERSION1, false)
+	}
 }
 
 func testworkspace(t *testing.T) {
@@ -261,3 +416,3443 @@ func testNodes(t *testing.T) {
 		t.Fatalf("node force delete failed with: %v", err)
 	}
 }
+
+func TestManagedClusters(t *testing.T) {
+	ensureversion(t)
+
+	runner := &recordingrunner{}
+	kuttilib.SetCommandRunner(runner)
+	defer kuttilib.SetCommandRunner(nil)
+
+	err := kuttilib.NewManagedCluster(MANAGEDCLUSTERNAME, K8SVERSION1, DRIVER1)
+	if err != nil {
+		t.Fatalf("managed cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteCluster(MANAGEDCLUSTERNAME, true)
+
+	cluster, _ := kuttilib.GetCluster(MANAGEDCLUSTERNAME)
+	if cluster.Type() != kuttilib.ClusterTypeManaged {
+		t.Fatalf("cluster type is %v instead of %v", cluster.Type(), kuttilib.ClusterTypeManaged)
+	}
+
+	_, err = cluster.NewWorkerNode(WORKERNAME)
+	if err == nil {
+		t.Fatal("worker creation should have failed without a control plane. Didn't")
+	}
+
+	runner.fail("kubeadm init")
+	controlplane, err := cluster.NewControlPlaneNode(CONTROLPLANENAME)
+	runner.fail("")
+	if err == nil || controlplane != nil {
+		t.Fatalf("control plane node creation with failing kubeadm init returned %v, %v instead of an error", controlplane, err)
+	}
+	if _, ok := cluster.GetNode(CONTROLPLANENAME); ok {
+		t.Fatal("control plane node whose initialization failed was not removed")
+	}
+
+	controlplane, err = cluster.NewControlPlaneNode(CONTROLPLANENAME)
+	if err != nil {
+		t.Fatalf("control plane node creation after failed initialization failed with: %v", err)
+	}
+	defer cluster.DeleteNode(CONTROLPLANENAME, true)
+
+	if controlplane.Type() != kuttilib.NodeTypeControlPlane {
+		t.Fatalf("node type is %v instead of %v", controlplane.Type(), kuttilib.NodeTypeControlPlane)
+	}
+
+	if !runner.issued(CONTROLPLANENAME + ": sudo kubeadm init") {
+		t.Fatal("kubeadm init was not run on the control plane node")
+	}
+
+	_, err = cluster.NewControlPlaneNode("control2")
+	if err == nil {
+		t.Fatal("second control plane creation should have failed. Didn't")
+	}
+
+	worker, err := cluster.NewWorkerNode(WORKERNAME)
+	if err != nil {
+		t.Fatalf("worker node creation failed with: %v", err)
+	}
+	defer cluster.DeleteNode(WORKERNAME, true)
+
+	if worker.Type() != kuttilib.NodeTypeWorker {
+		t.Fatalf("node type is %v instead of %v", worker.Type(), kuttilib.NodeTypeWorker)
+	}
+
+	if !runner.issued(WORKERNAME + ": sudo kubeadm join 10.0.0.2:6443 --token abcdef.0123456789abcdef --discovery-token-ca-cert-hash sha256:0123456789") {
+		t.Fatal("kubeadm join was not run with the created token and recorded hash")
+	}
+
+	_, err = cluster.NewWorkerNode("worker2")
+	if err != nil {
+		t.Fatalf("second worker node creation failed with: %v", err)
+	}
+	defer cluster.DeleteNode("worker2", true)
+
+	if runner.issuedcontaining("--ttl 0") {
+		t.Error("a join token that never expires was created")
+	}
+	if !runner.issued(CONTROLPLANENAME + ": sudo kubeadm token create --ttl 24h0m0s") {
+		t.Error("an expiring join token was not created on the control plane node")
+	}
+	if count := runner.countcontaining("kubeadm token create"); count != 1 {
+		t.Errorf("%v join tokens were created instead of one stored token", count)
+	}
+
+	confdir, _ := workspace.ConfigDir()
+	configdata, _ := os.ReadFile(filepath.Join(confdir, "kuttilib-clusters.json"))
+	if !strings.Contains(string(configdata), "abcdef.0123456789abcdef") ||
+		!strings.Contains(string(configdata), "JoinTokenExpiresAt") {
+		t.Error("the join token and its expiry were not saved in the cluster configuration")
+	}
+}
+
+func TestUnmanagedClusterRejectsKubeadmNodes(t *testing.T) {
+	ensureversion(t)
+
+	err := kuttilib.NewEmptyCluster("unmanaged1", K8SVERSION1, DRIVER1)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteCluster("unmanaged1", true)
+
+	cluster, _ := kuttilib.GetCluster("unmanaged1")
+	_, err = cluster.NewControlPlaneNode(CONTROLPLANENAME)
+	if err == nil {
+		t.Fatal("control plane creation in an unmanaged cluster should have failed. Didn't")
+	}
+}
+
+func TestContextOperations(t *testing.T) {
+	ensureversion(t)
+
+	canceledctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := kuttilib.NewEmptyClusterContext(canceledctx, CONTEXTCLUSTERNAME, K8SVERSION1, DRIVER1)
+	var cancelerr *kuttilib.CanceledError
+	if !errors.As(err, &cancelerr) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("cluster creation with canceled context returned %v instead of a CanceledError", err)
+	}
+
+	if _, ok := kuttilib.GetCluster(CONTEXTCLUSTERNAME); ok {
+		t.Fatal("cluster should not have been created with a canceled context")
+	}
+
+	driver, _ := kuttilib.GetDriver(DRIVER1)
+	version, _ := driver.GetVersion(K8SVERSION1)
+	err = version.FetchWithProgressContext(canceledctx, func(current int64, total int64) {
+		t.Error("progress was reported for a fetch with a canceled context")
+	})
+	if !errors.As(err, &cancelerr) {
+		t.Errorf("version fetch with canceled context returned %v instead of a CanceledError", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = kuttilib.NewEmptyClusterContext(ctx, CONTEXTCLUSTERNAME, K8SVERSION1, DRIVER1)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+
+	cluster, _ := kuttilib.GetCluster(CONTEXTCLUSTERNAME)
+	node, err := cluster.NewUninitializedNode(NEWNODE1NAME)
+	if err != nil {
+		t.Fatalf("new node creation failed with: %v", err)
+	}
+
+	err = node.StartContext(ctx)
+	if err != nil {
+		t.Fatalf("node start failed with: %v", err)
+	}
+
+	if nodestatus := node.Status(); nodestatus != kuttilib.NodeStatusRunning {
+		t.Fatalf("node status is %v instead of running", nodestatus)
+	}
+
+	err = cluster.DeleteNodeContext(canceledctx, NEWNODE1NAME, true)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("node delete with canceled context returned %v instead of a CanceledError", err)
+	}
+
+	if _, ok := cluster.GetNode(NEWNODE1NAME); !ok {
+		t.Fatal("node should not have been deleted with a canceled context")
+	}
+
+	err = node.StopContext(ctx)
+	if err != nil {
+		t.Fatalf("node stop failed with: %v", err)
+	}
+
+	err = cluster.DeleteNodeContext(ctx, NEWNODE1NAME, false)
+	if err != nil {
+		t.Fatalf("node delete failed with: %v", err)
+	}
+
+	err = kuttilib.DeleteClusterContext(canceledctx, CONTEXTCLUSTERNAME, false)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("cluster delete with canceled context returned %v instead of a CanceledError", err)
+	}
+
+	err = kuttilib.DeleteClusterContext(ctx, CONTEXTCLUSTERNAME, false)
+	if err != nil {
+		t.Fatalf("cluster delete failed with: %v", err)
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	ensureversion(t)
+
+	err := kuttilib.NewEmptyCluster(ERRORSCLUSTERNAME, K8SVERSION1, DRIVER1)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteCluster(ERRORSCLUSTERNAME, true)
+
+	err = kuttilib.NewEmptyCluster(ERRORSCLUSTERNAME, K8SVERSION1, DRIVER1)
+	if !errors.Is(err, kuttilib.ErrClusterExists) {
+		t.Fatalf("duplicate cluster creation returned %v instead of ErrClusterExists", err)
+	}
+
+	cluster, _ := kuttilib.GetCluster(ERRORSCLUSTERNAME)
+
+	err = cluster.DeleteNode(NEWNODE2NAME, false)
+	var nodeerr *kuttilib.NodeError
+	if !errors.As(err, &nodeerr) || !errors.Is(err, kuttilib.ErrNodeNotFound) {
+		t.Fatalf("deleting a missing node returned %v instead of a NodeError wrapping ErrNodeNotFound", err)
+	}
+
+	if nodeerr.Cluster != ERRORSCLUSTERNAME || nodeerr.Node != NEWNODE2NAME {
+		t.Fatalf("NodeError reports cluster %v and node %v", nodeerr.Cluster, nodeerr.Node)
+	}
+
+	node, err := cluster.NewUninitializedNode(NEWNODE1NAME)
+	if err != nil {
+		t.Fatalf("new node creation failed with: %v", err)
+	}
+	defer cluster.DeleteNode(NEWNODE1NAME, true)
+
+	err = node.ForwardSSHPort(HOSTPORT1)
+	if err != nil {
+		t.Fatalf("forwarding SSH port failed with: %v", err)
+	}
+
+	err = node.ForwardPort(HOSTPORT1, 80)
+	var porterr *kuttilib.PortError
+	if !errors.As(err, &porterr) || !errors.Is(err, kuttilib.ErrPortHostPortAlreadyUsed) {
+		t.Fatalf("forwarding to an occupied host port returned %v instead of a PortError wrapping ErrPortHostPortAlreadyUsed", err)
+	}
+
+	if porterr.HostPort != HOSTPORT1 {
+		t.Fatalf("PortError reports host port %v instead of %v", porterr.HostPort, HOSTPORT1)
+	}
+
+	err = node.Stop()
+	if !errors.Is(err, kuttilib.ErrNodeCannotStop) {
+		t.Fatalf("stopping a stopped node returned %v instead of ErrNodeCannotStop", err)
+	}
+}
+
+func TestConfigChangesFromOtherProcesses(t *testing.T) {
+	ensureversion(t)
+
+	err := kuttilib.NewEmptyCluster(PROCESSCLUSTER1, K8SVERSION1, DRIVER1)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteCluster(PROCESSCLUSTER1, true)
+
+	confdir, _ := workspace.ConfigDir()
+	configfile := filepath.Join(confdir, "kuttilib-clusters.json")
+
+	// Simulate another process adding a cluster behind our back
+	filedata, err := os.ReadFile(configfile)
+	if err != nil {
+		t.Fatalf("reading config file failed with: %v", err)
+	}
+
+	var ondisk struct {
+		Clusters map[string]map[string]interface{}
+	}
+	err = json.Unmarshal(filedata, &ondisk)
+	if err != nil {
+		t.Fatalf("parsing config file failed with: %v", err)
+	}
+
+	othercluster := map[string]interface{}{}
+	for key, value := range ondisk.Clusters[PROCESSCLUSTER1] {
+		othercluster[key] = value
+	}
+	othercluster["Name"] = PROCESSCLUSTER2
+	ondisk.Clusters[PROCESSCLUSTER2] = othercluster
+
+	filedata, _ = json.Marshal(ondisk)
+	err = os.WriteFile(configfile, filedata, 0644)
+	if err != nil {
+		t.Fatalf("writing config file failed with: %v", err)
+	}
+	defer kuttilib.DeleteCluster(PROCESSCLUSTER2, true)
+
+	err = kuttilib.NewEmptyCluster(PROCESSCLUSTER3, K8SVERSION1, DRIVER1)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteCluster(PROCESSCLUSTER3, true)
+
+	if _, ok := kuttilib.GetCluster(PROCESSCLUSTER2); !ok {
+		t.Fatal("cluster added by another process was not picked up")
+	}
+
+	filedata, _ = os.ReadFile(configfile)
+	err = json.Unmarshal(filedata, &ondisk)
+	if err != nil {
+		t.Fatalf("parsing config file failed with: %v", err)
+	}
+
+	for _, name := range []string{PROCESSCLUSTER1, PROCESSCLUSTER2, PROCESSCLUSTER3} {
+		if _, ok := ondisk.Clusters[name]; !ok {
+			t.Errorf("cluster %v was lost from the config file", name)
+		}
+	}
+
+	tempfiles, _ := filepath.Glob(filepath.Join(confdir, "*.tmp"))
+	if len(tempfiles) > 0 {
+		t.Errorf("temporary files left behind: %v", tempfiles)
+	}
+}
+
+// TestConcurrentUse exercises the API from several goroutines at
+// once. Run it with the race detector enabled.
+func TestConcurrentUse(t *testing.T) {
+	ensureversion(t)
+
+	err := kuttilib.NewEmptyCluster(HAMMERCLUSTERNAME, K8SVERSION1, DRIVER1)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+
+	cluster, _ := kuttilib.GetCluster(HAMMERCLUSTERNAME)
+	done := make(chan struct{})
+
+	var readers sync.WaitGroup
+	for i := 0; i < HAMMERWORKERS; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				kuttilib.ForEachCluster(func(c *kuttilib.Cluster) bool {
+					c.K8sVersion()
+					c.NodeNames()
+					for _, node := range c.Nodes() {
+						node.Status()
+						node.Ports()
+						node.SSHAddress()
+					}
+					return false
+				})
+				kuttilib.Clusters()
+				kuttilib.ClusterNames()
+				json.Marshal(cluster)
+			}
+		}()
+	}
+
+	var writers sync.WaitGroup
+	for i := 0; i < HAMMERWORKERS; i++ {
+		writers.Add(2)
+
+		go func(i int) {
+			defer writers.Done()
+
+			node, err := cluster.NewUninitializedNode(fmt.Sprintf("hnode%v", i))
+			if err != nil {
+				t.Errorf("node creation failed with: %v", err)
+				return
+			}
+
+			err = node.ForwardSSHPort(30000 + i)
+			if err != nil {
+				t.Errorf("forwarding SSH port failed with: %v", err)
+			}
+
+			err = node.ForwardPort(31000+i, 80)
+			if err != nil {
+				t.Errorf("forwarding port failed with: %v", err)
+			}
+
+			err = node.Start()
+			if err != nil {
+				t.Errorf("node start failed with: %v", err)
+			}
+
+			err = node.UnforwardPort(80)
+			if err != nil {
+				t.Errorf("unforwarding port failed with: %v", err)
+			}
+
+			err = node.Stop()
+			if err != nil {
+				t.Errorf("node stop failed with: %v", err)
+			}
+		}(i)
+
+		go func(i int) {
+			defer writers.Done()
+
+			clustername := fmt.Sprintf("hammer%v", i+2)
+			err := kuttilib.NewEmptyCluster(clustername, K8SVERSION1, DRIVER1)
+			if err != nil {
+				t.Errorf("cluster creation failed with: %v", err)
+				return
+			}
+
+			err = kuttilib.DeleteCluster(clustername, false)
+			if err != nil {
+				t.Errorf("cluster delete failed with: %v", err)
+			}
+		}(i)
+	}
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+
+	if nodecount := len(cluster.Nodes()); nodecount != HAMMERWORKERS {
+		t.Errorf("cluster has %v nodes instead of %v", nodecount, HAMMERWORKERS)
+	}
+
+	for _, node := range cluster.Nodes() {
+		if portcount := len(node.Ports()); portcount != 1 {
+			t.Errorf("node %v has %v ports instead of 1", node.Name(), portcount)
+		}
+
+		err = cluster.DeleteNode(node.Name(), true)
+		if err != nil {
+			t.Errorf("node delete failed with: %v", err)
+		}
+	}
+
+	err = kuttilib.DeleteCluster(HAMMERCLUSTERNAME, false)
+	if err != nil {
+		t.Fatalf("cluster delete failed with: %v", err)
+	}
+
+	if clustercount := len(kuttilib.ClusterNames()); clustercount != 0 {
+		t.Errorf("%v clusters left behind", clustercount)
+	}
+}
+
+func TestNodeDriverCallsOutsideLock(t *testing.T) {
+	ensuredriverversion(t, DRIVER2)
+
+	err := kuttilib.NewEmptyCluster(CREATECLUSTERNAME, K8SVERSION1, DRIVER2)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteCluster(CREATECLUSTERNAME, true)
+
+	cluster, _ := kuttilib.GetCluster(CREATECLUSTERNAME)
+	vmdriver, _ := drivercore.GetDriver(DRIVER2)
+	sized := vmdriver.(*sizeddriver)
+
+	updatable := false
+	var duplicateerr error
+	sized.setduringdriverop(func() {
+		updatable = configupdatable(cluster)
+		_, duplicateerr = cluster.NewUninitializedNode(NEWNODE1NAME)
+	})
+	_, err = cluster.NewUninitializedNode(NEWNODE1NAME)
+	sized.setduringdriverop(nil)
+	if err != nil {
+		t.Fatalf("node creation failed with: %v", err)
+	}
+	if !updatable {
+		t.Error("the configuration was locked while the host was created")
+	}
+	if !errors.Is(duplicateerr, kuttilib.ErrNodeExists) {
+		t.Errorf("adding a node while it was being added returned %v instead of ErrNodeExists", duplicateerr)
+	}
+
+	updatable = false
+	sized.setduringdriverop(func() {
+		updatable = configupdatable(cluster)
+	})
+	err = cluster.DeleteNode(NEWNODE1NAME, true)
+	sized.setduringdriverop(nil)
+	if err != nil {
+		t.Fatalf("node delete failed with: %v", err)
+	}
+	if !updatable {
+		t.Error("the configuration was locked while the host was deleted")
+	}
+
+	if vmdriver.UsesPerClusterNetworking() {
+		updatable = false
+		sized.setduringdriverop(func() {
+			updatable = configupdatable(cluster)
+			duplicateerr = kuttilib.NewEmptyCluster(CREATECLUSTER2NAME, K8SVERSION1, DRIVER2)
+		})
+		err = kuttilib.NewEmptyCluster(CREATECLUSTER2NAME, K8SVERSION1, DRIVER2)
+		sized.setduringdriverop(nil)
+		if err != nil {
+			t.Fatalf("cluster creation failed with: %v", err)
+		}
+		if !updatable {
+			t.Error("the configuration was locked while the network was created")
+		}
+		if !errors.Is(duplicateerr, kuttilib.ErrClusterExists) {
+			t.Errorf("adding a cluster while it was being added returned %v instead of ErrClusterExists", duplicateerr)
+		}
+
+		cluster2, _ := kuttilib.GetCluster(CREATECLUSTER2NAME)
+		updatable = false
+		sized.setduringdriverop(func() {
+			updatable = configupdatable(cluster)
+			_, duplicateerr = cluster2.NewUninitializedNode(NEWNODE1NAME)
+		})
+		err = kuttilib.DeleteCluster(CREATECLUSTER2NAME, false)
+		sized.setduringdriverop(nil)
+		if err != nil {
+			t.Fatalf("cluster delete failed with: %v", err)
+		}
+		if !updatable {
+			t.Error("the configuration was locked while the network was deleted")
+		}
+		if !errors.Is(duplicateerr, kuttilib.ErrClusterDeleting) {
+			t.Errorf("adding a node while the cluster was being deleted returned %v instead of ErrClusterDeleting", duplicateerr)
+		}
+		if _, ok := kuttilib.GetCluster(CREATECLUSTER2NAME); ok {
+			t.Error("the cluster was left behind after its network was deleted")
+		}
+	}
+
+	// A node being created by another process is left alone.
+	recordpendingartifact(t, DRIVER2, CREATECLUSTERNAME, NEWNODE2NAME)
+	_, err = cluster.NewUninitializedNode(NEWNODE2NAME)
+	if !errors.Is(err, kuttilib.ErrNodeExists) {
+		t.Errorf("adding a node being created elsewhere returned %v instead of ErrNodeExists", err)
+	}
+	if _, err := vmdriver.GetMachine(NEWNODE2NAME, CREATECLUSTERNAME); err == nil {
+		t.Error("a host was created for a node being created elsewhere")
+	}
+	dropartifact(t, DRIVER2, CREATECLUSTERNAME, NEWNODE2NAME)
+
+	// So is a host which already exists.
+	_, err = vmdriver.NewMachine(NEWNODE2NAME, CREATECLUSTERNAME, K8SVERSION1)
+	if err != nil {
+		t.Fatalf("host creation failed with: %v", err)
+	}
+	_, err = cluster.NewUninitializedNode(NEWNODE2NAME)
+	if !errors.Is(err, kuttilib.ErrNodeExists) {
+		t.Errorf("adding a node with an existing host returned %v instead of ErrNodeExists", err)
+	}
+	if _, err := vmdriver.GetMachine(NEWNODE2NAME, CREATECLUSTERNAME); err != nil {
+		t.Error("an existing host was deleted when a node could not be added")
+	}
+	vmdriver.DeleteMachine(NEWNODE2NAME, CREATECLUSTERNAME)
+
+	sized.setduringdriverop(func() {
+		sized.setduringdriverop(nil)
+		kuttilib.DeleteCluster(CREATECLUSTERNAME, true)
+	})
+	node, err := cluster.NewUninitializedNode(NEWNODE2NAME)
+	sized.setduringdriverop(nil)
+	if err == nil || node != nil {
+		t.Errorf("node creation in a cluster deleted meanwhile returned %v, %v instead of an error", node, err)
+	}
+	if _, err := vmdriver.GetMachine(NEWNODE2NAME, CREATECLUSTERNAME); err == nil {
+		t.Error("the host of a node which could not be added was left behind")
+	}
+}
+
+func TestBulkOperations(t *testing.T) {
+	ensureversion(t)
+
+	runner := &recordingrunner{}
+	kuttilib.SetCommandRunner(runner)
+	defer kuttilib.SetCommandRunner(nil)
+
+	err := kuttilib.NewManagedCluster(BULKCLUSTERNAME, K8SVERSION1, DRIVER1)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteCluster(BULKCLUSTERNAME, true)
+
+	cluster, _ := kuttilib.GetCluster(BULKCLUSTERNAME)
+	_, err = cluster.NewControlPlaneNode(CONTROLPLANENAME)
+	if err != nil {
+		t.Fatalf("control plane node creation failed with: %v", err)
+	}
+	defer cluster.DeleteNode(CONTROLPLANENAME, true)
+
+	for i := 1; i <= 3; i++ {
+		workername := fmt.Sprintf("worker%v", i)
+		_, err = cluster.NewWorkerNode(workername)
+		if err != nil {
+			t.Fatalf("worker node creation failed with: %v", err)
+		}
+		defer cluster.DeleteNode(workername, true)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := cluster.StopAll(ctx, kuttilib.BulkOptions{Parallelism: 2})
+	if err != nil {
+		t.Fatalf("StopAll failed with: %v", err)
+	}
+
+	if len(result.Results) != 4 {
+		t.Fatalf("StopAll reported %v results instead of 4", len(result.Results))
+	}
+
+	if result.Results[3].Node != CONTROLPLANENAME {
+		t.Errorf("control plane node was stopped before workers")
+	}
+
+	for _, node := range cluster.Nodes() {
+		if node.Status() != kuttilib.NodeStatusStopped {
+			t.Errorf("node %v is not stopped after StopAll", node.Name())
+		}
+	}
+
+	result, err = cluster.StartAll(ctx, kuttilib.BulkOptions{})
+	if err != nil {
+		t.Fatalf("StartAll failed with: %v", err)
+	}
+
+	if result.Results[0].Node != CONTROLPLANENAME {
+		t.Errorf("control plane node was not started first")
+	}
+
+	result, err = cluster.StartAll(ctx, kuttilib.BulkOptions{})
+	if err != nil {
+		t.Fatalf("second StartAll failed with: %v", err)
+	}
+
+	for _, noderesult := range result.Results {
+		if !noderesult.Skipped {
+			t.Errorf("running node %v was not skipped", noderesult.Node)
+		}
+	}
+
+	worker1, _ := cluster.GetNode("worker1")
+	err = worker1.Stop()
+	if err != nil {
+		t.Fatalf("stopping worker1 failed with: %v", err)
+	}
+
+	result, err = cluster.RestartAll(ctx, kuttilib.BulkOptions{Parallelism: 1})
+	if err != nil {
+		t.Fatalf("RestartAll failed with: %v", err)
+	}
+
+	for _, noderesult := range result.Results {
+		if noderesult.Skipped != (noderesult.Node == "worker1") {
+			t.Errorf("RestartAll result for node %v has Skipped %v", noderesult.Node, noderesult.Skipped)
+		}
+	}
+
+	if worker1.Status() != kuttilib.NodeStatusStopped {
+		t.Error("RestartAll started a node which was stopped before the call")
+	}
+
+	_, err = cluster.ForceStopAll(ctx, kuttilib.BulkOptions{})
+	if err != nil {
+		t.Fatalf("ForceStopAll failed with: %v", err)
+	}
+
+	canceledctx, cancelnow := context.WithCancel(context.Background())
+	cancelnow()
+
+	result, err = cluster.StartAll(canceledctx, kuttilib.BulkOptions{})
+	if !errors.Is(err, context.Canceled) || len(result.Failed()) != 4 {
+		t.Fatalf("StartAll with a canceled context returned %v", err)
+	}
+}
+
+func TestDeleteClusterCascade(t *testing.T) {
+	ensureversion(t)
+
+	err := kuttilib.NewEmptyCluster(CASCADECLUSTERNAME, K8SVERSION1, DRIVER1)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+
+	cluster, _ := kuttilib.GetCluster(CASCADECLUSTERNAME)
+	node1, err := cluster.NewUninitializedNode(NEWNODE1NAME)
+	if err != nil {
+		t.Fatalf("new node creation failed with: %v", err)
+	}
+
+	_, err = cluster.NewUninitializedNode(NEWNODE2NAME)
+	if err != nil {
+		t.Fatalf("second new node creation failed with: %v", err)
+	}
+
+	err = node1.ForwardSSHPort(HOSTPORT1)
+	if err != nil {
+		t.Fatalf("forwarding SSH port failed with: %v", err)
+	}
+
+	err = node1.Start()
+	if err != nil {
+		t.Fatalf("node start failed with: %v", err)
+	}
+
+	err = kuttilib.DeleteCluster(CASCADECLUSTERNAME, true)
+	if !errors.Is(err, kuttilib.ErrClusterNotEmpty) {
+		t.Fatalf("non-cascading delete returned %v instead of ErrClusterNotEmpty", err)
+	}
+
+	report, err := kuttilib.DeleteClusterCascade(
+		context.Background(),
+		CASCADECLUSTERNAME,
+		kuttilib.CascadeOptions{ContinueOnError: true},
+	)
+	if err != nil {
+		t.Fatalf("cascading delete failed with: %v", err)
+	}
+
+	if !report.ClusterDeleted {
+		t.Error("report does not show the cluster as deleted")
+	}
+
+	if len(report.Nodes) != 2 {
+		t.Errorf("report shows %v nodes instead of 2", len(report.Nodes))
+	}
+
+	if len(report.Leftovers) != 0 {
+		t.Errorf("report shows leftovers: %v", report.Leftovers)
+	}
+
+	if _, ok := kuttilib.GetCluster(CASCADECLUSTERNAME); ok {
+		t.Error("cluster still exists after cascading delete")
+	}
+
+	_, err = kuttilib.DeleteClusterCascade(context.Background(), CASCADECLUSTERNAME, kuttilib.CascadeOptions{})
+	if !errors.Is(err, kuttilib.ErrClusterDoesNotExist) {
+		t.Errorf("cascading delete of missing cluster returned %v instead of ErrClusterDoesNotExist", err)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	ensureversion(t)
+
+	err := kuttilib.NewEmptyCluster(RECONCILECLUSTERNAME, K8SVERSION1, DRIVER1)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteClusterCascade(context.Background(), RECONCILECLUSTERNAME, kuttilib.CascadeOptions{ContinueOnError: true})
+
+	cluster, _ := kuttilib.GetCluster(RECONCILECLUSTERNAME)
+	_, err = cluster.NewUninitializedNode(NEWNODE1NAME)
+	if err != nil {
+		t.Fatalf("new node creation failed with: %v", err)
+	}
+	_, err = cluster.NewUninitializedNode(NEWNODE2NAME)
+	if err != nil {
+		t.Fatalf("second new node creation failed with: %v", err)
+	}
+
+	_, err = cluster.NewUninitializedNode(ORPHANNODENAME)
+	if err != nil {
+		t.Fatalf("orphan node creation failed with: %v", err)
+	}
+	dropfromconfigfile(t, RECONCILECLUSTERNAME, ORPHANNODENAME)
+	if !configupdatable(cluster) {
+		t.Fatal("reloading the configuration failed")
+	}
+	if _, ok := cluster.GetNode(ORPHANNODENAME); ok {
+		t.Fatal("node removed from the configuration file was not dropped")
+	}
+
+	vmdriver, _ := drivercore.GetDriver(DRIVER1)
+	vmdriver.DeleteMachine(NEWNODE2NAME, RECONCILECLUSTERNAME)
+	vmdriver.DeleteNetwork(RECONCILECLUSTERNAME)
+	ghost, err := vmdriver.GetMachine(ORPHANNODENAME, RECONCILECLUSTERNAME)
+	if err != nil {
+		t.Fatalf("getting orphan machine failed with: %v", err)
+	}
+	defer vmdriver.DeleteMachine(ORPHANNODENAME, RECONCILECLUSTERNAME)
+
+	report, err := cluster.Check(kuttilib.ReconcileOptions{})
+	if err != nil {
+		t.Fatalf("check failed with: %v", err)
+	}
+
+	missinghosts := report.OfKind(kuttilib.DiscrepancyMissingHost)
+	if len(missinghosts) != 1 || missinghosts[0].Node != NEWNODE2NAME {
+		t.Errorf("check reported missing hosts %v instead of %v", missinghosts, NEWNODE2NAME)
+	}
+	if len(report.OfKind(kuttilib.DiscrepancyMissingNetwork)) != 1 {
+		t.Error("check did not report the missing network")
+	}
+	if _, ok := cluster.GetNode(NEWNODE2NAME); !ok {
+		t.Error("check without repair options removed a node")
+	}
+
+	report, err = kuttilib.Reconcile(kuttilib.ReconcileOptions{})
+	if err != nil {
+		t.Fatalf("reconcile failed with: %v", err)
+	}
+
+	foundghost := false
+	for _, discrepancy := range report.OfKind(kuttilib.DiscrepancyOrphanedMachine) {
+		if discrepancy.Name == ghost.Name() {
+			foundghost = true
+		}
+	}
+	if !foundghost {
+		t.Errorf("reconcile did not report orphaned machine %v", ghost.Name())
+	}
+
+	recordpendingartifact(t, DRIVER1, RECONCILECLUSTERNAME, INFLIGHTNODENAME)
+	inflight, err := vmdriver.NewMachine(INFLIGHTNODENAME, RECONCILECLUSTERNAME, K8SVERSION1)
+	if err != nil {
+		t.Fatalf("in-flight machine creation failed with: %v", err)
+	}
+	defer vmdriver.DeleteMachine(INFLIGHTNODENAME, RECONCILECLUSTERNAME)
+
+	report, err = kuttilib.Reconcile(kuttilib.ReconcileOptions{DeleteOrphanedMachines: true})
+	if err != nil {
+		t.Fatalf("reconcile with orphan deletion failed with: %v", err)
+	}
+	for _, discrepancy := range report.OfKind(kuttilib.DiscrepancyOrphanedMachine) {
+		if discrepancy.Name == inflight.Name() {
+			t.Errorf("reconcile reported machine %v, which another process is adding", inflight.Name())
+		}
+	}
+	if _, err := vmdriver.GetMachine(INFLIGHTNODENAME, RECONCILECLUSTERNAME); err != nil {
+		t.Error("reconcile deleted a machine which another process is adding")
+	}
+
+	foreign, err := vmdriver.NewMachine(ORPHANNODENAME, FOREIGNCLUSTERNAME, K8SVERSION1)
+	if err != nil {
+		t.Fatalf("foreign machine creation failed with: %v", err)
+	}
+	defer vmdriver.DeleteMachine(ORPHANNODENAME, FOREIGNCLUSTERNAME)
+
+	report, err = kuttilib.Reconcile(kuttilib.ReconcileOptions{DeleteOrphanedMachines: true})
+	if err != nil {
+		t.Fatalf("reconcile with orphan deletion failed with: %v", err)
+	}
+	for _, discrepancy := range report.OfKind(kuttilib.DiscrepancyOrphanedMachine) {
+		if discrepancy.Name == foreign.Name() {
+			t.Errorf("reconcile reported machine %v of a cluster outside the workspace", foreign.Name())
+		}
+	}
+	if _, err := vmdriver.GetMachine(ORPHANNODENAME, FOREIGNCLUSTERNAME); err != nil {
+		t.Error("reconcile deleted a machine of a cluster outside the workspace")
+	}
+
+	err = kuttilib.NewEmptyCluster(LOSTCLUSTERNAME, K8SVERSION1, DRIVER1)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+	lostcluster, _ := kuttilib.GetCluster(LOSTCLUSTERNAME)
+	_, err = lostcluster.NewUninitializedNode(NEWNODE1NAME)
+	if err != nil {
+		t.Fatalf("new node creation failed with: %v", err)
+	}
+	lostmachine, _ := vmdriver.GetMachine(NEWNODE1NAME, LOSTCLUSTERNAME)
+	lostnetwork, _ := vmdriver.GetNetwork(LOSTCLUSTERNAME)
+	defer vmdriver.DeleteMachine(NEWNODE1NAME, LOSTCLUSTERNAME)
+	defer vmdriver.DeleteNetwork(LOSTCLUSTERNAME)
+
+	dropfromconfigfile(t, LOSTCLUSTERNAME, "")
+	if !configupdatable(cluster) {
+		t.Fatal("reloading the configuration failed")
+	}
+	if _, ok := kuttilib.GetCluster(LOSTCLUSTERNAME); ok {
+		t.Fatal("cluster removed from the configuration file was not dropped")
+	}
+
+	report, err = kuttilib.Reconcile(kuttilib.ReconcileOptions{
+		DeleteOrphanedMachines: true,
+		DeleteOrphanedNetworks: true,
+	})
+	if err != nil {
+		t.Fatalf("reconcile with orphan deletion failed with: %v", err)
+	}
+	foundmachine, foundnetwork := false, false
+	for _, discrepancy := range report.Discrepancies {
+		if discrepancy.Cluster != LOSTCLUSTERNAME {
+			continue
+		}
+		switch {
+		case discrepancy.Kind == kuttilib.DiscrepancyOrphanedMachine && discrepancy.Name == lostmachine.Name():
+			foundmachine = discrepancy.Repaired
+		case discrepancy.Kind == kuttilib.DiscrepancyOrphanedNetwork && discrepancy.Name == lostnetwork.Name():
+			foundnetwork = discrepancy.Repaired
+		default:
+			t.Errorf("reconcile reported unexpected discrepancy %v", discrepancy)
+		}
+	}
+	if !foundmachine || !foundnetwork {
+		t.Errorf("reconcile did not delete the machine and network of a cluster lost from the configuration: %v", report.Discrepancies)
+	}
+	if _, err := vmdriver.GetMachine(NEWNODE1NAME, LOSTCLUSTERNAME); err == nil {
+		t.Error("machine of a lost cluster was not deleted")
+	}
+	if _, err := vmdriver.GetNetwork(LOSTCLUSTERNAME); err == nil {
+		t.Error("network of a lost cluster was not deleted")
+	}
+
+	report, err = kuttilib.Reconcile(kuttilib.ReconcileOptions{})
+	if err != nil {
+		t.Fatalf("reconcile after orphan deletion failed with: %v", err)
+	}
+	for _, discrepancy := range report.Discrepancies {
+		if discrepancy.Cluster == LOSTCLUSTERNAME {
+			t.Errorf("reconcile reported deleted orphan %v", discrepancy)
+		}
+	}
+
+	_, err = kuttilib.Reconcile(kuttilib.ReconcileOptions{
+		RemoveMissingHosts:     true,
+		DeleteOrphanedMachines: true,
+		CreateMissingNetworks:  true,
+	})
+	if err != nil {
+		t.Fatalf("reconcile with repairs failed with: %v", err)
+	}
+
+	if _, ok := cluster.GetNode(NEWNODE2NAME); ok {
+		t.Error("node with missing host was not removed")
+	}
+	if _, err := vmdriver.GetMachine(ORPHANNODENAME, RECONCILECLUSTERNAME); err == nil {
+		t.Error("orphaned machine was not deleted")
+	}
+
+	report, err = cluster.Check(kuttilib.ReconcileOptions{})
+	if err != nil {
+		t.Fatalf("check after repair failed with: %v", err)
+	}
+	if len(report.Discrepancies) != 0 {
+		t.Errorf("check after repair reported %v", report.Discrepancies)
+	}
+}
+
+func TestReconcileUnavailableHost(t *testing.T) {
+	ensuredriverversion(t, DRIVER2)
+
+	err := kuttilib.NewEmptyCluster(RECONCILEHOSTSNAME, K8SVERSION1, DRIVER2)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteClusterCascade(context.Background(), RECONCILEHOSTSNAME, kuttilib.CascadeOptions{ContinueOnError: true})
+
+	cluster, _ := kuttilib.GetCluster(RECONCILEHOSTSNAME)
+	_, err = cluster.NewUninitializedNode(NEWNODE1NAME)
+	if err != nil {
+		t.Fatalf("new node creation failed with: %v", err)
+	}
+
+	// The driver cannot tell whether the machine does not exist, so
+	// the node is left alone.
+	vmdriver, _ := drivercore.GetDriver(DRIVER2)
+	vmdriver.DeleteMachine(NEWNODE1NAME, RECONCILEHOSTSNAME)
+	defer vmdriver.NewMachine(NEWNODE1NAME, RECONCILEHOSTSNAME, K8SVERSION1)
+
+	report, err := cluster.Check(kuttilib.ReconcileOptions{RemoveMissingHosts: true})
+	if err != nil {
+		t.Fatalf("check failed with: %v", err)
+	}
+
+	unavailable := report.OfKind(kuttilib.DiscrepancyHostUnavailable)
+	if len(unavailable) != 1 || unavailable[0].Node != NEWNODE1NAME || unavailable[0].Repaired {
+		t.Errorf("check reported unavailable hosts %v instead of %v", unavailable, NEWNODE1NAME)
+	}
+	if missing := report.OfKind(kuttilib.DiscrepancyMissingHost); len(missing) != 0 {
+		t.Errorf("check reported missing hosts %v for a driver which cannot tell", missing)
+	}
+	if _, ok := cluster.GetNode(NEWNODE1NAME); !ok {
+		t.Error("node whose host could not be looked up was removed")
+	}
+}
+
+func TestReconcilePorts(t *testing.T) {
+	ensuredriverversion(t, DRIVER3)
+
+	err := kuttilib.NewEmptyCluster(RECONCILEPORTSNAME, K8SVERSION1, DRIVER3)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteClusterCascade(context.Background(), RECONCILEPORTSNAME, kuttilib.CascadeOptions{ContinueOnError: true})
+
+	cluster, _ := kuttilib.GetCluster(RECONCILEPORTSNAME)
+	node, err := cluster.NewUninitializedNode(NEWNODE1NAME)
+	if err != nil {
+		t.Fatalf("new node creation failed with: %v", err)
+	}
+
+	err = node.ForwardPort(HOSTPORT1, 80)
+	if err != nil {
+		t.Fatalf("port forwarding failed with: %v", err)
+	}
+
+	vmdriver, _ := drivercore.GetDriver(DRIVER3)
+	host, _ := vmdriver.GetMachine(NEWNODE1NAME, RECONCILEPORTSNAME)
+	host.UnforwardPort(80)
+	host.ForwardPort(HOSTPORT2, 22)
+
+	report, err := cluster.Check(kuttilib.ReconcileOptions{})
+	if err != nil {
+		t.Fatalf("check failed with: %v", err)
+	}
+
+	staleports := report.OfKind(kuttilib.DiscrepancyStalePortMapping)
+	if len(staleports) != 2 {
+		t.Fatalf("check reported stale port mappings %v instead of 2", staleports)
+	}
+	for _, discrepancy := range staleports {
+		switch discrepancy.NodePort {
+		case 80:
+			if discrepancy.HostPort != HOSTPORT1 || discrepancy.Detail != "mapping not present in driver" {
+				t.Errorf("check reported %v for the mapping missing from the driver", discrepancy)
+			}
+		case 22:
+			if discrepancy.HostPort != HOSTPORT2 || discrepancy.Detail != "mapping not present in configuration" {
+				t.Errorf("check reported %v for the mapping missing from the configuration", discrepancy)
+			}
+		default:
+			t.Errorf("check reported unexpected stale port mapping %v", discrepancy)
+		}
+	}
+
+	report, err = cluster.Check(kuttilib.ReconcileOptions{RepairPortMappings: true})
+	if err != nil {
+		t.Fatalf("check with repairs failed with: %v", err)
+	}
+	for _, discrepancy := range report.Discrepancies {
+		if !discrepancy.Repaired {
+			t.Errorf("stale port mapping %v was not repaired", discrepancy)
+		}
+	}
+
+	ports, _ := host.(*snapshotmachine).ForwardedPorts()
+	if len(ports) != 1 || ports[80] != HOSTPORT1 {
+		t.Errorf("driver ports after repair are %v", ports)
+	}
+
+	host.UnforwardPort(80)
+	host.ForwardPort(HOSTPORT2, 80)
+
+	report, err = cluster.Check(kuttilib.ReconcileOptions{RepairPortMappings: true})
+	if err != nil {
+		t.Fatalf("check with repairs failed with: %v", err)
+	}
+	staleports = report.OfKind(kuttilib.DiscrepancyStalePortMapping)
+	if len(staleports) != 1 || staleports[0].HostPort != HOSTPORT1 || staleports[0].Detail != fmt.Sprintf("driver maps node port to host port %v", HOSTPORT2) {
+		t.Errorf("check reported %v for a mapping to another host port in the driver", staleports)
+	}
+
+	ports, _ = host.(*snapshotmachine).ForwardedPorts()
+	if len(ports) != 1 || ports[80] != HOSTPORT1 {
+		t.Errorf("driver ports after repairing a changed mapping are %v", ports)
+	}
+
+	report, err = cluster.Check(kuttilib.ReconcileOptions{})
+	if err != nil {
+		t.Fatalf("check after repair failed with: %v", err)
+	}
+	if len(report.Discrepancies) != 0 {
+		t.Errorf("check after repair reported %v", report.Discrepancies)
+	}
+}
+
+func TestNodeSpec(t *testing.T) {
+	ensureversion(t)
+	ensuredriverversion(t, DRIVER2)
+
+	spec := kuttilib.NodeSpec{CPUs: 2, MemoryMB: 4096, DiskGB: 40, ExtraNICs: 1}
+
+	err := spec.Validate(kuttilib.NodeSpecLimits{MaxCPUs: 1})
+	if !errors.Is(err, kuttilib.ErrNodeSpecExceedsLimits) {
+		t.Errorf("validating oversized spec returned %v instead of ErrNodeSpecExceedsLimits", err)
+	}
+
+	err = kuttilib.NodeSpec{MemoryMB: -1}.Validate(kuttilib.NodeSpecLimits{})
+	if !errors.Is(err, kuttilib.ErrNodeSpecInvalid) {
+		t.Errorf("validating negative spec returned %v instead of ErrNodeSpecInvalid", err)
+	}
+
+	err = kuttilib.NewEmptyCluster(SIZEDCLUSTERNAME, K8SVERSION1, DRIVER1)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+	cluster, _ := kuttilib.GetCluster(SIZEDCLUSTERNAME)
+
+	_, err = cluster.NewUninitializedNodeWithSpec(NEWNODE1NAME, spec)
+	if !errors.Is(err, kuttilib.ErrNodeSpecNotSupported) {
+		t.Errorf("sized node creation on %v returned %v instead of ErrNodeSpecNotSupported", DRIVER1, err)
+	}
+
+	err = kuttilib.DeleteCluster(SIZEDCLUSTERNAME, true)
+	if err != nil {
+		t.Fatalf("cluster deletion failed with: %v", err)
+	}
+
+	err = kuttilib.NewEmptyCluster(SIZEDCLUSTERNAME, K8SVERSION1, DRIVER2)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteClusterCascade(context.Background(), SIZEDCLUSTERNAME, kuttilib.CascadeOptions{ContinueOnError: true})
+	cluster, _ = kuttilib.GetCluster(SIZEDCLUSTERNAME)
+
+	_, err = cluster.NewUninitializedNodeWithSpec(NEWNODE1NAME, kuttilib.NodeSpec{CPUs: 8})
+	if !errors.Is(err, kuttilib.ErrNodeSpecExceedsLimits) {
+		t.Errorf("oversized node creation returned %v instead of ErrNodeSpecExceedsLimits", err)
+	}
+
+	node, err := cluster.NewUninitializedNodeWithSpec(NEWNODE1NAME, spec)
+	if err != nil {
+		t.Fatalf("sized node creation failed with: %v", err)
+	}
+
+	if node.Spec() != spec {
+		t.Errorf("node spec is %v instead of %v", node.Spec(), spec)
+	}
+
+	vmdriver, _ := drivercore.GetDriver(DRIVER2)
+	sized := vmdriver.(*sizeddriver)
+	sized.mu.Lock()
+	passed := sized.specs[NEWNODE1NAME]
+	sized.mu.Unlock()
+	if passed != [4]int{2, 4096, 40, 1} {
+		t.Errorf("driver received spec %v", passed)
+	}
+
+	data, err := json.Marshal(node)
+	if err != nil {
+		t.Fatalf("marshaling node failed with: %v", err)
+	}
+
+	loaded := &kuttilib.Node{}
+	err = json.Unmarshal(data, loaded)
+	if err != nil {
+		t.Fatalf("unmarshaling node failed with: %v", err)
+	}
+
+	if loaded.Spec() != spec {
+		t.Errorf("loaded node spec is %v instead of %v", loaded.Spec(), spec)
+	}
+}
+
+func TestApplyClusterSpec(t *testing.T) {
+	ensureversion(t)
+
+	_, err := kuttilib.ParseClusterSpec([]byte(`{"Name": "spec1", "Driver": "mock1", "K8sVersion": "1.23", "Colour": "blue"}`))
+	if !errors.Is(err, kuttilib.ErrClusterSpecInvalid) {
+		t.Errorf("parsing spec with unknown field returned %v instead of ErrClusterSpecInvalid", err)
+	}
+
+	_, err = kuttilib.ParseClusterSpec([]byte(`{
+		"Name": "spec1", "Driver": "mock1", "K8sVersion": "1.23",
+		"Nodes": [{"Name": "node1", "Type": "Worker"}]
+	}`))
+	if !errors.Is(err, kuttilib.ErrClusterNotManaged) {
+		t.Errorf("parsing spec with worker in unmanaged cluster returned %v instead of ErrClusterNotManaged", err)
+	}
+
+	specjson := fmt.Sprintf(`{
+		"Name": %q,
+		"Driver": %q,
+		"K8sVersion": %q,
+		"Nodes": [
+			{"Name": %q, "Ports": {"22": %v}},
+			{"Name": %q, "Ports": {"22": %v, "80": 8080}}
+		]
+	}`, SPECCLUSTERNAME, DRIVER1, K8SVERSION1, NEWNODE1NAME, HOSTPORT1, NEWNODE2NAME, HOSTPORT2)
+
+	spec, err := kuttilib.ParseClusterSpec([]byte(specjson))
+	if err != nil {
+		t.Fatalf("parsing spec failed with: %v", err)
+	}
+
+	specyaml := fmt.Sprintf(`
+Name: %s
+Driver: %s
+K8sVersion: %q
+Nodes:
+  - Name: %s
+    Ports:
+      22: %v
+  - Name: %s
+    Ports:
+      22: %v
+      80: 8080
+`, SPECCLUSTERNAME, DRIVER1, K8SVERSION1, NEWNODE1NAME, HOSTPORT1, NEWNODE2NAME, HOSTPORT2)
+	yamlspec, err := kuttilib.ParseClusterSpec([]byte(specyaml))
+	if err != nil {
+		t.Fatalf("parsing YAML spec failed with: %v", err)
+	}
+	if !reflect.DeepEqual(yamlspec, spec) {
+		t.Errorf("YAML spec parsed as %+v instead of %+v", yamlspec, spec)
+	}
+
+	_, err = kuttilib.ParseClusterSpec([]byte("Name: spec1\nDriver: mock1\nK8sVersion: \"1.23\"\nColour: blue\n"))
+	if !errors.Is(err, kuttilib.ErrClusterSpecInvalid) {
+		t.Errorf("parsing YAML spec with unknown field returned %v instead of ErrClusterSpecInvalid", err)
+	}
+
+	report, err := kuttilib.ApplyClusterSpec(context.Background(), spec)
+	defer kuttilib.DeleteClusterCascade(context.Background(), SPECCLUSTERNAME, kuttilib.CascadeOptions{ContinueOnError: true})
+	if err != nil {
+		t.Fatalf("applying spec failed with: %v", err)
+	}
+
+	if len(report.Actions) != 6 {
+		t.Errorf("first apply performed %v actions instead of 6: %v", len(report.Actions), report.Actions)
+	}
+
+	cluster, ok := kuttilib.GetCluster(SPECCLUSTERNAME)
+	if !ok {
+		t.Fatal("cluster not created by spec")
+	}
+
+	node2, ok := cluster.GetNode(NEWNODE2NAME)
+	if !ok {
+		t.Fatal("node not created by spec")
+	}
+	if node2.Ports()[80] != 8080 {
+		t.Errorf("node ports are %v, expected 80 to be forwarded to 8080", node2.Ports())
+	}
+
+	report, err = kuttilib.ApplyClusterSpec(context.Background(), spec)
+	if err != nil {
+		t.Fatalf("applying spec again failed with: %v", err)
+	}
+	if len(report.Actions) != 0 {
+		t.Errorf("second apply performed actions: %v", report.Actions)
+	}
+
+	spec.Nodes[1].Ports[80] = 9090
+	_, err = kuttilib.ApplyClusterSpec(context.Background(), spec)
+	if !errors.Is(err, kuttilib.ErrClusterSpecConflict) {
+		t.Errorf("applying conflicting spec returned %v instead of ErrClusterSpecConflict", err)
+	}
+}
+
+func TestApplyManagedClusterSpec(t *testing.T) {
+	ensureversion(t)
+
+	runner := &recordingrunner{}
+	kuttilib.SetCommandRunner(runner)
+	defer kuttilib.SetCommandRunner(nil)
+
+	spec := &kuttilib.ClusterSpec{
+		Name:       MANAGEDSPECNAME,
+		Driver:     DRIVER1,
+		K8sVersion: K8SVERSION1,
+		Type:       kuttilib.ClusterTypeManaged,
+		Nodes: []kuttilib.ClusterSpecNode{
+			{Name: CONTROLPLANENAME, Type: kuttilib.NodeTypeControlPlane, State: kuttilib.NodeStatusRunning},
+			{Name: WORKERNAME},
+			{Name: "worker2", State: kuttilib.NodeStatusStopped},
+		},
+	}
+
+	report, err := kuttilib.ApplyClusterSpec(context.Background(), spec)
+	defer kuttilib.DeleteClusterCascade(context.Background(), MANAGEDSPECNAME, kuttilib.CascadeOptions{ContinueOnError: true})
+	if err != nil {
+		t.Fatalf("applying managed spec failed with: %v", err)
+	}
+
+	for _, action := range report.Actions {
+		if action.Action == kuttilib.ActionStartNode {
+			t.Errorf("first apply started node %v, which kubeadm had started", action.Node)
+		}
+	}
+
+	cluster, _ := kuttilib.GetCluster(MANAGEDSPECNAME)
+	worker2, _ := cluster.GetNode("worker2")
+	if worker2.Status() != kuttilib.NodeStatusStopped {
+		t.Errorf("node worker2 is %v instead of stopped", worker2.Status())
+	}
+
+	report, err = kuttilib.ApplyClusterSpec(context.Background(), spec)
+	if err != nil {
+		t.Fatalf("applying managed spec again failed with: %v", err)
+	}
+	if len(report.Actions) != 0 {
+		t.Errorf("second apply of managed spec performed actions: %v", report.Actions)
+	}
+}
+
+func TestPlanClusterSpec(t *testing.T) {
+	ensureversion(t)
+
+	spec := &kuttilib.ClusterSpec{
+		Name:       PLANCLUSTERNAME,
+		Driver:     DRIVER1,
+		K8sVersion: K8SVERSION1,
+		Nodes: []kuttilib.ClusterSpecNode{
+			{Name: NEWNODE1NAME, Ports: map[int]int{22: HOSTPORT1}, State: kuttilib.NodeStatusRunning},
+			{Name: NEWNODE2NAME, Ports: map[int]int{22: HOSTPORT2, 80: 8080}},
+		},
+	}
+
+	plan, err := kuttilib.PlanClusterSpec(spec, kuttilib.PlanOptions{})
+	if err != nil {
+		t.Fatalf("planning failed with: %v", err)
+	}
+
+	expected := []string{
+		kuttilib.ActionCreateCluster,
+		kuttilib.ActionCreateNode,
+		kuttilib.ActionCreateNode,
+		kuttilib.ActionForwardPort,
+		kuttilib.ActionForwardPort,
+		kuttilib.ActionForwardPort,
+		kuttilib.ActionStartNode,
+	}
+	if len(plan.Steps) != len(expected) {
+		t.Fatalf("plan has %v steps instead of %v:\n%v", len(plan.Steps), len(expected), plan)
+	}
+	for i, step := range plan.Steps {
+		if step.Action != expected[i] {
+			t.Errorf("step %v is %v instead of %v", i+1, step.Action, expected[i])
+		}
+	}
+
+	if _, ok := kuttilib.GetCluster(PLANCLUSTERNAME); ok {
+		t.Fatal("planning created the cluster")
+	}
+
+	data, err := json.Marshal(plan)
+	if err != nil {
+		t.Fatalf("marshaling plan failed with: %v", err)
+	}
+	loadedplan := &kuttilib.Plan{}
+	err = json.Unmarshal(data, loadedplan)
+	if err != nil {
+		t.Fatalf("unmarshaling plan failed with: %v", err)
+	}
+
+	result, err := loadedplan.Execute(context.Background())
+	defer kuttilib.DeleteClusterCascade(context.Background(), PLANCLUSTERNAME, kuttilib.CascadeOptions{ContinueOnError: true})
+	if err != nil {
+		t.Fatalf("executing plan failed with: %v", err)
+	}
+	if len(result.Steps) != len(expected) {
+		t.Errorf("executed %v steps instead of %v", len(result.Steps), len(expected))
+	}
+
+	cluster, _ := kuttilib.GetCluster(PLANCLUSTERNAME)
+	node1, _ := cluster.GetNode(NEWNODE1NAME)
+	if node1.Status() != kuttilib.NodeStatusRunning {
+		t.Errorf("node %v is %v after executing plan", NEWNODE1NAME, node1.Status())
+	}
+
+	plan, err = kuttilib.PlanClusterSpec(spec, kuttilib.PlanOptions{})
+	if err != nil {
+		t.Fatalf("replanning failed with: %v", err)
+	}
+	if !plan.IsEmpty() {
+		t.Errorf("plan for up-to-date cluster is not empty:\n%v", plan)
+	}
+
+	spec.Nodes = spec.Nodes[:1]
+	spec.Nodes[0].Ports[80] = 8081
+	spec.Nodes[0].State = kuttilib.NodeStatusStopped
+
+	_, err = kuttilib.PlanClusterSpec(spec, kuttilib.PlanOptions{})
+	if err != nil {
+		t.Fatalf("planning without prune failed with: %v", err)
+	}
+
+	plan, err = kuttilib.PlanClusterSpec(spec, kuttilib.PlanOptions{Prune: true})
+	if err != nil {
+		t.Fatalf("planning with prune failed with: %v", err)
+	}
+
+	expected = []string{
+		kuttilib.ActionDeleteNode,
+		kuttilib.ActionForwardPort,
+		kuttilib.ActionStopNode,
+	}
+	if len(plan.Steps) != len(expected) {
+		t.Fatalf("pruning plan has %v steps instead of %v:\n%v", len(plan.Steps), len(expected), plan)
+	}
+	for i, step := range plan.Steps {
+		if step.Action != expected[i] {
+			t.Errorf("pruning step %v is %v instead of %v", i+1, step.Action, expected[i])
+		}
+	}
+
+	for _, step := range plan.Steps {
+		err = step.Execute(context.Background())
+		if err != nil {
+			t.Fatalf("executing step %q failed with: %v", step, err)
+		}
+	}
+
+	if _, ok := cluster.GetNode(NEWNODE2NAME); ok {
+		t.Error("pruned node still exists")
+	}
+	if node1.Status() != kuttilib.NodeStatusStopped {
+		t.Errorf("node %v is %v after executing pruning plan", NEWNODE1NAME, node1.Status())
+	}
+}
+
+func TestPlanManagedClusterSpec(t *testing.T) {
+	ensureversion(t)
+
+	runner := &recordingrunner{}
+	kuttilib.SetCommandRunner(runner)
+	defer kuttilib.SetCommandRunner(nil)
+
+	spec := &kuttilib.ClusterSpec{
+		Name:             MANAGEDPLANNAME,
+		Driver:           DRIVER1,
+		K8sVersion:       K8SVERSION1,
+		Type:             kuttilib.ClusterTypeManaged,
+		AutoForwardPorts: true,
+		Nodes: []kuttilib.ClusterSpecNode{
+			{Name: WORKERNAME, State: kuttilib.NodeStatusRunning},
+			{Name: "worker2", State: kuttilib.NodeStatusStopped},
+			{Name: CONTROLPLANENAME, Type: kuttilib.NodeTypeControlPlane},
+		},
+	}
+
+	spec.Nodes[0].Ports = map[int]int{22: HOSTPORT1}
+	_, err := kuttilib.PlanClusterSpec(spec, kuttilib.PlanOptions{})
+	if !errors.Is(err, kuttilib.ErrClusterSpecInvalid) {
+		t.Errorf("planning spec forwarding an automatically forwarded port returned %v instead of ErrClusterSpecInvalid", err)
+	}
+	spec.Nodes[0].Ports = nil
+
+	plan, err := kuttilib.PlanClusterSpec(spec, kuttilib.PlanOptions{})
+	if err != nil {
+		t.Fatalf("planning managed spec failed with: %v", err)
+	}
+
+	expected := []string{
+		kuttilib.ActionCreateCluster,
+		kuttilib.ActionSetAutoForwardPorts,
+		kuttilib.ActionCreateNode,
+		kuttilib.ActionCreateNode,
+		kuttilib.ActionCreateNode,
+		kuttilib.ActionStopNode,
+	}
+	if len(plan.Steps) != len(expected) {
+		t.Fatalf("managed plan has %v steps instead of %v:\n%v", len(plan.Steps), len(expected), plan)
+	}
+	for i, step := range plan.Steps {
+		if step.Action != expected[i] {
+			t.Errorf("managed plan step %v is %v instead of %v", i+1, step.Action, expected[i])
+		}
+	}
+	if plan.Steps[2].Node != CONTROLPLANENAME || plan.Steps[5].Node != "worker2" {
+		t.Errorf("managed plan creates %v first and stops %v", plan.Steps[2].Node, plan.Steps[5].Node)
+	}
+
+	// Commands can only reach nodes on a NAT driver once their SSH
+	// port is forwarded.
+	unreachable := []string{}
+	kuttilib.SetCommandRunner(kuttilib.CommandRunnerFunc(func(node *kuttilib.Node, command string) (string, error) {
+		if _, ok := node.Ports()[22]; !ok {
+			unreachable = append(unreachable, node.Name()+": "+command)
+		}
+		return runner.RunCommand(node, command)
+	}))
+
+	_, err = plan.Execute(context.Background())
+	defer kuttilib.DeleteClusterCascade(context.Background(), MANAGEDPLANNAME, kuttilib.CascadeOptions{ContinueOnError: true})
+	if err != nil {
+		t.Fatalf("executing managed plan failed with: %v", err)
+	}
+	if len(unreachable) != 0 {
+		t.Errorf("executing managed plan ran %q before the SSH ports of nodes were forwarded", unreachable)
+	}
+
+	cluster, _ := kuttilib.GetCluster(MANAGEDPLANNAME)
+	if !cluster.AutoForwardPorts() {
+		t.Error("automatic port forwarding was not enabled by the managed plan")
+	}
+
+	plan, err = kuttilib.PlanClusterSpec(spec, kuttilib.PlanOptions{})
+	if err != nil {
+		t.Fatalf("replanning managed spec failed with: %v", err)
+	}
+	if !plan.IsEmpty() {
+		t.Errorf("plan for up-to-date managed cluster is not empty:\n%v", plan)
+	}
+
+	spec.AutoForwardPorts = false
+	plan, err = kuttilib.PlanClusterSpec(spec, kuttilib.PlanOptions{})
+	if err != nil || !plan.IsEmpty() {
+		t.Errorf("plan without automatic port forwarding and prune is %v, with error %v", plan, err)
+	}
+
+	plan, err = kuttilib.PlanClusterSpec(spec, kuttilib.PlanOptions{Prune: true})
+	if err != nil {
+		t.Fatalf("planning managed spec with prune failed with: %v", err)
+	}
+	if len(plan.Steps) != 1 || plan.Steps[0].Action != kuttilib.ActionSetAutoForwardPorts || plan.Steps[0].AutoForwardPorts {
+		t.Errorf("pruning plan without automatic port forwarding is:\n%v", plan)
+	}
+}
+
+func TestKubeconfig(t *testing.T) {
+	ensureversion(t)
+
+	runner := &recordingrunner{}
+	kuttilib.SetCommandRunner(runner)
+	defer kuttilib.SetCommandRunner(nil)
+
+	err := kuttilib.NewManagedCluster(KUBECONFIGCLUSTERNAME, K8SVERSION1, DRIVER1)
+	if err != nil {
+		t.Fatalf("managed cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteClusterCascade(context.Background(), KUBECONFIGCLUSTERNAME, kuttilib.CascadeOptions{ContinueOnError: true})
+
+	cluster, _ := kuttilib.GetCluster(KUBECONFIGCLUSTERNAME)
+	_, err = cluster.Kubeconfig()
+	if !errors.Is(err, kuttilib.ErrNoControlPlane) {
+		t.Errorf("kubeconfig without control plane returned %v instead of ErrNoControlPlane", err)
+	}
+
+	controlplane, err := cluster.NewControlPlaneNode(CONTROLPLANENAME)
+	if err != nil {
+		t.Fatalf("control plane node creation failed with: %v", err)
+	}
+
+	_, err = cluster.Kubeconfig()
+	if !errors.Is(err, kuttilib.ErrAPIServerNotForwarded) {
+		t.Errorf("kubeconfig without forwarded API server returned %v instead of ErrAPIServerNotForwarded", err)
+	}
+
+	err = controlplane.ForwardPort(APISERVERHOSTPORT, 6443)
+	if err != nil {
+		t.Fatalf("forwarding API server port failed with: %v", err)
+	}
+
+	data, err := cluster.Kubeconfig()
+	if err != nil {
+		t.Fatalf("getting kubeconfig failed with: %v", err)
+	}
+
+	var config struct {
+		Clusters []struct {
+			Name    string
+			Cluster map[string]any
+		}
+		CurrentContext string `json:"current-context"`
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		t.Fatalf("parsing kubeconfig failed with: %v", err)
+	}
+
+	contextname := kuttilib.KubeconfigContextName(KUBECONFIGCLUSTERNAME)
+	if config.CurrentContext != contextname {
+		t.Errorf("current context is %v instead of %v", config.CurrentContext, contextname)
+	}
+	if len(config.Clusters) != 1 || config.Clusters[0].Name != contextname {
+		t.Fatalf("kubeconfig clusters are %v", config.Clusters)
+	}
+	server := fmt.Sprintf("https://127.0.0.1:%v", APISERVERHOSTPORT)
+	if config.Clusters[0].Cluster["server"] != server {
+		t.Errorf("server is %v instead of %v", config.Clusters[0].Cluster["server"], server)
+	}
+	if config.Clusters[0].Cluster["certificate-authority-data"] != "Q0E=" {
+		t.Error("certificate authority data was not preserved")
+	}
+
+	kubeconfigfile := filepath.Join(t.TempDir(), "config")
+	err = kuttilib.WriteKubeconfig(kubeconfigfile, []byte(`{
+		"apiVersion": "v1",
+		"kind": "Config",
+		"clusters": [{"name": "other", "cluster": {"server": "https://other:6443"}}],
+		"contexts": [{"name": "other", "context": {"cluster": "other", "user": "other"}}],
+		"users": [{"name": "other", "user": {"token": "secret"}}],
+		"current-context": "other"
+	}`))
+	if err != nil {
+		t.Fatalf("writing kubeconfig failed with: %v", err)
+	}
+
+	err = kuttilib.MergeKubeconfig(kubeconfigfile, data, false)
+	if err != nil {
+		t.Fatalf("merging kubeconfig failed with: %v", err)
+	}
+	err = kuttilib.MergeKubeconfig(kubeconfigfile, data, false)
+	if err != nil {
+		t.Fatalf("merging kubeconfig again failed with: %v", err)
+	}
+
+	mergeddata, err := os.ReadFile(kubeconfigfile)
+	if err != nil {
+		t.Fatalf("reading merged kubeconfig failed with: %v", err)
+	}
+	err = json.Unmarshal(mergeddata, &config)
+	if err != nil {
+		t.Fatalf("parsing merged kubeconfig failed with: %v", err)
+	}
+
+	if len(config.Clusters) != 2 {
+		t.Errorf("merged kubeconfig has %v clusters instead of 2", len(config.Clusters))
+	}
+	if config.CurrentContext != "other" {
+		t.Errorf("merge changed current context to %v", config.CurrentContext)
+	}
+
+	yamlfile := filepath.Join(t.TempDir(), "config")
+	err = kuttilib.WriteKubeconfig(yamlfile, []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: other
+  cluster:
+    server: https://other:6443
+contexts:
+- name: other
+  context:
+    cluster: other
+    user: other
+users:
+- name: other
+  user:
+    token: secret
+current-context: other
+`))
+	if err != nil {
+		t.Fatalf("writing YAML kubeconfig failed with: %v", err)
+	}
+
+	err = kuttilib.MergeKubeconfig(yamlfile, data, true)
+	if err != nil {
+		t.Fatalf("merging into YAML kubeconfig failed with: %v", err)
+	}
+
+	mergeddata, err = os.ReadFile(yamlfile)
+	if err != nil {
+		t.Fatalf("reading merged YAML kubeconfig failed with: %v", err)
+	}
+	if json.Valid(mergeddata) {
+		t.Error("merged YAML kubeconfig was written as JSON")
+	}
+	mergeddata, err = yaml.YAMLToJSON(mergeddata)
+	if err == nil {
+		err = json.Unmarshal(mergeddata, &config)
+	}
+	if err != nil {
+		t.Fatalf("parsing merged YAML kubeconfig failed with: %v", err)
+	}
+	if len(config.Clusters) != 2 || config.CurrentContext != contextname {
+		t.Errorf("merged YAML kubeconfig has %v clusters and current context %v", len(config.Clusters), config.CurrentContext)
+	}
+
+	err = os.WriteFile(yamlfile, []byte("{not: [a kubeconfig"), 0600)
+	if err != nil {
+		t.Fatalf("writing invalid kubeconfig failed with: %v", err)
+	}
+	err = kuttilib.MergeKubeconfig(yamlfile, data, false)
+	if !errors.Is(err, kuttilib.ErrKubeconfigNotMergeable) {
+		t.Errorf("merging into invalid kubeconfig returned %v instead of ErrKubeconfigNotMergeable", err)
+	}
+}
+
+func TestAutoForwardPorts(t *testing.T) {
+	ensureversion(t)
+
+	runner := &recordingrunner{}
+	kuttilib.SetCommandRunner(runner)
+	defer kuttilib.SetCommandRunner(nil)
+
+	err := kuttilib.NewManagedCluster(AUTOFORWARDCLUSTERNAME, K8SVERSION1, DRIVER1)
+	if err != nil {
+		t.Fatalf("managed cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteClusterCascade(context.Background(), AUTOFORWARDCLUSTERNAME, kuttilib.CascadeOptions{ContinueOnError: true})
+
+	cluster, _ := kuttilib.GetCluster(AUTOFORWARDCLUSTERNAME)
+	if cluster.AutoForwardPorts() {
+		t.Error("automatic port forwarding is enabled by default")
+	}
+
+	err = cluster.SetAutoForwardPorts(true)
+	if err != nil {
+		t.Fatalf("enabling automatic port forwarding failed with: %v", err)
+	}
+
+	_, err = cluster.APIServerAddress()
+	if !errors.Is(err, kuttilib.ErrNoControlPlane) {
+		t.Errorf("API server address without control plane returned %v instead of ErrNoControlPlane", err)
+	}
+
+	controlplane, err := cluster.NewControlPlaneNode(CONTROLPLANENAME)
+	if err != nil {
+		t.Fatalf("control plane node creation failed with: %v", err)
+	}
+
+	worker, err := cluster.NewWorkerNode(WORKERNAME)
+	if err != nil {
+		t.Fatalf("worker node creation failed with: %v", err)
+	}
+
+	controlplaneports := controlplane.Ports()
+	workerports := worker.Ports()
+	if controlplaneports[22] == 0 || controlplaneports[6443] == 0 {
+		t.Fatalf("control plane ports are %v, expected 22 and 6443 to be forwarded", controlplaneports)
+	}
+	if workerports[22] == 0 || workerports[6443] != 0 {
+		t.Errorf("worker ports are %v, expected only 22 to be forwarded", workerports)
+	}
+	if workerports[22] == controlplaneports[22] {
+		t.Errorf("worker and control plane SSH ports are both forwarded to %v", workerports[22])
+	}
+
+	address, err := cluster.APIServerAddress()
+	if err != nil {
+		t.Fatalf("getting API server address failed with: %v", err)
+	}
+	expected := fmt.Sprintf("127.0.0.1:%v", controlplaneports[6443])
+	if address != expected {
+		t.Errorf("API server address is %v instead of %v", address, expected)
+	}
+
+	ranges := kuttilib.HostPortRanges()
+	defer kuttilib.SetHostPortRanges(ranges)
+	err = kuttilib.SetHostPortRanges([]kuttilib.PortRange{{First: workerports[22], Last: workerports[22]}})
+	if err != nil {
+		t.Fatalf("setting host port ranges failed with: %v", err)
+	}
+
+	_, err = cluster.NewWorkerNode("worker2")
+	if !errors.Is(err, kuttilib.ErrNoFreeHostPort) {
+		t.Errorf("worker node creation without free host ports returned %v instead of ErrNoFreeHostPort", err)
+	}
+	if !runner.issued("worker2: sudo kubeadm join") {
+		t.Error("worker node was not joined after port forwarding failed")
+	}
+}
+
+func TestHostPortAllocator(t *testing.T) {
+	ensureversion(t)
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("listening on a free port failed with: %v", err)
+	}
+	defer listener.Close()
+	busyport := listener.Addr().(*net.TCPAddr).Port
+
+	err = kuttilib.SetHostPortRanges([]kuttilib.PortRange{{First: 20, Last: 10}})
+	if !errors.Is(err, kuttilib.ErrPortRangeInvalid) {
+		t.Errorf("setting invalid range returned %v instead of ErrPortRangeInvalid", err)
+	}
+
+	err = kuttilib.SetHostPortRanges([]kuttilib.PortRange{{First: busyport, Last: busyport + 10}})
+	if err != nil {
+		t.Fatalf("setting host port ranges failed with: %v", err)
+	}
+	defer kuttilib.SetHostPortRanges(nil)
+
+	ranges := kuttilib.HostPortRanges()
+	if len(ranges) != 1 || ranges[0].First != busyport {
+		t.Errorf("host port ranges are %v", ranges)
+	}
+
+	for _, clustername := range []string{PORTSCLUSTER1, PORTSCLUSTER2} {
+		err = kuttilib.NewEmptyCluster(clustername, K8SVERSION1, DRIVER1)
+		if err != nil {
+			t.Fatalf("cluster creation failed with: %v", err)
+		}
+		defer kuttilib.DeleteClusterCascade(context.Background(), clustername, kuttilib.CascadeOptions{ContinueOnError: true})
+	}
+
+	cluster1, _ := kuttilib.GetCluster(PORTSCLUSTER1)
+	cluster2, _ := kuttilib.GetCluster(PORTSCLUSTER2)
+	node1, err := cluster1.NewUninitializedNode(NEWNODE1NAME)
+	if err != nil {
+		t.Fatalf("node creation failed with: %v", err)
+	}
+	node2, err := cluster2.NewUninitializedNode(NEWNODE1NAME)
+	if err != nil {
+		t.Fatalf("node creation failed with: %v", err)
+	}
+
+	err = node1.ForwardSSHPort(busyport)
+	if !errors.Is(err, kuttilib.ErrPortHostPortUnavailable) {
+		t.Errorf("forwarding to busy host port returned %v instead of ErrPortHostPortUnavailable", err)
+	}
+
+	hostport, err := kuttilib.AllocateHostPort()
+	if err != nil {
+		t.Fatalf("allocating host port failed with: %v", err)
+	}
+	if hostport <= busyport || hostport > busyport+10 {
+		t.Errorf("allocated host port %v is outside the range %v-%v, or busy", hostport, busyport+1, busyport+10)
+	}
+
+	err = node1.ForwardSSHPort(hostport)
+	if err != nil {
+		t.Fatalf("forwarding allocated host port failed with: %v", err)
+	}
+
+	err = node2.ForwardSSHPort(hostport)
+	if !errors.Is(err, kuttilib.ErrPortHostPortAlreadyUsed) {
+		t.Errorf("forwarding host port used by another cluster returned %v instead of ErrPortHostPortAlreadyUsed", err)
+	}
+
+	nexthostport, err := kuttilib.AllocateHostPort()
+	if err != nil {
+		t.Fatalf("allocating second host port failed with: %v", err)
+	}
+	if nexthostport == hostport {
+		t.Errorf("allocated host port %v again", hostport)
+	}
+}
+
+func TestExec(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the SSH test server runs commands with sh")
+	}
+	driver := sshtestdriver(t)
+
+	err := kuttilib.NewEmptyCluster(EXECCLUSTERNAME, K8SVERSION1, DRIVER4)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteClusterCascade(context.Background(), EXECCLUSTERNAME, kuttilib.CascadeOptions{ContinueOnError: true})
+
+	cluster, _ := kuttilib.GetCluster(EXECCLUSTERNAME)
+	node, err := cluster.NewUninitializedNode(NEWNODE1NAME)
+	if err != nil {
+		t.Fatalf("node creation failed with: %v", err)
+	}
+
+	_, _, _, err = node.Exec(context.Background(), "true")
+	if !errors.Is(err, kuttilib.ErrSSHNotAvailable) {
+		t.Errorf("exec without SSH port returned %v instead of ErrSSHNotAvailable", err)
+	}
+
+	forwardsshport(t, node)
+	host := driver.host(t, node)
+
+	removesshkeys()
+	defer removesshkeys()
+	_, _, _, err = node.Exec(context.Background(), "true")
+	if !errors.Is(err, kuttilib.ErrSSHFailed) {
+		t.Errorf("exec without SSH key returned %v instead of ErrSSHFailed", err)
+	}
+	_, err = node.SSHClientConfig()
+	if !errors.Is(err, kuttilib.ErrNoSSHKey) {
+		t.Errorf("SSH client config without SSH key returned %v instead of ErrNoSSHKey", err)
+	}
+
+	publickey, err := kuttilib.EnsureSSHKey()
+	if err != nil {
+		t.Fatalf("generating SSH key failed with: %v", err)
+	}
+
+	kuttilib.SetSSHUser("tester")
+	defer kuttilib.SetSSHUser("kuttiadmin")
+	host.authorize(t, "tester", publickey)
+
+	stdout, stderr, exitcode, err := node.Exec(context.Background(), "echo hello; echo oops >&2; exit 3")
+	if err != nil {
+		t.Fatalf("exec failed with: %v", err)
+	}
+	if stdout != "hello\n" || stderr != "oops\n" || exitcode != 3 {
+		t.Errorf("exec returned stdout %q, stderr %q and exit code %v", stdout, stderr, exitcode)
+	}
+
+	logins, commands := host.loginsandcommands()
+	if !slices.Equal(logins, []string{"tester publickey", "tester publickey"}) ||
+		len(commands) != 2 ||
+		!strings.HasPrefix(commands[0], "home=$(getent passwd 'tester' | ") ||
+		commands[1] != "echo hello; echo oops >&2; exit 3" {
+		t.Errorf("SSH server saw logins %q and commands %q", logins, commands)
+	}
+	if node.SSHKeyFingerprint() == "" {
+		t.Errorf("SSH key was not added before the node was first used")
+	}
+	if node.SSHHostKey() != host.publickey() {
+		t.Errorf("pinned SSH host key is %q instead of %q", node.SSHHostKey(), host.publickey())
+	}
+
+	clientconfig, err := node.SSHClientConfig()
+	if err != nil {
+		t.Fatalf("getting SSH client config failed with: %v", err)
+	}
+	client, err := ssh.Dial("tcp", node.SSHAddress(), clientconfig)
+	if err != nil {
+		t.Fatalf("connecting with SSH client config failed with: %v", err)
+	}
+	session, err := client.NewSession()
+	if err == nil {
+		var output []byte
+		output, err = session.Output("echo hello")
+		if string(output) != "hello\n" {
+			t.Errorf("command run with SSH client config returned %q", output)
+		}
+	}
+	client.Close()
+	if err != nil {
+		t.Errorf("running command with SSH client config failed with: %v", err)
+	}
+
+	var streamed strings.Builder
+	_, err = node.ExecStream(context.Background(), "cat", strings.NewReader("streamed"), &streamed, nil)
+	if err != nil {
+		t.Fatalf("streaming exec failed with: %v", err)
+	}
+	if streamed.String() != "streamed" {
+		t.Errorf("streaming exec returned %q", streamed.String())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, _, err = node.Exec(ctx, "true")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("exec with canceled context returned %v instead of context.Canceled", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, _, _, err = node.Exec(ctx, "sleep 10")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("exec outliving its context returned %v instead of context.DeadlineExceeded", err)
+	}
+
+	tempdir := t.TempDir()
+	localfile := filepath.Join(tempdir, "local")
+	remotefile := filepath.Join(tempdir, "remote file")
+	copiedfile := filepath.Join(tempdir, "copied")
+
+	err = os.WriteFile(localfile, []byte("kutti"), 0640)
+	if err != nil {
+		t.Fatalf("writing local file failed with: %v", err)
+	}
+
+	err = node.CopyTo(context.Background(), localfile, remotefile)
+	if err != nil {
+		t.Fatalf("copying to node failed with: %v", err)
+	}
+	if info, err := os.Stat(remotefile); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("copied remote file has mode %v, error %v", info.Mode(), err)
+	}
+
+	err = node.CopyFrom(context.Background(), remotefile, copiedfile)
+	if err != nil {
+		t.Fatalf("copying from node failed with: %v", err)
+	}
+
+	data, err := os.ReadFile(copiedfile)
+	if err != nil || string(data) != "kutti" {
+		t.Errorf("copied file contains %q, error %v", data, err)
+	}
+
+	err = node.CopyFrom(context.Background(), filepath.Join(tempdir, "missing"), copiedfile)
+	if !errors.Is(err, kuttilib.ErrCommandFailed) {
+		t.Errorf("copying missing file returned %v instead of ErrCommandFailed", err)
+	}
+	if data, err := os.ReadFile(copiedfile); err != nil || string(data) != "kutti" {
+		t.Errorf("failed copy changed existing local file to %q, error %v", data, err)
+	}
+
+	err = node.CopyFrom(context.Background(), filepath.Join(tempdir, "missing"), filepath.Join(tempdir, "new"))
+	if !errors.Is(err, kuttilib.ErrCommandFailed) {
+		t.Errorf("copying missing file to new local file returned %v instead of ErrCommandFailed", err)
+	}
+	if entries, _ := os.ReadDir(tempdir); len(entries) != 3 {
+		t.Errorf("failed copies left files behind: %v", entries)
+	}
+
+	err = node.CopyTo(context.Background(), localfile, filepath.Join(tempdir, "missing", "file"))
+	if !errors.Is(err, kuttilib.ErrCommandFailed) {
+		t.Errorf("copying to missing directory returned %v instead of ErrCommandFailed", err)
+	}
+
+	err = host.rekey()
+	if err != nil {
+		t.Fatalf("changing host key failed with: %v", err)
+	}
+	_, _, _, err = node.Exec(context.Background(), "true")
+	if !errors.Is(err, kuttilib.ErrSSHHostKeyMismatch) {
+		t.Errorf("exec with changed host key returned %v instead of ErrSSHHostKeyMismatch", err)
+	}
+
+	err = node.ForgetSSHHostKey()
+	if err != nil {
+		t.Fatalf("forgetting host key failed with: %v", err)
+	}
+	_, _, _, err = node.Exec(context.Background(), "true")
+	if err != nil {
+		t.Errorf("exec after forgetting host key failed with: %v", err)
+	}
+	if node.SSHHostKey() != host.publickey() {
+		t.Errorf("changed SSH host key was not pinned")
+	}
+}
+
+// fakesudo is a stand-in for sudo, which appends its arguments to the
+// file named by FAKESUDOLOG, and prints a join command when asked to.
+const fakesudo = `#!/bin/sh
+printf '%s\n' "$*" >> "$FAKESUDOLOG"
+case "$*" in
+*--print-join-command*) printf '%s' "$FAKEJOINCOMMAND" ;;
+esac
+`
+
+func TestDefaultCommandRunner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the SSH test server runs commands with sh")
+	}
+	driver := sshtestdriver(t)
+
+	bindir := t.TempDir()
+	err := os.WriteFile(filepath.Join(bindir, "sudo"), []byte(fakesudo), 0755)
+	if err != nil {
+		t.Fatalf("writing sudo stand-in failed with: %v", err)
+	}
+	t.Setenv("PATH", bindir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	sudolog := filepath.Join(bindir, "sudo.log")
+	t.Setenv("FAKESUDOLOG", sudolog)
+	t.Setenv("FAKEJOINCOMMAND", TESTJOINCOMMAND)
+
+	defer removesshkeys()
+	_, err = kuttilib.EnsureSSHKey()
+	if err != nil {
+		t.Fatalf("generating SSH key failed with: %v", err)
+	}
+	driver.setpassword("secret")
+	defer driver.setpassword("")
+
+	err = kuttilib.NewManagedCluster(RUNNERCLUSTERNAME, K8SVERSION1, DRIVER4)
+	if err != nil {
+		t.Fatalf("managed cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteClusterCascade(context.Background(), RUNNERCLUSTERNAME, kuttilib.CascadeOptions{ContinueOnError: true})
+
+	cluster, _ := kuttilib.GetCluster(RUNNERCLUSTERNAME)
+	err = cluster.SetAutoForwardPorts(true)
+	if err != nil {
+		t.Fatalf("enabling port forwarding failed with: %v", err)
+	}
+
+	_, err = cluster.NewControlPlaneNode(CONTROLPLANENAME)
+	if !errors.Is(err, kuttilib.ErrNoSSHPassword) {
+		t.Fatalf("control plane node creation without an SSH password returned %v instead of ErrNoSSHPassword", err)
+	}
+	if _, ok := cluster.GetNode(CONTROLPLANENAME); ok {
+		t.Fatal("control plane node which could not be reached was not removed")
+	}
+	if _, err := os.Stat(sudolog); err == nil {
+		t.Error("kubeadm was run on a node which does not accept the SSH key")
+	}
+
+	kuttilib.SetSSHPassword("secret")
+	defer kuttilib.SetSSHPassword("")
+
+	node, err := cluster.NewControlPlaneNode(CONTROLPLANENAME)
+	if err != nil {
+		t.Fatalf("control plane node creation failed with: %v", err)
+	}
+
+	data, err := os.ReadFile(sudolog)
+	if err != nil {
+		t.Fatalf("reading sudo stand-in log failed with: %v", err)
+	}
+	commands := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(commands) < 2 ||
+		!strings.HasPrefix(commands[0], "kubeadm init --node-name "+CONTROLPLANENAME) ||
+		!strings.HasPrefix(commands[1], "kubeadm token create") {
+		t.Errorf("commands run over SSH were %q", commands)
+	}
+
+	logins, _ := driver.host(t, node).loginsandcommands()
+	if !slices.Contains(logins, "kuttiadmin password") || logins[len(logins)-1] != "kuttiadmin publickey" {
+		t.Errorf("SSH server saw logins %q", logins)
+	}
+}
+
+func TestSSHKey(t *testing.T) {
+	ensureversion(t)
+
+	runner := &recordingrunner{}
+	kuttilib.SetCommandRunner(runner)
+	defer kuttilib.SetCommandRunner(nil)
+
+	confdir, _ := workspace.ConfigDir()
+	keyfile := filepath.Join(confdir, "kuttilib-ssh-key")
+	defer func() {
+		for _, suffix := range []string{"", ".pub", ".old", ".old.pub"} {
+			os.Remove(keyfile + suffix)
+		}
+	}()
+
+	_, err := kuttilib.SSHPublicKey()
+	if !errors.Is(err, kuttilib.ErrNoSSHKey) {
+		t.Fatalf("getting missing SSH key returned %v instead of ErrNoSSHKey", err)
+	}
+
+	publickey, err := kuttilib.EnsureSSHKey()
+	if err != nil {
+		t.Fatalf("generating SSH key failed with: %v", err)
+	}
+	if !strings.HasPrefix(publickey, "ssh-ed25519 ") {
+		t.Errorf("public key %q is not an ed25519 key", publickey)
+	}
+
+	again, _ := kuttilib.EnsureSSHKey()
+	if again != publickey {
+		t.Errorf("SSH key was regenerated")
+	}
+
+	keybody := strings.Fields(publickey)[1]
+	if _, err := exec.LookPath("ssh-keygen"); err == nil {
+		output, err := exec.Command("ssh-keygen", "-y", "-f", keyfile).Output()
+		if err != nil {
+			t.Errorf("ssh-keygen could not read private key: %v", err)
+		} else if fields := strings.Fields(string(output)); len(fields) < 2 || fields[1] != keybody {
+			t.Errorf("ssh-keygen derived public key %q instead of %q", output, publickey)
+		}
+	}
+
+	err = kuttilib.NewEmptyCluster(SSHKEYCLUSTERNAME, K8SVERSION1, DRIVER1)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteClusterCascade(context.Background(), SSHKEYCLUSTERNAME, kuttilib.CascadeOptions{ContinueOnError: true})
+
+	cluster, _ := kuttilib.GetCluster(SSHKEYCLUSTERNAME)
+	node, err := cluster.NewUninitializedNode(NEWNODE1NAME)
+	if err != nil {
+		t.Fatalf("node creation failed with: %v", err)
+	}
+
+	injections := runner.countcontaining(keybody)
+	err = node.StartContext(context.Background())
+	if err != nil {
+		t.Fatalf("node start failed with: %v", err)
+	}
+	if runner.countcontaining(keybody) != injections {
+		t.Errorf("SSH key was injected on start")
+	}
+
+	canceledctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = node.InjectSSHKeyContext(canceledctx)
+	var canceled *kuttilib.CanceledError
+	if !errors.As(err, &canceled) {
+		t.Errorf("SSH key injection with canceled context returned %v instead of a CanceledError", err)
+	}
+
+	err = node.InjectSSHKey()
+	if err != nil {
+		t.Fatalf("SSH key injection failed with: %v", err)
+	}
+	if !runner.issuedcontaining(keybody) {
+		t.Errorf("SSH key was not injected")
+	}
+	if node.SSHKeyFingerprint() == "" {
+		t.Errorf("SSH key fingerprint was not recorded")
+	}
+
+	fingerprint := node.SSHKeyFingerprint()
+	results, err := kuttilib.RotateSSHKey(context.Background(), kuttilib.BulkOptions{})
+	if err != nil {
+		t.Fatalf("rotating SSH key failed with: %v", err)
+	}
+	if result := results[SSHKEYCLUSTERNAME]; result == nil || len(result.Results) != 1 || result.Results[0].Skipped {
+		t.Errorf("rotation result is %+v", result)
+	}
+
+	newpublickey, _ := kuttilib.SSHPublicKey()
+	if newpublickey == publickey {
+		t.Errorf("SSH key was not rotated")
+	}
+	if !runner.issuedcontaining(strings.Fields(newpublickey)[1]) || !runner.issuedcontaining("grep -v -F '"+keybody+"'") {
+		t.Errorf("rotated SSH key was not injected in place of the old one")
+	}
+	if node.SSHKeyFingerprint() == fingerprint {
+		t.Errorf("SSH key fingerprint was not updated by rotation")
+	}
+}
+
+func TestSSHKeyPasswordLogin(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the SSH test server runs commands with sh")
+	}
+	driver := sshtestdriver(t)
+
+	kuttilib.SetSSHPassword("secret")
+	defer kuttilib.SetSSHPassword("")
+	driver.setpassword("secret")
+	defer driver.setpassword("")
+
+	defer removesshkeys()
+	publickey, err := kuttilib.EnsureSSHKey()
+	if err != nil {
+		t.Fatalf("generating SSH key failed with: %v", err)
+	}
+
+	err = kuttilib.NewEmptyCluster(SSHBOOTSTRAPNAME, K8SVERSION1, DRIVER4)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteClusterCascade(context.Background(), SSHBOOTSTRAPNAME, kuttilib.CascadeOptions{ContinueOnError: true})
+
+	cluster, _ := kuttilib.GetCluster(SSHBOOTSTRAPNAME)
+	nodes := []*kuttilib.Node{}
+	for _, nodename := range []string{NEWNODE1NAME, NEWNODE2NAME} {
+		node, err := cluster.NewUninitializedNode(nodename)
+		if err != nil {
+			t.Fatalf("node creation failed with: %v", err)
+		}
+		forwardsshport(t, node)
+		nodes = append(nodes, node)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = nodes[0].StartContext(ctx)
+	if err != nil {
+		t.Fatalf("node start failed with: %v", err)
+	}
+	if nodes[0].SSHKeyFingerprint() != "" {
+		t.Error("SSH key fingerprint was recorded on start")
+	}
+
+	_, _, _, err = nodes[0].Exec(context.Background(), "true")
+	if err != nil {
+		t.Errorf("exec with injected SSH key failed with: %v", err)
+	}
+
+	logins, commands := driver.host(t, nodes[0]).loginsandcommands()
+	if !slices.Contains(logins, "kuttiadmin password") {
+		t.Errorf("SSH server saw logins %q", logins)
+	}
+	if len(commands) < 2 || !strings.Contains(commands[len(commands)-2], strings.Fields(publickey)[1]) {
+		t.Errorf("SSH key injection ran %q", commands)
+	}
+	if logins[len(logins)-1] != "kuttiadmin publickey" {
+		t.Errorf("exec after SSH key injection logged in with %q", logins[len(logins)-1])
+	}
+	if nodes[0].SSHKeyFingerprint() == "" {
+		t.Error("SSH key fingerprint was not recorded")
+	}
+
+	kuttilib.SetSSHPassword("wrong")
+
+	start := time.Now()
+	err = nodes[1].StartContext(context.Background())
+	if err != nil {
+		t.Errorf("node start with wrong SSH password failed with: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("node start with wrong SSH password took %v", elapsed)
+	}
+	if nodes[1].Status() != kuttilib.NodeStatusRunning {
+		t.Errorf("node with wrong SSH password is %v instead of running", nodes[1].Status())
+	}
+	if nodes[1].SSHKeyFingerprint() != "" {
+		t.Error("SSH key fingerprint was recorded after a failed injection")
+	}
+
+	kuttilib.SetSSHPassword("secret")
+	err = nodes[1].InjectSSHKey()
+	if err != nil {
+		t.Errorf("injecting SSH key again failed with: %v", err)
+	}
+	if nodes[1].SSHKeyFingerprint() == "" {
+		t.Error("SSH key fingerprint was not recorded after injecting again")
+	}
+}
+
+func TestHealth(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the SSH test server runs commands with sh")
+	}
+	driver := sshtestdriver(t)
+
+	runner := &recordingrunner{}
+	kuttilib.SetCommandRunner(runner)
+	defer kuttilib.SetCommandRunner(nil)
+
+	defer removesshkeys()
+	publickey, err := kuttilib.EnsureSSHKey()
+	if err != nil {
+		t.Fatalf("generating SSH key failed with: %v", err)
+	}
+
+	err = kuttilib.NewManagedCluster(HEALTHCLUSTERNAME, K8SVERSION1, DRIVER4)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteClusterCascade(context.Background(), HEALTHCLUSTERNAME, kuttilib.CascadeOptions{ContinueOnError: true})
+
+	cluster, _ := kuttilib.GetCluster(HEALTHCLUSTERNAME)
+	health, err := cluster.Health(context.Background())
+	if err != nil || health.Status != kuttilib.HealthStatusUnknown {
+		t.Errorf("health of empty cluster is %+v, error %v", health, err)
+	}
+
+	controlplane, err := cluster.NewControlPlaneNode(NEWNODE1NAME)
+	if err != nil {
+		t.Fatalf("control plane node creation failed with: %v", err)
+	}
+	worker, err := cluster.NewWorkerNode(NEWNODE2NAME)
+	if err != nil {
+		t.Fatalf("worker node creation failed with: %v", err)
+	}
+
+	nodehealth, _ := controlplane.Health(context.Background())
+	if check, _ := nodehealth.Check(kuttilib.HealthCheckSSH); check.Status != kuttilib.HealthStatusUnhealthy {
+		t.Errorf("SSH check without SSH port is %+v", check)
+	}
+
+	for _, node := range []*kuttilib.Node{controlplane, worker} {
+		forwardsshport(t, node)
+		driver.host(t, node).authorize(t, kuttilib.SSHUser(), publickey)
+	}
+
+	nodehealth, err = controlplane.Health(context.Background())
+	if err != nil {
+		t.Fatalf("node health check failed with: %v", err)
+	}
+	if nodehealth.Status != kuttilib.HealthStatusHealthy || len(nodehealth.Checks) != 5 {
+		t.Errorf("control plane node health is %+v", nodehealth)
+	}
+
+	health, err = cluster.Health(context.Background())
+	if err != nil {
+		t.Fatalf("cluster health check failed with: %v", err)
+	}
+	if health.Status != kuttilib.HealthStatusDegraded || len(health.Nodes) != 2 {
+		t.Errorf("cluster health is %v instead of Degraded", health.Status)
+	}
+	for _, nodehealth := range health.Nodes {
+		if nodehealth.Node != NEWNODE2NAME {
+			continue
+		}
+		check, _ := nodehealth.Check(kuttilib.HealthCheckNodeReady)
+		if nodehealth.Status != kuttilib.HealthStatusUnhealthy || check.Status != kuttilib.HealthStatusUnhealthy {
+			t.Errorf("worker node health is %+v", nodehealth)
+		}
+	}
+
+	kuttilib.SetCommandRunner(blockingrunner{})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	start := time.Now()
+	_, err = controlplane.Health(ctx)
+	cancel()
+	kuttilib.SetCommandRunner(runner)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("health check with blocked commands returned %v instead of context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("health check with blocked commands took %v", elapsed)
+	}
+
+	err = controlplane.StopContext(context.Background())
+	if err != nil {
+		t.Fatalf("stopping control plane node failed with: %v", err)
+	}
+
+	health, _ = cluster.Health(context.Background())
+	if health.Status != kuttilib.HealthStatusUnhealthy {
+		t.Errorf("cluster health with stopped control plane is %v instead of Unhealthy", health.Status)
+	}
+	for _, nodehealth := range health.Nodes {
+		check, _ := nodehealth.Check(kuttilib.HealthCheckNodeReady)
+		if check.Status != kuttilib.HealthStatusUnknown {
+			t.Errorf("node readiness with stopped control plane is %+v", check)
+		}
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = cluster.Health(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("health check with canceled context returned %v instead of context.Canceled", err)
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the SSH test server runs commands with sh")
+	}
+	driver := sshtestdriver(t)
+
+	runner := &recordingrunner{}
+	kuttilib.SetCommandRunner(runner)
+	defer kuttilib.SetCommandRunner(nil)
+
+	defer removesshkeys()
+	publickey, err := kuttilib.EnsureSSHKey()
+	if err != nil {
+		t.Fatalf("generating SSH key failed with: %v", err)
+	}
+
+	err = kuttilib.NewManagedCluster(WAITCLUSTERNAME, K8SVERSION1, DRIVER4)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteClusterCascade(context.Background(), WAITCLUSTERNAME, kuttilib.CascadeOptions{ContinueOnError: true})
+
+	cluster, _ := kuttilib.GetCluster(WAITCLUSTERNAME)
+	controlplane, err := cluster.NewControlPlaneNode(NEWNODE1NAME)
+	if err != nil {
+		t.Fatalf("control plane node creation failed with: %v", err)
+	}
+
+	err = controlplane.WaitFor(context.Background(), kuttilib.NodeHasStatus(kuttilib.NodeStatusRunning), kuttilib.WaitOptions{Timeout: time.Second})
+	if err != nil {
+		t.Errorf("waiting for running node failed with: %v", err)
+	}
+
+	checks := 0
+	never := func(ctx context.Context, n *kuttilib.Node) (bool, string, error) {
+		checks++
+		return false, fmt.Sprintf("check %v", checks), nil
+	}
+	opts := kuttilib.WaitOptions{
+		Timeout:         100 * time.Millisecond,
+		PollInterval:    10 * time.Millisecond,
+		Backoff:         2,
+		MaxPollInterval: 40 * time.Millisecond,
+	}
+	err = controlplane.WaitFor(context.Background(), never, opts)
+	var timeouterr *kuttilib.TimeoutError
+	if !errors.As(err, &timeouterr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("waiting for unmet condition returned %v instead of a TimeoutError", err)
+	}
+	if checks < 2 || timeouterr.LastStatus != fmt.Sprintf("check %v", checks) {
+		t.Errorf("timeout after %v checks reported last status %q", checks, timeouterr.LastStatus)
+	}
+
+	failing := func(ctx context.Context, n *kuttilib.Node) (bool, string, error) {
+		return false, "", kuttilib.ErrCommandFailed
+	}
+	err = controlplane.WaitFor(context.Background(), failing, kuttilib.WaitOptions{})
+	if !errors.Is(err, kuttilib.ErrCommandFailed) {
+		t.Errorf("waiting for failing condition returned %v instead of ErrCommandFailed", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = controlplane.WaitFor(ctx, never, kuttilib.WaitOptions{})
+	var cancelederr *kuttilib.CanceledError
+	if !errors.As(err, &cancelederr) {
+		t.Errorf("waiting with canceled context returned %v instead of a CanceledError", err)
+	}
+
+	forwardsshport(t, controlplane)
+	driver.host(t, controlplane).authorize(t, kuttilib.SSHUser(), publickey)
+
+	err = cluster.WaitForReady(context.Background(), kuttilib.WaitOptions{Timeout: 5 * time.Second})
+	if err != nil {
+		t.Errorf("waiting for ready cluster failed with: %v", err)
+	}
+
+	_, err = cluster.NewWorkerNode(NEWNODE2NAME)
+	if err != nil {
+		t.Fatalf("worker node creation failed with: %v", err)
+	}
+
+	err = cluster.WaitForReady(context.Background(), kuttilib.WaitOptions{Timeout: 50 * time.Millisecond, PollInterval: 10 * time.Millisecond})
+	if !errors.As(err, &timeouterr) || !strings.Contains(timeouterr.LastStatus, NEWNODE2NAME) {
+		t.Errorf("waiting for cluster with unready node returned %v", err)
+	}
+}
+
+func TestDefaultWaitOptions(t *testing.T) {
+	ensuredriverversion(t, DRIVER2)
+
+	err := kuttilib.NewEmptyCluster(CREATECLUSTERNAME, K8SVERSION1, DRIVER2)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteCluster(CREATECLUSTERNAME, true)
+
+	cluster, _ := kuttilib.GetCluster(CREATECLUSTERNAME)
+	vmdriver, _ := drivercore.GetDriver(DRIVER2)
+	sized := vmdriver.(*sizeddriver)
+
+	node, err := cluster.NewUninitializedNode(NEWNODE1NAME)
+	if err != nil {
+		t.Fatalf("node creation failed with: %v", err)
+	}
+	defer cluster.DeleteNode(NEWNODE1NAME, true)
+
+	if opts := kuttilib.DefaultWaitOptions(); opts.Timeout != kuttilib.DefaultWaitTimeout {
+		t.Errorf("default wait timeout is %v instead of %v", opts.Timeout, kuttilib.DefaultWaitTimeout)
+	}
+
+	opts := kuttilib.WaitOptions{Timeout: time.Second, PollInterval: 10 * time.Millisecond}
+	kuttilib.SetDefaultWaitOptions(opts)
+	defer kuttilib.SetDefaultWaitOptions(kuttilib.WaitOptions{Timeout: kuttilib.DefaultWaitTimeout})
+	if current := kuttilib.DefaultWaitOptions(); current != opts {
+		t.Errorf("default wait options are %v instead of %v", current, opts)
+	}
+
+	before := len(sized.waits())
+	err = node.Start()
+	if err != nil {
+		t.Fatalf("node start failed with: %v", err)
+	}
+	if nodestatus := node.Status(); nodestatus != kuttilib.NodeStatusRunning {
+		t.Errorf("node status after start is %v instead of running", nodestatus)
+	}
+
+	err = node.ForceStop()
+	if err != nil {
+		t.Fatalf("node force stop failed with: %v", err)
+	}
+	if nodestatus := node.Status(); nodestatus != kuttilib.NodeStatusStopped {
+		t.Errorf("node status after force stop is %v instead of stopped", nodestatus)
+	}
+
+	if waits := sized.waits()[before:]; len(waits) != 0 {
+		t.Errorf("node operations made fixed driver waits %v", waits)
+	}
+
+	kuttilib.SetDefaultWaitOptions(kuttilib.WaitOptions{Timeout: 50 * time.Millisecond, PollInterval: 10 * time.Millisecond})
+	sized.setstuck(true)
+	defer sized.setstuck(false)
+
+	var timeouterr *kuttilib.TimeoutError
+	err = node.Start()
+	if !errors.As(err, &timeouterr) {
+		t.Errorf("start of a node which does not start returned %v instead of a TimeoutError", err)
+	}
+	err = node.StartContext(context.Background())
+	if !errors.As(err, &timeouterr) {
+		t.Errorf("start with a context of a node which does not start returned %v instead of a TimeoutError", err)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	ensureversion(t)
+
+	events := make(chan kuttilib.Event, 100)
+	unsubscribe := kuttilib.Subscribe(func(event kuttilib.Event) {
+		if event.Cluster == EVENTSCLUSTERNAME {
+			events <- event
+		}
+	})
+	defer unsubscribe()
+
+	confdir, _ := workspace.ConfigDir()
+	configfile := filepath.Join(confdir, "kuttilib-clusters.json")
+	savedports := make(chan bool, 10)
+	unsubscribeports := kuttilib.Subscribe(func(event kuttilib.Event) {
+		if event.Cluster == EVENTSCLUSTERNAME && event.Type == kuttilib.EventPortForwarded {
+			data, _ := os.ReadFile(configfile)
+			savedports <- strings.Contains(string(data), strconv.Itoa(event.HostPort))
+		}
+	})
+	defer unsubscribeports()
+
+	expect := func(eventtype kuttilib.EventType, node string) kuttilib.Event {
+		t.Helper()
+		select {
+		case event := <-events:
+			if event.Type != eventtype || event.Node != node || event.Time.IsZero() {
+				t.Errorf("got event %+v, expected %v for node %q", event, eventtype, node)
+			}
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for event %v", eventtype)
+		}
+		return kuttilib.Event{}
+	}
+
+	err := kuttilib.NewEmptyCluster(EVENTSCLUSTERNAME, K8SVERSION1, DRIVER1)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteClusterCascade(context.Background(), EVENTSCLUSTERNAME, kuttilib.CascadeOptions{ContinueOnError: true})
+	expect(kuttilib.EventClusterCreated, "")
+
+	cluster, _ := kuttilib.GetCluster(EVENTSCLUSTERNAME)
+	node, err := cluster.NewUninitializedNode(NEWNODE1NAME)
+	if err != nil {
+		t.Fatalf("node creation failed with: %v", err)
+	}
+	expect(kuttilib.EventNodeCreated, NEWNODE1NAME)
+
+	hostport, err := kuttilib.AllocateHostPort()
+	if err != nil {
+		t.Fatalf("allocating host port failed with: %v", err)
+	}
+	err = node.ForwardSSHPort(hostport)
+	if err != nil {
+		t.Fatalf("forwarding SSH port failed with: %v", err)
+	}
+	event := expect(kuttilib.EventPortForwarded, NEWNODE1NAME)
+	if event.HostPort != hostport || event.NodePort != 22 {
+		t.Errorf("port forwarded event has ports %v:%v", event.HostPort, event.NodePort)
+	}
+	if !<-savedports {
+		t.Error("port forwarded event was published before the port was saved")
+	}
+
+	err = node.StartContext(context.Background())
+	if err != nil {
+		t.Fatalf("node start failed with: %v", err)
+	}
+	expect(kuttilib.EventNodeStarted, NEWNODE1NAME)
+
+	err = node.StopContext(context.Background())
+	if err != nil {
+		t.Fatalf("node stop failed with: %v", err)
+	}
+	expect(kuttilib.EventNodeStopped, NEWNODE1NAME)
+
+	err = cluster.DeleteNode(NEWNODE1NAME, false)
+	if err != nil {
+		t.Fatalf("node deletion failed with: %v", err)
+	}
+	expect(kuttilib.EventPortUnforwarded, NEWNODE1NAME)
+	expect(kuttilib.EventNodeDeleted, NEWNODE1NAME)
+
+	err = kuttilib.DeleteCluster(EVENTSCLUSTERNAME, false)
+	if err != nil {
+		t.Fatalf("cluster deletion failed with: %v", err)
+	}
+	expect(kuttilib.EventClusterDeleted, "")
+
+	err = kuttilib.DeleteCluster(EVENTSCLUSTERNAME, false)
+	event = expect(kuttilib.EventClusterDeleteFailed, "")
+	if !errors.Is(event.Err, kuttilib.ErrClusterDoesNotExist) || !errors.Is(err, kuttilib.ErrClusterDoesNotExist) {
+		t.Errorf("delete failed event has error %v", event.Err)
+	}
+
+	unsubscribe()
+	kuttilib.NewEmptyCluster(EVENTSCLUSTERNAME, K8SVERSION1, DRIVER1)
+	select {
+	case event := <-events:
+		t.Errorf("got event %+v after unsubscribing", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestLogger(t *testing.T) {
+	ensureversion(t)
+
+	levels := map[kuttilib.VerbosityLevel]slog.Level{
+		kuttilib.VerbosityQuiet: slog.LevelWarn,
+		kuttilib.VerbosityInfo:  slog.LevelInfo,
+		kuttilib.VerbosityDebug: slog.LevelDebug,
+	}
+	for level, expected := range levels {
+		if level.SlogLevel() != expected {
+			t.Errorf("verbosity level %v maps to %v instead of %v", level, level.SlogLevel(), expected)
+		}
+	}
+
+	var buffer bytes.Buffer
+	kuttilib.SetLogger(slog.New(slog.NewJSONHandler(&buffer, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	defer kuttilib.SetLogger(nil)
+
+	err := kuttilib.NewEmptyCluster(LOGGERCLUSTERNAME, K8SVERSION1, DRIVER1)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteClusterCascade(context.Background(), LOGGERCLUSTERNAME, kuttilib.CascadeOptions{ContinueOnError: true})
+
+	cluster, _ := kuttilib.GetCluster(LOGGERCLUSTERNAME)
+	node, err := cluster.NewUninitializedNode(NEWNODE1NAME)
+	if err != nil {
+		t.Fatalf("node creation failed with: %v", err)
+	}
+
+	buffer.Reset()
+	err = node.ForceStart()
+	if err != nil {
+		t.Fatalf("node force start failed with: %v", err)
+	}
+
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		var record map[string]any
+		err := json.Unmarshal([]byte(line), &record)
+		if err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+
+		if record["msg"] != "Done." {
+			continue
+		}
+		found = true
+		if record["level"] != "INFO" ||
+			record["cluster"] != LOGGERCLUSTERNAME ||
+			record["node"] != NEWNODE1NAME ||
+			record["driver"] != DRIVER1 ||
+			record["operation"] != "force start" ||
+			record["duration"] == nil {
+			t.Errorf("log record is %v", record)
+		}
+	}
+	if !found {
+		t.Errorf("force start was not logged: %q", buffer.String())
+	}
+}
+
+func TestConfigSchema(t *testing.T) {
+	confdir, err := workspace.ConfigDir()
+	if err != nil {
+		t.Fatalf("getting config dir failed with: %v", err)
+	}
+	defer kuttilib.SetWorkspace(filepath.Dir(confdir))
+
+	workspacepath := t.TempDir()
+	testconfdir := filepath.Join(workspacepath, "kutti-config")
+	configfile := filepath.Join(testconfdir, "kuttilib-clusters.json")
+	err = os.MkdirAll(testconfdir, 0755)
+	if err != nil {
+		t.Fatalf("creating config dir failed with: %v", err)
+	}
+
+	olddata := []byte(`{"Clusters":{},"HostPortRanges":[{"First":20000,"Last":20010}]}`)
+	err = os.WriteFile(configfile, olddata, 0644)
+	if err != nil {
+		t.Fatalf("writing config file failed with: %v", err)
+	}
+
+	err = kuttilib.SetWorkspace(workspacepath)
+	if err != nil {
+		t.Fatalf("setting workspace with unversioned config failed with: %v", err)
+	}
+	ranges := kuttilib.HostPortRanges()
+	if len(ranges) != 1 || ranges[0].First != 20000 {
+		t.Errorf("migrated host port ranges are %v", ranges)
+	}
+
+	backupdata, err := os.ReadFile(configfile + ".v0.bak")
+	if err != nil || string(backupdata) != string(olddata) {
+		t.Errorf("backup of unversioned config is %q, error %v", backupdata, err)
+	}
+
+	err = kuttilib.SetHostPortRanges(ranges)
+	if err != nil {
+		t.Fatalf("saving migrated config failed with: %v", err)
+	}
+	var saved struct{ SchemaVersion int }
+	newdata, _ := os.ReadFile(configfile)
+	json.Unmarshal(newdata, &saved)
+	if saved.SchemaVersion != kuttilib.ConfigSchemaVersion {
+		t.Errorf("saved config has schema version %v instead of %v", saved.SchemaVersion, kuttilib.ConfigSchemaVersion)
+	}
+	if runtime.GOOS != "windows" {
+		for _, filename := range []string{configfile, configfile + ".v0.bak"} {
+			info, err := os.Stat(filename)
+			if err != nil {
+				t.Errorf("checking %v failed with: %v", filepath.Base(filename), err)
+			} else if info.Mode().Perm() != 0600 {
+				t.Errorf("%v has mode %v instead of 0600", filepath.Base(filename), info.Mode().Perm())
+			}
+		}
+	}
+
+	newerdata := fmt.Sprintf(`{"SchemaVersion":%v,"Clusters":{}}`, kuttilib.ConfigSchemaVersion+1)
+	err = os.WriteFile(configfile, []byte(newerdata), 0644)
+	if err != nil {
+		t.Fatalf("writing config file failed with: %v", err)
+	}
+
+	err = kuttilib.SetWorkspace(workspacepath)
+	if !errors.Is(err, kuttilib.ErrConfigSchemaTooNew) {
+		t.Errorf("setting workspace with newer config returned %v instead of ErrConfigSchemaTooNew", err)
+	}
+
+	err = kuttilib.SetHostPortRanges(nil)
+	if !errors.Is(err, kuttilib.ErrConfigSchemaTooNew) {
+		t.Errorf("changing newer config returned %v instead of ErrConfigSchemaTooNew", err)
+	}
+	data, _ := os.ReadFile(configfile)
+	if string(data) != newerdata {
+		t.Errorf("newer config was overwritten with %q", data)
+	}
+
+	_, err = kuttilib.EnsureSSHKey()
+	if !errors.Is(err, kuttilib.ErrConfigSchemaTooNew) {
+		t.Errorf("creating SSH key in workspace with newer config returned %v instead of ErrConfigSchemaTooNew", err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	ensureversion(t)
+
+	runner := &recordingrunner{}
+	kuttilib.SetCommandRunner(runner)
+	defer kuttilib.SetCommandRunner(nil)
+
+	err := kuttilib.NewManagedCluster(EXPORTCLUSTERNAME, K8SVERSION1, DRIVER1)
+	if err != nil {
+		t.Fatalf("managed cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteClusterCascade(context.Background(), EXPORTCLUSTERNAME, kuttilib.CascadeOptions{ContinueOnError: true})
+
+	cluster, _ := kuttilib.GetCluster(EXPORTCLUSTERNAME)
+	err = cluster.SetAutoForwardPorts(true)
+	if err != nil {
+		t.Fatalf("enabling automatic port forwarding failed with: %v", err)
+	}
+
+	_, err = cluster.NewControlPlaneNode(CONTROLPLANENAME)
+	if err != nil {
+		t.Fatalf("control plane node creation failed with: %v", err)
+	}
+	_, err = cluster.NewWorkerNode(WORKERNAME)
+	if err != nil {
+		t.Fatalf("worker node creation failed with: %v", err)
+	}
+
+	var archive bytes.Buffer
+	err = kuttilib.ExportCluster(EXPORTCLUSTERNAME, &archive, kuttilib.ExportOptions{})
+	if err != nil {
+		t.Fatalf("export failed with: %v", err)
+	}
+
+	archivereader, err := gzip.NewReader(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatalf("reading exported archive failed with: %v", err)
+	}
+	archivedata, _ := io.ReadAll(archivereader)
+	if bytes.Contains(archivedata, []byte("abcdef.0123456789abcdef")) {
+		t.Error("the join token was exported")
+	}
+
+	_, err = kuttilib.ImportCluster(bytes.NewReader(archive.Bytes()), EXPORTCLUSTERNAME)
+	if !errors.Is(err, kuttilib.ErrClusterExists) {
+		t.Errorf("import with existing name returned %v instead of ErrClusterExists", err)
+	}
+
+	_, err = kuttilib.ImportCluster(strings.NewReader("not an archive"), IMPORTCLUSTERNAME)
+	if !errors.Is(err, kuttilib.ErrArchiveInvalid) {
+		t.Errorf("import of invalid data returned %v instead of ErrArchiveInvalid", err)
+	}
+
+	// Commands can only reach nodes on a NAT driver once their SSH
+	// port is forwarded.
+	var unreachable []string
+	var unreachablemu sync.Mutex
+	kuttilib.SetCommandRunner(kuttilib.CommandRunnerFunc(func(node *kuttilib.Node, command string) (string, error) {
+		if _, ok := node.Ports()[22]; !ok {
+			unreachablemu.Lock()
+			unreachable = append(unreachable, node.Name()+": "+command)
+			unreachablemu.Unlock()
+		}
+		return runner.RunCommand(node, command)
+	}))
+
+	imported, err := kuttilib.ImportCluster(bytes.NewReader(archive.Bytes()), IMPORTCLUSTERNAME)
+	if imported != nil {
+		defer kuttilib.DeleteClusterCascade(context.Background(), IMPORTCLUSTERNAME, kuttilib.CascadeOptions{ContinueOnError: true})
+	}
+	if err != nil {
+		t.Fatalf("import failed with: %v", err)
+	}
+	if len(unreachable) != 0 {
+		t.Errorf("import ran %q before the SSH ports of nodes were forwarded", unreachable)
+	}
+
+	if imported.Name() != IMPORTCLUSTERNAME || imported.Type() != kuttilib.ClusterTypeManaged || !imported.AutoForwardPorts() {
+		t.Errorf("imported cluster is %v of type %v with automatic port forwarding %v", imported.Name(), imported.Type(), imported.AutoForwardPorts())
+	}
+
+	for _, original := range cluster.Nodes() {
+		node, ok := imported.GetNode(original.Name())
+		if !ok {
+			t.Errorf("node %v was not imported", original.Name())
+			continue
+		}
+		if node.Type() != original.Type() {
+			t.Errorf("node %v was imported as type %v instead of %v", node.Name(), node.Type(), original.Type())
+		}
+
+		originalports, ports := original.Ports(), node.Ports()
+		if len(ports) != len(originalports) {
+			t.Errorf("node %v was imported with ports %v instead of %v", node.Name(), ports, originalports)
+		}
+		for nodeport, hostport := range originalports {
+			if ports[nodeport] == 0 || ports[nodeport] == hostport {
+				t.Errorf("node %v port %v was imported as host port %v, expected a port other than %v", node.Name(), nodeport, ports[nodeport], hostport)
+			}
+		}
+	}
+
+	err = cluster.SetAutoForwardPorts(false)
+	if err != nil {
+		t.Fatalf("disabling automatic port forwarding failed with: %v", err)
+	}
+
+	archive.Reset()
+	err = kuttilib.ExportCluster(EXPORTCLUSTERNAME, &archive, kuttilib.ExportOptions{})
+	if err != nil {
+		t.Fatalf("export without automatic port forwarding failed with: %v", err)
+	}
+
+	imported2, err := kuttilib.ImportCluster(bytes.NewReader(archive.Bytes()), IMPORTCLUSTER2NAME)
+	if imported2 != nil {
+		defer kuttilib.DeleteClusterCascade(context.Background(), IMPORTCLUSTER2NAME, kuttilib.CascadeOptions{ContinueOnError: true})
+	}
+	if err != nil {
+		t.Fatalf("import without automatic port forwarding failed with: %v", err)
+	}
+	if imported2.AutoForwardPorts() {
+		t.Error("automatic port forwarding was enabled in the imported cluster")
+	}
+	if len(unreachable) != 0 {
+		t.Errorf("import without automatic port forwarding ran %q before the SSH ports of nodes were forwarded", unreachable)
+	}
+	kuttilib.SetCommandRunner(runner)
+
+	for _, node := range cluster.Nodes() {
+		if node.Status() == kuttilib.NodeStatusRunning {
+			err = node.Stop()
+			if err != nil {
+				t.Fatalf("stopping node %v failed with: %v", node.Name(), err)
+			}
+		}
+	}
+
+	archive.Reset()
+	err = kuttilib.ExportCluster(EXPORTCLUSTERNAME, &archive, kuttilib.ExportOptions{IncludeDisks: true})
+	if !errors.Is(err, kuttilib.ErrDiskExportNotSupported) {
+		t.Errorf("export with disks returned %v instead of ErrDiskExportNotSupported", err)
+	}
+	if archive.Len() != 0 {
+		t.Errorf("failed export wrote %v bytes", archive.Len())
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	ensureversion(t)
+	ensuredriverversion(t, DRIVER3)
+
+	err := kuttilib.NewEmptyCluster(SNAPSHOTCLUSTER1, K8SVERSION1, DRIVER1)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteClusterCascade(context.Background(), SNAPSHOTCLUSTER1, kuttilib.CascadeOptions{ContinueOnError: true})
+
+	cluster, _ := kuttilib.GetCluster(SNAPSHOTCLUSTER1)
+	node, err := cluster.NewUninitializedNode(NEWNODE1NAME)
+	if err != nil {
+		t.Fatalf("node creation failed with: %v", err)
+	}
+
+	err = node.Snapshot("snapa")
+	if !errors.Is(err, kuttilib.ErrSnapshotsNotSupported) {
+		t.Errorf("snapshot with unsupporting driver returned %v instead of ErrSnapshotsNotSupported", err)
+	}
+
+	_, err = cluster.SnapshotAll(context.Background(), "snapa", kuttilib.BulkOptions{})
+	if !errors.Is(err, kuttilib.ErrSnapshotsNotSupported) {
+		t.Errorf("cluster snapshot with unsupporting driver returned %v instead of ErrSnapshotsNotSupported", err)
+	}
+
+	err = kuttilib.NewEmptyCluster(SNAPSHOTCLUSTER2, K8SVERSION1, DRIVER3)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteClusterCascade(context.Background(), SNAPSHOTCLUSTER2, kuttilib.CascadeOptions{ContinueOnError: true})
+
+	cluster, _ = kuttilib.GetCluster(SNAPSHOTCLUSTER2)
+	node1, err := cluster.NewUninitializedNode(NEWNODE1NAME)
+	if err != nil {
+		t.Fatalf("node creation failed with: %v", err)
+	}
+	node2, err := cluster.NewUninitializedNode(NEWNODE2NAME)
+	if err != nil {
+		t.Fatalf("node creation failed with: %v", err)
+	}
+
+	err = node1.Start()
+	if err != nil {
+		t.Fatalf("node start failed with: %v", err)
+	}
+
+	err = node1.Snapshot("Bad Name")
+	if !errors.Is(err, kuttilib.ErrInvalidName) {
+		t.Errorf("snapshot with invalid name returned %v instead of ErrInvalidName", err)
+	}
+
+	driver, _ := drivercore.GetDriver(DRIVER3)
+	snapdriver := driver.(*snapshotdriver)
+	updatable := false
+	snapdriver.setduringdriverop(func() {
+		updatable = configupdatable(cluster)
+	})
+
+	err = node1.Snapshot("snapa")
+	snapdriver.setduringdriverop(nil)
+	if err != nil {
+		t.Fatalf("snapshot failed with: %v", err)
+	}
+	if !updatable {
+		t.Error("the configuration was locked while the snapshot was taken")
+	}
+
+	err = node1.Snapshot("snapa")
+	if !errors.Is(err, kuttilib.ErrSnapshotExists) {
+		t.Errorf("duplicate snapshot returned %v instead of ErrSnapshotExists", err)
+	}
+
+	snapshots := node1.Snapshots()
+	if len(snapshots) != 1 || snapshots[0].Name != "snapa" || snapshots[0].CreatedAt.IsZero() {
+		t.Errorf("node snapshots are %+v, expected snapa", snapshots)
+	}
+
+	err = node1.RestoreSnapshot("snapa")
+	if !errors.Is(err, kuttilib.ErrNodeIsRunning) {
+		t.Errorf("restoring a running node returned %v instead of ErrNodeIsRunning", err)
+	}
+
+	_, err = cluster.SnapshotAll(context.Background(), "snapa", kuttilib.BulkOptions{})
+	if !errors.Is(err, kuttilib.ErrSnapshotExists) {
+		t.Errorf("cluster snapshot with existing name returned %v instead of ErrSnapshotExists", err)
+	}
+	if len(node2.Snapshots()) != 0 {
+		t.Errorf("failed cluster snapshot left snapshots %+v", node2.Snapshots())
+	}
+
+	result, err := cluster.SnapshotAll(context.Background(), "snapb", kuttilib.BulkOptions{})
+	if err != nil {
+		t.Fatalf("cluster snapshot failed with: %v", err)
+	}
+	if len(result.Results) != 2 {
+		t.Errorf("cluster snapshot reported %v results instead of 2", len(result.Results))
+	}
+	if node1.Status() != kuttilib.NodeStatusRunning || node2.Status() != kuttilib.NodeStatusStopped {
+		t.Errorf("after cluster snapshot, node statuses are %v and %v, expected them to be unchanged", node1.Status(), node2.Status())
+	}
+	if len(node2.Snapshots()) != 1 || node2.Snapshots()[0].Name != "snapb" {
+		t.Errorf("node snapshots are %+v, expected snapb", node2.Snapshots())
+	}
+
+	err = node1.Stop()
+	if err != nil {
+		t.Fatalf("node stop failed with: %v", err)
+	}
+
+	snapdriver.mu.Lock()
+	restoredbefore := len(snapdriver.restored)
+	snapdriver.mu.Unlock()
+
+	err = node1.RestoreSnapshot("snapz")
+	if !errors.Is(err, kuttilib.ErrSnapshotNotFound) {
+		t.Errorf("restoring a missing snapshot returned %v instead of ErrSnapshotNotFound", err)
+	}
+
+	err = node1.RestoreSnapshot("snapa")
+	if err != nil {
+		t.Fatalf("restoring snapshot failed with: %v", err)
+	}
+
+	snapdriver.mu.Lock()
+	restored := append([]string{}, snapdriver.restored[restoredbefore:]...)
+	snapdriver.mu.Unlock()
+	if len(restored) != 1 || !strings.HasSuffix(restored[0], " snapa") {
+		t.Errorf("driver restored %v, expected snapa", restored)
+	}
+
+	err = node1.DeleteSnapshot("snapa")
+	if err != nil {
+		t.Fatalf("deleting snapshot failed with: %v", err)
+	}
+
+	snapshots = node1.Snapshots()
+	if len(snapshots) != 1 || snapshots[0].Name != "snapb" {
+		t.Errorf("after deletion, node snapshots are %+v, expected snapb", snapshots)
+	}
+	machinename := restored[0][:strings.Index(restored[0], " ")]
+	if machinesnapshots := snapdriver.machinesnapshots(machinename); len(machinesnapshots) != 1 || machinesnapshots[0] != "snapb" {
+		t.Errorf("after deletion, driver snapshots are %v, expected snapb", machinesnapshots)
+	}
+
+	err = node1.DeleteSnapshot("snapa")
+	if !errors.Is(err, kuttilib.ErrSnapshotNotFound) {
+		t.Errorf("deleting a missing snapshot returned %v instead of ErrSnapshotNotFound", err)
+	}
+}
+
+func TestCloneCluster(t *testing.T) {
+	ensureversion(t)
+	ensuredriverversion(t, DRIVER3)
+
+	runner := &recordingrunner{}
+	kuttilib.SetCommandRunner(runner)
+	defer kuttilib.SetCommandRunner(nil)
+
+	err := kuttilib.NewEmptyCluster(CLONESOURCENAME, K8SVERSION1, DRIVER1)
+	if err != nil {
+		t.Fatalf("cluster creation failed with: %v", err)
+	}
+
+	_, err = kuttilib.CloneCluster(CLONESOURCENAME, CLONECLUSTER1, kuttilib.CloneOptions{})
+	if !errors.Is(err, kuttilib.ErrCloneNotSupported) {
+		t.Errorf("clone with unsupporting driver returned %v instead of ErrCloneNotSupported", err)
+	}
+	if _, ok := kuttilib.GetCluster(CLONECLUSTER1); ok {
+		t.Error("failed clone created a cluster")
+	}
+
+	err = kuttilib.DeleteCluster(CLONESOURCENAME, false)
+	if err != nil {
+		t.Fatalf("cluster deletion failed with: %v", err)
+	}
+
+	err = kuttilib.NewManagedCluster(CLONESOURCENAME, K8SVERSION1, DRIVER3)
+	if err != nil {
+		t.Fatalf("managed cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteClusterCascade(context.Background(), CLONESOURCENAME, kuttilib.CascadeOptions{ContinueOnError: true})
+
+	source, _ := kuttilib.GetCluster(CLONESOURCENAME)
+	err = source.SetAutoForwardPorts(true)
+	if err != nil {
+		t.Fatalf("enabling automatic port forwarding failed with: %v", err)
+	}
+
+	_, err = source.NewControlPlaneNode(CONTROLPLANENAME)
+	if err != nil {
+		t.Fatalf("control plane node creation failed with: %v", err)
+	}
+	_, err = source.NewWorkerNode(WORKERNAME)
+	if err != nil {
+		t.Fatalf("worker node creation failed with: %v", err)
+	}
+
+	_, err = kuttilib.CloneCluster(CLONESOURCENAME, CLONESOURCENAME, kuttilib.CloneOptions{})
+	if !errors.Is(err, kuttilib.ErrClusterExists) {
+		t.Errorf("clone to existing name returned %v instead of ErrClusterExists", err)
+	}
+
+	driver, _ := drivercore.GetDriver(DRIVER3)
+	snapdriver := driver.(*snapshotdriver)
+	snapdriver.mu.Lock()
+	clonesbefore := len(snapdriver.clones)
+	snapdriver.mu.Unlock()
+
+	clonerunner := &recordingrunner{}
+	tokenclusters := []string{}
+	unreachable := []string{}
+	kuttilib.SetCommandRunner(kuttilib.CommandRunnerFunc(func(node *kuttilib.Node, command string) (string, error) {
+		if strings.Contains(command, "kubeadm token create") {
+			tokenclusters = append(tokenclusters, node.Cluster().Name())
+		}
+		// Commands can only reach nodes on a NAT driver once their
+		// SSH port is forwarded.
+		if _, ok := node.Ports()[22]; !ok {
+			unreachable = append(unreachable, node.Name()+": "+command)
+		}
+		return clonerunner.RunCommand(node, command)
+	}))
+
+	updatable := true
+	snapdriver.setduringdriverop(func() {
+		updatable = updatable && configupdatable(source)
+	})
+
+	clone, err := kuttilib.CloneCluster(CLONESOURCENAME, CLONECLUSTER1, kuttilib.CloneOptions{})
+	snapdriver.setduringdriverop(nil)
+	if clone != nil {
+		defer kuttilib.DeleteClusterCascade(context.Background(), CLONECLUSTER1, kuttilib.CascadeOptions{ContinueOnError: true})
+	}
+	if err != nil {
+		t.Fatalf("clone failed with: %v", err)
+	}
+	if !updatable {
+		t.Error("the configuration was locked while nodes were cloned")
+	}
+
+	if clone.DriverName() != DRIVER3 || clone.K8sVersion() != K8SVERSION1 || clone.Type() != kuttilib.ClusterTypeManaged || !clone.AutoForwardPorts() {
+		t.Errorf("cloned cluster has driver %v, version %v, type %v and automatic port forwarding %v", clone.DriverName(), clone.K8sVersion(), clone.Type(), clone.AutoForwardPorts())
+	}
+
+	for _, original := range source.Nodes() {
+		node, ok := clone.GetNode(original.Name())
+		if !ok {
+			t.Errorf("node %v was not cloned", original.Name())
+			continue
+		}
+		if node.Type() != original.Type() {
+			t.Errorf("node %v was cloned as type %v instead of %v", node.Name(), node.Type(), original.Type())
+		}
+
+		originalports, ports := original.Ports(), node.Ports()
+		if len(ports) != len(originalports) {
+			t.Errorf("node %v was cloned with ports %v instead of %v", node.Name(), ports, originalports)
+		}
+		for nodeport, hostport := range originalports {
+			if ports[nodeport] == 0 || ports[nodeport] == hostport {
+				t.Errorf("node %v port %v was cloned as host port %v, expected a port other than %v", node.Name(), nodeport, ports[nodeport], hostport)
+			}
+		}
+	}
+
+	if clonerunner.issuedcontaining("kubeadm") {
+		t.Error("cloned nodes were initialized or joined again")
+	}
+	if len(unreachable) != 0 {
+		t.Errorf("clone ran %q before the SSH ports of nodes were forwarded", unreachable)
+	}
+
+	controlplaneclone, _ := clone.GetNode(CONTROLPLANENAME)
+	if controlplaneclone.Status() != kuttilib.NodeStatusRunning {
+		t.Error("cloned control plane node was not started")
+	}
+
+	_, err = clone.NewWorkerNode(NEWNODE1NAME)
+	if err != nil {
+		t.Fatalf("worker node creation in cloned cluster failed with: %v", err)
+	}
+	if !slices.Equal(tokenclusters, []string{CLONECLUSTER1}) {
+		t.Errorf("join tokens were created in clusters %v instead of %v", tokenclusters, CLONECLUSTER1)
+	}
+	if !clonerunner.issued(NEWNODE1NAME + ": sudo kubeadm join 10.0.0.2:6443 ") {
+		t.Error("worker node in cloned cluster did not join the cloned control plane address")
+	}
+
+	clone2, err := kuttilib.CloneCluster(CLONESOURCENAME, CLONECLUSTER2, kuttilib.CloneOptions{FullClones: true})
+	if clone2 != nil {
+		defer kuttilib.DeleteClusterCascade(context.Background(), CLONECLUSTER2, kuttilib.CascadeOptions{ContinueOnError: true})
+	}
+	if err != nil {
+		t.Fatalf("full clone failed with: %v", err)
+	}
+
+	snapdriver.mu.Lock()
+	clones := append([]string{}, snapdriver.clones[clonesbefore:]...)
+	snapdriver.mu.Unlock()
+
+	expected := []string{
+		CONTROLPLANENAME + " " + CLONESOURCENAME + " " + CLONECLUSTER1 + " true",
+		WORKERNAME + " " + CLONESOURCENAME + " " + CLONECLUSTER1 + " true",
+		CONTROLPLANENAME + " " + CLONESOURCENAME + " " + CLONECLUSTER2 + " false",
+		WORKERNAME + " " + CLONESOURCENAME + " " + CLONECLUSTER2 + " false",
+	}
+	if strings.Join(clones, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("driver cloned %q instead of %q", clones, expected)
+	}
+
+	snapdriver.setcloneaddress("10.0.0.3")
+	defer snapdriver.setcloneaddress("")
+	clonerunner = &recordingrunner{}
+	unreachable = nil
+
+	clone3, err := kuttilib.CloneCluster(CLONESOURCENAME, CLONECLUSTER3, kuttilib.CloneOptions{})
+	if clone3 != nil {
+		defer kuttilib.DeleteClusterCascade(context.Background(), CLONECLUSTER3, kuttilib.CascadeOptions{ContinueOnError: true})
+	}
+	if err != nil {
+		t.Fatalf("clone with a changed control plane address failed with: %v", err)
+	}
+	if len(unreachable) != 0 {
+		t.Errorf("clone with a changed control plane address ran %q before the SSH ports of nodes were forwarded", unreachable)
+	}
+
+	replacement := `'s/\b10\.0\.0\.2\b/10.0.0.3/g'`
+	for _, command := range []string{
+		CONTROLPLANENAME + ": sudo sed -i " + replacement + " /etc/kubernetes/*.conf /etc/kubernetes/manifests/*.yaml",
+		CONTROLPLANENAME + ": sudo kubeadm init phase certs apiserver --apiserver-advertise-address 10.0.0.3",
+		CONTROLPLANENAME + ": sudo kubeadm init phase certs etcd-server",
+		CONTROLPLANENAME + ": sudo kubectl --kubeconfig /etc/kubernetes/admin.conf -n kube-public get configmap cluster-info",
+		WORKERNAME + ": sudo sed -i " + replacement + " /etc/kubernetes/kubelet.conf",
+	} {
+		if !clonerunner.issued(command) {
+			t.Errorf("clone with a changed control plane address did not run %q", command)
+		}
+	}
+	if clonerunner.issuedcontaining("kubeadm init --") || clonerunner.issuedcontaining("kubeadm join") {
+		t.Error("cloned nodes were initialized or joined again after the control plane address changed")
+	}
+
+	_, err = clone3.NewWorkerNode(NEWNODE1NAME)
+	if err != nil {
+		t.Fatalf("worker node creation in cloned cluster with a changed address failed with: %v", err)
+	}
+	if !clonerunner.issued(NEWNODE1NAME + ": sudo kubeadm join 10.0.0.3:6443 ") {
+		t.Error("worker node did not join the changed control plane address")
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	ensuredriverversion(t, DRIVER3)
+
+	runner := &recordingrunner{}
+	kuttilib.SetCommandRunner(runner)
+	defer kuttilib.SetCommandRunner(nil)
+
+	err := kuttilib.NewManagedCluster(UPGRADECLUSTER2, K8SVERSION1, DRIVER1)
+	if err != nil {
+		t.Fatalf("managed cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteClusterCascade(context.Background(), UPGRADECLUSTER2, kuttilib.CascadeOptions{ContinueOnError: true})
+
+	unsupported, _ := kuttilib.GetCluster(UPGRADECLUSTER2)
+	_, err = unsupported.NewControlPlaneNode(CONTROLPLANENAME)
+	if err != nil {
+		t.Fatalf("control plane node creation failed with: %v", err)
+	}
+	err = unsupported.Upgrade(K8SVERSION2)
+	if !errors.Is(err, kuttilib.ErrUpgradeNotSupported) {
+		t.Errorf("upgrade with a driver that cannot install binaries returned %v instead of ErrUpgradeNotSupported", err)
+	}
+	if runner.issuedcontaining("drain") {
+		t.Errorf("unsupported upgrade drained a node")
+	}
+
+	err = kuttilib.NewManagedCluster(UPGRADECLUSTERNAME, K8SVERSION1, DRIVER3)
+	if err != nil {
+		t.Fatalf("managed cluster creation failed with: %v", err)
+	}
+	defer kuttilib.DeleteClusterCascade(context.Background(), UPGRADECLUSTERNAME, kuttilib.CascadeOptions{ContinueOnError: true})
+
+	cluster, _ := kuttilib.GetCluster(UPGRADECLUSTERNAME)
+	err = cluster.Upgrade(K8SVERSION2)
+	if !errors.Is(err, kuttilib.ErrImageNotAvailable) {
+		t.Errorf("upgrade to a version not downloaded returned %v instead of ErrImageNotAvailable", err)
+	}
+
+	controlplane, err := cluster.NewControlPlaneNode(CONTROLPLANENAME)
+	if err != nil {
+		t.Fatalf("control plane node creation failed with: %v", err)
+	}
+	worker, err := cluster.NewWorkerNode(WORKERNAME)
+	if err != nil {
+		t.Fatalf("worker node creation failed with: %v", err)
+	}
+
+	driver, _ := kuttilib.GetDriver(DRIVER3)
+	for _, k8sversion := range []string{K8SVERSION2, K8SVERSION3} {
+		version, err := driver.GetVersion(k8sversion)
+		if err != nil {
+			t.Fatalf("getting k8s version %v failed with: %v", k8sversion, err)
+		}
+		err = version.Fetch()
+		if err != nil {
+			t.Fatalf("version fetch failed with: %v", err)
+		}
+		defer version.PurgeLocal()
+	}
+
+	for _, k8sversion := range []string{K8SVERSION1, K8SVERSION3} {
+		err = cluster.Upgrade(k8sversion)
+		if !errors.Is(err, kuttilib.ErrUpgradeInvalid) {
+			t.Errorf("upgrade from %v to %v returned %v instead of ErrUpgradeInvalid", K8SVERSION1, k8sversion, err)
+		}
+	}
+
+	// kubeadm and the kubelet report the version installed by the
+	// driver, except that the kubelet of the worker is stale at first.
+	mockdriver, _ := drivercore.GetDriver(DRIVER3)
+	snapdriver := mockdriver.(*snapshotdriver)
+	stalekubelet := true
+	runner.mu.Lock()
+	runner.k8sversion = func(node *kuttilib.Node) string {
+		version := snapdriver.installedversion(node)
+		if version == "" || (stalekubelet && node.Name() == WORKERNAME) {
+			return K8SVERSION1
+		}
+		return version
+	}
+	runner.mu.Unlock()
+
+	kubectl := "sudo kubectl --kubeconfig /etc/kubernetes/admin.conf "
+	err = cluster.Upgrade(K8SVERSION2)
+	if !errors.Is(err, kuttilib.ErrUpgradeFailed) {
+		t.Errorf("upgrade with a stale kubelet returned %v instead of ErrUpgradeFailed", err)
+	}
+	if cluster.K8sVersion() != K8SVERSION1 || controlplane.K8sVersion() != K8SVERSION2 || worker.K8sVersion() != K8SVERSION1 {
+		t.Errorf(
+			"after failed upgrade, cluster version is %v and node versions are %v and %v",
+			cluster.K8sVersion(), controlplane.K8sVersion(), worker.K8sVersion(),
+		)
+	}
+	if !runner.issued(CONTROLPLANENAME + ": " + kubectl + "uncordon " + WORKERNAME) {
+		t.Errorf("worker was not uncordoned after failed upgrade")
+	}
+
+	// A clone of the partly upgraded cluster keeps the version of
+	// each node.
+	kuttilib.SetCommandRunner(&recordingrunner{})
+	clone, err := kuttilib.CloneCluster(UPGRADECLUSTERNAME, UPGRADECLONENAME, kuttilib.CloneOptions{})
+	kuttilib.SetCommandRunner(runner)
+	if clone != nil {
+		defer kuttilib.DeleteClusterCascade(context.Background(), UPGRADECLONENAME, kuttilib.CascadeOptions{ContinueOnError: true})
+	}
+	if err != nil {
+		t.Fatalf("clone of partly upgraded cluster failed with: %v", err)
+	}
+	controlplaneclone, _ := clone.GetNode(CONTROLPLANENAME)
+	workerclone, _ := clone.GetNode(WORKERNAME)
+	if controlplaneclone.K8sVersion() != K8SVERSION2 || workerclone.K8sVersion() != K8SVERSION1 {
+		t.Errorf(
+			"clone of partly upgraded cluster has node versions %v and %v instead of %v and %v",
+			controlplaneclone.K8sVersion(), workerclone.K8sVersion(), K8SVERSION2, K8SVERSION1,
+		)
+	}
+
+	stalekubelet = false
+	err = cluster.Upgrade(K8SVERSION2)
+	if err != nil {
+		t.Fatalf("upgrade failed with: %v", err)
+	}
+
+	if cluster.K8sVersion() != K8SVERSION2 || controlplane.K8sVersion() != K8SVERSION2 || worker.K8sVersion() != K8SVERSION2 {
+		t.Errorf(
+			"after upgrade, cluster version is %v and node versions are %v and %v, expected %v",
+			cluster.K8sVersion(), controlplane.K8sVersion(), worker.K8sVersion(), K8SVERSION2,
+		)
+	}
+
+	expected := []string{
+		CONTROLPLANENAME + ": " + kubectl + "drain " + CONTROLPLANENAME + " ",
+		CONTROLPLANENAME + ": sudo kubeadm version -o short",
+		CONTROLPLANENAME + ": sudo kubeadm upgrade apply -y v" + K8SVERSION2 + ".2",
+		CONTROLPLANENAME + ": kubelet --version",
+		CONTROLPLANENAME + ": " + kubectl + "uncordon " + CONTROLPLANENAME,
+		CONTROLPLANENAME + ": " + kubectl + "drain " + WORKERNAME + " ",
+		WORKERNAME + ": sudo kubeadm upgrade node",
+		WORKERNAME + ": kubelet --version",
+		CONTROLPLANENAME + ": " + kubectl + "uncordon " + WORKERNAME,
+		CONTROLPLANENAME + ": " + kubectl + "drain " + WORKERNAME + " ",
+		WORKERNAME + ": sudo kubeadm upgrade node",
+		WORKERNAME + ": kubelet --version",
+		CONTROLPLANENAME + ": " + kubectl + "uncordon " + WORKERNAME,
+	}
+	runner.mu.Lock()
+	commands := append([]string{}, runner.commands...)
+	runner.mu.Unlock()
+
+	next := 0
+	for _, command := range commands {
+		if next < len(expected) && strings.HasPrefix(command, expected[next]) {
+			next++
+		}
+	}
+	if next < len(expected) {
+		t.Errorf("upgrade commands were %q, expected %q in that order", commands, expected[next])
+	}
+
+	err = cluster.Upgrade(K8SVERSION2)
+	if !errors.Is(err, kuttilib.ErrUpgradeInvalid) {
+		t.Errorf("repeated upgrade returned %v instead of ErrUpgradeInvalid", err)
+	}
+
+	newworker, err := cluster.NewWorkerNode(NEWNODE1NAME)
+	if err != nil {
+		t.Fatalf("worker node creation after upgrade failed with: %v", err)
+	}
+	if newworker.K8sVersion() != K8SVERSION2 {
+		t.Errorf("node created after upgrade has version %v instead of %v", newworker.K8sVersion(), K8SVERSION2)
+	}
+}
@@ -0,0 +1,266 @@
+package kuttilib
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Snapshot describes a saved state of a node's host, which the node
+// can be restored to.
+type Snapshot struct {
+	// Name identifies the snapshot among those of its node.
+	Name string
+	// CreatedAt is when the snapshot was taken.
+	CreatedAt time.Time
+}
+
+// MachineSnapshotter is implemented by the machines of drivers that
+// can save and restore their state. Snapshot names are unique per
+// machine. The snapshot operations of Node and Cluster use it, and
+// return ErrSnapshotsNotSupported if the host of a node does not
+// implement it.
+type MachineSnapshotter interface {
+	CreateSnapshot(name string) error
+	RestoreSnapshot(name string) error
+	DeleteSnapshot(name string) error
+}
+
+// Snapshots returns the snapshots of the node, oldest first.
+func (n *Node) Snapshots() []Snapshot {
+	configlock.RLock()
+	defer configlock.RUnlock()
+
+	result := make([]Snapshot, len(n.snapshots))
+	copy(result, n.snapshots)
+	return result
+}
+
+// Snapshot saves the current state of the node's host as a snapshot
+// with the specified name. The name must be valid as per ValidName,
+// and must not be used by another snapshot of the node. Whether the
+// node may be running depends on the driver. If the driver cannot take
+// snapshots, because the host does not implement MachineSnapshotter,
+// ErrSnapshotsNotSupported is returned.
+func (n *Node) Snapshot(name string) error {
+	if !ValidName(name) {
+		return n.wraperror("snapshot", ErrInvalidName)
+	}
+
+	snapshotter, err := n.snapshotter()
+	if err != nil {
+		return n.wraperror("snapshot", err)
+	}
+
+	if n.hassnapshot(name) {
+		return n.wraperror("snapshot", ErrSnapshotExists)
+	}
+
+	// The driver is called outside Update, so that the configuration
+	// is not locked while the snapshot is taken.
+	logf(VerbosityInfo, n.logfields("snapshot"), "Taking snapshot %s of node %s...", name, n.name)
+	start := time.Now()
+	err = snapshotter.CreateSnapshot(name)
+	if err != nil {
+		return n.wraperror("snapshot", err)
+	}
+	logf(VerbosityInfo, append(n.logfields("snapshot"), "duration", time.Since(start)), "Snapshot %s taken.", name)
+
+	return clusterconfigmanager.Update(func() error {
+		err := n.checkconfigured()
+		if err != nil {
+			return n.wraperror("snapshot", err)
+		}
+
+		if n.hassnapshot(name) {
+			return n.wraperror("snapshot", ErrSnapshotExists)
+		}
+
+		configlock.Lock()
+		n.snapshots = append(n.snapshots, Snapshot{Name: name, CreatedAt: time.Now()})
+		configlock.Unlock()
+
+		return nil
+	})
+}
+
+// RestoreSnapshot restores the node's host to the state saved in the
+// named snapshot. The node must be stopped; if it is not,
+// ErrNodeIsRunning is returned. If the snapshot does not exist,
+// ErrSnapshotNotFound is returned.
+//
+// The snapshot is kept, and can be restored again. The workspace SSH
+// key is added to the node again when it is next started, in case it
+// was rotated after the snapshot was taken.
+func (n *Node) RestoreSnapshot(name string) error {
+	snapshotter, err := n.snapshotter()
+	if err != nil {
+		return n.wraperror("restore snapshot", err)
+	}
+
+	if n.Status() != NodeStatusStopped {
+		return n.wraperror("restore snapshot", ErrNodeIsRunning)
+	}
+
+	if !n.hassnapshot(name) {
+		return n.wraperror("restore snapshot", ErrSnapshotNotFound)
+	}
+
+	logf(VerbosityInfo, n.logfields("restore snapshot"), "Restoring node %s to snapshot %s...", n.name, name)
+	start := time.Now()
+	err = snapshotter.RestoreSnapshot(name)
+	if err != nil {
+		return n.wraperror("restore snapshot", err)
+	}
+	logf(VerbosityInfo, append(n.logfields("restore snapshot"), "duration", time.Since(start)), "Node %s restored.", n.name)
+
+	return clusterconfigmanager.Update(func() error {
+		err := n.checkconfigured()
+		if err != nil {
+			return n.wraperror("restore snapshot", err)
+		}
+
+		configlock.Lock()
+		n.sshKey = ""
+		configlock.Unlock()
+
+		return nil
+	})
+}
+
+// DeleteSnapshot deletes the named snapshot of the node. If the
+// snapshot does not exist, ErrSnapshotNotFound is returned.
+func (n *Node) DeleteSnapshot(name string) error {
+	snapshotter, err := n.snapshotter()
+	if err != nil {
+		return n.wraperror("delete snapshot", err)
+	}
+
+	if !n.hassnapshot(name) {
+		return n.wraperror("delete snapshot", ErrSnapshotNotFound)
+	}
+
+	err = snapshotter.DeleteSnapshot(name)
+	if err != nil {
+		return n.wraperror("delete snapshot", err)
+	}
+
+	return clusterconfigmanager.Update(func() error {
+		err := n.checkconfigured()
+		if err != nil {
+			return n.wraperror("delete snapshot", err)
+		}
+
+		configlock.Lock()
+		defer configlock.Unlock()
+
+		snapshots := make([]Snapshot, 0, len(n.snapshots))
+		for _, snapshot := range n.snapshots {
+			if snapshot.Name != name {
+				snapshots = append(snapshots, snapshot)
+			}
+		}
+		n.snapshots = snapshots
+
+		return nil
+	})
+}
+
+// snapshotter returns the node's host as a MachineSnapshotter, or
+// ErrSnapshotsNotSupported.
+func (n *Node) snapshotter() (MachineSnapshotter, error) {
+	err := n.Cluster().ensuredriver()
+	if err != nil {
+		return nil, err
+	}
+
+	err = n.ensurehost()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotter, ok := n.host.(MachineSnapshotter)
+	if !ok {
+		return nil, ErrSnapshotsNotSupported
+	}
+	return snapshotter, nil
+}
+
+func (n *Node) hassnapshot(name string) bool {
+	configlock.RLock()
+	defer configlock.RUnlock()
+
+	for _, snapshot := range n.snapshots {
+		if snapshot.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SnapshotAll takes a snapshot with the specified name of every node
+// in the cluster, so that the cluster as a whole can be restored to a
+// consistent state. Running nodes are stopped first, as StopAll does,
+// and started again afterwards, as StartAll does.
+//
+// Nothing is done if a node cannot take snapshots, or already has a
+// snapshot with that name. If taking the snapshot fails on some nodes,
+// the snapshots taken on the others are deleted. The result reports
+// the outcome of taking the snapshot on each node. The returned error
+// also includes failures to stop or restart nodes.
+func (c *Cluster) SnapshotAll(ctx context.Context, name string, opts BulkOptions) (*BulkResult, error) {
+	if !ValidName(name) {
+		return nil, ErrInvalidName
+	}
+
+	for _, node := range c.Nodes() {
+		_, err := node.snapshotter()
+		if err != nil {
+			return nil, node.wraperror("snapshot", err)
+		}
+
+		if node.hassnapshot(name) {
+			return nil, node.wraperror("snapshot", ErrSnapshotExists)
+		}
+	}
+
+	running := map[string]bool{}
+	for _, node := range c.Nodes() {
+		if node.Status() == NodeStatusRunning {
+			running[node.name] = true
+		}
+	}
+
+	restart := func() error {
+		_, err := c.bulkoperation(context.WithoutCancel(ctx), "start", opts, true, func(ctx context.Context, n *Node) (bool, error) {
+			if !running[n.name] || n.Status() == NodeStatusRunning {
+				return true, nil
+			}
+			return false, n.StartContext(ctx)
+		})
+		return err
+	}
+
+	_, err := c.StopAll(ctx, opts)
+	if err != nil {
+		return nil, errors.Join(err, restart())
+	}
+
+	result, err := c.bulkoperation(ctx, "snapshot", opts, true, func(ctx context.Context, n *Node) (bool, error) {
+		return false, n.Snapshot(name)
+	})
+	if err != nil {
+		for _, noderesult := range result.Results {
+			if noderesult.Err != nil || noderesult.Skipped {
+				continue
+			}
+
+			node, ok := c.GetNode(noderesult.Node)
+			if ok {
+				err = errors.Join(err, node.DeleteSnapshot(name))
+			}
+		}
+	}
+
+	return result, errors.Join(err, restart())
+}
@@ -0,0 +1,196 @@
+package kuttilib_test
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/kuttiproject/drivercore"
+	"github.com/kuttiproject/drivercore/drivercoretest/drivermock"
+	"github.com/kuttiproject/kuttilib"
+)
+
+// snapshotdriver is a mock driver whose machines can take snapshots,
+// be cloned, and list their forwarded ports.
+type snapshotdriver struct {
+	*drivermock.MockDriver
+
+	mu        sync.Mutex
+	snapshots map[string][]string
+	restored  []string
+	clones    []string
+	ports     map[string]map[int]int
+
+	// duringdriverop, if set, is called while snapshots are taken and
+	// machines are cloned.
+	duringdriverop func()
+	// cloneaddress, if set, is the IP address of cloned machines.
+	cloneaddress string
+	addresses    map[string]string
+	installed    map[string]string
+}
+
+func (d *snapshotdriver) setduringdriverop(f func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.duringdriverop = f
+}
+
+func (d *snapshotdriver) driverop() {
+	d.mu.Lock()
+	f := d.duringdriverop
+	d.mu.Unlock()
+	if f != nil {
+		f()
+	}
+}
+
+func (d *snapshotdriver) NewMachine(machinename string, clustername string, k8sversion string) (drivercore.Machine, error) {
+	machine, err := d.MockDriver.NewMachine(machinename, clustername, k8sversion)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotmachine{Machine: machine, driver: d}, nil
+}
+
+func (d *snapshotdriver) GetMachine(machinename string, clustername string) (drivercore.Machine, error) {
+	machine, err := d.MockDriver.GetMachine(machinename, clustername)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotmachine{Machine: machine, driver: d}, nil
+}
+
+func (d *snapshotdriver) DeleteMachine(machinename string, clustername string) error {
+	machine, err := d.MockDriver.GetMachine(machinename, clustername)
+	if err == nil {
+		d.mu.Lock()
+		delete(d.snapshots, machine.Name())
+		delete(d.ports, machine.Name())
+		delete(d.addresses, machine.Name())
+		delete(d.installed, machine.Name())
+		d.mu.Unlock()
+	}
+	return d.MockDriver.DeleteMachine(machinename, clustername)
+}
+
+func (d *snapshotdriver) CloneMachine(machinename string, clustername string, newclustername string, linked bool) (drivercore.Machine, error) {
+	d.driverop()
+
+	machine, err := d.NewMachine(machinename, newclustername, K8SVERSION1)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.clones = append(d.clones, fmt.Sprintf("%s %s %s %v", machinename, clustername, newclustername, linked))
+	if d.cloneaddress != "" {
+		d.addresses[machine.Name()] = d.cloneaddress
+	}
+	return machine, nil
+}
+
+func (d *snapshotdriver) setcloneaddress(address string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cloneaddress = address
+}
+
+// installedversion returns the Kubernetes version last installed on
+// the host of node, or the empty string.
+func (d *snapshotdriver) installedversion(node *kuttilib.Node) string {
+	machine, err := d.MockDriver.GetMachine(node.Name(), node.Cluster().Name())
+	if err != nil {
+		return ""
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.installed[machine.Name()]
+}
+
+func (d *snapshotdriver) machinesnapshots(machinename string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string{}, d.snapshots[machinename]...)
+}
+
+// snapshotmachine is a mock machine that records snapshots and
+// installed Kubernetes versions in its driver.
+type snapshotmachine struct {
+	drivercore.Machine
+	driver *snapshotdriver
+}
+
+func (m *snapshotmachine) IPAddress() string {
+	m.driver.mu.Lock()
+	address, ok := m.driver.addresses[m.Name()]
+	m.driver.mu.Unlock()
+	if ok {
+		return address
+	}
+	return m.Machine.IPAddress()
+}
+
+func (m *snapshotmachine) CreateSnapshot(name string) error {
+	m.driver.driverop()
+
+	m.driver.mu.Lock()
+	defer m.driver.mu.Unlock()
+	m.driver.snapshots[m.Name()] = append(m.driver.snapshots[m.Name()], name)
+	return nil
+}
+
+func (m *snapshotmachine) RestoreSnapshot(name string) error {
+	m.driver.mu.Lock()
+	defer m.driver.mu.Unlock()
+	m.driver.restored = append(m.driver.restored, m.Name()+" "+name)
+	return nil
+}
+
+func (m *snapshotmachine) DeleteSnapshot(name string) error {
+	m.driver.mu.Lock()
+	defer m.driver.mu.Unlock()
+	snapshots := []string{}
+	for _, snapshot := range m.driver.snapshots[m.Name()] {
+		if snapshot != name {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	m.driver.snapshots[m.Name()] = snapshots
+	return nil
+}
+
+func (m *snapshotmachine) InstallK8sVersion(k8sversion string) error {
+	m.driver.mu.Lock()
+	defer m.driver.mu.Unlock()
+	m.driver.installed[m.Name()] = k8sversion
+	return nil
+}
+
+func (m *snapshotmachine) ForwardPort(hostport int, machineport int) error {
+	m.driver.mu.Lock()
+	defer m.driver.mu.Unlock()
+	if m.driver.ports[m.Name()] == nil {
+		m.driver.ports[m.Name()] = map[int]int{}
+	}
+	m.driver.ports[m.Name()][machineport] = hostport
+	return m.Machine.ForwardPort(hostport, machineport)
+}
+
+func (m *snapshotmachine) UnforwardPort(machineport int) error {
+	m.driver.mu.Lock()
+	defer m.driver.mu.Unlock()
+	delete(m.driver.ports[m.Name()], machineport)
+	return m.Machine.UnforwardPort(machineport)
+}
+
+func (m *snapshotmachine) ForwardedPorts() (map[int]int, error) {
+	m.driver.mu.Lock()
+	defer m.driver.mu.Unlock()
+	result := map[int]int{}
+	for machineport, hostport := range m.driver.ports[m.Name()] {
+		result[machineport] = hostport
+	}
+	return result, nil
+}
@@ -0,0 +1,209 @@
+package kuttilib
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kuttiproject/drivercore"
+)
+
+// NodeSpec describes the hardware resources of a node. A zero value
+// in any field means the driver default is used for that resource.
+type NodeSpec struct {
+	// CPUs is the number of virtual CPUs.
+	CPUs int `json:",omitempty"`
+	// MemoryMB is the amount of memory, in megabytes.
+	MemoryMB int `json:",omitempty"`
+	// DiskGB is the size of the primary disk, in gigabytes.
+	DiskGB int `json:",omitempty"`
+	// ExtraNICs is the number of network interfaces to add, over
+	// and above those the driver creates by default.
+	ExtraNICs int `json:",omitempty"`
+}
+
+// IsDefault returns true if the spec asks for driver defaults for
+// all resources.
+func (s NodeSpec) IsDefault() bool {
+	return s == NodeSpec{}
+}
+
+// NodeSpecLimits describes the largest NodeSpec a driver can
+// create. A zero value in any field means the driver does not
+// limit that resource.
+type NodeSpecLimits struct {
+	MaxCPUs      int
+	MaxMemoryMB  int
+	MaxDiskGB    int
+	MaxExtraNICs int
+}
+
+// Validate checks the spec against limits. It returns an error
+// wrapping ErrNodeSpecInvalid if any value is negative, or
+// ErrNodeSpecExceedsLimits if any value is over its limit.
+func (s NodeSpec) Validate(limits NodeSpecLimits) error {
+	checks := []struct {
+		resource string
+		value    int
+		limit    int
+	}{
+		{"CPUs", s.CPUs, limits.MaxCPUs},
+		{"memory (MB)", s.MemoryMB, limits.MaxMemoryMB},
+		{"disk (GB)", s.DiskGB, limits.MaxDiskGB},
+		{"extra NICs", s.ExtraNICs, limits.MaxExtraNICs},
+	}
+
+	for _, check := range checks {
+		if check.value < 0 {
+			return fmt.Errorf("%w: %s cannot be %v", ErrNodeSpecInvalid, check.resource, check.value)
+		}
+		if check.limit > 0 && check.value > check.limit {
+			return fmt.Errorf(
+				"%w: %v %s requested, driver allows at most %v",
+				ErrNodeSpecExceedsLimits,
+				check.value,
+				check.resource,
+				check.limit,
+			)
+		}
+	}
+
+	return nil
+}
+
+// SizedMachineCreator is implemented by drivers which can create
+// machines with specified hardware resources. Zero values ask for
+// the driver default. The limits returned by MachineLimits are zero
+// for resources that the driver does not limit. Nodes with a
+// non-default NodeSpec can only be created by drivers which implement
+// it. Otherwise, ErrNodeSpecNotSupported is returned.
+type SizedMachineCreator interface {
+	MachineLimits() (maxcpus int, maxmemorymb int, maxdiskgb int, maxextranics int)
+	NewSizedMachine(
+		machinename string,
+		clustername string,
+		k8sversion string,
+		cpus int,
+		memorymb int,
+		diskgb int,
+		extranics int,
+	) (drivercore.Machine, error)
+}
+
+// SupportsNodeSpec returns true if the driver can create nodes with
+// a non-default NodeSpec, which it can if it implements
+// SizedMachineCreator.
+func (d *Driver) SupportsNodeSpec() bool {
+	_, ok := d.vmdriver.(SizedMachineCreator)
+	return ok
+}
+
+// NodeSpecLimits returns the largest NodeSpec the driver can create.
+// It returns ErrNodeSpecNotSupported if the driver cannot create nodes
+// with a non-default NodeSpec.
+func (d *Driver) NodeSpecLimits() (NodeSpecLimits, error) {
+	return nodespeclimits(d.vmdriver)
+}
+
+func nodespeclimits(driver drivercore.Driver) (NodeSpecLimits, error) {
+	sizer, ok := driver.(SizedMachineCreator)
+	if !ok {
+		return NodeSpecLimits{}, ErrNodeSpecNotSupported
+	}
+
+	maxcpus, maxmemorymb, maxdiskgb, maxextranics := sizer.MachineLimits()
+	return NodeSpecLimits{
+		MaxCPUs:      maxcpus,
+		MaxMemoryMB:  maxmemorymb,
+		MaxDiskGB:    maxdiskgb,
+		MaxExtraNICs: maxextranics,
+	}, nil
+}
+
+// checknodespec returns an error if the cluster's driver cannot create
+// a node with the specified spec.
+func (c *Cluster) checknodespec(spec NodeSpec) error {
+	if spec.IsDefault() {
+		return nil
+	}
+
+	err := spec.Validate(NodeSpecLimits{})
+	if err != nil {
+		return err
+	}
+
+	err = c.ensuredriver()
+	if err != nil {
+		return err
+	}
+
+	limits, err := nodespeclimits(c.driver)
+	if err != nil {
+		return err
+	}
+
+	return spec.Validate(limits)
+}
+
+// NewUninitializedNodeWithSpec adds a node with the specified hardware
+// resources, but does not join it to a Kubernetes cluster, as
+// NewUninitializedNode does. It returns ErrNodeSpecNotSupported if the
+// cluster's driver cannot honour a non-default spec.
+func (c *Cluster) NewUninitializedNodeWithSpec(nodename string, spec NodeSpec) (*Node, error) {
+	return c.newnodewithspec(nodename, NodeTypeUnmanaged, spec, nil)
+}
+
+// NewControlPlaneNodeWithSpec adds a node with the specified hardware
+// resources, and initializes a Kubernetes control plane on it, as
+// NewControlPlaneNode does. It returns ErrNodeSpecNotSupported if the
+// cluster's driver cannot honour a non-default spec.
+func (c *Cluster) NewControlPlaneNodeWithSpec(nodename string, spec NodeSpec) (*Node, error) {
+	return c.newnodewithspec(nodename, NodeTypeControlPlane, spec, nil)
+}
+
+// NewWorkerNodeWithSpec adds a node with the specified hardware
+// resources, and joins it to the Kubernetes cluster, as NewWorkerNode
+// does. It returns ErrNodeSpecNotSupported if the cluster's driver
+// cannot honour a non-default spec.
+func (c *Cluster) NewWorkerNodeWithSpec(nodename string, spec NodeSpec) (*Node, error) {
+	return c.newnodewithspec(nodename, NodeTypeWorker, spec, nil)
+}
+
+// newnodewithspec adds a node of the specified type, sets it up, and
+// initializes or joins it if it is a control plane or worker node.
+// If prepare is not nil, it is called once the node has been added,
+// before anything is run on it, so that its ports can be forwarded.
+func (c *Cluster) newnodewithspec(nodename string, nodetype string, spec NodeSpec, prepare func(*Node) error) (*Node, error) {
+	err := c.ValidateNodeName(nodename)
+	if err != nil {
+		return nil, err
+	}
+
+	newnode, err := c.addnode(nodename, nodetype, spec)
+	if err != nil {
+		return newnode, err
+	}
+
+	var prepareerr error
+	if prepare != nil {
+		prepareerr = prepare(newnode)
+	}
+	setuperr := errors.Join(prepareerr, newnode.setup())
+
+	switch nodetype {
+	case NodeTypeControlPlane:
+		// The control plane is initialized even if setup fails, since
+		// the node is usable without its forwarded ports.
+		initerr := newnode.kubeadminit()
+		if initerr != nil {
+			// A control plane node which was not initialized cannot be
+			// used, and would prevent another from being added, so it
+			// is removed.
+			deleteerr := c.DeleteNode(nodename, true)
+			return nil, errors.Join(setuperr, newnode.wraperror("initialize", initerr), deleteerr)
+		}
+	case NodeTypeWorker:
+		return newnode, errors.Join(setuperr, newnode.wraperror("join", newnode.kubeadmjoin()))
+	}
+
+	return newnode, setuperr
+}
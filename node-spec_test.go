@@ -0,0 +1,130 @@
+package kuttilib_test
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/kuttiproject/drivercore"
+	"github.com/kuttiproject/drivercore/drivercoretest/drivermock"
+)
+
+// sizeddriver is a mock driver that can create sized machines.
+type sizeddriver struct {
+	*drivermock.MockDriver
+
+	mu    sync.Mutex
+	specs map[string][4]int
+	// duringdriverop, if set, is called while machines and networks
+	// are created and deleted.
+	duringdriverop func()
+	// statechangewaits records the durations passed to
+	// WaitForStateChange by machines.
+	statechangewaits []int
+	// stuck, if set, makes machines ignore requests to start.
+	stuck bool
+}
+
+func (d *sizeddriver) setduringdriverop(f func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.duringdriverop = f
+}
+
+func (d *sizeddriver) driverop() {
+	d.mu.Lock()
+	f := d.duringdriverop
+	d.mu.Unlock()
+	if f != nil {
+		f()
+	}
+}
+
+func (d *sizeddriver) NewMachine(machinename string, clustername string, k8sversion string) (drivercore.Machine, error) {
+	d.driverop()
+	machine, err := d.MockDriver.NewMachine(machinename, clustername, k8sversion)
+	if err != nil {
+		return nil, err
+	}
+	return &sizedmachine{Machine: machine, driver: d}, nil
+}
+
+func (d *sizeddriver) GetMachine(machinename string, clustername string) (drivercore.Machine, error) {
+	machine, err := d.MockDriver.GetMachine(machinename, clustername)
+	if err != nil {
+		return nil, err
+	}
+	return &sizedmachine{Machine: machine, driver: d}, nil
+}
+
+func (d *sizeddriver) waits() []int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return slices.Clone(d.statechangewaits)
+}
+
+// sizedmachine is a mock machine that records waits for state changes
+// in its driver.
+type sizedmachine struct {
+	drivercore.Machine
+	driver *sizeddriver
+}
+
+func (d *sizeddriver) setstuck(stuck bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stuck = stuck
+}
+
+func (m *sizedmachine) Start() error {
+	m.driver.mu.Lock()
+	stuck := m.driver.stuck
+	m.driver.mu.Unlock()
+	if stuck {
+		return nil
+	}
+
+	return m.Machine.Start()
+}
+
+func (m *sizedmachine) WaitForStateChange(timeoutinseconds int) {
+	m.driver.mu.Lock()
+	m.driver.statechangewaits = append(m.driver.statechangewaits, timeoutinseconds)
+	m.driver.mu.Unlock()
+
+	m.Machine.WaitForStateChange(timeoutinseconds)
+}
+
+func (d *sizeddriver) NewNetwork(networkname string) (drivercore.Network, error) {
+	d.driverop()
+	return d.MockDriver.NewNetwork(networkname)
+}
+
+func (d *sizeddriver) DeleteNetwork(clustername string) error {
+	d.driverop()
+	return d.MockDriver.DeleteNetwork(clustername)
+}
+
+func (d *sizeddriver) DeleteMachine(machinename string, clustername string) error {
+	d.driverop()
+	return d.MockDriver.DeleteMachine(machinename, clustername)
+}
+
+func (d *sizeddriver) MachineLimits() (int, int, int, int) {
+	return 4, 8192, 0, 2
+}
+
+func (d *sizeddriver) NewSizedMachine(
+	machinename string,
+	clustername string,
+	k8sversion string,
+	cpus int,
+	memorymb int,
+	diskgb int,
+	extranics int,
+) (drivercore.Machine, error) {
+	d.mu.Lock()
+	d.specs[machinename] = [4]int{cpus, memorymb, diskgb, extranics}
+	d.mu.Unlock()
+
+	return d.NewMachine(machinename, clustername, k8sversion)
+}
@@ -0,0 +1,770 @@
+package kuttilib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// sshkeyfilename is the name of the workspace SSH private key
+	// file, in the workspace configuration directory.
+	sshkeyfilename = "kuttilib-ssh-key"
+	// sshdialtimeout is how long connecting to a node over SSH,
+	// including the SSH handshake, may take.
+	sshdialtimeout = 30 * time.Second
+	// sshreadytimeout is how long a node that has just started is
+	// given for its SSH server to accept connections.
+	sshreadytimeout = 2 * time.Minute
+)
+
+var (
+	sshuserlock sync.RWMutex
+	sshuser     = "kuttiadmin"
+	sshpassword string
+)
+
+// SSHUser returns the user name used to connect to nodes over SSH.
+func SSHUser() string {
+	sshuserlock.RLock()
+	defer sshuserlock.RUnlock()
+	return sshuser
+}
+
+// SetSSHUser sets the user name used to connect to nodes over SSH.
+// The default is "kuttiadmin", the administrative user of kutti
+// node images.
+func SetSSHUser(user string) {
+	sshuserlock.Lock()
+	defer sshuserlock.Unlock()
+	sshuser = user
+}
+
+// SSHPassword returns the password used to log in to nodes over SSH
+// which do not accept the workspace SSH key yet, or an empty string if
+// none has been set.
+func SSHPassword() string {
+	sshuserlock.RLock()
+	defer sshuserlock.RUnlock()
+	return sshpassword
+}
+
+// SetSSHPassword sets the password used to log in to nodes over SSH
+// in order to add the workspace SSH key to them. There is no default.
+// Until a password is set, the key can only be added to nodes which
+// accept it already, or by a CommandRunner set with SetCommandRunner.
+func SetSSHPassword(password string) {
+	sshuserlock.Lock()
+	defer sshuserlock.Unlock()
+	sshpassword = password
+}
+
+// sshauth returns the methods used to log in to nodes over SSH. If
+// password is true, the password returned by SSHPassword is used.
+// Otherwise, the workspace SSH key is used, along with the key it
+// replaced, which is still authorized on nodes that were stopped when
+// the key was last rotated.
+func sshauth(password bool) []ssh.AuthMethod {
+	if password {
+		secret := SSHPassword()
+		return []ssh.AuthMethod{
+			ssh.Password(secret),
+			ssh.KeyboardInteractive(func(name string, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = secret
+				}
+				return answers, nil
+			}),
+		}
+	}
+
+	key, err := workspacesshkey()
+	if err != nil {
+		return nil
+	}
+
+	signers := []ssh.Signer{}
+	for _, key := range []*sshkey{key, oldsshkey()} {
+		if key == nil {
+			continue
+		}
+		signers = append(signers, key.signer)
+	}
+	return []ssh.AuthMethod{ssh.PublicKeys(signers...)}
+}
+
+// SSHHostKey returns the SSH host key pinned for the node, in
+// authorized_keys format, or an empty string if none has been.
+//
+// The host key presented by the node the first time kuttilib connects
+// to it over SSH is pinned. Later connections fail with
+// ErrSSHHostKeyMismatch if the node presents a different key, until
+// ForgetSSHHostKey is called. A node created again with the same name
+// starts with no pinned key.
+func (n *Node) SSHHostKey() string {
+	configlock.RLock()
+	defer configlock.RUnlock()
+
+	return n.sshHostKey
+}
+
+// ForgetSSHHostKey removes the SSH host key pinned for the node, so
+// that the key it presents at the next SSH connection is pinned in its
+// place. This is needed if the host key of the node has been changed
+// deliberately.
+func (n *Node) ForgetSSHHostKey() error {
+	return clusterconfigmanager.Update(func() error {
+		err := n.checkconfigured()
+		if err != nil {
+			return n.wraperror("forget SSH host key", err)
+		}
+
+		configlock.Lock()
+		n.sshHostKey = ""
+		configlock.Unlock()
+
+		return nil
+	})
+}
+
+// checksshhostkey returns a host key callback which accepts only the
+// host key pinned for the node. If none has been pinned, the key
+// presented is accepted, and passed to presented so that it can be
+// pinned. Pinning saves the configuration, which must not be done
+// during the SSH handshake.
+func (n *Node) checksshhostkey(presented func(ssh.PublicKey)) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		pinned := n.SSHHostKey()
+		if pinned == "" {
+			presented(key)
+			return nil
+		}
+
+		if authorizedhostkey(key) != pinned {
+			return fmt.Errorf("%w: node presented %v", ErrSSHHostKeyMismatch, ssh.FingerprintSHA256(key))
+		}
+		return nil
+	}
+}
+
+// pinsshhostkey pins key as the SSH host key of the node, unless one
+// has been pinned already. Failures are only logged, since the key
+// presented at the next connection will be pinned instead.
+func (n *Node) pinsshhostkey(key ssh.PublicKey) {
+	hostkey := authorizedhostkey(key)
+	err := clusterconfigmanager.Update(func() error {
+		err := n.checkconfigured()
+		if err != nil {
+			return err
+		}
+
+		configlock.Lock()
+		if n.sshHostKey == "" {
+			n.sshHostKey = hostkey
+		}
+		configlock.Unlock()
+
+		return nil
+	})
+	if err != nil {
+		logf(VerbosityDebug, n.logfields("pin SSH host key"), "Error pinning SSH host key of node %s: %v.", n.name, err)
+	}
+}
+
+func authorizedhostkey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// sshclientconfig returns the configuration for SSH connections to
+// the node, as SSHUser. If password is true, it logs in with the
+// password returned by SSHPassword instead of the workspace SSH key.
+// The host key of the node is checked as described for SSHHostKey,
+// and a key presented by a node with no pinned key is passed to
+// presented.
+func (n *Node) sshclientconfig(password bool, presented func(ssh.PublicKey)) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            SSHUser(),
+		Auth:            sshauth(password),
+		HostKeyCallback: n.checksshhostkey(presented),
+		Timeout:         sshdialtimeout,
+	}
+}
+
+// dialssh connects to the node over SSH, with the configuration
+// returned by sshclientconfig. If the node had no pinned host key,
+// the key it presented is pinned once the connection succeeds.
+func (n *Node) dialssh(ctx context.Context, password bool) (*ssh.Client, error) {
+	address := n.SSHAddress()
+	if address == "" {
+		return nil, ErrSSHNotAvailable
+	}
+
+	dialer := net.Dialer{Timeout: sshdialtimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		// The dialer times out at the deadline of ctx, possibly just
+		// before ctx itself reports it.
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			return nil, context.DeadlineExceeded
+		}
+		if ctxerr := ctx.Err(); ctxerr != nil {
+			return nil, ctxerr
+		}
+		return nil, fmt.Errorf("%w: %w", ErrSSHFailed, err)
+	}
+
+	// The handshake must also finish within the dial timeout, and is
+	// abandoned if ctx is done.
+	conn.SetDeadline(time.Now().Add(sshdialtimeout))
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	var presented ssh.PublicKey
+	config := n.sshclientconfig(password, func(key ssh.PublicKey) { presented = key })
+	sshconn, channels, requests, err := ssh.NewClientConn(conn, address, config)
+	if err != nil {
+		conn.Close()
+		if ctxerr := ctx.Err(); ctxerr != nil {
+			return nil, ctxerr
+		}
+		if errors.Is(err, ErrSSHHostKeyMismatch) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %w", ErrSSHFailed, err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	if presented != nil {
+		n.pinsshhostkey(presented)
+	}
+	return ssh.NewClient(sshconn, channels, requests), nil
+}
+
+// waitforssh waits until the SSH server of the node accepts
+// connections, for up to sshreadytimeout, since a node is running as
+// soon as its host is powered on, well before SSH is available. If a
+// CommandRunner has been set with SetCommandRunner, commands are not
+// run over SSH, so it returns at once. If the node has no SSH address,
+// ErrCommandsNotSupported is returned.
+func (n *Node) waitforssh(ctx context.Context) error {
+	if _, ok := currentcommandrunner().(defaultcommandrunner); !ok {
+		return nil
+	}
+
+	if n.SSHAddress() == "" {
+		return ErrCommandsNotSupported
+	}
+
+	opts := WaitOptions{Timeout: sshreadytimeout, Backoff: 2, MaxPollInterval: 10 * time.Second}
+	return waitfor(ctx, "wait for SSH", opts, func(ctx context.Context) (bool, string, error) {
+		err := n.probessh(ctx)
+		if err != nil {
+			return false, err.Error(), nil
+		}
+		return true, "", nil
+	})
+}
+
+// probessh connects to the SSH address of the node, and checks that
+// an SSH server answers with its version banner. It does not log in,
+// so no host key is pinned.
+func (n *Node) probessh(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: sshdialtimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", n.SSHAddress())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(sshdialtimeout))
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// Servers may send other lines before the banner.
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(line, "SSH-") {
+			return nil
+		}
+	}
+}
+
+// sshsession connects to the node over SSH as dialssh does, and opens
+// a session. The connection is closed if ctx is done before the
+// returned close function is called.
+func (n *Node) sshsession(ctx context.Context, op string, password bool) (*ssh.Session, func(), error) {
+	err := checkcontext(ctx, op)
+	if err != nil {
+		return nil, nil, n.wraperror(op, err)
+	}
+
+	client, err := n.dialssh(ctx, password)
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return nil, nil, n.wraperror(op, &CanceledError{Op: op, Err: err})
+	}
+	if err != nil {
+		return nil, nil, n.wraperror(op, err)
+	}
+
+	stop := context.AfterFunc(ctx, func() { client.Close() })
+	session, err := client.NewSession()
+	if err != nil {
+		stop()
+		client.Close()
+		return nil, nil, n.wraperror(op, fmt.Errorf("%w: %w", ErrSSHFailed, err))
+	}
+
+	return session, func() {
+		stop()
+		session.Close()
+		client.Close()
+	}, nil
+}
+
+// ExecStream runs a shell command on the node over SSH. The command's
+// standard input is read from stdin, and its output is streamed to
+// stdout and stderr as it is produced. Any of these may be nil.
+//
+// The exit code of the command is returned. A non-zero exit code is
+// not an error. An error is returned if the node cannot be reached,
+// or the SSH connection fails, or ctx is canceled before the command
+// completes, in which case the exit code is -1.
+//
+// SSH connections use the workspace SSH key, if one exists, and the
+// user name returned by SSHUser. If the node does not have the current
+// key yet, it is added first, as InjectSSHKey does. The host key of
+// the node is pinned as described for SSHHostKey.
+func (n *Node) ExecStream(ctx context.Context, command string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	n.ensuresshkeyonuse(ctx)
+	return n.execstream(ctx, "exec", false, command, stdin, stdout, stderr)
+}
+
+func (n *Node) execstream(ctx context.Context, op string, password bool, command string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	session, closesession, err := n.sshsession(ctx, op, password)
+	if err != nil {
+		return -1, err
+	}
+	defer closesession()
+
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	err = session.Run(command)
+	if ctxerr := checkcontext(ctx, op); ctxerr != nil {
+		return -1, n.wraperror(op, ctxerr)
+	}
+
+	var exiterr *ssh.ExitError
+	if errors.As(err, &exiterr) {
+		return exiterr.ExitStatus(), nil
+	}
+	if err != nil {
+		return -1, n.wraperror(op, fmt.Errorf("%w: %w", ErrSSHFailed, err))
+	}
+
+	return 0, nil
+}
+
+// Exec runs a shell command on the node over SSH, as ExecStream does,
+// and returns its standard output, standard error and exit code.
+func (n *Node) Exec(ctx context.Context, command string) (string, string, int, error) {
+	var stdout, stderr bytes.Buffer
+	exitcode, err := n.ExecStream(ctx, command, nil, &stdout, &stderr)
+	return stdout.String(), stderr.String(), exitcode, err
+}
+
+// CopyTo copies a local file to the node over SSH, using the scp
+// protocol. The remote file is created or replaced, with the
+// permissions of the local file. The scp program must be installed on
+// the node, as it is on kutti node images.
+func (n *Node) CopyTo(ctx context.Context, localfile string, remotefile string) error {
+	file, err := os.Open(localfile)
+	if err != nil {
+		return n.wraperror("copy to", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return n.wraperror("copy to", err)
+	}
+	if !info.Mode().IsRegular() {
+		return n.wraperror("copy to", fmt.Errorf("%v is not a regular file", localfile))
+	}
+
+	return n.runscp(ctx, "copy to", "scp -t "+shellquote(remotefile), func(w io.Writer, r *bufio.Reader) error {
+		err := readscpack(r)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w, "C%04o %d %s\n", info.Mode().Perm(), info.Size(), path.Base(remotefile))
+		if err != nil {
+			return err
+		}
+		err = readscpack(r)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.CopyN(w, file, info.Size())
+		if err != nil {
+			return err
+		}
+		_, err = w.Write([]byte{0})
+		if err != nil {
+			return err
+		}
+		return readscpack(r)
+	})
+}
+
+// CopyFrom copies a file from the node to a local file over SSH, using
+// the scp protocol. The local file is created or replaced, with the
+// permissions of the remote file, once the copy has succeeded; if it
+// fails, an existing local file is left as it was. The scp program
+// must be installed on the node, as it is on kutti node images.
+func (n *Node) CopyFrom(ctx context.Context, remotefile string, localfile string) error {
+	// The file is copied to a temporary file next to localfile, and
+	// renamed over it only if the copy succeeds.
+	file, err := os.CreateTemp(filepath.Dir(localfile), filepath.Base(localfile)+".*.tmp")
+	if err != nil {
+		return n.wraperror("copy from", err)
+	}
+	tempfilename := file.Name()
+
+	var mode uint32
+	err = n.runscp(ctx, "copy from", "scp -f "+shellquote(remotefile), func(w io.Writer, r *bufio.Reader) error {
+		_, err := w.Write([]byte{0})
+		if err != nil {
+			return err
+		}
+
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if header[0] == 1 || header[0] == 2 {
+			return scperror(header[1:])
+		}
+
+		var size int64
+		_, err = fmt.Sscanf(header, "C%o %d", &mode, &size)
+		if err != nil {
+			return fmt.Errorf("%w: unexpected scp message %q", ErrSSHFailed, header)
+		}
+
+		_, err = w.Write([]byte{0})
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(file, r, size)
+		if err != nil {
+			return err
+		}
+		err = readscpack(r)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write([]byte{0})
+		return err
+	})
+
+	if err == nil {
+		err = file.Chmod(os.FileMode(mode).Perm())
+		if err == nil {
+			err = file.Sync()
+		}
+		err = n.wraperror("copy from", err)
+	}
+	closeerr := file.Close()
+	if err == nil && closeerr != nil {
+		err = n.wraperror("copy from", closeerr)
+	}
+	if err == nil {
+		err = n.wraperror("copy from", os.Rename(tempfilename, localfile))
+	}
+	if err != nil {
+		os.Remove(tempfilename)
+	}
+	return err
+}
+
+// runscp runs an scp command on the node, in source or sink mode, and
+// calls transfer to exchange scp protocol messages with it through w
+// and r. Errors reported by the remote scp are returned wrapping
+// ErrCommandFailed.
+func (n *Node) runscp(ctx context.Context, op string, command string, transfer func(w io.Writer, r *bufio.Reader) error) error {
+	n.ensuresshkeyonuse(ctx)
+	session, closesession, err := n.sshsession(ctx, op, false)
+	if err != nil {
+		return err
+	}
+	defer closesession()
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return n.wraperror(op, err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return n.wraperror(op, err)
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+
+	err = session.Start(command)
+	if err != nil {
+		return n.wraperror(op, fmt.Errorf("%w: %w", ErrSSHFailed, err))
+	}
+
+	transfererr := transfer(stdin, bufio.NewReader(stdout))
+	stdin.Close()
+	err = session.Wait()
+	if ctxerr := checkcontext(ctx, op); ctxerr != nil {
+		return n.wraperror(op, ctxerr)
+	}
+
+	if errors.Is(transfererr, ErrCommandFailed) {
+		return n.wraperror(op, transfererr)
+	}
+	var exiterr *ssh.ExitError
+	if errors.As(err, &exiterr) {
+		return n.wraperror(op, commandfailure(exiterr.ExitStatus(), stderr.String()))
+	}
+	if err != nil {
+		return n.wraperror(op, fmt.Errorf("%w: %w", ErrSSHFailed, err))
+	}
+	return n.wraperror(op, transfererr)
+}
+
+// readscpack reads the response of the remote scp to a protocol
+// message. A warning or error reported in it is returned as an error.
+func readscpack(r *bufio.Reader) error {
+	code, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if code == 0 {
+		return nil
+	}
+
+	message, _ := r.ReadString('\n')
+	return scperror(message)
+}
+
+func scperror(message string) error {
+	return fmt.Errorf("%w: scp: %s", ErrCommandFailed, strings.TrimSpace(message))
+}
+
+// commandfailure returns an error wrapping ErrCommandFailed if
+// exitcode is non-zero, or nil.
+func commandfailure(exitcode int, stderr string) error {
+	if exitcode == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: exit status %v: %s", ErrCommandFailed, exitcode, strings.TrimSpace(stderr))
+}
+
+// shellquote quotes s for use as a single word in a POSIX shell
+// command.
+func shellquote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// runsshcommand runs a command on the node over SSH, and returns its
+// standard output. A non-zero exit code is returned as an error.
+func runsshcommand(ctx context.Context, n *Node, command string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	exitcode, err := n.execstream(ctx, "exec", false, command, nil, &stdout, &stderr)
+	if err != nil {
+		return stdout.String(), err
+	}
+	return stdout.String(), commandfailure(exitcode, stderr.String())
+}
+
+// runsshpasswordcommand runs a command on the node over SSH as
+// runsshcommand does, but logs in with the password returned by
+// SSHPassword instead of the workspace key.
+func runsshpasswordcommand(ctx context.Context, n *Node, command string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	exitcode, err := n.execstream(ctx, "inject SSH key", true, command, nil, &stdout, &stderr)
+	if err != nil {
+		return stdout.String(), err
+	}
+	return stdout.String(), commandfailure(exitcode, stderr.String())
+}
+
+// SSHClientConfig returns a configuration with which clients using
+// golang.org/x/crypto/ssh can connect to the node, at the address
+// returned by SSHAddress. It logs in as SSHUser with the workspace SSH
+// key, and checks the host key of the node as described for
+// SSHHostKey. If the workspace does not have a key, ErrNoSSHKey is
+// returned.
+func (n *Node) SSHClientConfig() (*ssh.ClientConfig, error) {
+	_, err := workspacesshkey()
+	if err != nil {
+		return nil, n.wraperror("get SSH client config", err)
+	}
+
+	// The dial is made by the client, so the presented key is pinned
+	// in the background rather than once it succeeds.
+	return n.sshclientconfig(false, func(key ssh.PublicKey) { go n.pinsshhostkey(key) }), nil
+}
+
+// SSHKeyFingerprint returns the fingerprint of the workspace SSH key
+// that was last added to the node's authorized keys, or an empty
+// string if none has been. If it differs from the fingerprint of the
+// current workspace key, the key is added the next time the node is
+// used over SSH, or can be added with InjectSSHKey.
+func (n *Node) SSHKeyFingerprint() string {
+	configlock.RLock()
+	defer configlock.RUnlock()
+
+	return n.sshKey
+}
+
+// InjectSSHKey adds the public key of the workspace SSH key pair to
+// the authorized keys of the SSH user on the node, and removes the key
+// it replaced, if the workspace key has been rotated. The node must be
+// running, and commands must be runnable on it. If the workspace does
+// not have a key, ErrNoSSHKey is returned.
+//
+// The key is added using the CommandRunner set with SetCommandRunner,
+// if any. Otherwise, it is added over SSH, logging in with the
+// password returned by SSHPassword if the node does not accept the
+// workspace key yet.
+//
+// If the node does not accept the workspace key, and no password has
+// been set, ErrNoSSHPassword is returned.
+//
+// This is done when a node is created, once its SSH server accepts
+// connections, and the first time a node that does not have the
+// current key is used over SSH after that, so it is only needed to
+// add the key ahead of time, or to see why it could not be added.
+func (n *Node) InjectSSHKey() error {
+	return n.InjectSSHKeyContext(context.Background())
+}
+
+// InjectSSHKeyContext adds the workspace SSH key to the node, like
+// InjectSSHKey.
+// If ctx is canceled or its deadline expires before the key has been
+// added, a *CanceledError is returned.
+func (n *Node) InjectSSHKeyContext(ctx context.Context) error {
+	err := checkcontext(ctx, "inject SSH key")
+	if err != nil {
+		return n.wraperror("inject SSH key", err)
+	}
+
+	key, err := workspacesshkey()
+	if err != nil {
+		return n.wraperror("inject SSH key", err)
+	}
+
+	_, err = n.runsshkeycommand(ctx, authorizedkeyscommand(key, oldsshkey()))
+	if err != nil {
+		return n.wraperror("inject SSH key", err)
+	}
+
+	return clusterconfigmanager.Update(func() error {
+		err := n.checkconfigured()
+		if err != nil {
+			return err
+		}
+
+		configlock.Lock()
+		n.sshKey = key.fingerprint()
+		configlock.Unlock()
+
+		return nil
+	})
+}
+
+// runsshkeycommand runs a command which changes the authorized keys
+// of the node, as described for InjectSSHKey.
+func (n *Node) runsshkeycommand(ctx context.Context, command string) (string, error) {
+	if _, ok := currentcommandrunner().(defaultcommandrunner); !ok {
+		return n.runcommand(ctx, command)
+	}
+
+	if n.SSHAddress() == "" {
+		return "", ErrCommandsNotSupported
+	}
+
+	output, err := runsshcommand(ctx, n, command)
+	if errors.Is(err, ErrSSHFailed) {
+		if SSHPassword() == "" {
+			return output, fmt.Errorf("%w: %w", ErrNoSSHPassword, err)
+		}
+		return runsshpasswordcommand(ctx, n, command)
+	}
+	return output, err
+}
+
+// ensuresshkey injects the workspace SSH key into a running node, if
+// the workspace has a key and it has not been injected already. Since
+// the node may have just started, it first waits for SSH as waitforssh
+// does. Nodes which cannot run commands are skipped, and this is
+// logged. Other failures are returned, and leave SSHKeyFingerprint
+// unchanged.
+func (n *Node) ensuresshkey(ctx context.Context) error {
+	key, err := workspacesshkey()
+	if err != nil || n.SSHKeyFingerprint() == key.fingerprint() {
+		return nil
+	}
+
+	if n.Status() != NodeStatusRunning {
+		return nil
+	}
+
+	err = n.waitforssh(ctx)
+	if err == nil {
+		err = n.InjectSSHKeyContext(ctx)
+	}
+	if errors.Is(err, ErrCommandsNotSupported) {
+		logf(VerbosityInfo, n.logfields("inject SSH key"), "Node %s cannot run commands, so the SSH key was not added.", n.name)
+		return nil
+	}
+	return n.wraperror("inject SSH key", err)
+}
+
+// ensuresshkeyonuse adds the workspace SSH key to a running node that
+// is about to be used over SSH, if it does not have the current key.
+// Nodes are not given the key when they are started, since their SSH
+// servers may take minutes to accept connections, so a node that was
+// stopped when the key was rotated is given it here. Failures are
+// logged rather than returned, since the connection that follows
+// fails anyway if the node does not accept the key.
+func (n *Node) ensuresshkeyonuse(ctx context.Context) {
+	key, err := workspacesshkey()
+	if err != nil || n.SSHKeyFingerprint() == key.fingerprint() {
+		return
+	}
+
+	if n.SSHAddress() == "" || n.Status() != NodeStatusRunning {
+		return
+	}
+
+	err = n.InjectSSHKeyContext(ctx)
+	if err != nil {
+		logf(VerbosityInfo, append(n.logfields("inject SSH key"), "error", err), "The SSH key could not be added to node %s: %v.", n.name, err)
+	}
+}
@@ -0,0 +1,400 @@
+package kuttilib_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kuttiproject/drivercore"
+	"github.com/kuttiproject/drivercore/drivercoretest/drivermock"
+	"github.com/kuttiproject/kuttilib"
+	"github.com/kuttiproject/workspace"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshdriver is a mock driver whose machines run an in-process SSH
+// server on the host port to which their SSH port is forwarded. Each
+// machine has a host key, generated when it is created, and a
+// directory in which the server runs commands with sh.
+//
+// kuttilib adds keys to .ssh/authorized_keys in the home directory of
+// the SSH user on nodes, which it looks up with getent. Since the user
+// does not exist locally, the server runs commands with a stand-in for
+// getent, which reports a directory named ~USER within the machine
+// directory as the home directory. The server accepts the keys listed
+// there, and the password set with setpassword, if any.
+type sshdriver struct {
+	*drivermock.MockDriver
+
+	mu       sync.Mutex
+	hosts    map[string]*sshhost
+	password string
+}
+
+// fakegetent is a stand-in for getent, which reports ~USER in the
+// current directory as the home directory of any user.
+const fakegetent = `#!/bin/sh
+printf '%s:x:1000:1000::%s:/bin/sh\n' "$2" "$PWD/~$2"
+`
+
+// sshhost is the SSH server of a machine of sshdriver.
+type sshhost struct {
+	driver   *sshdriver
+	dir      string
+	listener net.Listener
+
+	mu       sync.Mutex
+	hostkey  ssh.Signer
+	logins   []string
+	commands []string
+}
+
+func (d *sshdriver) NewMachine(machinename string, clustername string, k8sversion string) (drivercore.Machine, error) {
+	machine, err := d.MockDriver.NewMachine(machinename, clustername, k8sversion)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "kuttilib-sshhost-*")
+	if err != nil {
+		return nil, err
+	}
+	err = os.Mkdir(filepath.Join(dir, "bin"), 0755)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "bin", "getent"), []byte(fakegetent), 0755)
+	}
+	if err != nil {
+		return nil, err
+	}
+	host := &sshhost{driver: d, dir: dir}
+	err = host.rekey()
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	d.hosts[machine.Name()] = host
+	d.mu.Unlock()
+
+	return &sshmachine{Machine: machine, driver: d}, nil
+}
+
+func (d *sshdriver) GetMachine(machinename string, clustername string) (drivercore.Machine, error) {
+	machine, err := d.MockDriver.GetMachine(machinename, clustername)
+	if err != nil {
+		return nil, err
+	}
+	return &sshmachine{Machine: machine, driver: d}, nil
+}
+
+func (d *sshdriver) DeleteMachine(machinename string, clustername string) error {
+	machine, err := d.MockDriver.GetMachine(machinename, clustername)
+	if err == nil {
+		d.mu.Lock()
+		host := d.hosts[machine.Name()]
+		delete(d.hosts, machine.Name())
+		d.mu.Unlock()
+
+		if host != nil {
+			host.stop()
+			os.RemoveAll(host.dir)
+		}
+	}
+	return d.MockDriver.DeleteMachine(machinename, clustername)
+}
+
+// setpassword sets the password accepted by the SSH servers, or stops
+// them accepting passwords if password is empty.
+func (d *sshdriver) setpassword(password string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.password = password
+}
+
+func (d *sshdriver) acceptspassword(password string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.password != "" && password == d.password
+}
+
+// host returns the SSH server of the host of node.
+func (d *sshdriver) host(t *testing.T, node *kuttilib.Node) *sshhost {
+	machine, err := d.MockDriver.GetMachine(node.Name(), node.Cluster().Name())
+	if err != nil {
+		t.Fatalf("getting host of node %v failed with: %v", node.Name(), err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.hosts[machine.Name()]
+}
+
+func (d *sshdriver) machinehost(machinename string) *sshhost {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.hosts[machinename]
+}
+
+// rekey gives the host a new host key.
+func (h *sshhost) rekey() error {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hostkey = signer
+	return nil
+}
+
+// publickey returns the host key, in authorized_keys format.
+func (h *sshhost) publickey() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(h.hostkey.PublicKey())))
+}
+
+func (h *sshhost) authorizedkeysfile(user string) string {
+	return filepath.Join(h.dir, "~"+user, ".ssh", "authorized_keys")
+}
+
+// authorize adds a public key to the authorized keys of user.
+func (h *sshhost) authorize(t *testing.T, user string, publickey string) {
+	filename := h.authorizedkeysfile(user)
+	err := os.MkdirAll(filepath.Dir(filename), 0700)
+	if err == nil {
+		err = os.WriteFile(filename, []byte(publickey+"\n"), 0600)
+	}
+	if err != nil {
+		t.Fatalf("authorizing SSH key failed with: %v", err)
+	}
+}
+
+func (h *sshhost) authorized(user string, key ssh.PublicKey) bool {
+	data, _ := os.ReadFile(h.authorizedkeysfile(user))
+	for len(data) > 0 {
+		authorized, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return false
+		}
+		if bytes.Equal(authorized.Marshal(), key.Marshal()) {
+			return true
+		}
+		data = rest
+	}
+	return false
+}
+
+// loginsandcommands returns the logins made to the host, as "USER
+// METHOD", and the commands run on it.
+func (h *sshhost) loginsandcommands() ([]string, []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return slices.Clone(h.logins), slices.Clone(h.commands)
+}
+
+func (h *sshhost) listen(hostport int) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(hostport)))
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.listener = listener
+	h.mu.Unlock()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go h.serve(conn)
+		}
+	}()
+	return nil
+}
+
+func (h *sshhost) stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.listener != nil {
+		h.listener.Close()
+		h.listener = nil
+	}
+}
+
+func (h *sshhost) serve(conn net.Conn) {
+	defer conn.Close()
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !h.authorized(meta.User(), key) {
+				return nil, errors.New("key not authorized")
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"method": "publickey"}}, nil
+		},
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if !h.driver.acceptspassword(string(password)) {
+				return nil, errors.New("wrong password")
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"method": "password"}}, nil
+		},
+	}
+	h.mu.Lock()
+	config.AddHostKey(h.hostkey)
+	h.mu.Unlock()
+
+	sshconn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer sshconn.Close()
+
+	h.mu.Lock()
+	h.logins = append(h.logins, sshconn.User()+" "+sshconn.Permissions.Extensions["method"])
+	h.mu.Unlock()
+
+	go ssh.DiscardRequests(requests)
+	for newchannel := range channels {
+		if newchannel.ChannelType() != "session" {
+			newchannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, channelrequests, err := newchannel.Accept()
+		if err != nil {
+			continue
+		}
+		go h.session(channel, channelrequests)
+	}
+}
+
+// session runs the command of the first exec request of a session,
+// and reports its exit status.
+func (h *sshhost) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for request := range requests {
+		var payload struct{ Command string }
+		if request.Type != "exec" || ssh.Unmarshal(request.Payload, &payload) != nil {
+			request.Reply(false, nil)
+			continue
+		}
+		request.Reply(true, nil)
+
+		h.mu.Lock()
+		h.commands = append(h.commands, payload.Command)
+		h.mu.Unlock()
+
+		status := h.run(payload.Command, channel)
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+		return
+	}
+}
+
+func (h *sshhost) run(command string, channel ssh.Channel) uint32 {
+	shell := exec.Command("sh", "-c", command)
+	shell.Dir = h.dir
+	shell.Env = append(os.Environ(), "PATH="+filepath.Join(h.dir, "bin")+string(os.PathListSeparator)+os.Getenv("PATH"))
+	shell.Stdout = channel
+	shell.Stderr = channel.Stderr()
+	stdin, err := shell.StdinPipe()
+	if err != nil {
+		return 255
+	}
+
+	err = shell.Start()
+	if err != nil {
+		return 127
+	}
+	go func() {
+		io.Copy(stdin, channel)
+		stdin.Close()
+	}()
+
+	err = shell.Wait()
+	var exiterr *exec.ExitError
+	if errors.As(err, &exiterr) {
+		return uint32(exiterr.ExitCode())
+	}
+	if err != nil {
+		return 255
+	}
+	return 0
+}
+
+// sshmachine is a mock machine whose SSH server listens on the host
+// port to which its SSH port is forwarded.
+type sshmachine struct {
+	drivercore.Machine
+	driver *sshdriver
+}
+
+func (m *sshmachine) ForwardPort(hostport int, machineport int) error {
+	if machineport == 22 {
+		host := m.driver.machinehost(m.Name())
+		host.stop()
+		err := host.listen(hostport)
+		if err != nil {
+			return err
+		}
+	}
+	return m.Machine.ForwardPort(hostport, machineport)
+}
+
+func (m *sshmachine) ForwardSSHPort(hostport int) error {
+	return m.ForwardPort(hostport, 22)
+}
+
+func (m *sshmachine) UnforwardPort(machineport int) error {
+	if machineport == 22 {
+		m.driver.machinehost(m.Name()).stop()
+	}
+	return m.Machine.UnforwardPort(machineport)
+}
+
+// sshtestdriver returns the driver whose machines run SSH servers.
+func sshtestdriver(t *testing.T) *sshdriver {
+	ensuredriverversion(t, DRIVER4)
+
+	driver, _ := drivercore.GetDriver(DRIVER4)
+	return driver.(*sshdriver)
+}
+
+// forwardsshport forwards the SSH port of node to a free host port,
+// which starts the SSH server of its host.
+func forwardsshport(t *testing.T, node *kuttilib.Node) {
+	hostport, err := kuttilib.AllocateHostPort()
+	if err != nil {
+		t.Fatalf("allocating host port failed with: %v", err)
+	}
+	err = node.ForwardSSHPort(hostport)
+	if err != nil {
+		t.Fatalf("forwarding SSH port failed with: %v", err)
+	}
+}
+
+// removesshkeys removes the workspace SSH key files.
+func removesshkeys() {
+	confdir, _ := workspace.ConfigDir()
+	keyfile := filepath.Join(confdir, "kuttilib-ssh-key")
+	for _, suffix := range []string{"", ".pub", ".old", ".old.pub"} {
+		os.Remove(keyfile + suffix)
+	}
+}
@@ -0,0 +1,206 @@
+package kuttilib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultWaitTimeout is how long node operations such as
+	// Node.Start wait for the node to reach the desired status, unless
+	// SetDefaultWaitOptions is used to change it.
+	DefaultWaitTimeout = 25 * time.Second
+	// DefaultPollInterval is the interval between checks of a waited
+	// condition, if WaitOptions does not specify one.
+	DefaultPollInterval = 500 * time.Millisecond
+)
+
+// errwaittimedout is the cause of a wait context expiring because
+// of WaitOptions.Timeout, as opposed to the caller's context.
+var errwaittimedout = errors.New("wait timed out")
+
+// WaitOptions control how a condition is waited for.
+type WaitOptions struct {
+	// Timeout is the maximum time to wait. If it is zero, the wait
+	// lasts until the condition is met or the context is done.
+	Timeout time.Duration
+	// PollInterval is the interval between the first checks of the
+	// condition. If it is zero, DefaultPollInterval is used.
+	PollInterval time.Duration
+	// Backoff is the factor by which the interval grows after each
+	// check. Values of 1 or less keep the interval constant.
+	Backoff float64
+	// MaxPollInterval caps the interval when Backoff is used. If it
+	// is zero, the interval is not capped.
+	MaxPollInterval time.Duration
+}
+
+var (
+	defaultwaitoptionslock sync.RWMutex
+	defaultwaitoptions     = WaitOptions{Timeout: DefaultWaitTimeout}
+)
+
+// SetDefaultWaitOptions sets how node operations, such as Node.Start
+// and Node.StopContext, wait for the node to reach the desired status.
+// If it is not reached within opts.Timeout, they return a
+// *TimeoutError. The variants with a context also stop waiting when
+// the context is done. A zero Timeout makes the variants without a
+// context wait indefinitely.
+func SetDefaultWaitOptions(opts WaitOptions) {
+	defaultwaitoptionslock.Lock()
+	defer defaultwaitoptionslock.Unlock()
+	defaultwaitoptions = opts
+}
+
+// DefaultWaitOptions returns the options set by SetDefaultWaitOptions.
+// Initially, they specify a Timeout of DefaultWaitTimeout.
+func DefaultWaitOptions() WaitOptions {
+	defaultwaitoptionslock.RLock()
+	defer defaultwaitoptionslock.RUnlock()
+	return defaultwaitoptions
+}
+
+// nextinterval returns the poll interval to use after interval.
+func (opts WaitOptions) nextinterval(interval time.Duration) time.Duration {
+	if opts.Backoff > 1 {
+		interval = time.Duration(float64(interval) * opts.Backoff)
+	}
+	if opts.MaxPollInterval > 0 && interval > opts.MaxPollInterval {
+		interval = opts.MaxPollInterval
+	}
+	return interval
+}
+
+// NodeCondition is a condition on a node that can be waited for. It
+// returns true if the condition is met, and a description of what it
+// observed, which is reported if the wait times out. If it returns an
+// error, the wait ends with that error.
+type NodeCondition func(ctx context.Context, n *Node) (bool, string, error)
+
+// NodeHasStatus returns a condition that is met when a node has the
+// specified status.
+func NodeHasStatus(status NodeStatus) NodeCondition {
+	return func(ctx context.Context, n *Node) (bool, string, error) {
+		current := n.Status()
+		return current == status, "status " + string(current), nil
+	}
+}
+
+// NodeIsHealthy returns a condition that is met when all health checks
+// on a node pass, as reported by Node.Health.
+func NodeIsHealthy() NodeCondition {
+	return func(ctx context.Context, n *Node) (bool, string, error) {
+		health, err := n.Health(ctx)
+		if err != nil {
+			return false, "", err
+		}
+		return health.Status == HealthStatusHealthy, describenodehealth(health), nil
+	}
+}
+
+// WaitFor waits until condition is met for the node. The condition is
+// checked immediately, and then repeatedly as specified by opts. If
+// opts.Timeout passes first, a *TimeoutError reporting the last
+// observation of the condition is returned. If ctx is canceled or its
+// deadline expires first, a *CanceledError is returned.
+func (n *Node) WaitFor(ctx context.Context, condition NodeCondition, opts WaitOptions) error {
+	err := waitfor(ctx, "wait", opts, func(ctx context.Context) (bool, string, error) {
+		return condition(ctx, n)
+	})
+	return n.wraperror("wait", err)
+}
+
+// WaitForReady waits until all health checks on all nodes of the
+// cluster pass, as reported by Cluster.Health. It waits in the same
+// way as Node.WaitFor. A *TimeoutError reports the health of each node
+// that was not healthy at the last check.
+func (c *Cluster) WaitForReady(ctx context.Context, opts WaitOptions) error {
+	return waitfor(ctx, "wait for ready", opts, func(ctx context.Context) (bool, string, error) {
+		health, err := c.Health(ctx)
+		if err != nil {
+			return false, "", err
+		}
+
+		unhealthy := []string{}
+		for _, nodehealth := range health.Nodes {
+			if nodehealth.Status != HealthStatusHealthy {
+				unhealthy = append(unhealthy, nodehealth.Node+": "+describenodehealth(nodehealth))
+			}
+		}
+		status := "cluster " + string(health.Status)
+		if len(unhealthy) > 0 {
+			status += " (" + strings.Join(unhealthy, "; ") + ")"
+		}
+
+		return health.Status == HealthStatusHealthy, status, nil
+	})
+}
+
+// describenodehealth summarizes the checks that did not pass.
+func describenodehealth(health *NodeHealth) string {
+	failed := []string{}
+	for _, check := range health.Checks {
+		if check.Status != HealthStatusHealthy {
+			failed = append(failed, fmt.Sprintf("%s %s", check.Name, check.Status))
+		}
+	}
+	if len(failed) == 0 {
+		return string(health.Status)
+	}
+	return string(health.Status) + ": " + strings.Join(failed, ", ")
+}
+
+// waitfor checks a condition until it is met, as specified by opts.
+func waitfor(ctx context.Context, op string, opts WaitOptions, check func(context.Context) (bool, string, error)) error {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, opts.Timeout, errwaittimedout)
+		defer cancel()
+	}
+
+	interval := opts.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+
+	laststatus := ""
+	for {
+		done, status, err := check(ctx)
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+		if err == nil {
+			if done {
+				return nil
+			}
+			laststatus = status
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if errors.Is(context.Cause(ctx), errwaittimedout) {
+				return &TimeoutError{Op: op, Timeout: opts.Timeout, LastStatus: laststatus}
+			}
+			return &CanceledError{Op: op, Err: ctx.Err()}
+		case <-timer.C:
+		}
+
+		interval = opts.nextinterval(interval)
+	}
+}
+
+// waitforstatus polls the node status until it becomes the specified
+// status, as specified by the default wait options, or ctx is done.
+// If the status is not reached within their timeout, a *TimeoutError
+// is returned.
+func (n *Node) waitforstatus(ctx context.Context, op string, status NodeStatus) error {
+	return waitfor(ctx, op, DefaultWaitOptions(), func(ctx context.Context) (bool, string, error) {
+		return NodeHasStatus(status)(ctx, n)
+	})
+}
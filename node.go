@@ -1,12 +1,12 @@
 package kuttilib
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
-	"github.com/kuttiproject/kuttilog"
-
 	"github.com/kuttiproject/drivercore"
 )
 
@@ -21,6 +21,18 @@ const (
 	NodeStatusRunning = NodeStatus(drivercore.MachineStatusRunning)
 )
 
+// The NodeType* constants list valid node types.
+const (
+	// NodeTypeUnmanaged nodes are not joined to a Kubernetes cluster
+	// by kuttilib.
+	NodeTypeUnmanaged = "Unmanaged"
+	// NodeTypeControlPlane nodes run the Kubernetes control plane of
+	// a managed cluster.
+	NodeTypeControlPlane = "ControlPlane"
+	// NodeTypeWorker nodes are joined to a managed cluster as workers.
+	NodeTypeWorker = "Worker"
+)
+
 // nodedata is a data-only representation of the Node type,
 // used for serialization and output.
 type nodedata struct {
@@ -28,7 +40,12 @@ type nodedata struct {
 	Name        string
 	CreatedAt   time.Time
 	Type        string
+	K8sVersion  string    `json:",omitempty"`
+	Spec        *NodeSpec `json:",omitempty"`
 	Ports       map[int]int
+	SSHKey      string     `json:",omitempty"`
+	SSHHostKey  string     `json:",omitempty"`
+	Snapshots   []Snapshot `json:",omitempty"`
 }
 
 // Node represents a node in a Kubernetes cluster.
@@ -41,9 +58,18 @@ type Node struct {
 	name        string
 	createdAt   time.Time
 	nodetype    string
+	k8sVersion  string
+	spec        NodeSpec
 	host        drivercore.Machine
 	//status      string
-	ports map[int]int
+	ports      map[int]int
+	sshKey     string
+	sshHostKey string
+	snapshots  []Snapshot
+
+	// mu guards the cluster and host, which are cached at
+	// runtime. Persisted fields are guarded by configlock.
+	mu sync.Mutex
 }
 
 // Name returns the name of the node.
@@ -56,15 +82,42 @@ func (n *Node) Type() string {
 	return n.nodetype
 }
 
+// K8sVersion returns the Kubernetes version of this node. This is the
+// version of its cluster, unless an upgrade of the cluster has not yet
+// reached, or has not completed for, all of its nodes.
+func (n *Node) K8sVersion() string {
+	configlock.RLock()
+	version := n.k8sVersion
+	configlock.RUnlock()
+
+	if version == "" {
+		return n.Cluster().K8sVersion()
+	}
+	return version
+}
+
+// Spec returns the hardware resources requested for this node
+// when it was created.
+func (n *Node) Spec() NodeSpec {
+	return n.spec
+}
+
 // CreatedAt returns the time this node was created.
 func (n *Node) CreatedAt() time.Time {
 	return n.createdAt
 }
 
-// Ports returns the node port to host port
+// Ports returns a copy of the node port to host port
 // mappings of this node.
 func (n *Node) Ports() map[int]int {
-	return n.ports
+	configlock.RLock()
+	defer configlock.RUnlock()
+
+	result := make(map[int]int, len(n.ports))
+	for nodeport, hostport := range n.ports {
+		result[nodeport] = hostport
+	}
+	return result
 }
 
 // IPAddress returns the IP address of the node if it is running,
@@ -101,11 +154,21 @@ func (n *Node) SSHAddress() string {
 
 // Cluster returns the Cluster this node belongs to.
 func (n *Node) Cluster() *Cluster {
+	n.mu.Lock()
 	if n.cluster == nil {
+		configlock.RLock()
 		n.cluster = config.Clusters[n.clusterName]
-		n.cluster.ensuredriver()
+		configlock.RUnlock()
 	}
-	return n.cluster
+	c := n.cluster
+	n.mu.Unlock()
+
+	// The driver is always ensured here, so that callers
+	// can safely use c.driver afterwards.
+	if c != nil {
+		c.ensuredriver()
+	}
+	return c
 }
 
 // Status returns the current status of this node.
@@ -118,87 +181,150 @@ func (n *Node) Status() NodeStatus {
 	return NodeStatus(n.host.Status())
 }
 
-// Start starts this node.
+// Start starts this node, and waits until it is running, for up to the
+// timeout of the default wait options. If it is not running by then,
+// a *TimeoutError is returned. The node may still start after that.
+//
+// The workspace SSH key is not added to the node here, since its SSH
+// server may take minutes to accept connections after it has started.
+// If the node does not have the current key, because it was stopped
+// when the key was rotated, the key is added the first time the node
+// is used over SSH, or can be added ahead of time with InjectSSHKey.
 func (n *Node) Start() error {
-	err := n.ensurehost()
+	err := n.start()
 	if err != nil {
-		return err
+		return n.wraperror("start", err)
 	}
 
-	if n.Status() == NodeStatusStopped {
-		err = n.host.Start()
-		if err != nil {
-			return err
-		}
+	return n.wraperror("start", n.waitforstatus(context.Background(), "start", NodeStatusRunning))
+}
 
-		n.host.WaitForStateChange(25)
-		return nil
+// StartContext starts this node, and waits until it is running, as
+// Start does. As with Start, the workspace SSH key is not added to it.
+// If ctx is canceled or its deadline expires before the node is
+// running, a *CanceledError is returned. The node may still start
+// after that.
+func (n *Node) StartContext(ctx context.Context) error {
+	err := checkcontext(ctx, "start")
+	if err != nil {
+		return n.wraperror("start", err)
+	}
+
+	err = n.start()
+	if err != nil {
+		return n.wraperror("start", err)
 	}
 
-	return errNodeCannotStart
+	return n.wraperror("start", n.waitforstatus(ctx, "start", NodeStatusRunning))
 }
 
-// ForceStart tries to forcibly start this node.
+// ForceStart tries to forcibly start this node. As with Start, the
+// workspace SSH key is not added to it.
 // It does not check the current status before doing so.
 func (n *Node) ForceStart() error {
-	err := n.ensurehost()
+	err := n.forcestart()
 	if err != nil {
-		return err
+		return n.wraperror("force start", err)
 	}
 
-	err = n.host.Start()
+	logprint(VerbosityInfo, n.logfields("force start"), "Waiting for node to start...")
+	start := time.Now()
+	err = n.waitforstatus(context.Background(), "force start", NodeStatusRunning)
 	if err != nil {
-		return err
+		logprintln(VerbosityInfo, append(n.logfields("force start"), "duration", time.Since(start)), "Failed.")
+		return n.wraperror("force start", err)
 	}
-
-	// TODO: Consider moving this wait, or standardize the duration
-	kuttilog.Print(kuttilog.Info, "Waiting for node to start...")
-	n.host.WaitForStateChange(25)
-	kuttilog.Println(kuttilog.Info, "Done.")
+	logprintln(VerbosityInfo, append(n.logfields("force start"), "duration", time.Since(start)), "Done.")
 	return nil
 }
 
-// Stop stops this node gracefully.
+// ForceStartContext tries to forcibly start this node, and waits
+// until it is running. It does not check the current status before
+// doing so.
+// If ctx is canceled or its deadline expires before the node is
+// running, a *CanceledError is returned.
+func (n *Node) ForceStartContext(ctx context.Context) error {
+	err := checkcontext(ctx, "force start")
+	if err != nil {
+		return n.wraperror("force start", err)
+	}
+
+	err = n.forcestart()
+	if err != nil {
+		return n.wraperror("force start", err)
+	}
+
+	return n.wraperror("force start", n.waitforstatus(ctx, "force start", NodeStatusRunning))
+}
+
+// Stop stops this node gracefully, and waits until it has stopped, as
+// Start waits for it to start.
 func (n *Node) Stop() error {
-	err := n.ensurehost()
+	err := n.stop()
 	if err != nil {
-		return err
+		return n.wraperror("stop", err)
 	}
 
-	if n.Status() == NodeStatusRunning {
-		err = n.host.Stop()
-		if err != nil {
-			return err
-		}
+	return n.wraperror("stop", n.waitforstatus(context.Background(), "stop", NodeStatusStopped))
+}
 
-		n.host.WaitForStateChange(25)
-		return nil
+// StopContext stops this node gracefully, and waits until it has
+// stopped, as Stop does.
+// If ctx is canceled or its deadline expires before the node has
+// stopped, a *CanceledError is returned. The node may still stop
+// after that.
+func (n *Node) StopContext(ctx context.Context) error {
+	err := checkcontext(ctx, "stop")
+	if err != nil {
+		return n.wraperror("stop", err)
 	}
 
-	return errNodeCannotStop
+	err = n.stop()
+	if err != nil {
+		return n.wraperror("stop", err)
+	}
 
+	return n.wraperror("stop", n.waitforstatus(ctx, "stop", NodeStatusStopped))
 }
 
 // ForceStop tries to forcibly stop this node.
 // It does not check the current status before doing so.
 func (n *Node) ForceStop() error {
-	err := n.ensurehost()
+	err := n.forcestop()
 	if err != nil {
-		return err
+		return n.wraperror("force stop", err)
 	}
 
-	err = n.host.ForceStop()
+	logprint(VerbosityInfo, n.logfields("force stop"), "Waiting for node to stop...")
+	start := time.Now()
+	err = n.waitforstatus(context.Background(), "force stop", NodeStatusStopped)
 	if err != nil {
-		return err
+		logprintln(VerbosityInfo, append(n.logfields("force stop"), "duration", time.Since(start)), "Failed.")
+		return n.wraperror("force stop", err)
 	}
-
-	// TODO: Consider moving this wait, or standardize the duration
-	kuttilog.Print(kuttilog.Info, "Waiting for node to stop...")
-	n.host.WaitForStateChange(25)
-	kuttilog.Println(kuttilog.Info, "Done.")
+	logprintln(VerbosityInfo, append(n.logfields("force stop"), "duration", time.Since(start)), "Done.")
 	return nil
 }
 
+// ForceStopContext tries to forcibly stop this node, and waits
+// until it has stopped. It does not check the current status
+// before doing so.
+// If ctx is canceled or its deadline expires before the node has
+// stopped, a *CanceledError is returned.
+func (n *Node) ForceStopContext(ctx context.Context) error {
+	err := checkcontext(ctx, "force stop")
+	if err != nil {
+		return n.wraperror("force stop", err)
+	}
+
+	err = n.forcestop()
+	if err != nil {
+		return n.wraperror("force stop", err)
+	}
+
+	return n.wraperror("force stop", n.waitforstatus(ctx, "force stop", NodeStatusStopped))
+}
+
 // ForwardSSHPort forwards the node's SSH port to the specified host
 // port.
 func (n *Node) ForwardSSHPort(hostport int) error {
@@ -209,43 +335,68 @@ func (n *Node) ForwardSSHPort(hostport int) error {
 func (n *Node) ForwardPort(hostport int, nodeport int) error {
 	err := n.Cluster().ensuredriver()
 	if err != nil {
-		return err
+		return n.wraperror("forward port", err)
 	}
 
 	if !n.Cluster().driver.UsesNATNetworking() {
-		return errPortForwardNotSupported
+		return n.wraperror("forward port", ErrPortForwardNotSupported)
 	}
 
 	if !ValidPort(nodeport) {
-		return errPortNodePortInvalid
+		return n.porterror("forward port", hostport, nodeport, ErrPortNodePortInvalid)
 	}
 
 	if !ValidPort(hostport) {
-		return errPortHostPortInvalid
+		return n.porterror("forward port", hostport, nodeport, ErrPortHostPortInvalid)
 	}
 
 	err = n.ensurehost()
 	if err != nil {
-		return err
+		return n.wraperror("forward port", err)
 	}
 
-	err = n.CheckHostPort(hostport)
+	err = clusterconfigmanager.Update(func() error {
+		return n.forwardport(hostport, nodeport)
+	})
 	if err != nil {
 		return err
 	}
 
+	publish(Event{Type: EventPortForwarded, Cluster: n.clusterName, Node: n.name, HostPort: hostport, NodePort: nodeport})
+	return nil
+}
+
+// forwardport checks and forwards a port. It must be called from
+// within clusterconfigmanager.Update, after ensurehost. The caller
+// publishes EventPortForwarded once the update has been saved.
+func (n *Node) forwardport(hostport int, nodeport int) error {
+	err := n.checkconfigured()
+	if err != nil {
+		return n.wraperror("forward port", err)
+	}
+
+	err = CheckWorkspaceHostPort(hostport)
+	if err != nil {
+		return n.wraperror("forward port", err)
+	}
+
+	configlock.RLock()
 	_, ok := n.ports[nodeport]
+	configlock.RUnlock()
 	if ok {
-		return errPortNodePortInUse
+		return n.porterror("forward port", hostport, nodeport, ErrPortNodePortInUse)
 	}
 
 	err = n.host.ForwardPort(hostport, nodeport)
 	if err != nil {
-		return err
+		return n.porterror("forward port", hostport, nodeport, err)
 	}
 
+	configlock.Lock()
 	n.ports[nodeport] = hostport
-	return clusterconfigmanager.Save()
+	configlock.Unlock()
+
+	return nil
 }
 
 // UnforwardPort removes any mapping of the specified node port.
@@ -253,38 +404,56 @@ func (n *Node) UnforwardPort(nodeport int) error {
 	cluster := n.Cluster()
 	err := cluster.ensuredriver()
 	if err != nil {
-		return err
+		return n.wraperror("unforward port", err)
 	}
 
 	if !cluster.driver.UsesNATNetworking() {
-		return errPortForwardNotSupported
+		return n.wraperror("unforward port", ErrPortForwardNotSupported)
 	}
 
 	if !ValidPort(nodeport) {
-		return errPortNodePortInvalid
+		return n.porterror("unforward port", 0, nodeport, ErrPortNodePortInvalid)
 	}
 
 	if nodeport == 22 {
-		return errPortCannotUnmap
-	}
-
-	_, ok := n.ports[nodeport]
-	if !ok {
-		return errPortNotForwarded
+		return n.porterror("unforward port", n.Ports()[nodeport], nodeport, ErrPortCannotUnmap)
 	}
 
 	err = n.ensurehost()
 	if err != nil {
-		return err
+		return n.wraperror("unforward port", err)
 	}
 
-	err = n.host.UnforwardPort(nodeport)
+	var hostport int
+	err = clusterconfigmanager.Update(func() error {
+		err := n.checkconfigured()
+		if err != nil {
+			return n.wraperror("unforward port", err)
+		}
+
+		var ok bool
+		hostport, ok = n.ports[nodeport]
+		if !ok {
+			return n.porterror("unforward port", 0, nodeport, ErrPortNotForwarded)
+		}
+
+		err = n.host.UnforwardPort(nodeport)
+		if err != nil {
+			return n.porterror("unforward port", hostport, nodeport, err)
+		}
+
+		configlock.Lock()
+		delete(n.ports, nodeport)
+		configlock.Unlock()
+
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	delete(n.ports, nodeport)
-	return clusterconfigmanager.Save()
+	publish(Event{Type: EventPortUnforwarded, Cluster: n.clusterName, Node: n.name, HostPort: hostport, NodePort: nodeport})
+	return nil
 }
 
 // CheckHostPort checks if a host port is occupied in the current cluster.
@@ -296,12 +465,25 @@ func (n *Node) CheckHostPort(hostport int) error {
 // MarshalJSON returns the JSON encoding of the node.
 func (n *Node) MarshalJSON() ([]byte, error) {
 	utcloc, _ := time.LoadLocation("UTC")
+
+	configlock.RLock()
+	k8sversion := n.k8sVersion
+	configlock.RUnlock()
+
 	savedata := nodedata{
 		ClusterName: n.clusterName,
 		Name:        n.name,
 		CreatedAt:   n.createdAt.In(utcloc),
 		Type:        n.nodetype,
-		Ports:       n.ports,
+		K8sVersion:  k8sversion,
+		Ports:       n.Ports(),
+		SSHKey:      n.SSHKeyFingerprint(),
+		SSHHostKey:  n.SSHHostKey(),
+		Snapshots:   n.Snapshots(),
+	}
+	if !n.spec.IsDefault() {
+		spec := n.spec
+		savedata.Spec = &spec
 	}
 
 	return json.Marshal(savedata)
@@ -323,24 +505,97 @@ func (n *Node) UnmarshalJSON(b []byte) error {
 	n.name = loaddata.Name
 	n.createdAt = loaddata.CreatedAt.In(localloc)
 	n.nodetype = loaddata.Type
+	n.k8sVersion = loaddata.K8sVersion
+	if loaddata.Spec != nil {
+		n.spec = *loaddata.Spec
+	}
 	n.ports = loaddata.Ports
+	n.sshKey = loaddata.SSHKey
+	n.sshHostKey = loaddata.SSHHostKey
+	n.snapshots = loaddata.Snapshots
+
+	return nil
+}
+
+// sameas returns true if loaded represents the same node as n,
+// rather than a different node created with the same name.
+func (n *Node) sameas(loaded *Node) bool {
+	return n.nodetype == loaded.nodetype &&
+		n.createdAt.Equal(loaded.createdAt)
+}
+
+// merge updates the mutable persisted fields of the node from a
+// freshly loaded copy. It must be called with configlock held for
+// writing.
+func (n *Node) merge(loaded *Node) {
+	n.ports = loaded.ports
+	if n.ports == nil {
+		n.ports = map[int]int{}
+	}
+	n.sshKey = loaded.sshKey
+	n.sshHostKey = loaded.sshHostKey
+	n.snapshots = loaded.snapshots
+	n.k8sVersion = loaded.k8sVersion
+}
+
+// checkconfigured returns an error if the node or its cluster has
+// been deleted from the configuration, possibly by another process.
+func (n *Node) checkconfigured() error {
+	configlock.RLock()
+	defer configlock.RUnlock()
+
+	c, ok := config.Clusters[n.clusterName]
+	if !ok {
+		return ErrClusterDoesNotExist
+	}
+
+	if c.nodes[n.name] != n {
+		return ErrNodeNotFound
+	}
 
 	return nil
 }
 
+// wraperror wraps err in a *NodeError for this node.
+func (n *Node) wraperror(op string, err error) error {
+	return wrapnodeerror(n.clusterName, n.name, op, err)
+}
+
+// porterror wraps err in a *PortError, and then in a *NodeError
+// for this node.
+func (n *Node) porterror(op string, hostport int, nodeport int, err error) error {
+	return n.wraperror(op, &PortError{HostPort: hostport, NodePort: nodeport, Err: err})
+}
+
 func (n *Node) createhost() error {
 	c := n.Cluster()
+	k8sversion := c.K8sVersion()
 
-	driverimage, err := c.driver.GetImage(c.k8sVersion)
+	driverimage, err := c.driver.GetImage(k8sversion)
 	if err != nil {
 		return err
 	}
 
 	if driverimage.Deprecated() {
-		return errVersionDeprecated
+		return ErrVersionDeprecated
+	}
+
+	var host drivercore.Machine
+	if n.spec.IsDefault() {
+		host, err = c.driver.NewMachine(n.name, c.name, k8sversion)
+	} else if sizer, ok := c.driver.(SizedMachineCreator); ok {
+		host, err = sizer.NewSizedMachine(
+			n.name,
+			c.name,
+			k8sversion,
+			n.spec.CPUs,
+			n.spec.MemoryMB,
+			n.spec.DiskGB,
+			n.spec.ExtraNICs,
+		)
+	} else {
+		err = ErrNodeSpecNotSupported
 	}
-
-	host, err := c.driver.NewMachine(n.name, c.name, c.k8sVersion)
 	if err != nil {
 		n.host = nil
 		return err
@@ -350,8 +605,12 @@ func (n *Node) createhost() error {
 }
 
 func (n *Node) ensurehost() error {
+	c := n.Cluster()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
 	if n.host == nil {
-		c := n.Cluster()
 		host, err := c.driver.GetMachine(n.name, c.name)
 		if err != nil {
 			return err
@@ -361,3 +620,59 @@ func (n *Node) ensurehost() error {
 	}
 	return nil
 }
+
+func (n *Node) start() error {
+	err := n.ensurehost()
+	if err != nil {
+		return err
+	}
+
+	if n.Status() != NodeStatusStopped {
+		return ErrNodeCannotStart
+	}
+
+	err = n.host.Start()
+	publishresult(EventNodeStarted, EventNodeStartFailed, Event{Cluster: n.clusterName, Node: n.name}, err)
+
+	return err
+}
+
+func (n *Node) forcestart() error {
+	err := n.ensurehost()
+	if err != nil {
+		return err
+	}
+
+	err = n.host.Start()
+	publishresult(EventNodeStarted, EventNodeStartFailed, Event{Cluster: n.clusterName, Node: n.name}, err)
+
+	return err
+}
+
+func (n *Node) stop() error {
+	err := n.ensurehost()
+	if err != nil {
+		return err
+	}
+
+	if n.Status() != NodeStatusRunning {
+		return ErrNodeCannotStop
+	}
+
+	err = n.host.Stop()
+	publishresult(EventNodeStopped, EventNodeStopFailed, Event{Cluster: n.clusterName, Node: n.name}, err)
+
+	return err
+}
+
+func (n *Node) forcestop() error {
+	err := n.ensurehost()
+	if err != nil {
+		return err
+	}
+
+	err = n.host.ForceStop()
+	publishresult(EventNodeStopped, EventNodeStopFailed, Event{Cluster: n.clusterName, Node: n.name}, err)
+
+	return err
+}
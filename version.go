@@ -1,7 +1,9 @@
 package kuttilib
 
 import (
+	"context"
 	"encoding/json"
+	"sync"
 
 	"github.com/kuttiproject/drivercore"
 )
@@ -60,6 +62,17 @@ func (v *Version) Fetch() error {
 	return v.image.Fetch()
 }
 
+// FetchContext downloads this version's image from the Driver
+// repository, like Fetch.
+//
+// If ctx is canceled or its deadline expires before the download
+// completes, a *CanceledError is returned. Drivers cannot abort a
+// download in progress, so it keeps running in the background, and
+// the version may become available later.
+func (v *Version) FetchContext(ctx context.Context) error {
+	return v.FetchWithProgressContext(ctx, nil)
+}
+
 // FetchWithProgress downloads this version's image from the Driver
 // repository into the local cache, and reports progress via the
 // supplied callback. The callback reports current and total in bytes.
@@ -67,6 +80,48 @@ func (v *Version) FetchWithProgress(progress func(current int64, total int64)) e
 	return v.image.FetchWithProgress(progress)
 }
 
+// FetchWithProgressContext downloads this version's image, and
+// reports progress, like FetchWithProgress. A nil progress callback
+// is allowed.
+//
+// If ctx is canceled or its deadline expires before the download
+// completes, a *CanceledError is returned, and progress is no longer
+// reported. Drivers cannot abort a download in progress, so it keeps
+// running in the background, and the version may become available
+// later.
+func (v *Version) FetchWithProgressContext(ctx context.Context, progress func(current int64, total int64)) error {
+	err := checkcontext(ctx, "fetch version")
+	if err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	canceled := false
+	report := func(current int64, total int64) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if progress != nil && !canceled {
+			progress(current, total)
+		}
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- v.image.FetchWithProgress(report)
+	}()
+
+	select {
+	case err = <-result:
+		return err
+	case <-ctx.Done():
+		mu.Lock()
+		canceled = true
+		mu.Unlock()
+		return &CanceledError{Op: "fetch version", Err: ctx.Err()}
+	}
+}
+
 // FromFile imports this version's image from the specified
 // local file.
 func (v *Version) FromFile(filename string) error {